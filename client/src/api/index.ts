@@ -60,14 +60,22 @@ export const confirmRow = async (projectId: number, sourceFileId: number, confir
 };
 
 export const exportProject = async (id: number, usePlaceholder: boolean = true, onlyConfirmed: boolean = false, outputPath?: string) => {
-    await api.post(`/projects/${id}/export`, {
+    const res = await api.post<{ export_id: number, job_id: number, output_path: string }>(`/projects/${id}/export`, {
         use_placeholder: usePlaceholder,
         only_confirmed: onlyConfirmed,
         output_path: outputPath
     });
+    return res.data;
 };
 
-export const getExportProgress = async (id: number) => {
-    const res = await api.get<{ total: number, processed: number, current: string, status: string }>(`/projects/${id}/export_progress`);
+export const getExportProgress = async (id: number, exportId?: number) => {
+    const res = await api.get<{ total: number, processed: number, failed: number, current: string, status: string, output_path: string, job_id: number, error?: string }>(`/projects/${id}/export_progress`, {
+        params: exportId ? { export_id: exportId } : undefined
+    });
     return res.data;
 };
+
+// Resume a paused background job
+export const resumeJob = async (jobId: number) => {
+    await api.post(`/jobs/${jobId}/resume`);
+};
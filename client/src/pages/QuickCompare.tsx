@@ -1,7 +1,7 @@
 import React, { useEffect, useState, useMemo, useRef } from 'react';
 import { Table, Button, Input, Space, Image, message, Checkbox, InputNumber, Select, Modal, List, Radio, Progress } from 'antd';
 import { useParams } from 'react-router-dom';
-import { getProjectFiles, getCandidates, selectCandidate, markNoMatch, confirmRow, exportProject, getProject, getExportProgress } from '../api';
+import { getProjectFiles, getCandidates, selectCandidate, markNoMatch, confirmRow, exportProject, getProject, getExportProgress, resumeJob } from '../api';
 import type { FileNode, FileData, ProjectTarget } from '../types';
 import { ExportOutlined, CheckSquareOutlined, StopOutlined, CheckCircleFilled } from '@ant-design/icons';
 
@@ -272,14 +272,14 @@ const QuickCompare: React.FC = () => {
                     setExportProgress(null); // 清除之前的进度
                     exportPathRef.current = exportPath; // 保存到 ref
                     console.log('Export path saved to ref:', exportPath);
-                    await exportProject(projectId, usePlaceholder, onlyConfirmed, exportPath);
+                    const { export_id } = await exportProject(projectId, usePlaceholder, onlyConfirmed, exportPath);
                     message.success('导出已在后台开始');
                     // Update the output path after successful export start
                     if (exportPath) {
                         setProjectOutputPath(exportPath);
                     }
                     // Start polling for progress
-                    pollExportProgress();
+                    pollExportProgress(export_id);
                 } catch (e: any) {
                     message.error('导出启动失败: ' + (e.message || '未知错误'));
                     setIsExporting(false);
@@ -290,15 +290,52 @@ const QuickCompare: React.FC = () => {
     };
 
     // Poll export progress
-    const pollExportProgress = async () => {
+    const pollExportProgress = async (exportId: number) => {
         const interval = setInterval(async () => {
             try {
-                const progress = await getExportProgress(projectId);
+                const progress = await getExportProgress(projectId, exportId);
                 setExportProgress(progress);
 
+                if (progress.status === 'failed' || progress.status === 'cancelled') {
+                    clearInterval(interval);
+                    clearTimeout(timeout);
+                    message.error(progress.status === 'failed' ? '导出失败: ' + (progress.error || '未知错误') : '导出已取消');
+                    setIsExporting(false);
+                    setExportProgress(null);
+                    return;
+                }
+
+                // 暂停的导出不会再有进展，停止轮询并提供继续导出
+                if (progress.status === 'paused') {
+                    clearInterval(interval);
+                    clearTimeout(timeout);
+                    Modal.confirm({
+                        title: '导出已暂停',
+                        content: `已处理 ${progress.processed} / ${progress.total} 个文件，继续导出将从暂停处接着处理。`,
+                        okText: '继续导出',
+                        cancelText: '稍后',
+                        onOk: async () => {
+                            try {
+                                await resumeJob(progress.job_id);
+                                pollExportProgress(exportId);
+                            } catch (e: any) {
+                                message.error('继续导出失败: ' + (e.response?.data?.error || e.message));
+                                setIsExporting(false);
+                                setExportProgress(null);
+                            }
+                        },
+                        onCancel: () => {
+                            setIsExporting(false);
+                            setExportProgress(null);
+                        }
+                    });
+                    return;
+                }
+
                 // Stop polling if export is complete (check status field)
                 if (progress.status === 'completed' || progress.status === 'no_files') {
                     clearInterval(interval);
+                    clearTimeout(timeout);
 
                     // 延迟1秒后显示完成对话框
                     setTimeout(() => {
@@ -341,6 +378,7 @@ const QuickCompare: React.FC = () => {
             } catch (e) {
                 console.error('Failed to fetch export progress:', e);
                 clearInterval(interval);
+                clearTimeout(timeout);
                 message.error('获取导出进度失败');
                 setIsExporting(false);
                 setExportProgress(null);
@@ -348,7 +386,7 @@ const QuickCompare: React.FC = () => {
         }, 1000);
 
         // Stop polling after 30 minutes
-        setTimeout(() => {
+        const timeout = setTimeout(() => {
             clearInterval(interval);
             if (exportProgress && exportProgress.status === 'in_progress') {
                 message.warning('导出超时，请检查服务状态');
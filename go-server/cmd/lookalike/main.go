@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/services"
+)
+
+const usage = `Usage: lookalike <command> [flags]
+
+Commands:
+  rebase        Move the source and/or target roots of a project
+  undo-export   Move the files of a move-mode export back
+
+Run "lookalike <command> -h" for the flags of a command.
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "rebase":
+		err = runRebase(os.Args[2:])
+	case "undo-export":
+		err = runUndoExport(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// targetFlag collects repeated -target id=path values
+type targetFlag map[uint]string
+
+func (t targetFlag) String() string {
+	parts := make([]string, 0, len(t))
+	for id, path := range t {
+		parts = append(parts, fmt.Sprintf("%d=%s", id, path))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t targetFlag) Set(value string) error {
+	idStr, path, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("expected id=path, got %q", value)
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid target id %q", idStr)
+	}
+	t[uint(id)] = path
+	return nil
+}
+
+func runRebase(args []string) error {
+	targets := targetFlag{}
+
+	fs := flag.NewFlagSet("rebase", flag.ExitOnError)
+	dbPath := fs.String("db", database.DefaultPath(), "path to the SQLite database")
+	projectID := fs.Uint("project", 0, "project ID (required)")
+	sourcePath := fs.String("source", "", "new source root")
+	fs.Var(targets, "target", "new target root as id=path (repeatable)")
+	fs.Parse(args)
+
+	if *projectID == 0 {
+		return fmt.Errorf("-project is required")
+	}
+	if *sourcePath == "" && len(targets) == 0 {
+		return fmt.Errorf("nothing to do: pass -source and/or -target")
+	}
+
+	if err := database.Initialize(*dbPath); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	var project models.Project
+	if err := database.DB.First(&project, *projectID).Error; err != nil {
+		return fmt.Errorf("project %d not found", *projectID)
+	}
+
+	// A server may be working on the project with the current roots
+	running, err := services.HasRunningJob(project.ID)
+	if err != nil {
+		return err
+	}
+	if running {
+		return fmt.Errorf("project %d has a queued or running job; wait for it or pause it first", project.ID)
+	}
+
+	if err := services.RebaseRoots(&project, *sourcePath, targets); err != nil {
+		return err
+	}
+
+	fmt.Printf("Project %d (%s) rebased\n", project.ID, project.Name)
+	return nil
+}
+
+func runUndoExport(args []string) error {
+	fs := flag.NewFlagSet("undo-export", flag.ExitOnError)
+	dbPath := fs.String("db", database.DefaultPath(), "path to the SQLite database")
+	exportID := fs.Uint("export", 0, "export ID (required)")
+	fs.Parse(args)
+
+	if *exportID == 0 {
+		return fmt.Errorf("-export is required")
+	}
+
+	if err := database.Initialize(*dbPath); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	var run models.ExportRun
+	if err := database.DB.First(&run, *exportID).Error; err != nil {
+		return fmt.Errorf("export %d not found", *exportID)
+	}
+
+	restored, err := services.UndoExport(&run)
+	if err != nil {
+		return fmt.Errorf("%w (%d files restored)", err, restored)
+	}
+
+	fmt.Printf("Export %d undone, %d files restored\n", run.ID, restored)
+	return nil
+}
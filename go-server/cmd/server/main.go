@@ -8,6 +8,8 @@ import (
 
 	"github.com/bilibili/look-alike/internal/api"
 	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/services"
+	"github.com/bilibili/look-alike/internal/workers"
 )
 
 func main() {
@@ -25,11 +27,7 @@ func main() {
 	}
 
 	// Database path - check multiple locations
-	dbPath := filepath.Join(baseDir, "db/look_alike.sqlite3")
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		// Try relative to working directory
-		dbPath = "db/look_alike.sqlite3"
-	}
+	dbPath := database.DefaultPath()
 
 	// Ensure database directory exists
 	dbDir := filepath.Dir(dbPath)
@@ -45,14 +43,31 @@ func main() {
 	}
 	defer database.Close()
 
+	// Projects left mid-run by a crash or restart wait for a resume or restart,
+	// unless their job is queued again below
+	interrupted, err := services.MarkInterruptedProjects()
+	if err != nil {
+		log.Fatalf("Failed to check for interrupted projects: %v", err)
+	}
+	for _, p := range interrupted {
+		log.Printf("Project %d (%s) was interrupted: POST /api/projects/%d/resume or /restart to continue", p.ID, p.Name, p.ID)
+	}
+
+	// Start the background job queue
+	queue := workers.GetQueue()
+	services.RegisterJobHandlers(queue)
+	if err := queue.Start(); err != nil {
+		log.Fatalf("Failed to start job queue: %v", err)
+	}
+
 	// Client dist path (for production mode)
 	// Try multiple locations: executable dir, working dir
 	var clientDistPath string
 	possiblePaths := []string{
-		filepath.Join(baseDir, "dist"),         // Same directory as executable
-		"dist",                                   // Relative to working directory
-		filepath.Join(baseDir, "client/dist"),   // Legacy location (for backward compatibility)
-		"client/dist",                            // Legacy location (relative)
+		filepath.Join(baseDir, "dist"),        // Same directory as executable
+		"dist",                                // Relative to working directory
+		filepath.Join(baseDir, "client/dist"), // Legacy location (for backward compatibility)
+		"client/dist",                         // Legacy location (relative)
 	}
 
 	for _, path := range possiblePaths {
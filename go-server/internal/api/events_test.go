@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/events"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// readEvent returns the event name of the next Server-Sent Event
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	name := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the event stream: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" && name != "" {
+			return name
+		}
+		if strings.HasPrefix(line, "event:") {
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		}
+	}
+}
+
+func TestProjectEvents(t *testing.T) {
+	project := models.Project{Name: t.Name(), SourcePath: t.TempDir(), Status: "completed"}
+	if err := database.DB.Create(&project).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrap the handler to notice when it returns, which also ends the
+	// subscription
+	returned := make(chan struct{})
+	router := gin.New()
+	router.GET("/projects/:id/events", func(c *gin.Context) {
+		defer close(returned)
+		GetProjectEvents(c)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/projects/%d/events", server.URL, project.ID), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	if name := readEvent(t, r); name != events.TypeStatus {
+		t.Fatalf("first event is %q, want the current status", name)
+	}
+	events.Publish(events.Event{Type: events.TypeJob, ProjectID: project.ID, State: "running"})
+	if name := readEvent(t, r); name != events.TypeJob {
+		t.Fatalf("received %q, want the published job event", name)
+	}
+
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still streams after the client disconnected")
+	}
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/services"
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+// createExportFixture stores a project with two source files that have no
+// match in its only target
+func createExportFixture(t *testing.T) *models.Project {
+	t.Helper()
+	project := models.Project{
+		Name:           t.Name(),
+		SourcePath:     t.TempDir(),
+		Status:         "completed",
+		ProjectTargets: []models.ProjectTarget{{Name: "T", Path: t.TempDir()}},
+	}
+	if err := database.DB.Create(&project).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		sf := models.SourceFile{ProjectID: project.ID, RelativePath: name, Width: 8, Height: 8, Status: "analyzed"}
+		if err := database.DB.Create(&sf).Error; err != nil {
+			t.Fatal(err)
+		}
+		selection := models.TargetSelection{SourceFileID: sf.ID, ProjectTargetID: project.ProjectTargets[0].ID, NoMatch: true}
+		if err := database.DB.Create(&selection).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &project
+}
+
+// decode unmarshals a JSON response
+func decode(t *testing.T, body []byte) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", body, err)
+	}
+	return v
+}
+
+func TestExportRuns(t *testing.T) {
+	project := createExportFixture(t)
+	output := t.TempDir()
+
+	for _, body := range []map[string]interface{}{
+		{"manifest": "xml"},
+		{"layout": "{unknown}/{stem}"},
+		{"mode": "rename"},
+		{"format": "heic"},
+		{"quality": 101},
+		{"resize": "fit"},
+		{"resize": "pad", "max_width": 100},
+		{"mode": "move", "format": "jpg"},
+		{"mode": "move", "on_conflict": "overwrite"},
+		{"placeholder_pattern": "stripes"},
+		{"layout": "{target}/flat.{ext}"},
+	} {
+		w := serve(t, http.MethodPost, fmt.Sprintf("/api/projects/%d/export", project.ID), body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST export with %v = %d, want 400", body, w.Code)
+		}
+	}
+
+	w := serve(t, http.MethodPost, fmt.Sprintf("/api/projects/%d/export", project.ID), map[string]interface{}{"use_placeholder": true, "output_path": output})
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST export = %d %s", w.Code, w.Body)
+	}
+	started := decode(t, w.Body.Bytes())
+	if started["output_path"] != output || started["export_id"] == nil {
+		t.Fatalf("POST export = %v", started)
+	}
+	exportID := uint(started["export_id"].(float64))
+
+	progressPath := fmt.Sprintf("/api/projects/%d/export_progress?export_id=%d", project.ID, exportID)
+	deadline := time.Now().Add(10 * time.Second)
+	var progress map[string]interface{}
+	for {
+		progress = decode(t, serve(t, http.MethodGet, progressPath, nil).Body.Bytes())
+		if progress["status"] != "in_progress" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("export still in progress: %v", progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if progress["status"] != "completed" || progress["total"] != float64(2) || progress["processed"] != float64(2) {
+		t.Errorf("export progress = %v", progress)
+	}
+
+	history := decode(t, serve(t, http.MethodGet, fmt.Sprintf("/api/projects/%d/exports", project.ID), nil).Body.Bytes())
+	if history["total"] != float64(1) {
+		t.Errorf("export history = %v, want one run", history)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{method: http.MethodGet, path: fmt.Sprintf("/api/projects/%d/exports/%d", project.ID, exportID), code: http.StatusOK},
+		{method: http.MethodGet, path: fmt.Sprintf("/api/projects/%d/exports/%d", project.ID, exportID+100), code: http.StatusNotFound},
+		{method: http.MethodGet, path: fmt.Sprintf("/api/projects/%d/exports/%d", project.ID+100, exportID), code: http.StatusNotFound},
+		{method: http.MethodPost, path: fmt.Sprintf("/api/projects/%d/exports/%d/undo", project.ID, exportID), code: http.StatusBadRequest},
+		{method: http.MethodPost, path: fmt.Sprintf("/api/projects/%d/exports/%d/undo", project.ID, exportID+100), code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serve(t, tt.method, tt.path, nil); w.Code != tt.code {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+	}
+}
+
+func TestDownloadExport(t *testing.T) {
+	project := createExportFixture(t)
+
+	w := serve(t, http.MethodGet, fmt.Sprintf("/api/projects/%d/export/download?use_placeholder=true", project.ID), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("download = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"T/a.png_no_match_placeholder.png", "T/b.png_no_match_placeholder.png"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("download holds %v, want %v", names, want)
+	}
+
+	// Malformed options are rejected rather than replaced with defaults
+	for _, tt := range []struct {
+		method string
+		query  string
+		body   interface{}
+	}{
+		{method: http.MethodGet, query: "?use_placeholder=maybe"},
+		{method: http.MethodPost, body: map[string]interface{}{"use_placeholder": "yes"}},
+	} {
+		path := fmt.Sprintf("/api/projects/%d/export/download%s", project.ID, tt.query)
+		if w := serve(t, tt.method, path, tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s with %v = %d, want 400", tt.method, path, tt.body, w.Code)
+		}
+	}
+	if w := serve(t, http.MethodPost, fmt.Sprintf("/api/projects/%d/export/download", project.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("download without a body = %d, want 200", w.Code)
+	}
+
+	// Downloads are not part of the export history
+	history := decode(t, serve(t, http.MethodGet, fmt.Sprintf("/api/projects/%d/exports", project.ID), nil).Body.Bytes())
+	if history["total"] != float64(0) {
+		t.Errorf("export history = %v, want no runs", history)
+	}
+}
+
+func TestExportDryRunAndConflicts(t *testing.T) {
+	project := createExportFixture(t)
+	output := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(output, "T"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(output, "T", "a.png_no_match_placeholder.png"), []byte("earlier"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/projects/%d/export", project.ID)
+
+	w := serve(t, http.MethodPost, path, map[string]interface{}{"use_placeholder": true, "output_path": output, "dry_run": true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run = %d %s", w.Code, w.Body)
+	}
+	plan := decode(t, w.Body.Bytes())
+	if ops, _ := plan["operations"].([]interface{}); len(ops) != 2 {
+		t.Errorf("dry run planned %v, want 2 operations", plan["operations"])
+	}
+	if conflicts, _ := plan["conflicts"].([]interface{}); len(conflicts) != 1 {
+		t.Errorf("dry run conflicts = %v, want the existing placeholder", plan["conflicts"])
+	}
+
+	tests := []struct {
+		body map[string]interface{}
+		want int
+	}{
+		{body: map[string]interface{}{"on_conflict": "ask"}, want: http.StatusBadRequest},
+		{body: map[string]interface{}{"use_placeholder": "yes", "output_path": output}, want: http.StatusBadRequest},
+		{body: map[string]interface{}{"use_placeholder": true, "output_path": output, "replace": "true"}, want: http.StatusBadRequest},
+		{body: map[string]interface{}{"use_placeholder": true, "output_path": output, "on_conflict": "fail"}, want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if w := serve(t, http.MethodPost, path, tt.body); w.Code != tt.want {
+			t.Errorf("POST export with %v = %d, want %d", tt.body, w.Code, tt.want)
+		}
+	}
+
+	// Neither the dry run nor the rejected export was recorded
+	history := decode(t, serve(t, http.MethodGet, fmt.Sprintf("/api/projects/%d/exports", project.ID), nil).Body.Bytes())
+	if history["total"] != float64(0) {
+		t.Errorf("export history = %v, want no runs", history)
+	}
+}
+
+func TestMovedFilesBlockReview(t *testing.T) {
+	project := createExportFixture(t)
+	run := models.ExportRun{ProjectID: project.ID, Options: models.ExportOptions{Mode: "move"}}
+	if err := database.DB.Create(&run).Error; err != nil {
+		t.Fatal(err)
+	}
+	entry := models.ExportJournalEntry{ExportRunID: run.ID, FromPath: "a", ToPath: "b", State: "moved"}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	var sf models.SourceFile
+	database.DB.Where("project_id = ?", project.ID).First(&sf)
+	noMatch := map[string]interface{}{"source_file_id": sf.ID, "project_target_id": project.ProjectTargets[0].ID}
+
+	requests := []struct {
+		path string
+		body interface{}
+	}{
+		{path: "mark_no_match", body: noMatch},
+		{path: "confirm_row", body: map[string]interface{}{"source_file_id": sf.ID, "confirmed": true}},
+		{path: "export", body: map[string]interface{}{"use_placeholder": true, "output_path": t.TempDir()}},
+		{path: "export/download", body: map[string]interface{}{"use_placeholder": true}},
+	}
+	for _, r := range requests {
+		w := serve(t, http.MethodPost, fmt.Sprintf("/api/projects/%d/%s", project.ID, r.path), r.body)
+		if w.Code != http.StatusConflict {
+			t.Errorf("POST %s with moved files = %d, want 409", r.path, w.Code)
+		}
+	}
+
+	// Undone, the review can go on
+	database.DB.Model(&entry).Update("state", "restored")
+	w := serve(t, http.MethodPost, fmt.Sprintf("/api/projects/%d/mark_no_match", project.ID), noMatch)
+	if w.Code != http.StatusOK {
+		t.Errorf("POST mark_no_match after undo = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestExportReplace(t *testing.T) {
+	project := createExportFixture(t)
+	paused := models.Job{Type: services.JobExport, ProjectID: project.ID, State: workers.JobPaused}
+	if err := database.DB.Create(&paused).Error; err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/projects/%d/export", project.ID)
+	body := map[string]interface{}{"use_placeholder": true, "output_path": t.TempDir()}
+
+	if w := serve(t, http.MethodPost, path, body); w.Code != http.StatusConflict {
+		t.Errorf("POST export with a paused export = %d, want 409", w.Code)
+	}
+	database.DB.First(&paused, paused.ID)
+	if paused.State != workers.JobPaused {
+		t.Errorf("refused export left the paused one %s", paused.State)
+	}
+
+	body["replace"] = true
+	if w := serve(t, http.MethodPost, path, body); w.Code != http.StatusOK {
+		t.Fatalf("POST export with replace = %d %s", w.Code, w.Body)
+	}
+	database.DB.First(&paused, paused.ID)
+	if paused.State != workers.JobCancelled {
+		t.Errorf("replaced export is %s, want cancelled", paused.State)
+	}
+	waitForIdle(t, project.ID)
+}
@@ -1,22 +1,28 @@
 package api
 
 import (
-	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bilibili/look-alike/internal/archive"
 	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/events"
 	"github.com/bilibili/look-alike/internal/models"
 	"github.com/bilibili/look-alike/internal/services"
+	"github.com/bilibili/look-alike/internal/storage"
 	"github.com/bilibili/look-alike/internal/workers"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // GetProjects returns list of projects with pagination
@@ -33,9 +39,17 @@ func GetProjects(c *gin.Context) {
 	database.DB.Model(&models.Project{}).Count(&total)
 	database.DB.Order("created_at DESC").Limit(perPage).Offset((page - 1) * perPage).Find(&projects)
 
+	projectIDs := make([]uint, 0, len(projects))
+	for _, project := range projects {
+		projectIDs = append(projectIDs, project.ID)
+	}
+	pausedJobs, _ := workers.GetQueue().PausedJobs(projectIDs...)
+
 	// Add statistics for each project
 	var projectsWithStats []map[string]interface{}
 	for _, project := range projects {
+		status, paused := pauseState(project.Status, pausedJobs[project.ID])
+
 		var totalFiles, confirmedFiles int64
 		database.DB.Model(&models.SourceFile{}).Where("project_id = ?", project.ID).Count(&totalFiles)
 		database.DB.Table("source_files").
@@ -44,15 +58,18 @@ func GetProjects(c *gin.Context) {
 			Count(&confirmedFiles)
 
 		projectData := map[string]interface{}{
-			"id":           project.ID,
-			"name":         project.Name,
-			"source_path":  project.SourcePath,
-			"status":       project.Status,
-			"started_at":   project.StartedAt,
-			"ended_at":     project.EndedAt,
-			"created_at":   project.CreatedAt,
-			"updated_at":   project.UpdatedAt,
-			"output_path":  filepath.Join(filepath.Dir(project.SourcePath), project.Name+"_Output"),
+			"id":          project.ID,
+			"name":        project.Name,
+			"type":        project.Type,
+			"source_path": project.SourcePath,
+			"status":      status,
+			"phase":       project.Phase,
+			"paused_jobs": paused,
+			"started_at":  project.StartedAt,
+			"ended_at":    project.EndedAt,
+			"created_at":  project.CreatedAt,
+			"updated_at":  project.UpdatedAt,
+			"output_path": services.DefaultOutputPath(&project),
 			"confirmation_stats": map[string]interface{}{
 				"confirmed": confirmedFiles,
 				"total":     totalFiles,
@@ -71,13 +88,19 @@ func GetProjects(c *gin.Context) {
 
 // CreateProject creates a new project
 func CreateProject(c *gin.Context) {
+	type targetRequest struct {
+		Name string             `json:"name"`
+		Path string             `json:"path"`
+		Scan models.ScanOptions `json:"scan"`
+	}
 	var req struct {
-		Name       string `json:"name" binding:"required"`
-		SourcePath string `json:"source_path" binding:"required"`
-		Targets    []struct {
-			Name string `json:"name"`
-			Path string `json:"path"`
-		} `json:"targets"`
+		Name            string             `json:"name" binding:"required"`
+		Type            string             `json:"type"`
+		SourcePath      string             `json:"source_path"`
+		SourceScan      models.ScanOptions `json:"source_scan"`
+		DedupeThreshold *float64           `json:"dedupe_threshold"` // percent, 90 if missing
+		Targets         []targetRequest    `json:"targets"`
+		Priority        int                `json:"priority"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -85,16 +108,71 @@ func CreateProject(c *gin.Context) {
 		return
 	}
 
+	switch req.Type {
+	case "", "compare":
+		req.Type = "compare"
+		if req.SourcePath == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "source_path is required"})
+			return
+		}
+	case "dedupe":
+		// The source folder of a dedupe project is searched like a target
+		if req.SourcePath != "" {
+			req.Targets = append([]targetRequest{{
+				Name: filepath.Base(req.SourcePath),
+				Path: req.SourcePath,
+				Scan: req.SourceScan,
+			}}, req.Targets...)
+		}
+		if len(req.Targets) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "source_path or targets is required"})
+			return
+		}
+		if req.DedupeThreshold == nil {
+			threshold := 90.0
+			req.DedupeThreshold = &threshold
+		}
+		if *req.DedupeThreshold < 0 || *req.DedupeThreshold > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dedupe_threshold must be between 0 and 100"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown project type: %s", req.Type)})
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, t := range req.Targets {
+		if names[t.Name] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duplicate target name: %s", t.Name)})
+			return
+		}
+		names[t.Name] = true
+	}
+
 	project := models.Project{
 		Name:       req.Name,
+		Type:       req.Type,
 		SourcePath: req.SourcePath,
 		Status:     "pending",
+		SourceScan: req.SourceScan,
+	}
+	if req.DedupeThreshold != nil {
+		project.DedupeThreshold = *req.DedupeThreshold
 	}
 
 	if err := database.DB.Create(&project).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	// Create stores the column default for a zero threshold
+	if req.DedupeThreshold != nil && *req.DedupeThreshold == 0 {
+		project.DedupeThreshold = 0
+		if err := database.DB.Model(&project).Update("dedupe_threshold", 0).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
 	// Create targets
 	for _, t := range req.Targets {
@@ -102,17 +180,16 @@ func CreateProject(c *gin.Context) {
 			ProjectID: project.ID,
 			Name:      t.Name,
 			Path:      t.Path,
+			Scan:      t.Scan,
 		}
 		database.DB.Create(&target)
 	}
 
-	// Start background comparison
-	manager := workers.GetManager()
-	manager.StartComparison(project.ID, func(ctx context.Context) {
-		if err := services.ProcessComparison(&project, ctx); err != nil {
-			log.Printf("Comparison failed for project %d: %v", project.ID, err)
-		}
-	})
+	// Queue background comparison
+	if _, err := workers.GetQueue().Enqueue(services.JobComparison, project.ID, req.Priority, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, project)
 }
@@ -141,25 +218,61 @@ func GetProject(c *gin.Context) {
 		progress = float64(processed) / float64(totalFiles) * 100
 	}
 
+	stats := gin.H{
+		"total_files": totalFiles,
+		"processed":   processed,
+		"progress":    progress,
+	}
+	if project.Type == "dedupe" {
+		var clusters int64
+		database.DB.Model(&models.DuplicateCluster{}).Where("project_id = ?", project.ID).Count(&clusters)
+		stats["clusters"] = clusters
+	}
+
+	pausedJobs, _ := workers.GetQueue().PausedJobs(project.ID)
+	status, paused := pauseState(project.Status, pausedJobs[project.ID])
+
 	c.JSON(http.StatusOK, gin.H{
-		"id":           project.ID,
-		"name":         project.Name,
-		"source_path":  project.SourcePath,
-		"status":       project.Status,
-		"error_message": project.ErrorMessage,
-		"started_at":   project.StartedAt,
-		"ended_at":     project.EndedAt,
-		"created_at":   project.CreatedAt,
-		"updated_at":   project.UpdatedAt,
-		"stats": gin.H{
-			"total_files": totalFiles,
-			"processed":   processed,
-			"progress":    progress,
-		},
-		"targets": targets,
+		"id":               project.ID,
+		"name":             project.Name,
+		"type":             project.Type,
+		"dedupe_threshold": project.DedupeThreshold,
+		"source_path":      project.SourcePath,
+		"source_scan":      project.SourceScan,
+		"status":           status,
+		"phase":            project.Phase,
+		"paused_jobs":      paused,
+		"error_message":    project.ErrorMessage,
+		"started_at":       project.StartedAt,
+		"ended_at":         project.EndedAt,
+		"created_at":       project.CreatedAt,
+		"updated_at":       project.UpdatedAt,
+		"stats":            stats,
+		"indexing":         services.GetIndexProgress(project.ID),
+		"targets":          targets,
 	})
 }
 
+// pauseState returns the status to show for a project and its paused jobs.
+// A paused comparison shows as status "paused"; a paused export only shows
+// in the job list, since it does not change the project status.
+func pauseState(status string, jobs []models.Job) (string, []gin.H) {
+	queue := workers.GetQueue()
+	paused := make([]gin.H, 0, len(jobs))
+	for _, job := range jobs {
+		if queue.Slot(job.Type) == workers.TaskTypeComparison {
+			status = "paused"
+		}
+		paused = append(paused, gin.H{
+			"id":             job.ID,
+			"type":           job.Type,
+			"progress_done":  job.ProgressDone,
+			"progress_total": job.ProgressTotal,
+		})
+	}
+	return status, paused
+}
+
 // DeleteProject deletes a project
 func DeleteProject(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
@@ -170,9 +283,9 @@ func DeleteProject(c *gin.Context) {
 		return
 	}
 
-	// Stop background tasks
-	manager := workers.GetManager()
-	manager.StopProjectTasks(project.ID)
+	// Stop background jobs
+	workers.GetQueue().CancelProjectJobs(project.ID)
+	services.ClearIndexProgress(project.ID)
 
 	// Delete project (cascade deletes related records)
 	if err := database.DB.Delete(&project).Error; err != nil {
@@ -186,6 +299,294 @@ func DeleteProject(c *gin.Context) {
 	})
 }
 
+// PauseProject pauses the comparison and/or export of a project. The jobs
+// give up their workers and continue from where they stopped on resume.
+func PauseProject(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var req struct {
+		Task string `json:"task"` // comparison, export, or empty for both
+	}
+	c.ShouldBindJSON(&req)
+
+	var slots []workers.TaskType
+	switch req.Task {
+	case "":
+		slots = []workers.TaskType{workers.TaskTypeComparison, workers.TaskTypeExport}
+	case string(workers.TaskTypeComparison), string(workers.TaskTypeExport):
+		slots = []workers.TaskType{workers.TaskType(req.Task)}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown task: %s", req.Task)})
+		return
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	paused := 0
+	for _, slot := range slots {
+		paused += workers.GetQueue().PauseActive(project.ID, slot)
+	}
+	if paused == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project has no queued or running task to pause"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "paused", "jobs": paused})
+}
+
+// ResumeProject resumes the paused jobs of a project, or continues an
+// interrupted or failed run when nothing is paused
+func ResumeProject(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	queue := workers.GetQueue()
+	pausedJobs, err := queue.PausedJobs(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if jobs := pausedJobs[uint(id)]; len(jobs) > 0 {
+		jobIDs := make([]uint, 0, len(jobs))
+		for _, job := range jobs {
+			if err := queue.Resume(job.ID); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			jobIDs = append(jobIDs, job.ID)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "resuming", "job_ids": jobIDs})
+		return
+	}
+
+	runProjectAgain(c, services.JobResume, "resuming")
+}
+
+// RestartProject discards the comparison results of a project and runs it
+// again
+func RestartProject(c *gin.Context) {
+	runProjectAgain(c, services.JobRestart, "restarting")
+}
+
+// runProjectAgain queues a resume or restart job unless the project already
+// has a comparison job
+func runProjectAgain(c *gin.Context, jobType string, status string) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var req struct {
+		Priority int `json:"priority"`
+	}
+	c.ShouldBindJSON(&req)
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	queue := workers.GetQueue()
+	if queue.HasActiveJob(project.ID, workers.TaskTypeComparison) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project is still being processed"})
+		return
+	}
+
+	job, err := queue.Enqueue(jobType, project.ID, req.Priority, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": status, "job_id": job.ID})
+}
+
+// RebaseProject moves the source and/or target roots of a project to new
+// locations, keeping all candidates and selections
+func RebaseProject(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var req struct {
+		SourcePath string `json:"source_path"`
+		Targets    []struct {
+			ID   uint   `json:"id"`
+			Path string `json:"path"`
+		} `json:"targets"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	// Running jobs read files from the current roots
+	running, err := services.HasRunningJob(project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if running {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project has a queued or running job; wait for it or pause it first"})
+		return
+	}
+
+	targetPaths := make(map[uint]string)
+	for _, t := range req.Targets {
+		if t.Path != "" {
+			targetPaths[t.ID] = strings.TrimSpace(t.Path)
+		}
+	}
+
+	if err := services.RebaseRoots(&project, strings.TrimSpace(req.SourcePath), targetPaths); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var targets []models.ProjectTarget
+	database.DB.Where("project_id = ?", project.ID).Find(&targets)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":          project.ID,
+		"source_path": project.SourcePath,
+		"targets":     targets,
+	})
+}
+
+// AddTarget adds a target to an existing project, then indexes it and
+// compares it with the already analyzed source files in the background.
+// Dedupe projects are clustered again instead.
+func AddTarget(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var req struct {
+		Name     string             `json:"name" binding:"required"`
+		Path     string             `json:"path" binding:"required"`
+		Scan     models.ScanOptions `json:"scan"`
+		Priority int                `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	queue := workers.GetQueue()
+	if queue.HasActiveJob(project.ID, workers.TaskTypeComparison) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project is still being processed"})
+		return
+	}
+
+	if targetNameTaken(project.ID, req.Name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("target name already exists: %s", req.Name)})
+		return
+	}
+
+	path := strings.TrimSpace(req.Path)
+	if err := storage.CheckRoot(path); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("target path is not accessible: %s: %v", path, err)})
+		return
+	}
+
+	target := models.ProjectTarget{
+		ProjectID: project.ID,
+		Name:      req.Name,
+		Path:      path,
+		Scan:      req.Scan,
+	}
+	if err := database.DB.Create(&target).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := queue.Enqueue(services.JobAddTarget, project.ID, req.Priority, services.AddTargetPayload{TargetID: target.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, target)
+}
+
+// UpdateTarget renames a target
+func UpdateTarget(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	targetID, _ := strconv.Atoi(c.Param("target_id"))
+
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var target models.ProjectTarget
+	if err := database.DB.Where("id = ? AND project_id = ?", targetID, id).First(&target).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Target not found"})
+		return
+	}
+
+	if targetNameTaken(target.ProjectID, req.Name, target.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("target name already exists: %s", req.Name)})
+		return
+	}
+
+	if err := database.DB.Model(&target).Update("name", req.Name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, target)
+}
+
+// DeleteTarget removes a target with its candidates and selections
+func DeleteTarget(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	targetID, _ := strconv.Atoi(c.Param("target_id"))
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	if workers.GetQueue().HasActiveJob(project.ID, workers.TaskTypeComparison) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project is still being processed"})
+		return
+	}
+
+	if err := services.RemoveTarget(&project, uint(targetID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// targetNameTaken reports whether another target of the project, other than
+// exceptID, already uses name. Names are folder names in exports.
+func targetNameTaken(projectID uint, name string, exceptID uint) bool {
+	var count int64
+	database.DB.Model(&models.ProjectTarget{}).
+		Where("project_id = ? AND name = ? AND id <> ?", projectID, name, exceptID).
+		Count(&count)
+	return count > 0
+}
+
 // GetProjectFiles returns file tree structure
 func GetProjectFiles(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
@@ -277,9 +678,22 @@ func GetCandidates(c *gin.Context) {
 		Where("id IN ?", req.FileIDs).
 		Find(&sourceFiles)
 
+	// Resolve candidate paths against their (possibly rebased) target roots
+	var allCandidates []models.ComparisonCandidate
+	for _, sf := range sourceFiles {
+		allCandidates = append(allCandidates, sf.ComparisonCandidates...)
+	}
+	candidatePaths, err := services.CandidatePaths(allCandidates)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	results := make(map[uint]interface{})
 
 	for _, sf := range sourceFiles {
+		sourcePath := services.SourceFilePath(&project, &sf)
+
 		// Group candidates by target
 		candidatesByTarget := make(map[string][]map[string]interface{})
 
@@ -289,7 +703,7 @@ func GetCandidates(c *gin.Context) {
 
 			candidateData := map[string]interface{}{
 				"id":         cand.ID,
-				"path":       cand.FilePath,
+				"path":       candidatePaths[cand.ID],
 				"similarity": cand.SimilarityScore,
 				"width":      cand.Width,
 				"height":     cand.Height,
@@ -320,9 +734,9 @@ func GetCandidates(c *gin.Context) {
 
 		results[sf.ID] = map[string]interface{}{
 			"source": map[string]interface{}{
-				"path":       sf.FullPath,
+				"path":       sourcePath,
 				"relative":   sf.RelativePath,
-				"thumb_url":  "/api/image?path=" + sf.FullPath,
+				"thumb_url":  "/api/image?path=" + sourcePath,
 				"width":      sf.Width,
 				"height":     sf.Height,
 				"size_bytes": sf.SizeBytes,
@@ -336,14 +750,39 @@ func GetCandidates(c *gin.Context) {
 	c.JSON(http.StatusOK, results)
 }
 
-// ServeImage serves an image file
+// ServeImage serves an image file, including entries inside archives and
+// objects on remote storage
 func ServeImage(c *gin.Context) {
 	path := c.Query("path")
-	c.File(path)
+	if !archive.IsVirtual(path) && !storage.IsRemote(path) {
+		c.File(path)
+		return
+	}
+
+	info, err := storage.StatContext(c.Request.Context(), path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	reader, err := storage.OpenContext(c.Request.Context(), path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer reader.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	c.DataFromReader(http.StatusOK, info.Size(), contentType, reader, nil)
 }
 
 // SelectCandidate selects a candidate for a target
 func SelectCandidate(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if !checkMovedFiles(c, uint(id)) {
+		return
+	}
+
 	var req struct {
 		SourceFileID        uint  `json:"source_file_id"`
 		ProjectTargetID     uint  `json:"project_target_id"`
@@ -368,6 +807,11 @@ func SelectCandidate(c *gin.Context) {
 
 // MarkNoMatch marks a target as having no match
 func MarkNoMatch(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if !checkMovedFiles(c, uint(id)) {
+		return
+	}
+
 	var req struct {
 		SourceFileID    uint `json:"source_file_id"`
 		ProjectTargetID uint `json:"project_target_id"`
@@ -391,6 +835,11 @@ func MarkNoMatch(c *gin.Context) {
 
 // ConfirmRow confirms/unconfirms a source file
 func ConfirmRow(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if !checkMovedFiles(c, uint(id)) {
+		return
+	}
+
 	var req struct {
 		SourceFileID uint `json:"source_file_id"`
 		Confirmed    bool `json:"confirmed"`
@@ -416,52 +865,345 @@ func ConfirmRow(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
-// StartExport starts export process
-func StartExport(c *gin.Context) {
-	id, _ := strconv.Atoi(c.Param("id"))
+// exportRequest holds the export options of StartExport (JSON body) and
+// DownloadExport (JSON body or query string)
+type exportRequest struct {
+	UsePlaceholder bool   `json:"use_placeholder" form:"use_placeholder"`
+	OnlyConfirmed  bool   `json:"only_confirmed" form:"only_confirmed"`
+	OutputPath     string `json:"output_path" form:"-"`
+	Manifest       string `json:"manifest" form:"manifest"`
+	Layout         string `json:"layout" form:"layout"`
+	Mode           string `json:"mode" form:"-"`
+	Archive        string `json:"archive" form:"archive"`
+	OnConflict     string `json:"on_conflict" form:"-"`
+	DryRun         bool   `json:"dry_run" form:"-"`
+	Replace        bool   `json:"replace" form:"-"`
+	Format         string `json:"format" form:"format"`
+	Quality        int    `json:"quality" form:"quality"`
+	Background     string `json:"background" form:"background"`
+	Resize         string `json:"resize" form:"resize"`
+	Filter         string `json:"filter" form:"filter"`
+
+	PlaceholderLayout  bool   `json:"placeholder_layout" form:"placeholder_layout"`
+	PlaceholderColor   string `json:"placeholder_color" form:"placeholder_color"`
+	PlaceholderPattern string `json:"placeholder_pattern" form:"placeholder_pattern"`
+	PlaceholderText    bool   `json:"placeholder_text" form:"placeholder_text"`
+	PlaceholderImage   string `json:"placeholder_image" form:"placeholder_image"`
+	MaxWidth           int    `json:"max_width" form:"max_width"`
+	MaxHeight          int    `json:"max_height" form:"max_height"`
+	Priority           int    `json:"priority" form:"-"`
+}
 
-	var req struct {
-		UsePlaceholder bool   `json:"use_placeholder"`
-		OnlyConfirmed  bool   `json:"only_confirmed"`
-		OutputPath     string `json:"output_path"`
+// exportOptions validates the options of an export request. It writes the
+// error response and returns false if the request is invalid.
+func exportOptions(c *gin.Context, req exportRequest) (models.ExportOptions, bool) {
+	options := models.ExportOptions{
+		UsePlaceholder: req.UsePlaceholder,
+		OnlyConfirmed:  req.OnlyConfirmed,
+		OutputPath:     req.OutputPath,
+		Manifest:       req.Manifest,
+		Layout:         req.Layout,
+		Mode:           req.Mode,
+		Archive:        req.Archive,
+		OnConflict:     req.OnConflict,
+		Format:         req.Format,
+		Quality:        req.Quality,
+		Background:     req.Background,
+		Resize:         req.Resize,
+		Filter:         req.Filter,
+
+		PlaceholderLayout:  req.PlaceholderLayout,
+		PlaceholderColor:   req.PlaceholderColor,
+		PlaceholderPattern: req.PlaceholderPattern,
+		PlaceholderText:    req.PlaceholderText,
+		PlaceholderImage:   req.PlaceholderImage,
+		MaxWidth:           req.MaxWidth,
+		MaxHeight:          req.MaxHeight,
 	}
-	c.ShouldBindJSON(&req)
 
-	var project models.Project
-	if err := database.DB.First(&project, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
-		return
+	if !services.ValidManifestFormat(req.Manifest) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown manifest format: %s", req.Manifest)})
+		return options, false
 	}
-
-	manager := workers.GetManager()
-	manager.StartExport(project.ID, func(ctx context.Context) {
-		svc := services.NewExportService(&project, req.UsePlaceholder, req.OnlyConfirmed, req.OutputPath, ctx)
-		if err := svc.Process(); err != nil {
-			log.Printf("Export failed for project %d: %v", project.ID, err)
-		}
-	})
-
-	c.JSON(http.StatusOK, gin.H{"status": "exporting"})
+	if !services.ValidExportMode(req.Mode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown export mode: %s", req.Mode)})
+		return options, false
+	}
+	if !archive.ValidFormat(req.Archive) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown archive format: %s", req.Archive)})
+		return options, false
+	}
+	if !services.ValidConflictPolicy(req.OnConflict) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown conflict policy: %s", req.OnConflict)})
+		return options, false
+	}
+	if req.Archive != "" && req.Mode != "" && req.Mode != services.ExportCopy {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("archive exports can only copy files, not %s them", req.Mode)})
+		return options, false
+	}
+	if _, err := services.ParseLayout(req.Layout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return options, false
+	}
+	if err := services.ValidateConvertOptions(options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return options, false
+	}
+	if err := services.ValidateMoveOptions(options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return options, false
+	}
+	if err := services.ValidatePlaceholderOptions(options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return options, false
+	}
+
+	return options, true
 }
 
-// GetExportProgress returns export progress
-func GetExportProgress(c *gin.Context) {
+// checkMovedFiles rejects requests while a move-mode export of the project
+// has not been undone, because target paths of the review and of exports
+// are stale until then. It writes the error response and returns false.
+func checkMovedFiles(c *gin.Context, projectID uint) bool {
+	runID, err := services.MovedFilesExport(projectID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if runID != 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     fmt.Sprintf("export %d moved target files, undo it first", runID),
+			"export_id": runID,
+		})
+		return false
+	}
+	return true
+}
+
+// checkExportPlan plans an export before anything is queued. It rejects
+// layouts that write several files to the same path, and existing output
+// files if the conflict policy is fail. It writes the error response and
+// returns false if the export cannot start.
+func checkExportPlan(c *gin.Context, project *models.Project, options models.ExportOptions) bool {
+	plan, err := services.PlanExport(project, options, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if !checkCollisions(c, plan.Collisions) {
+		return false
+	}
+	if len(plan.Conflicts) > 0 && options.OnConflict == services.ConflictFail {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     fmt.Sprintf("%d output files exist already", len(plan.Conflicts)),
+			"conflicts": plan.Conflicts,
+		})
+		return false
+	}
+	return true
+}
+
+// checkCollisions rejects layouts that write several files to the same path
+func checkCollisions(c *gin.Context, collisions []services.LayoutCollision) bool {
+	if len(collisions) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      fmt.Sprintf("layout maps %d output paths to more than one file", len(collisions)),
+			"collisions": collisions,
+		})
+		return false
+	}
+	return true
+}
+
+// StartExport starts export process
+func StartExport(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 
+	// The body is optional, but a malformed one is not silently ignored
+	var req exportRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var project models.Project
 	if err := database.DB.First(&project, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 		return
 	}
 
-	// Determine output path (same logic as NewExportService)
-	outputPath := filepath.Join(filepath.Dir(project.SourcePath), fmt.Sprintf("%s_Output", project.Name))
-	progressFile := filepath.Join(outputPath, ".export_progress.json")
+	options, ok := exportOptions(c, req)
+	if !ok || !checkMovedFiles(c, project.ID) {
+		return
+	}
+
+	// A dry run only reports what the export would do
+	if req.DryRun {
+		plan, err := services.PlanExport(&project, options, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, plan)
+		return
+	}
+
+	if !checkExportPlan(c, &project, options) {
+		return
+	}
+
+	// An export in progress, even a paused one, is only replaced on request
+	queue := workers.GetQueue()
+	if queue.HasActiveJob(project.ID, workers.TaskTypeExport) {
+		if !req.Replace {
+			c.JSON(http.StatusConflict, gin.H{"error": "An export is already queued, running or paused; pass replace to cancel it"})
+			return
+		}
+		queue.CancelActive(project.ID, workers.TaskTypeExport)
+	}
+
+	run, err := services.CreateExportRun(&project, options, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "exporting",
+		"export_id":   run.ID,
+		"job_id":      run.JobID,
+		"output_path": run.Options.OutputPath,
+	})
+}
+
+// DownloadExport streams an export as a ZIP (default) or tar.gz download.
+// It takes the options of StartExport except output_path, mode,
+// on_conflict, dry_run, replace and priority; nothing is written on the
+// server and no export run is stored.
+func DownloadExport(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	// Options come from the query or a body, malformed ones are rejected
+	var req exportRequest
+	if err := c.ShouldBind(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.OutputPath, req.Mode, req.OnConflict = "", "", ""
+	if req.Archive == "" {
+		req.Archive = archive.FormatZip
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
 
-	// Read progress file
-	data, err := os.ReadFile(progressFile)
+	options, ok := exportOptions(c, req)
+	if !ok || !checkMovedFiles(c, project.ID) {
+		return
+	}
+	// A download writes no files, so only collisions inside the archive matter
+	collisions, err := services.ExportCollisions(&project, options)
 	if err != nil {
-		// If file doesn't exist, export hasn't started or completed
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkCollisions(c, collisions) {
+		return
+	}
+
+	// The download counts as a running job
+	release, ok := workers.GetQueue().Reserve()
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "All job slots are busy, try again later"})
+		return
+	}
+	defer release()
+
+	filename := fmt.Sprintf("%s_Output%s", project.Name, archive.Ext(options.Archive))
+	contentType := "application/zip"
+	if options.Archive == archive.FormatTarGz {
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+
+	// The response has started; a failure can only cut the download short
+	run := &models.ExportRun{ProjectID: project.ID, Options: options}
+	svc := services.NewExportService(&project, run, c.Request.Context())
+	if err := svc.StreamArchive(c.Writer); err != nil {
+		log.Printf("[EXPORT] Download of project %d failed: %v", project.ID, err)
+		c.Abort()
+	}
+}
+
+// GetProjectEvents streams the events of a project as Server-Sent Events.
+// The stream starts with the current status and lasts until the client
+// disconnects; a comment is sent every 15 seconds to keep proxies from
+// closing it.
+func GetProjectEvents(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	stream, unsubscribe := events.Subscribe(project.ID)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	pausedJobs, _ := workers.GetQueue().PausedJobs(project.ID)
+	status, _ := pauseState(project.Status, pausedJobs[project.ID])
+	current := events.Event{
+		Type:      events.TypeStatus,
+		ProjectID: project.ID,
+		Status:    status,
+		Phase:     project.Phase,
+		Time:      time.Now(),
+	}
+	if project.ErrorMessage != nil {
+		current.Error = *project.ErrorMessage
+	}
+	c.SSEvent(current.Type, current)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-stream:
+			c.SSEvent(event.Type, event)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+// GetExportProgress returns the progress of an export run, the latest one
+// unless export_id is given
+func GetExportProgress(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	query := database.DB.Preload("Job").Where("project_id = ?", id)
+	if exportID := c.Query("export_id"); exportID != "" {
+		query = query.Where("id = ?", exportID)
+	}
+
+	var run models.ExportRun
+	if err := query.Order("id DESC").First(&run).Error; err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"total":     0,
 			"processed": 0,
@@ -471,25 +1213,546 @@ func GetExportProgress(c *gin.Context) {
 		return
 	}
 
-	var progress map[string]interface{}
-	if err := json.Unmarshal(data, &progress); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse progress"})
+	c.JSON(http.StatusOK, exportRunJSON(&run))
+}
+
+// GetExports returns the export history of a project, newest first
+func GetExports(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage := 20
+
+	var total int64
+	database.DB.Model(&models.ExportRun{}).Where("project_id = ?", id).Count(&total)
+
+	var runs []models.ExportRun
+	database.DB.Preload("Job").Where("project_id = ?", id).
+		Order("id DESC").Limit(perPage).Offset((page - 1) * perPage).
+		Find(&runs)
+
+	exports := make([]gin.H, 0, len(runs))
+	for i := range runs {
+		exports = append(exports, exportRunJSON(&runs[i]))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"exports":  exports,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+// GetExport returns a single export run
+func GetExport(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	exportID, _ := strconv.Atoi(c.Param("export_id"))
+
+	var run models.ExportRun
+	if err := database.DB.Preload("Job").Where("id = ? AND project_id = ?", exportID, id).First(&run).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
 		return
 	}
 
-	// Add status field
-	total := int(progress["total"].(float64))
-	processed := int(progress["processed"].(float64))
+	c.JSON(http.StatusOK, exportRunJSON(&run))
+}
 
-	var status string
-	if total == 0 {
-		status = "no_files"
-	} else if processed >= total {
-		status = "completed"
-	} else {
+// UndoExport moves the files of a move-mode export back to where they were
+func UndoExport(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	exportID, _ := strconv.Atoi(c.Param("export_id"))
+
+	var run models.ExportRun
+	if err := database.DB.Preload("Job").Where("id = ? AND project_id = ?", exportID, id).First(&run).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if run.Options.Mode != services.ExportMove {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only move-mode exports can be undone"})
+		return
+	}
+	if run.Job != nil {
+		switch run.Job.State {
+		case workers.JobQueued, workers.JobRunning, workers.JobPaused:
+			c.JSON(http.StatusConflict, gin.H{"error": "Export is still active, cancel it first"})
+			return
+		}
+	}
+
+	restored, err := services.UndoExport(&run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "restored": restored})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"export_id": run.ID,
+		"restored":  restored,
+		"undone_at": run.UndoneAt,
+	})
+}
+
+// exportRunJSON formats an export run. status keeps the values the client
+// polls for (in_progress, completed, no_files); state is the job state.
+func exportRunJSON(run *models.ExportRun) gin.H {
+	state := workers.JobQueued
+	var jobError *string
+	var startedAt, finishedAt *time.Time
+	if run.Job != nil {
+		state = run.Job.State
+		jobError = run.Job.Error
+		startedAt = run.Job.StartedAt
+		finishedAt = run.Job.FinishedAt
+	}
+
+	status := state
+	switch state {
+	case workers.JobQueued, workers.JobRunning:
 		status = "in_progress"
+	case workers.JobCompleted:
+		if run.Total == 0 {
+			status = "no_files"
+		}
+	}
+
+	return gin.H{
+		"id":          run.ID,
+		"job_id":      run.JobID,
+		"status":      status,
+		"state":       state,
+		"options":     run.Options,
+		"output_path": run.Options.OutputPath,
+		"total":       run.Total,
+		"processed":   run.Processed,
+		"failed":      run.Failed,
+		"current":     run.Current,
+		"undone_at":   run.UndoneAt,
+		"error":       jobError,
+		"created_at":  run.CreatedAt,
+		"started_at":  startedAt,
+		"finished_at": finishedAt,
+	}
+}
+
+// GetClusters returns the duplicate clusters of a dedupe project with
+// pagination, largest clusters first
+func GetClusters(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	if perPage < 1 || perPage > 200 {
+		perPage = 20
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
 	}
-	progress["status"] = status
 
-	c.JSON(http.StatusOK, progress)
+	clusters, total, err := services.ListClusters(&project, page, perPage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"clusters": clusters,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+// SetClusterKeeper picks the image kept from a duplicate cluster
+func SetClusterKeeper(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	clusterID, _ := strconv.Atoi(c.Param("cluster_id"))
+
+	var req struct {
+		MemberID uint `json:"member_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	if err := services.SetClusterKeeper(&project, uint(clusterID), req.MemberID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ResolveClusters exports or quarantines everything but the keepers of the
+// given clusters (all clusters when cluster_ids is empty) in the background
+func ResolveClusters(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var req struct {
+		Action     string `json:"action" binding:"required"` // export, quarantine
+		ClusterIDs []uint `json:"cluster_ids"`
+		OutputPath string `json:"output_path"`
+		Priority   int    `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	if project.Type != "dedupe" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only dedupe projects have duplicate clusters"})
+		return
+	}
+
+	// Clusters are rebuilt by a running dedupe and files are moved by an
+	// export, so resolve only once both are done
+	queue := workers.GetQueue()
+	if queue.HasActiveJob(project.ID, workers.TaskTypeComparison) || queue.HasActiveJob(project.ID, workers.TaskTypeExport) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project has a dedupe or export in progress"})
+		return
+	}
+
+	outputPath := req.OutputPath
+	switch req.Action {
+	case "export":
+		if outputPath == "" {
+			outputPath = services.DefaultOutputPath(&project)
+		}
+	case "quarantine":
+		if outputPath == "" {
+			outputPath = services.DefaultQuarantinePath(&project)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown action: %s", req.Action)})
+		return
+	}
+
+	job, err := queue.Enqueue(services.JobResolveDuplicates, project.ID, req.Priority, services.ResolveDuplicatesPayload{
+		Action:     req.Action,
+		ClusterIDs: req.ClusterIDs,
+		OutputPath: outputPath,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "processing",
+		"job_id":      job.ID,
+		"action":      req.Action,
+		"output_path": outputPath,
+	})
+}
+
+// GetOrphans lists target files that no source file maps to: never selected
+// and never a candidate scoring at or above threshold (default 50). Results
+// are grouped by target and paginated; format=csv downloads all of them.
+func GetOrphans(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	threshold, err := strconv.ParseFloat(c.DefaultQuery("threshold", strconv.FormatFloat(services.DefaultOrphanThreshold, 'f', -1, 64)), 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid threshold"})
+		return
+	}
+	targetID, _ := strconv.Atoi(c.DefaultQuery("target_id", "0"))
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "50"))
+	if perPage < 1 || perPage > 500 {
+		perPage = 50
+	}
+
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		orphans, _, err := services.FindOrphans(&project, threshold, uint(targetID), 1, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": fmt.Sprintf("%s_orphans.csv", project.Name),
+		}))
+
+		writer := csv.NewWriter(c.Writer)
+		writer.Write([]string{"target", "relative_path", "path", "width", "height", "size_bytes", "best_score"})
+		for _, o := range orphans {
+			bestScore := ""
+			if o.BestScore != nil {
+				bestScore = strconv.FormatFloat(*o.BestScore, 'f', 2, 64)
+			}
+			writer.Write([]string{
+				o.TargetName,
+				o.RelativePath,
+				o.Path,
+				strconv.Itoa(o.Width),
+				strconv.Itoa(o.Height),
+				strconv.FormatInt(o.SizeBytes, 10),
+				bestScore,
+			})
+		}
+		writer.Flush()
+		return
+	}
+
+	orphans, total, err := services.FindOrphans(&project, threshold, uint(targetID), page, perPage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stats, err := services.GetOrphanStats(&project, threshold)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Group the page by target, keeping the target order
+	type orphanGroup struct {
+		TargetID   uint                  `json:"target_id"`
+		TargetName string                `json:"target_name"`
+		Files      []services.OrphanFile `json:"files"`
+	}
+	groups := []*orphanGroup{}
+	for _, o := range orphans {
+		if len(groups) == 0 || groups[len(groups)-1].TargetID != o.TargetID {
+			groups = append(groups, &orphanGroup{TargetID: o.TargetID, TargetName: o.TargetName})
+		}
+		group := groups[len(groups)-1]
+		group.Files = append(group.Files, o)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"threshold": threshold,
+		"targets":   stats,
+		"groups":    groups,
+		"total":     total,
+		"page":      page,
+		"per_page":  perPage,
+	})
+}
+
+// jobJSON adds the completion percentage to a job
+func jobJSON(job *models.Job) gin.H {
+	progress := float64(0)
+	if job.ProgressTotal > 0 {
+		progress = float64(job.ProgressDone) / float64(job.ProgressTotal) * 100
+	}
+	return gin.H{
+		"id":             job.ID,
+		"type":           job.Type,
+		"project_id":     job.ProjectID,
+		"state":          job.State,
+		"priority":       job.Priority,
+		"payload":        json.RawMessage(nonEmptyJSON(job.Payload)),
+		"progress_done":  job.ProgressDone,
+		"progress_total": job.ProgressTotal,
+		"progress":       progress,
+		"error":          job.Error,
+		"attempts":       job.Attempts,
+		"created_at":     job.CreatedAt,
+		"started_at":     job.StartedAt,
+		"finished_at":    job.FinishedAt,
+		"updated_at":     job.UpdatedAt,
+	}
+}
+
+// nonEmptyJSON returns "null" for an empty JSON document
+func nonEmptyJSON(data string) string {
+	if data == "" {
+		return "null"
+	}
+	return data
+}
+
+// GetJobs lists background jobs, newest first. Query params: project_id,
+// state, type and page.
+func GetJobs(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage := 50
+
+	query := database.DB.Model(&models.Job{})
+	if projectID := c.Query("project_id"); projectID != "" {
+		query = query.Where("project_id = ?", projectID)
+	}
+	if state := c.Query("state"); state != "" {
+		query = query.Where("state = ?", state)
+	}
+	if jobType := c.Query("type"); jobType != "" {
+		query = query.Where("type = ?", jobType)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var jobs []models.Job
+	query.Order("id DESC").Limit(perPage).Offset((page - 1) * perPage).Find(&jobs)
+
+	result := make([]gin.H, 0, len(jobs))
+	for i := range jobs {
+		result = append(result, jobJSON(&jobs[i]))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":     result,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+// GetJob returns a single job
+func GetJob(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var job models.Job
+	if err := database.DB.First(&job, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobJSON(&job))
+}
+
+// CancelJob cancels a queued or running job
+func CancelJob(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := workers.GetQueue().Cancel(uint(id)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "cancelling"})
+}
+
+// PauseJob pauses a queued or running job
+func PauseJob(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := workers.GetQueue().Pause(uint(id)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "pausing"})
+}
+
+// ResumeJob queues a paused job again
+func ResumeJob(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := workers.GetQueue().Resume(uint(id)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "queued"})
+}
+
+// RetryJob queues a failed or cancelled job again
+func RetryJob(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	job, err := workers.GetQueue().Retry(uint(id))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "queued", "job_id": job.ID})
+}
+
+// SetJobPriority changes the priority of a queued job
+func SetJobPriority(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var req struct {
+		Priority *int `json:"priority" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, err := workers.GetQueue().SetPriority(uint(id), *req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "job_id": job.ID, "priority": job.Priority})
+}
+
+// GetCacheStats returns statistics about the shared feature cache
+func GetCacheStats(c *gin.Context) {
+	stats, err := services.GetCacheStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// EvictCache removes entries from the shared feature cache.
+// Query params: unused_days (drop entries not used for N days) and
+// max_entries (keep only the N most recently used). The whole cache is
+// only cleared with all=true.
+func EvictCache(c *gin.Context) {
+	unusedDays, err := strconv.Atoi(c.DefaultQuery("unused_days", "0"))
+	if err != nil || unusedDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unused_days must be a non-negative integer"})
+		return
+	}
+	maxEntries, err := strconv.Atoi(c.DefaultQuery("max_entries", "0"))
+	if err != nil || maxEntries < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_entries must be a non-negative integer"})
+		return
+	}
+	if unusedDays == 0 && maxEntries == 0 && c.Query("all") != "true" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pass unused_days or max_entries, or all=true to clear the whole cache"})
+		return
+	}
+
+	removed, err := services.EvictCache(time.Duration(unusedDays)*24*time.Hour, maxEntries)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"removed": removed,
+	})
 }
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/services"
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+func TestTargetEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	project := models.Project{
+		Name:           "targets",
+		SourcePath:     dir,
+		Status:         "completed",
+		ProjectTargets: []models.ProjectTarget{{Name: "A", Path: dir}},
+	}
+	if err := database.DB.Create(&project).Error; err != nil {
+		t.Fatal(err)
+	}
+	targetA := project.ProjectTargets[0].ID
+	base := fmt.Sprintf("/api/projects/%d/targets", project.ID)
+
+	w := serve(t, http.MethodPost, base, map[string]string{"name": "B", "path": dir})
+	if w.Code != http.StatusOK {
+		t.Fatalf("add target = %d %s", w.Code, w.Body)
+	}
+	waitForIdle(t, project.ID)
+	var targetB models.ProjectTarget
+	if err := database.DB.Where("project_id = ? AND name = ?", project.ID, "B").First(&targetB).Error; err != nil {
+		t.Fatalf("added target not stored: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{name: "add without name", method: http.MethodPost, path: base,
+			body: map[string]string{"path": dir}, want: http.StatusBadRequest},
+		{name: "add missing path", method: http.MethodPost, path: base,
+			body: map[string]string{"name": "C", "path": filepath.Join(dir, "missing")}, want: http.StatusBadRequest},
+		{name: "add to missing project", method: http.MethodPost, path: "/api/projects/999999/targets",
+			body: map[string]string{"name": "C", "path": dir}, want: http.StatusNotFound},
+		{name: "add taken name", method: http.MethodPost, path: base,
+			body: map[string]string{"name": "B", "path": dir}, want: http.StatusConflict},
+		{name: "rename to taken name", method: http.MethodPut, path: fmt.Sprintf("%s/%d", base, targetA),
+			body: map[string]string{"name": "B"}, want: http.StatusConflict},
+		{name: "rename to own name", method: http.MethodPut, path: fmt.Sprintf("%s/%d", base, targetA),
+			body: map[string]string{"name": "A"}, want: http.StatusOK},
+		{name: "create with duplicate target names", method: http.MethodPost, path: "/api/projects",
+			body: map[string]interface{}{"name": "duplicates", "source_path": dir, "targets": []map[string]string{
+				{"name": "T", "path": dir}, {"name": "T", "path": dir},
+			}}, want: http.StatusBadRequest},
+		{name: "rename", method: http.MethodPut, path: fmt.Sprintf("%s/%d", base, targetA),
+			body: map[string]string{"name": "Renamed"}, want: http.StatusOK},
+		{name: "rename missing target", method: http.MethodPut, path: base + "/999999",
+			body: map[string]string{"name": "X"}, want: http.StatusNotFound},
+		{name: "remove", method: http.MethodDelete, path: fmt.Sprintf("%s/%d", base, targetB.ID),
+			want: http.StatusOK},
+		{name: "remove missing target", method: http.MethodDelete, path: fmt.Sprintf("%s/%d", base, targetB.ID),
+			want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := serve(t, tt.method, tt.path, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d %s, want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+
+	var names []string
+	database.DB.Model(&models.ProjectTarget{}).Where("project_id = ?", project.ID).Order("id").Pluck("name", &names)
+	if fmt.Sprint(names) != "[Renamed]" {
+		t.Errorf("targets after the requests = %v, want [Renamed]", names)
+	}
+}
+
+func TestCreateDedupeProjectThreshold(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		body map[string]interface{}
+		code int
+		want float64
+	}{
+		{body: map[string]interface{}{}, code: http.StatusOK, want: 90},
+		{body: map[string]interface{}{"dedupe_threshold": 0}, code: http.StatusOK, want: 0},
+		{body: map[string]interface{}{"dedupe_threshold": 75.5}, code: http.StatusOK, want: 75.5},
+		{body: map[string]interface{}{"dedupe_threshold": -1}, code: http.StatusBadRequest},
+		{body: map[string]interface{}{"dedupe_threshold": 101}, code: http.StatusBadRequest},
+	}
+
+	for i, tt := range tests {
+		tt.body["name"] = fmt.Sprintf("%s-%d", t.Name(), i)
+		tt.body["type"] = "dedupe"
+		tt.body["source_path"] = dir
+		w := serve(t, http.MethodPost, "/api/projects", tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%v: status = %d %s, want %d", tt.body, w.Code, w.Body, tt.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var project models.Project
+		if err := database.DB.Where("name = ?", tt.body["name"]).First(&project).Error; err != nil {
+			t.Fatal(err)
+		}
+		waitForIdle(t, project.ID)
+		if project.DedupeThreshold != tt.want {
+			t.Errorf("%v: stored threshold %v, want %v", tt.body, project.DedupeThreshold, tt.want)
+		}
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	entry := models.FeatureCache{FileKey: t.Name(), Checksum: t.Name(), LastUsedAt: time.Now()}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: "", want: http.StatusBadRequest},
+		{query: "?unused_days=abc", want: http.StatusBadRequest},
+		{query: "?unused_days=-1", want: http.StatusBadRequest},
+		{query: "?max_entries=-5", want: http.StatusBadRequest},
+		{query: "?all=1", want: http.StatusBadRequest},
+		{query: "?unused_days=30", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serve(t, http.MethodDelete, "/api/cache"+tt.query, nil)
+		if w.Code != tt.want {
+			t.Errorf("DELETE /api/cache%s = %d %s, want %d", tt.query, w.Code, w.Body, tt.want)
+		}
+	}
+	var count int64
+	database.DB.Model(&models.FeatureCache{}).Count(&count)
+	if count == 0 {
+		t.Fatal("cache cleared without all=true")
+	}
+
+	if w := serve(t, http.MethodDelete, "/api/cache?all=true", nil); w.Code != http.StatusOK {
+		t.Fatalf("DELETE /api/cache?all=true = %d %s", w.Code, w.Body)
+	}
+	database.DB.Model(&models.FeatureCache{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d entries left after clearing the cache", count)
+	}
+}
+
+func TestResolveClusters(t *testing.T) {
+	compare := models.Project{Name: "compare", Type: "compare", SourcePath: t.TempDir(), Status: "completed"}
+	dedupe := models.Project{Name: "dedupe", Type: "dedupe", Status: "completed", DedupeThreshold: 90}
+	for _, p := range []*models.Project{&compare, &dedupe} {
+		if err := database.DB.Create(p).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve := func(project models.Project) int {
+		path := fmt.Sprintf("/api/projects/%d/clusters/resolve", project.ID)
+		return serve(t, http.MethodPost, path, map[string]string{"action": "quarantine", "output_path": t.TempDir()}).Code
+	}
+
+	if code := resolve(compare); code != http.StatusBadRequest {
+		t.Errorf("resolving a compare project = %d, want 400", code)
+	}
+
+	// A dedupe or export in progress, even a paused one, blocks resolving
+	for _, jobType := range []string{services.JobComparison, services.JobExport} {
+		job := models.Job{Type: jobType, ProjectID: dedupe.ID, State: workers.JobPaused}
+		if err := database.DB.Create(&job).Error; err != nil {
+			t.Fatal(err)
+		}
+		if code := resolve(dedupe); code != http.StatusConflict {
+			t.Errorf("resolving with a paused %s job = %d, want 409", jobType, code)
+		}
+		database.DB.Model(&job).Update("state", workers.JobCancelled)
+	}
+
+	if code := resolve(dedupe); code != http.StatusOK {
+		t.Errorf("resolving an idle dedupe project = %d, want 200", code)
+	}
+	waitForIdle(t, dedupe.ID)
+}
+
+func TestRebaseProjectWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	project := models.Project{Name: "rebase", SourcePath: filepath.Join(dir, "old"), Status: "completed"}
+	if err := database.DB.Create(&project).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Stored directly, so the queue never picks it up
+	job := models.Job{Type: services.JobComparison, ProjectID: project.ID, State: workers.JobRunning}
+	if err := database.DB.Create(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/projects/%d/roots", project.ID)
+
+	if w := serve(t, http.MethodPut, path, map[string]string{"source_path": dir}); w.Code != http.StatusConflict {
+		t.Errorf("rebase with a running job = %d, want 409", w.Code)
+	}
+	database.DB.Model(&job).Update("state", workers.JobCompleted)
+	if w := serve(t, http.MethodPut, path, map[string]string{"source_path": dir}); w.Code != http.StatusOK {
+		t.Errorf("rebase after the job = %d %s, want 200", w.Code, w.Body)
+	}
+	database.DB.First(&project, project.ID)
+	if project.SourcePath != dir {
+		t.Errorf("source path = %q, want %q", project.SourcePath, dir)
+	}
+}
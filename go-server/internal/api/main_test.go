@@ -0,0 +1,60 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/services"
+	"github.com/bilibili/look-alike/internal/testutil"
+	"github.com/bilibili/look-alike/internal/workers"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	testutil.RunWithDatabase(m)
+}
+
+// startQueue starts the job queue on the first request
+var startQueue sync.Once
+
+// serve sends a request with an optional JSON body through the API router
+func serve(t *testing.T, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	startQueue.Do(func() {
+		services.RegisterJobHandlers(workers.GetQueue())
+		if err := workers.GetQueue().Start(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	recorder := httptest.NewRecorder()
+	SetupRouter("").ServeHTTP(recorder, req)
+	return recorder
+}
+
+// waitForIdle waits until no comparison or export job is queued or running
+// for a project
+func waitForIdle(t *testing.T, projectID uint) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	queue := workers.GetQueue()
+	for queue.HasActiveJob(projectID, workers.TaskTypeComparison) || queue.HasActiveJob(projectID, workers.TaskTypeExport) {
+		if time.Now().After(deadline) {
+			t.Fatalf("project %d is still being processed", projectID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
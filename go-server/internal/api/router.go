@@ -44,10 +44,21 @@ func SetupRouter(clientDistPath string) *gin.Engine {
 		api.POST("/projects", CreateProject)
 		api.GET("/projects/:id", GetProject)
 		api.DELETE("/projects/:id", DeleteProject)
+		api.PUT("/projects/:id/roots", RebaseProject)
+		api.POST("/projects/:id/pause", PauseProject)
+		api.POST("/projects/:id/resume", ResumeProject)
+		api.POST("/projects/:id/restart", RestartProject)
+		api.GET("/projects/:id/events", GetProjectEvents)
+
+		// Targets
+		api.POST("/projects/:id/targets", AddTarget)
+		api.PUT("/projects/:id/targets/:target_id", UpdateTarget)
+		api.DELETE("/projects/:id/targets/:target_id", DeleteTarget)
 
 		// Files
 		api.GET("/projects/:id/files", GetProjectFiles)
 		api.POST("/projects/:id/candidates", GetCandidates)
+		api.GET("/projects/:id/orphans", GetOrphans)
 
 		// Image serving
 		api.GET("/image", ServeImage)
@@ -57,9 +68,32 @@ func SetupRouter(clientDistPath string) *gin.Engine {
 		api.POST("/projects/:id/mark_no_match", MarkNoMatch)
 		api.POST("/projects/:id/confirm_row", ConfirmRow)
 
+		// Duplicate clusters (dedupe projects)
+		api.GET("/projects/:id/clusters", GetClusters)
+		api.PUT("/projects/:id/clusters/:cluster_id/keeper", SetClusterKeeper)
+		api.POST("/projects/:id/clusters/resolve", ResolveClusters)
+
 		// Export
 		api.POST("/projects/:id/export", StartExport)
+		api.GET("/projects/:id/export/download", DownloadExport)
+		api.POST("/projects/:id/export/download", DownloadExport)
 		api.GET("/projects/:id/export_progress", GetExportProgress)
+		api.GET("/projects/:id/exports", GetExports)
+		api.GET("/projects/:id/exports/:export_id", GetExport)
+		api.POST("/projects/:id/exports/:export_id/undo", UndoExport)
+
+		// Background jobs
+		api.GET("/jobs", GetJobs)
+		api.GET("/jobs/:id", GetJob)
+		api.POST("/jobs/:id/cancel", CancelJob)
+		api.POST("/jobs/:id/pause", PauseJob)
+		api.POST("/jobs/:id/resume", ResumeJob)
+		api.POST("/jobs/:id/retry", RetryJob)
+		api.PUT("/jobs/:id/priority", SetJobPriority)
+
+		// Shared feature cache
+		api.GET("/cache/stats", GetCacheStats)
+		api.DELETE("/cache", EvictCache)
 	}
 
 	// Serve static files (frontend)
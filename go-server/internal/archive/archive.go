@@ -0,0 +1,454 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Separator separates the archive file from the entry inside it in a
+// virtual path, e.g. "/deliveries/bundle.zip!/dir/a.png"
+const Separator = "!/"
+
+// maxCachedIndexes bounds the number of archive indexes kept in memory
+const maxCachedIndexes = 16
+
+// Entry describes a regular file stored inside an archive
+type Entry struct {
+	Name    string // slash-separated path inside the archive
+	Size    int64
+	ModTime time.Time
+	offset  int64 // data offset in the uncompressed tar, unused for zip
+	header  fs.FileInfo
+	zipFile *zip.File
+}
+
+// index holds the entry table of a single archive. Entries are read from
+// the open zip reader or, for tar files, from dataPath at the entry offset.
+// An evicted index is closed once its last reader is closed.
+type index struct {
+	path     string
+	kind     string // zip, tar, tgz
+	modTime  time.Time
+	size     int64
+	entries  []Entry
+	byName   map[string]int
+	zip      *zip.ReadCloser
+	dataPath string // uncompressed tar: the archive itself, or a spooled copy of a tar.gz
+	spooled  bool   // dataPath is a temporary file owned by the index
+	refs     int    // open readers, guarded by cacheMu
+	evicted  bool
+}
+
+var (
+	cacheMu  sync.Mutex
+	cache    = make(map[string]*index)
+	order    []string                      // least recently used first
+	building = make(map[string]*buildCall) // indexes being built, key: archive path
+)
+
+// buildCall is an index build other loads of the same archive wait for
+type buildCall struct {
+	done chan struct{}
+	err  error
+}
+
+// IsArchive reports whether the file name has a supported archive extension
+func IsArchive(name string) bool {
+	return kindOf(name) != ""
+}
+
+// kindOf returns the archive kind for a file name, or "" if unsupported
+func kindOf(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// Split splits a virtual path into the archive file and the entry name at
+// the first separator that follows an archive name, so folders named like
+// "wow!" are kept in the archive path. ok is false when the path does not
+// point inside an archive.
+func Split(p string) (archivePath, entry string, ok bool) {
+	for start := 0; ; {
+		idx := strings.Index(p[start:], Separator)
+		if idx < 0 {
+			return p, "", false
+		}
+		idx += start
+		if IsArchive(p[:idx]) {
+			return p[:idx], p[idx+len(Separator):], true
+		}
+		start = idx + len(Separator)
+	}
+}
+
+// Join builds a virtual path for an entry inside an archive
+func Join(archivePath, entry string) string {
+	return archivePath + Separator + entry
+}
+
+// IsVirtual reports whether the path points inside an archive
+func IsVirtual(p string) bool {
+	_, _, ok := Split(p)
+	return ok
+}
+
+// Flatten turns a virtual path into a plain path by replacing the archive
+// separator with a directory separator, so "bundle.zip!/dir/a.png" becomes
+// "bundle.zip/dir/a.png". Used when virtual paths are mirrored on disk.
+func Flatten(p string) string {
+	return strings.ReplaceAll(p, Separator, string(os.PathSeparator))
+}
+
+// List returns all regular file entries of an archive, sorted by name
+func List(archivePath string) ([]Entry, error) {
+	idx, err := load(archivePath, false)
+	if err != nil {
+		return nil, err
+	}
+	return idx.entries, nil
+}
+
+// Open opens a file for reading. Virtual paths are resolved to the matching
+// archive entry, any other path is opened from the local filesystem.
+func Open(p string) (io.ReadCloser, error) {
+	archivePath, entry, ok := Split(p)
+	if !ok {
+		return os.Open(p)
+	}
+
+	// The reference keeps the index open while the entry is read
+	idx, err := load(archivePath, true)
+	if err != nil {
+		return nil, err
+	}
+	release := releaser{idx}
+	i, found := idx.byName[entry]
+	if !found {
+		release.Close()
+		return nil, fmt.Errorf("%s: entry not found in %s", entry, archivePath)
+	}
+	e := idx.entries[i]
+
+	if idx.kind == "zip" {
+		rc, err := e.zipFile.Open()
+		if err != nil {
+			release.Close()
+			return nil, err
+		}
+		return readCloser{rc, multiCloser{rc, release}}, nil
+	}
+
+	f, err := os.Open(idx.dataPath)
+	if err != nil {
+		release.Close()
+		return nil, err
+	}
+	return readCloser{io.NewSectionReader(f, e.offset, e.Size), multiCloser{f, release}}, nil
+}
+
+// Stat returns file information for a plain or virtual path
+func Stat(p string) (fs.FileInfo, error) {
+	archivePath, entry, ok := Split(p)
+	if !ok {
+		return os.Stat(p)
+	}
+
+	idx, err := load(archivePath, false)
+	if err != nil {
+		return nil, err
+	}
+	i, found := idx.byName[entry]
+	if !found {
+		return nil, fmt.Errorf("%s: entry not found in %s", entry, archivePath)
+	}
+	return idx.entries[i].header, nil
+}
+
+// ReadFile reads the whole content of a plain or virtual path
+func ReadFile(p string) ([]byte, error) {
+	if !IsVirtual(p) {
+		return os.ReadFile(p)
+	}
+	rc, err := Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, rc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// load returns the cached index for an archive, rebuilding it when the
+// archive changed on disk. Indexes are built without holding cacheMu, so a
+// large archive does not block the others; concurrent loads of the same
+// archive wait for a single build. With ref set the caller holds a
+// reference and must release it, see releaser.
+func load(archivePath string, ref bool) (*index, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMu.Lock()
+	for {
+		if idx, ok := cache[archivePath]; ok {
+			if idx.modTime.Equal(info.ModTime()) && idx.size == info.Size() {
+				touch(archivePath)
+				if ref {
+					idx.refs++
+				}
+				cacheMu.Unlock()
+				return idx, nil
+			}
+			evict(archivePath)
+		}
+
+		call, ok := building[archivePath]
+		if !ok {
+			break
+		}
+		cacheMu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		cacheMu.Lock()
+	}
+
+	call := &buildCall{done: make(chan struct{})}
+	building[archivePath] = call
+	cacheMu.Unlock()
+
+	idx, err := build(archivePath, info)
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	delete(building, archivePath)
+	call.err = err
+	close(call.done)
+	if err != nil {
+		return nil, err
+	}
+
+	if ref {
+		idx.refs++
+	}
+	cache[archivePath] = idx
+	order = append(order, archivePath)
+	for len(order) > maxCachedIndexes {
+		evict(order[0])
+	}
+	return idx, nil
+}
+
+// touch marks an archive as most recently used. Caller holds cacheMu.
+func touch(archivePath string) {
+	for i, p := range order {
+		if p == archivePath {
+			order = append(append(order[:i:i], order[i+1:]...), archivePath)
+			return
+		}
+	}
+}
+
+// evict drops an archive from the cache. Its resources are freed once no
+// reader uses them. Caller holds cacheMu.
+func evict(archivePath string) {
+	if idx, ok := cache[archivePath]; ok {
+		idx.evicted = true
+		if idx.refs == 0 {
+			idx.close()
+		}
+	}
+	delete(cache, archivePath)
+	for i, p := range order {
+		if p == archivePath {
+			order = append(order[:i], order[i+1:]...)
+			break
+		}
+	}
+}
+
+// close frees the open zip reader and the spooled tar of an index
+func (idx *index) close() {
+	if idx.zip != nil {
+		idx.zip.Close()
+	}
+	if idx.spooled {
+		os.Remove(idx.dataPath)
+	}
+}
+
+// releaser returns a reference taken by load when closed
+type releaser struct {
+	idx *index
+}
+
+func (r releaser) Close() error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	r.idx.refs--
+	if r.idx.refs == 0 && r.idx.evicted {
+		r.idx.close()
+	}
+	return nil
+}
+
+// build reads the entry table of an archive
+func build(archivePath string, info fs.FileInfo) (*index, error) {
+	idx := &index{
+		path:     archivePath,
+		kind:     kindOf(archivePath),
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		byName:   make(map[string]int),
+		dataPath: archivePath,
+	}
+
+	switch idx.kind {
+	case "zip":
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zip archive %s: %w", archivePath, err)
+		}
+		idx.zip = zr
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			idx.entries = append(idx.entries, Entry{
+				Name:    cleanName(f.Name),
+				Size:    int64(f.UncompressedSize64),
+				ModTime: f.Modified,
+				header:  f.FileInfo(),
+				zipFile: f,
+			})
+		}
+	case "tar", "tgz":
+		if err := idx.scanTar(); err != nil {
+			return nil, fmt.Errorf("failed to read tar archive %s: %w", archivePath, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported archive: %s", archivePath)
+	}
+
+	sort.Slice(idx.entries, func(i, j int) bool {
+		return idx.entries[i].Name < idx.entries[j].Name
+	})
+	for i, e := range idx.entries {
+		idx.byName[e.Name] = i
+	}
+	return idx, nil
+}
+
+// scanTar walks a tar file and records its entries. A compressed tar is
+// decompressed once into a temporary file while it is scanned, so entries
+// can be read at their offset instead of decompressing up to each of them.
+func (idx *index) scanTar() error {
+	f, err := os.Open(idx.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if idx.kind == "tgz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		spool, err := os.CreateTemp("", "look-alike-*.tar")
+		if err != nil {
+			return err
+		}
+		defer spool.Close()
+		idx.dataPath, idx.spooled = spool.Name(), true
+		r = io.TeeReader(gz, spool)
+	}
+
+	counter := &countingReader{r: r}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if idx.spooled {
+				os.Remove(idx.dataPath)
+			}
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		idx.entries = append(idx.entries, Entry{
+			Name:    cleanName(hdr.Name),
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			offset:  counter.n,
+			header:  hdr.FileInfo(),
+		})
+	}
+}
+
+// cleanName normalizes an entry name to a relative slash-separated path
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// countingReader counts bytes consumed from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readCloser pairs a reader with the closer of its backing resources
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// multiCloser closes several resources in order
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
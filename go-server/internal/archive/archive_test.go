@@ -0,0 +1,249 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeArchive creates an archive at archivePath, its kind taken from the
+// extension, holding files by name
+func writeArchive(t *testing.T, archivePath string, files map[string]string) {
+	t.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if kindOf(archivePath) == "zip" {
+		zw := zip.NewWriter(f)
+		for _, name := range names {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, files[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	var w io.Writer = f
+	if kindOf(archivePath) == "tgz" {
+		gz := gzip.NewWriter(f)
+		defer func() {
+			if err := gz.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		path        string
+		archivePath string
+		entry       string
+		ok          bool
+	}{
+		{path: "/d/bundle.zip!/dir/a.png", archivePath: "/d/bundle.zip", entry: "dir/a.png", ok: true},
+		{path: "/d/b.tar.gz!/a.png", archivePath: "/d/b.tar.gz", entry: "a.png", ok: true},
+		{path: "/d/b.TGZ!/a.png", archivePath: "/d/b.TGZ", entry: "a.png", ok: true},
+		{path: "/d/a.png", archivePath: "/d/a.png"},
+		{path: "/d/wow!/a.png", archivePath: "/d/wow!/a.png"},
+		{path: "/d/wow!/b.zip!/a.png", archivePath: "/d/wow!/b.zip", entry: "a.png", ok: true},
+		{path: "/d/b.zip!/inner.zip!/a.png", archivePath: "/d/b.zip", entry: "inner.zip!/a.png", ok: true},
+	}
+
+	for _, tt := range tests {
+		archivePath, entry, ok := Split(tt.path)
+		if archivePath != tt.archivePath || entry != tt.entry || ok != tt.ok {
+			t.Errorf("Split(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.path, archivePath, entry, ok, tt.archivePath, tt.entry, tt.ok)
+		}
+	}
+}
+
+func TestListAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"b.png": "second", "dir/a.png": "first entry", "./dir/c.png": "third"}
+	wantNames := []string{"b.png", "dir/a.png", "dir/c.png"}
+
+	for _, ext := range []string{".zip", ".tar", ".tar.gz"} {
+		archivePath := filepath.Join(dir, "bundle"+ext)
+		writeArchive(t, archivePath, files)
+
+		entries, err := List(archivePath)
+		if err != nil {
+			t.Fatalf("%s: List = %v", ext, err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("%s: List names = %v, want %v", ext, names, wantNames)
+		}
+
+		for name, content := range files {
+			p := Join(archivePath, cleanName(name))
+			data, err := ReadFile(p)
+			if err != nil || string(data) != content {
+				t.Errorf("%s: ReadFile(%q) = %q, %v, want %q", ext, p, data, err, content)
+			}
+			info, err := Stat(p)
+			if err != nil || info.Size() != int64(len(content)) {
+				t.Errorf("%s: Stat(%q) = %v, %v", ext, p, info, err)
+			}
+		}
+	}
+}
+
+func TestOpenAcrossEviction(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.png": "first entry", "dir/b.png": "second entry"}
+
+	tests := []struct {
+		name string
+		ext  string
+	}{
+		{name: "zip", ext: ".zip"},
+		{name: "tgz", ext: ".tar.gz"},
+	}
+
+	for _, tt := range tests {
+		archivePath := filepath.Join(dir, "open"+tt.ext)
+		writeArchive(t, archivePath, files)
+
+		reader, err := Open(Join(archivePath, "dir/b.png"))
+		if err != nil {
+			t.Fatalf("%s: Open = %v", tt.name, err)
+		}
+		cacheMu.Lock()
+		idx := cache[archivePath]
+		cacheMu.Unlock()
+
+		// Loading more archives than the cache holds evicts the open one
+		for i := 0; i < maxCachedIndexes; i++ {
+			other := filepath.Join(dir, fmt.Sprintf("%s-other-%d%s", tt.name, i, tt.ext))
+			writeArchive(t, other, files)
+			if _, err := List(other); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cacheMu.Lock()
+		_, cached := cache[archivePath]
+		cacheMu.Unlock()
+		if cached {
+			t.Fatalf("%s: archive was not evicted", tt.name)
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Errorf("%s: read after eviction = %v", tt.name, err)
+		} else if string(data) != files["dir/b.png"] {
+			t.Errorf("%s: read %q after eviction, want %q", tt.name, data, files["dir/b.png"])
+		}
+		if idx.spooled {
+			if _, err := os.Stat(idx.dataPath); err != nil {
+				t.Errorf("%s: spooled tar removed while a reader is open: %v", tt.name, err)
+			}
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("%s: Close = %v", tt.name, err)
+		}
+		if idx.spooled {
+			if _, err := os.Stat(idx.dataPath); !os.IsNotExist(err) {
+				t.Errorf("%s: spooled tar %s kept after the last reader closed", tt.name, idx.dataPath)
+			}
+		}
+
+		// The evicted archive is loaded again on the next open
+		data, err = ReadFile(Join(archivePath, "a.png"))
+		if err != nil || string(data) != files["a.png"] {
+			t.Errorf("%s: ReadFile after eviction = %q, %v", tt.name, data, err)
+		}
+	}
+}
+
+func TestConcurrentLoad(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "shared.tar.gz")
+	writeArchive(t, archivePath, map[string]string{"a.png": "a", "b.png": "b"})
+
+	// Loads racing for an uncached archive share one build
+	const loaders = 8
+	results := make(chan *index, loaders)
+	for i := 0; i < loaders; i++ {
+		go func() {
+			idx, err := load(archivePath, false)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- idx
+		}()
+	}
+	first := <-results
+	for i := 1; i < loaders; i++ {
+		if idx := <-results; idx != first {
+			t.Error("concurrent loads built separate indexes")
+		}
+	}
+
+	cacheMu.Lock()
+	pending := len(building)
+	cacheMu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d builds still registered", pending)
+	}
+}
+
+func TestOpenMissingEntry(t *testing.T) {
+	for _, ext := range []string{".zip", ".tar", ".tar.gz"} {
+		archivePath := filepath.Join(t.TempDir(), "missing"+ext)
+		writeArchive(t, archivePath, map[string]string{"a.png": "a"})
+
+		_, err := Open(Join(archivePath, "b.png"))
+		if err == nil || !strings.Contains(err.Error(), "entry not found") {
+			t.Errorf("%s: Open of a missing entry = %v", ext, err)
+		}
+		cacheMu.Lock()
+		refs := cache[archivePath].refs
+		cacheMu.Unlock()
+		if refs != 0 {
+			t.Errorf("%s: failed Open left %d references", ext, refs)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Formats an export can be written as
+const (
+	FormatZip   = "zip"
+	FormatTarGz = "tar.gz"
+)
+
+// ValidFormat reports whether format is an archive format, or empty for a
+// plain folder
+func ValidFormat(format string) bool {
+	return format == "" || format == FormatZip || format == FormatTarGz
+}
+
+// Ext returns the file extension of an archive format, e.g. ".zip"
+func Ext(format string) string {
+	if format == "" {
+		return ""
+	}
+	return "." + format
+}
+
+// Writer streams files into a ZIP or gzip-compressed tar archive. Entries
+// are written in the order they are added; nothing is kept in memory
+// except tar entries of unknown size.
+type Writer struct {
+	zip *zip.Writer
+	gz  *gzip.Writer
+	tar *tar.Writer
+}
+
+// NewWriter returns a writer producing an archive of the given format on w
+func NewWriter(w io.Writer, format string) (*Writer, error) {
+	switch format {
+	case FormatZip:
+		return &Writer{zip: zip.NewWriter(w)}, nil
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &Writer{gz: gz, tar: tar.NewWriter(gz)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format: %s", format)
+}
+
+// Add writes a file named name (slash-separated, relative) with the content
+// produced by write. size is the length of the content, or -1 if unknown;
+// tar needs the size before the content, so such entries are buffered.
+func (w *Writer) Add(name string, modTime time.Time, size int64, write func(io.Writer) error) error {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	if w.zip != nil {
+		header := &zip.FileHeader{Name: name, Modified: modTime, Method: zip.Deflate}
+		if compressed(name) {
+			header.Method = zip.Store
+		}
+		entry, err := w.zip.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		return write(entry)
+	}
+
+	var buffered *bytes.Buffer
+	if size < 0 {
+		buffered = &bytes.Buffer{}
+		if err := write(buffered); err != nil {
+			return err
+		}
+		size = int64(buffered.Len())
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	if buffered != nil {
+		_, err := w.tar.Write(buffered.Bytes())
+		return err
+	}
+
+	// A file that ends early is padded so the archive stays readable; the
+	// entry is reported as failed
+	counter := &countingWriter{w: w.tar}
+	err := write(counter)
+	if counter.n < size {
+		if _, padErr := io.CopyN(w.tar, zeroReader{}, size-counter.n); padErr != nil {
+			return padErr
+		}
+		if err == nil {
+			err = fmt.Errorf("%s is shorter than %d bytes", name, size)
+		}
+	}
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Close finishes the archive. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.zip != nil {
+		return w.zip.Close()
+	}
+	if err := w.tar.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// compressed reports whether a file is already compressed, so deflating it
+// again only costs time
+func compressed(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".zip", ".gz", ".tgz":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriterAdd(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	short := errors.New("source ended early")
+
+	tests := []struct {
+		name       string
+		size       int64 // -1 for unknown
+		content    string
+		writeErr   error
+		wantName   string
+		wantData   string // content read back, "" to skip the check
+		wantErr    bool
+		tarErrOnly bool // only tar knows the size before the content
+	}{
+		{name: "a.png", size: 5, content: "hello", wantName: "a.png", wantData: "hello"},
+		{name: "dir/b.txt", size: -1, content: "unknown size", wantName: "dir/b.txt", wantData: "unknown size"},
+		{name: "/abs/c.txt", size: 1, content: "c", wantName: "abs/c.txt", wantData: "c"},
+		{name: "x/../d.txt", size: 1, content: "d", wantName: "d.txt", wantData: "d"},
+		{name: "empty.txt", size: 0, content: "", wantName: "empty.txt"},
+		{name: "short.txt", size: 10, content: "abc", wantName: "short.txt", wantErr: true, tarErrOnly: true},
+		{name: "failed.txt", size: 3, content: "abc", writeErr: short, wantName: "failed.txt", wantErr: true},
+	}
+
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		archivePath := filepath.Join(t.TempDir(), "out"+Ext(format))
+		f, err := os.Create(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewWriter(f, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			err := w.Add(tt.name, modTime, tt.size, func(output io.Writer) error {
+				if _, err := io.WriteString(output, tt.content); err != nil {
+					return err
+				}
+				return tt.writeErr
+			})
+			wantErr := tt.wantErr && (format == FormatTarGz || !tt.tarErrOnly)
+			if (err != nil) != wantErr {
+				t.Errorf("%s: Add(%q) error = %v, wantErr %v", format, tt.name, err, wantErr)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// The archive stays readable after failed entries
+		entries, err := List(archivePath)
+		if err != nil {
+			t.Fatalf("%s: List = %v", format, err)
+		}
+		if len(entries) != len(tests) {
+			t.Errorf("%s: %d entries, want %d", format, len(entries), len(tests))
+		}
+		for _, tt := range tests {
+			if tt.wantData == "" {
+				continue
+			}
+			data, err := ReadFile(Join(archivePath, tt.wantName))
+			if err != nil {
+				t.Errorf("%s: ReadFile(%q) = %v", format, tt.wantName, err)
+				continue
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("%s: %q = %q, want %q", format, tt.wantName, data, tt.wantData)
+			}
+			info, err := Stat(Join(archivePath, tt.wantName))
+			if err != nil {
+				t.Errorf("%s: Stat(%q) = %v", format, tt.wantName, err)
+			} else if !info.ModTime().Equal(modTime) {
+				t.Errorf("%s: %q modified %v, want %v", format, tt.wantName, info.ModTime(), modTime)
+			}
+		}
+	}
+}
+
+func TestWriterUnknownFormat(t *testing.T) {
+	if _, err := NewWriter(io.Discard, "rar"); err == nil {
+		t.Error("NewWriter accepted an unknown format")
+	}
+}
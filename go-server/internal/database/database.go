@@ -3,6 +3,10 @@ package database
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/bilibili/look-alike/internal/models"
 	"gorm.io/driver/sqlite"
@@ -12,10 +16,30 @@ import (
 
 var DB *gorm.DB
 
+// DefaultPath returns the database location shared by the server and the
+// command line tool: db/look_alike.sqlite3 next to the executable if it
+// exists there, otherwise relative to the working directory
+func DefaultPath() string {
+	if exePath, err := os.Executable(); err == nil {
+		dbPath := filepath.Join(filepath.Dir(exePath), "db/look_alike.sqlite3")
+		if _, err := os.Stat(dbPath); err == nil {
+			return dbPath
+		}
+	}
+	return "db/look_alike.sqlite3"
+}
+
 // Initialize initializes the database connection
 func Initialize(dbPath string) error {
+	// Writers of concurrent jobs wait for each other instead of failing
+	// with "database is locked". The timeout is set per connection.
+	dsn := dbPath
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=10000"
+	}
+
 	var err error
-	DB, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{
+	DB, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent), // Can be changed to logger.Info for debugging
 	})
 	if err != nil {
@@ -44,6 +68,9 @@ func Initialize(dbPath string) error {
 	if err := autoMigrate(); err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
+	if err := migrateRelativePaths(dbPath); err != nil {
+		return fmt.Errorf("failed to migrate file paths: %w", err)
+	}
 
 	log.Println("SQLite database initialized with WAL mode")
 	return nil
@@ -59,9 +86,115 @@ func autoMigrate() error {
 		&models.ComparisonCandidate{},
 		&models.TargetSelection{},
 		&models.SourceConfirmation{},
+		&models.FeatureCache{},
+		&models.DuplicateCluster{},
+		&models.DuplicateMember{},
+		&models.Job{},
+		&models.ExportRun{},
+		&models.ExportJournalEntry{},
+		&models.ExportOutcome{},
 	)
 }
 
+// migrateRelativePaths upgrades databases that stored absolute file paths.
+// Candidates are linked to their TargetFile before the path columns are
+// dropped; paths are resolved from the project roots from now on. The
+// database is copied first, the dropped paths stay in the backup.
+func migrateRelativePaths(dbPath string) error {
+	migrator := DB.Migrator()
+
+	pending := migrator.HasColumn("comparison_candidates", "file_path")
+	for _, table := range []string{"source_files", "target_files"} {
+		pending = pending || migrator.HasColumn(table, "full_path")
+	}
+	if !pending {
+		return nil
+	}
+	if err := backupDatabase(dbPath); err != nil {
+		return err
+	}
+
+	if migrator.HasColumn("comparison_candidates", "file_path") {
+		log.Println("Migrating comparison candidates to target file references...")
+		if migrator.HasColumn("target_files", "full_path") {
+			err := DB.Exec(`UPDATE comparison_candidates SET target_file_id = (
+				SELECT target_files.id FROM target_files
+				WHERE target_files.project_target_id = comparison_candidates.project_target_id
+				AND target_files.full_path = comparison_candidates.file_path
+			) WHERE target_file_id IS NULL OR target_file_id = 0`).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := logUnmatchedCandidates(); err != nil {
+			return err
+		}
+		if err := dropColumn("comparison_candidates", "file_path"); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"source_files", "target_files"} {
+		if migrator.HasColumn(table, "full_path") {
+			log.Printf("Dropping absolute paths from %s...", table)
+			if err := dropColumn(table, "full_path"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// backupDatabase copies the database next to itself before a migration
+// that drops data
+func backupDatabase(dbPath string) error {
+	dbPath, _, _ = strings.Cut(dbPath, "?")
+	if dbPath == "" || dbPath == ":memory:" || strings.HasPrefix(dbPath, "file:") {
+		return nil
+	}
+
+	backupPath := fmt.Sprintf("%s.%s.bak", dbPath, time.Now().Format("20060102-150405"))
+	if err := DB.Exec("VACUUM INTO ?", backupPath).Error; err != nil {
+		return fmt.Errorf("failed to back up database to %s: %w", backupPath, err)
+	}
+	log.Printf("Database backed up to %s before migration", backupPath)
+	return nil
+}
+
+// logUnmatchedCandidates reports candidates whose path matches no indexed
+// target file. They lose their image and can be restored from the backup.
+func logUnmatchedCandidates() error {
+	var unmatched []struct {
+		ID       uint
+		FilePath string
+	}
+	err := DB.Raw(`SELECT id, file_path FROM comparison_candidates
+		WHERE target_file_id IS NULL OR target_file_id = 0`).Scan(&unmatched).Error
+	if err != nil {
+		return err
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+
+	log.Printf("[WARN] %d comparison candidates match no target file and lose their image", len(unmatched))
+	for i, c := range unmatched {
+		if i == 20 {
+			log.Printf("[WARN]   ... and %d more", len(unmatched)-i)
+			break
+		}
+		log.Printf("[WARN]   candidate %d: %s", c.ID, c.FilePath)
+	}
+	return nil
+}
+
+// dropColumn drops an unindexed column in place. Unlike Migrator.DropColumn,
+// which recreates the table on SQLite, this keeps the table's indexes.
+func dropColumn(table, column string) error {
+	return DB.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `%s`", table, column)).Error
+}
+
 // Close closes the database connection
 func Close() error {
 	sqlDB, err := DB.DB()
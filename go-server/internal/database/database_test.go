@@ -0,0 +1,79 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrateRelativePaths(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.sqlite3")
+	if err := Initialize(dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recreate the absolute path columns of the old schema
+	for _, stmt := range []string{
+		"ALTER TABLE comparison_candidates ADD COLUMN file_path TEXT",
+		"ALTER TABLE target_files ADD COLUMN full_path TEXT",
+		"ALTER TABLE source_files ADD COLUMN full_path TEXT",
+		"INSERT INTO target_files (id, project_target_id, relative_path, full_path) VALUES (1, 1, 'a.png', '/t/a.png'), (2, 1, 'b.png', '/t/b.png')",
+		"INSERT INTO comparison_candidates (id, source_file_id, project_target_id, file_path) VALUES (1, 1, 1, '/t/b.png'), (2, 1, 1, '/t/gone.png')",
+	} {
+		if err := DB.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	Close()
+
+	if err := Initialize(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	migrator := DB.Migrator()
+	for table, column := range map[string]string{
+		"comparison_candidates": "file_path",
+		"target_files":          "full_path",
+		"source_files":          "full_path",
+	} {
+		if migrator.HasColumn(table, column) {
+			t.Errorf("%s.%s was not dropped", table, column)
+		}
+	}
+
+	var candidates []models.ComparisonCandidate
+	DB.Order("id").Find(&candidates)
+	if len(candidates) != 2 || candidates[0].TargetFileID != 2 || candidates[1].TargetFileID != 0 {
+		t.Errorf("candidates after migration = %+v", candidates)
+	}
+
+	// The dropped paths are kept in a backup, taken once
+	backups, err := filepath.Glob(dbPath + ".*.bak")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("backups = %v, %v, want one", backups, err)
+	}
+	backup, err := gorm.Open(sqlite.Open(backups[0]), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.Migrator().HasColumn("comparison_candidates", "file_path") {
+		t.Error("backup has no file_path column")
+	}
+	if sqlDB, err := backup.DB(); err == nil {
+		sqlDB.Close()
+	}
+	os.Remove(backups[0])
+
+	Close()
+	if err := Initialize(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := filepath.Glob(dbPath + ".*.bak"); len(backups) != 0 {
+		t.Errorf("migrated database backed up again: %v", backups)
+	}
+}
@@ -0,0 +1,90 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	TypeStatus    = "status"     // status or phase of the project changed
+	TypeIndexing  = "indexing"   // indexing counters of the project
+	TypeProgress  = "progress"   // progress of a running job
+	TypeFileError = "file_error" // a file could not be read, decoded or exported
+	TypeJob       = "job"        // a job started, was paused or finished
+)
+
+// Event is a change of a project published by indexing, comparison, export
+// and the job queue
+type Event struct {
+	Type       string      `json:"type"`
+	ProjectID  uint        `json:"project_id"`
+	JobID      uint        `json:"job_id,omitempty"`
+	JobType    string      `json:"job_type,omitempty"`
+	State      string      `json:"state,omitempty"` // job state
+	Status     string      `json:"status,omitempty"`
+	Phase      string      `json:"phase,omitempty"`
+	Done       int64       `json:"done,omitempty"`
+	Total      int64       `json:"total,omitempty"`
+	ETASeconds *float64    `json:"eta_seconds,omitempty"`
+	File       string      `json:"file,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	Time       time.Time   `json:"time"`
+}
+
+// subscriberBuffer is how many events a subscriber may lag behind before
+// further events are dropped for it
+const subscriberBuffer = 256
+
+// bus fans events out to the subscribers of each project
+type bus struct {
+	mu          sync.RWMutex
+	subscribers map[uint]map[chan Event]struct{} // key: project ID
+}
+
+var global = &bus{subscribers: make(map[uint]map[chan Event]struct{})}
+
+// Publish sends an event to every subscriber of its project. It never
+// blocks: a subscriber that does not keep up misses events.
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	global.mu.RLock()
+	defer global.mu.RUnlock()
+
+	for ch := range global.subscribers[event.ProjectID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events of a project and a
+// function that ends the subscription
+func Subscribe(projectID uint) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	global.mu.Lock()
+	if global.subscribers[projectID] == nil {
+		global.subscribers[projectID] = make(map[chan Event]struct{})
+	}
+	global.subscribers[projectID][ch] = struct{}{}
+	global.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			global.mu.Lock()
+			delete(global.subscribers[projectID], ch)
+			if len(global.subscribers[projectID]) == 0 {
+				delete(global.subscribers, projectID)
+			}
+			global.mu.Unlock()
+		})
+	}
+	return ch, unsubscribe
+}
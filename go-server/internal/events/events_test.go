@@ -0,0 +1,109 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// receive returns the next event of a subscription, failing after a second
+func receive(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+func TestPublishToSubscribers(t *testing.T) {
+	first, unsubscribeFirst := Subscribe(1)
+	defer unsubscribeFirst()
+	second, unsubscribeSecond := Subscribe(1)
+	defer unsubscribeSecond()
+	other, unsubscribeOther := Subscribe(2)
+	defer unsubscribeOther()
+
+	Publish(Event{Type: TypeStatus, ProjectID: 1, Status: "comparing"})
+
+	for _, ch := range []<-chan Event{first, second} {
+		event := receive(t, ch)
+		if event.Type != TypeStatus || event.Status != "comparing" || event.Time.IsZero() {
+			t.Errorf("received %+v", event)
+		}
+	}
+	select {
+	case event := <-other:
+		t.Errorf("subscriber of project 2 received %+v", event)
+	default:
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	ch, unsubscribe := Subscribe(3)
+	unsubscribe()
+	unsubscribe() // a second call is harmless
+
+	Publish(Event{Type: TypeStatus, ProjectID: 3})
+	select {
+	case event := <-ch:
+		t.Errorf("received %+v after unsubscribing", event)
+	default:
+	}
+
+	global.mu.RLock()
+	_, ok := global.subscribers[3]
+	global.mu.RUnlock()
+	if ok {
+		t.Error("project without subscribers is still registered")
+	}
+}
+
+func TestSlowSubscriberMissesEvents(t *testing.T) {
+	slow, unsubscribeSlow := Subscribe(4)
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := Subscribe(4)
+	defer unsubscribeFast()
+
+	// Publish never blocks, the slow subscriber keeps the first
+	// subscriberBuffer events and misses the rest
+	published := subscriberBuffer + 10
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range fast {
+			n++
+			if n == published {
+				break
+			}
+		}
+		received <- n
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= published; i++ {
+			Publish(Event{Type: TypeProgress, ProjectID: 4, Done: int64(i)})
+			if i%(subscriberBuffer/4) == 0 {
+				time.Sleep(10 * time.Millisecond) // let the fast subscriber catch up
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	if n := <-received; n != published {
+		t.Errorf("fast subscriber received %d events, want %d", n, published)
+	}
+	if len(slow) != subscriberBuffer {
+		t.Errorf("slow subscriber holds %d events, want %d", len(slow), subscriberBuffer)
+	}
+	if first := receive(t, slow); first.Done != 1 {
+		t.Errorf("slow subscriber's first event is %d, want 1", first.Done)
+	}
+}
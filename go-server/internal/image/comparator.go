@@ -7,8 +7,8 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"math"
-	"os"
 
+	"github.com/bilibili/look-alike/internal/storage"
 	_ "github.com/chai2010/webp"
 	"github.com/corona10/goimagehash"
 	_ "golang.org/x/image/bmp"
@@ -38,58 +38,42 @@ type ImageComparator struct {
 	Height         int
 }
 
-// NewImageComparator creates a new ImageComparator for the given image path
+// NewImageComparator creates a new ImageComparator for the given image path.
+// The path may point inside an archive or to remote storage (see storage.For).
 func NewImageComparator(imagePath string) (*ImageComparator, error) {
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+	if _, err := storage.Stat(imagePath); err != nil {
 		return nil, fmt.Errorf("file does not exist: %s", imagePath)
 	}
 
-	// Get image dimensions
-	width, height, err := getImageDimensions(imagePath)
+	img, err := LoadImage(imagePath)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewImageComparatorFromImage(imagePath, img)
+}
+
+// NewImageComparatorFromImage creates an ImageComparator for an already
+// decoded image, so callers can split decoding from feature computation
+func NewImageComparatorFromImage(imagePath string, img image.Image) (*ImageComparator, error) {
+	bounds := img.Bounds()
 	ic := &ImageComparator{
 		ImagePath: imagePath,
-		Width:     width,
-		Height:    height,
+		Width:     bounds.Dx(),
+		Height:    bounds.Dy(),
 	}
 
 	// Calculate phash and color histogram
-	if err := ic.calculatePhash(); err != nil {
-		return nil, err
-	}
-	if err := ic.calculateColorHistogram(); err != nil {
+	if err := ic.calculatePhash(img); err != nil {
 		return nil, err
 	}
+	ic.calculateColorHistogram(img)
 
 	return ic, nil
 }
 
-// getImageDimensions returns the width and height of an image
-func getImageDimensions(imagePath string) (int, int, error) {
-	file, err := os.Open(imagePath)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer file.Close()
-
-	img, _, err := image.DecodeConfig(file)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	return img.Width, img.Height, nil
-}
-
 // calculatePhash calculates the perceptual hash using goimagehash library
-func (ic *ImageComparator) calculatePhash() error {
-	img, err := loadImage(ic.ImagePath)
-	if err != nil {
-		return err
-	}
-
+func (ic *ImageComparator) calculatePhash(img image.Image) error {
 	hash, err := goimagehash.PerceptionHash(img)
 	if err != nil {
 		return err
@@ -100,12 +84,7 @@ func (ic *ImageComparator) calculatePhash() error {
 }
 
 // calculateColorHistogram calculates RGB color histogram
-func (ic *ImageComparator) calculateColorHistogram() error {
-	img, err := loadImage(ic.ImagePath)
-	if err != nil {
-		return err
-	}
-
+func (ic *ImageComparator) calculateColorHistogram(img image.Image) {
 	bounds := img.Bounds()
 	histogram := make([]int, 48) // R(16) + G(16) + B(16)
 	totalPixels := 0
@@ -118,9 +97,9 @@ func (ic *ImageComparator) calculateColorHistogram() error {
 			gBin := int(g>>8) / 16 // 0-15
 			bBin := int(b>>8) / 16 // 0-15
 
-			histogram[rBin]++      // R: 0-15
-			histogram[16+gBin]++   // G: 16-31
-			histogram[32+bBin]++   // B: 32-47
+			histogram[rBin]++    // R: 0-15
+			histogram[16+gBin]++ // G: 16-31
+			histogram[32+bBin]++ // B: 32-47
 			totalPixels++
 		}
 	}
@@ -129,13 +108,11 @@ func (ic *ImageComparator) calculateColorHistogram() error {
 	for i := 0; i < 48; i++ {
 		ic.ColorHistogram[i] = float64(histogram[i]) / float64(totalPixels)
 	}
-
-	return nil
 }
 
-// loadImage loads an image from file
-func loadImage(imagePath string) (image.Image, error) {
-	file, err := os.Open(imagePath)
+// LoadImage loads and decodes an image from any storage backend
+func LoadImage(imagePath string) (image.Image, error) {
+	file, err := storage.Open(imagePath)
 	if err != nil {
 		return nil, err
 	}
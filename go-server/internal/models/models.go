@@ -9,13 +9,21 @@ type Project struct {
 	ID           uint       `gorm:"primarykey" json:"id"`
 	Name         string     `gorm:"not null" json:"name"`
 	SourcePath   string     `gorm:"not null" json:"source_path"`
-	Status       string     `gorm:"default:pending" json:"status"` // pending, processing, indexed, comparing, completed, error
+	Status       string     `gorm:"default:pending" json:"status"` // pending, processing, indexed, comparing, completed, error, interrupted
+	Phase        string     `json:"phase"`                         // indexing_source, indexing_targets, comparing, auto_selecting, clustering; empty when idle
+	Type         string     `gorm:"default:compare" json:"type"`   // compare (sources against targets), dedupe (duplicates within the targets)
 	ErrorMessage *string    `json:"error_message,omitempty"`
 	StartedAt    *time.Time `json:"started_at,omitempty"`
 	EndedAt      *time.Time `json:"ended_at,omitempty"`
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
 
+	// Minimum similarity (%) for two images to share a duplicate cluster
+	DedupeThreshold float64 `gorm:"default:90" json:"dedupe_threshold"`
+
+	// Traversal policy of the source root, reused on every re-index
+	SourceScan ScanOptions `gorm:"embedded;embeddedPrefix:source_scan_" json:"source_scan"`
+
 	// Associations
 	ProjectTargets []ProjectTarget `gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE" json:"targets,omitempty"`
 	SourceFiles    []SourceFile    `gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE" json:"source_files,omitempty"`
@@ -26,12 +34,20 @@ func (Project) TableName() string {
 	return "projects"
 }
 
+// ScanOptions controls how a root directory is traversed while indexing
+type ScanOptions struct {
+	FollowSymlinks bool `gorm:"default:false" json:"follow_symlinks"` // descend into symlinked directories (loops are detected)
+	SkipHidden     bool `gorm:"default:false" json:"skip_hidden"`     // ignore dotfiles and dot-directories
+	OneFilesystem  bool `gorm:"default:false" json:"one_filesystem"`  // do not cross mount points
+}
+
 // ProjectTarget represents a target directory for comparison
 type ProjectTarget struct {
-	ID        uint   `gorm:"primarykey" json:"id"`
-	ProjectID uint   `gorm:"not null;index" json:"project_id"`
-	Name      string `json:"name"`
-	Path      string `json:"path"`
+	ID        uint        `gorm:"primarykey" json:"id"`
+	ProjectID uint        `gorm:"not null;index" json:"project_id"`
+	Name      string      `json:"name"`
+	Path      string      `json:"path"`
+	Scan      ScanOptions `gorm:"embedded;embeddedPrefix:scan_" json:"scan"`
 
 	// Associations
 	Project              *Project              `gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE" json:"-"`
@@ -50,7 +66,7 @@ type SourceFile struct {
 	ID           uint      `gorm:"primarykey" json:"id"`
 	ProjectID    uint      `gorm:"not null;index:idx_project_relative,priority:1;index" json:"project_id"`
 	RelativePath string    `gorm:"index:idx_project_relative,priority:2" json:"relative_path"`
-	FullPath     string    `json:"full_path"`
+	FullPath     string    `gorm:"-" json:"full_path,omitempty"` // resolved from Project.SourcePath at read time
 	Width        int       `json:"width"`
 	Height       int       `json:"height"`
 	SizeBytes    int64     `json:"size_bytes"`
@@ -84,7 +100,7 @@ func (SourceFile) TableName() string {
 type TargetFile struct {
 	ID              uint      `gorm:"primarykey" json:"id"`
 	ProjectTargetID uint      `gorm:"not null;index:idx_target_relative,priority:1;index" json:"project_target_id"`
-	FullPath        string    `gorm:"not null" json:"full_path"`
+	FullPath        string    `gorm:"-" json:"full_path,omitempty"` // resolved from ProjectTarget.Path at read time
 	RelativePath    string    `gorm:"not null;index:idx_target_relative,priority:2" json:"relative_path"`
 	Width           int       `json:"width"`
 	Height          int       `json:"height"`
@@ -112,7 +128,8 @@ type ComparisonCandidate struct {
 	ID              uint    `gorm:"primarykey" json:"id"`
 	SourceFileID    uint    `gorm:"not null;index" json:"source_file_id"`
 	ProjectTargetID uint    `gorm:"not null;index" json:"project_target_id"`
-	FilePath        string  `json:"file_path"`
+	TargetFileID    uint    `gorm:"index" json:"target_file_id"`
+	FilePath        string  `gorm:"-" json:"file_path,omitempty"` // resolved from TargetFile at read time
 	SimilarityScore float64 `json:"similarity_score"`
 	Rank            int     `json:"rank"`
 	Width           int     `json:"width"`
@@ -121,6 +138,7 @@ type ComparisonCandidate struct {
 	// Associations
 	SourceFile      *SourceFile      `gorm:"foreignKey:SourceFileID;constraint:OnDelete:CASCADE" json:"-"`
 	ProjectTarget   *ProjectTarget   `gorm:"foreignKey:ProjectTargetID;constraint:OnDelete:CASCADE" json:"-"`
+	TargetFile      *TargetFile      `gorm:"foreignKey:TargetFileID" json:"-"`
 	TargetSelection *TargetSelection `gorm:"foreignKey:SelectedCandidateID" json:"-"`
 }
 
@@ -167,3 +185,184 @@ type SourceConfirmation struct {
 func (SourceConfirmation) TableName() string {
 	return "source_confirmations"
 }
+
+// FeatureCache stores computed image features shared by all projects.
+// Entries are found by FileKey (path + size + mtime) without reading the
+// file, or by Checksum (SHA-256 of the content) when the file moved.
+type FeatureCache struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	FileKey    string    `gorm:"not null;uniqueIndex" json:"file_key"`
+	Checksum   string    `gorm:"index" json:"checksum"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Phash      string    `gorm:"type:text" json:"phash"`
+	Histogram  string    `gorm:"type:text" json:"histogram"` // JSON array
+	HitCount   int64     `gorm:"default:0" json:"hit_count"`
+	LastUsedAt time.Time `gorm:"index" json:"last_used_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for FeatureCache
+func (FeatureCache) TableName() string {
+	return "feature_cache"
+}
+
+// DuplicateCluster groups near-duplicate images found by a dedupe project
+type DuplicateCluster struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	ProjectID uint      `gorm:"not null;index" json:"project_id"`
+	KeeperID  *uint     `json:"keeper_id,omitempty"` // DuplicateMember left in place when the rest is exported or quarantined
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Associations
+	Project *Project          `gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE" json:"-"`
+	Members []DuplicateMember `gorm:"foreignKey:ClusterID;constraint:OnDelete:CASCADE" json:"members,omitempty"`
+}
+
+// TableName specifies the table name for DuplicateCluster
+func (DuplicateCluster) TableName() string {
+	return "duplicate_clusters"
+}
+
+// DuplicateMember is one image of a duplicate cluster
+type DuplicateMember struct {
+	ID           uint   `gorm:"primarykey" json:"id"`
+	ClusterID    uint   `gorm:"not null;index" json:"cluster_id"`
+	TargetFileID uint   `gorm:"not null;index" json:"target_file_id"`
+	Status       string `gorm:"default:pending" json:"status"` // pending, exported, quarantined
+	OutputPath   string `json:"output_path,omitempty"`         // where the file was exported or moved to
+
+	// Where a quarantined file was, kept because its target file is deleted
+	TargetID     uint   `json:"target_id,omitempty"`
+	RelativePath string `json:"relative_path,omitempty"`
+	OriginalPath string `json:"original_path,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Associations
+	TargetFile *TargetFile `gorm:"foreignKey:TargetFileID" json:"-"`
+}
+
+// TableName specifies the table name for DuplicateMember
+func (DuplicateMember) TableName() string {
+	return "duplicate_members"
+}
+
+// ExportOptions are the parameters of an export run
+type ExportOptions struct {
+	UsePlaceholder bool   `json:"use_placeholder"` // write a placeholder where a source has no match
+	OnlyConfirmed  bool   `json:"only_confirmed"`  // export confirmed source files only
+	OutputPath     string `json:"output_path"`
+	Manifest       string `json:"manifest"`    // csv, json or both; empty writes no manifest
+	Layout         string `json:"layout"`      // output path template, e.g. "{target}/{rel_dir}/{stem}.{ext}"
+	Mode           string `json:"mode"`        // copy, hardlink, symlink, reflink or move; empty copies
+	Archive        string `json:"archive"`     // zip or tar.gz to write an archive file instead of a folder
+	OnConflict     string `json:"on_conflict"` // overwrite (default), skip, rename or fail when an output file exists
+	Format         string `json:"format"`      // jpg, png, webp, gif, bmp or tiff; empty keeps the layout's extension
+	Quality        int    `json:"quality"`     // JPEG/WebP quality 1-100, 0 for the default
+	Background     string `json:"background"`  // color transparent areas are flattened onto, e.g. "#ffffff"
+	Resize         string `json:"resize"`      // source (fit within), stretch, fill or pad to size exported images after their source file
+	Filter         string `json:"filter"`      // resampling filter: lanczos (default), catmullrom, linear, box or nearest
+	MaxWidth       int    `json:"max_width"`   // scale down to fit, 0 for no limit
+	MaxHeight      int    `json:"max_height"`
+
+	// No-match placeholders, written when UsePlaceholder is set
+	PlaceholderLayout  bool   `json:"placeholder_layout"`  // write placeholders where a match would go, in the same format
+	PlaceholderColor   string `json:"placeholder_color"`   // fill color, default #808080
+	PlaceholderPattern string `json:"placeholder_pattern"` // solid (default) or checkerboard
+	PlaceholderText    bool   `json:"placeholder_text"`    // draw the source path and target name onto the placeholder
+	PlaceholderImage   string `json:"placeholder_image"`   // image file used instead of a generated placeholder
+}
+
+// ExportRun is one export of a project. Its state is the state of its job;
+// the run keeps the parameters and the counters of the export.
+type ExportRun struct {
+	ID        uint          `gorm:"primarykey" json:"id"`
+	ProjectID uint          `gorm:"not null;index" json:"project_id"`
+	JobID     uint          `gorm:"index" json:"job_id"`
+	Options   ExportOptions `gorm:"embedded" json:"options"`
+	Total     int64         `json:"total"`               // source files to export
+	Processed int64         `json:"processed"`           // source files handled so far, including failed ones
+	Failed    int64         `json:"failed"`              // source files that could not be exported completely
+	Current   string        `json:"current"`             // relative path of the last source file handled
+	UndoneAt  *time.Time    `json:"undone_at,omitempty"` // when the files moved by a move-mode export were restored
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+
+	// Associations
+	Job *Job `gorm:"foreignKey:JobID" json:"-"`
+}
+
+// TableName specifies the table name for ExportRun
+func (ExportRun) TableName() string {
+	return "export_runs"
+}
+
+// ExportJournalEntry is a file moved by a move-mode export. The entry is
+// written before the file is moved and updated afterwards, so undoing the
+// export can restore every file even after a crash.
+type ExportJournalEntry struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	ExportRunID uint      `gorm:"not null;index" json:"export_run_id"`
+	FromPath    string    `gorm:"not null" json:"from_path"`                   // where the target file was
+	ToPath      string    `gorm:"not null" json:"to_path"`                     // where the export moved it
+	State       string    `gorm:"not null;default:pending;index" json:"state"` // pending, moved, failed, restored
+	Error       *string   `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for ExportJournalEntry
+func (ExportJournalEntry) TableName() string {
+	return "export_journal"
+}
+
+// ExportOutcome is what an export run did for one selection of a source
+// file. Outcomes are stored with the checkpoint, so a resumed export can
+// list the files written before it was paused in its manifest.
+type ExportOutcome struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	ExportRunID  uint      `gorm:"not null;uniqueIndex:idx_export_outcome,priority:1" json:"export_run_id"`
+	SourceFileID uint      `gorm:"not null;uniqueIndex:idx_export_outcome,priority:2" json:"source_file_id"`
+	TargetName   string    `gorm:"not null;uniqueIndex:idx_export_outcome,priority:3" json:"target_name"`
+	OutputPath   string    `json:"output_path"`
+	Method       string    `json:"method"`
+	Adjustment   string    `json:"adjustment"`
+	Status       string    `gorm:"not null" json:"status"` // as in the manifest
+	Error        string    `json:"error"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for ExportOutcome
+func (ExportOutcome) TableName() string {
+	return "export_outcomes"
+}
+
+// Job is a unit of background work. Jobs are stored so that queued work
+// survives a restart and past runs stay visible.
+type Job struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	Type          string     `gorm:"not null;index" json:"type"` // comparison, add_target, resume, restart, export, resolve_duplicates
+	ProjectID     uint       `gorm:"not null;index" json:"project_id"`
+	State         string     `gorm:"not null;default:queued;index" json:"state"` // queued, running, paused, completed, failed, cancelled
+	Priority      int        `gorm:"default:0" json:"priority"`                  // higher runs first
+	Payload       string     `gorm:"type:text" json:"payload,omitempty"`         // JSON arguments of the job type
+	Checkpoint    string     `gorm:"type:text" json:"checkpoint,omitempty"`      // where a paused or interrupted job continues
+	ProgressDone  int64      `json:"progress_done"`
+	ProgressTotal int64      `json:"progress_total"`
+	Error         *string    `json:"error,omitempty"`
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// TableName specifies the table name for Job
+func (Job) TableName() string {
+	return "jobs"
+}
@@ -0,0 +1,69 @@
+package services
+
+import "github.com/bilibili/look-alike/internal/image"
+
+// bkTree indexes 64-bit perceptual hashes by Hamming distance, so the
+// hashes within a radius can be found without comparing against all of them
+type bkTree struct {
+	root *bkNode
+}
+
+// bkNode holds the items sharing one hash; children are keyed by their
+// distance to it
+type bkNode struct {
+	hash     uint64
+	items    []int
+	children map[int]*bkNode
+}
+
+// add inserts item under hash
+func (t *bkTree) add(hash uint64, item int) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, items: []int{item}}
+		return
+	}
+
+	node := t.root
+	for {
+		distance := image.HammingDistance(hash, node.hash)
+		if distance == 0 {
+			node.items = append(node.items, item)
+			return
+		}
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[distance] = &bkNode{hash: hash, items: []int{item}}
+			return
+		}
+		node = child
+	}
+}
+
+// search calls fn for every item whose hash is at most radius away
+func (t *bkTree) search(hash uint64, radius int, fn func(item int)) {
+	if t.root == nil {
+		return
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		distance := image.HammingDistance(hash, node.hash)
+		if distance <= radius {
+			for _, item := range node.items {
+				fn(item)
+			}
+		}
+		// Triangle inequality: only children in this band can match
+		for d, child := range node.children {
+			if d >= distance-radius && d <= distance+radius {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/image"
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+func TestBKTreeSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var hashes []uint64
+	for i := 0; i < 500; i++ {
+		hash := rng.Uint64()
+		if i%5 == 0 && i > 0 {
+			// Near and exact duplicates of an earlier hash
+			hash = hashes[rng.Intn(i)] ^ (1 << uint(rng.Intn(64)))
+			if i%10 == 0 {
+				hash = hashes[i-1]
+			}
+		}
+		hashes = append(hashes, hash)
+	}
+
+	var tree bkTree
+	for i, hash := range hashes {
+		tree.add(hash, i)
+	}
+
+	tests := []struct {
+		query  uint64
+		radius int
+	}{
+		{query: hashes[0], radius: 0},
+		{query: hashes[10], radius: 0},
+		{query: hashes[10], radius: 1},
+		{query: hashes[42], radius: 8},
+		{query: hashes[99], radius: 24},
+		{query: rng.Uint64(), radius: 20},
+		{query: rng.Uint64(), radius: 64},
+	}
+
+	for _, tt := range tests {
+		var got []int
+		tree.search(tt.query, tt.radius, func(item int) {
+			got = append(got, item)
+		})
+		sort.Ints(got)
+
+		var want []int
+		for i, hash := range hashes {
+			if image.HammingDistance(tt.query, hash) <= tt.radius {
+				want = append(want, i)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("search(%016x, %d) = %v, want %v", tt.query, tt.radius, got, want)
+		}
+	}
+}
+
+func TestBKTreeEmpty(t *testing.T) {
+	var tree bkTree
+	tree.search(0, 64, func(item int) {
+		t.Errorf("empty tree returned item %d", item)
+	})
+}
+
+func TestMaxPhashDistance(t *testing.T) {
+	// Best possible score of two images whose phashes are distance apart
+	bestScore := func(distance int, maxColor float64) float64 {
+		return image.HashSimilarity(0, 1<<uint(distance)-1, 64)*image.Weights["phash"] +
+			maxColor*image.Weights["color"]
+	}
+
+	tests := []struct {
+		threshold float64
+		maxColor  float64
+		want      int
+	}{
+		{threshold: 0, maxColor: maxColorSimilarity, want: 64},
+		{threshold: 50, maxColor: maxColorSimilarity, want: 64},
+		{threshold: 90, maxColor: maxColorSimilarity, want: 64},
+		{threshold: 95, maxColor: maxColorSimilarity, want: 59},
+		{threshold: 99, maxColor: maxColorSimilarity, want: 55},
+		{threshold: 100, maxColor: maxColorSimilarity, want: 54},
+		{threshold: 200, maxColor: maxColorSimilarity, want: 0},
+		{threshold: 50, maxColor: 100, want: 45},
+		{threshold: 90, maxColor: 200, want: 36},
+		{threshold: 90, maxColor: 100, want: 9},
+		{threshold: 90, maxColor: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		got := maxPhashDistance(tt.threshold, tt.maxColor)
+		if got != tt.want {
+			t.Errorf("maxPhashDistance(%v, %v) = %d, want %d", tt.threshold, tt.maxColor, got, tt.want)
+		}
+		// No pair beyond the distance can reach the threshold, and a pair
+		// at the distance can
+		if got < 64 && bestScore(got+1, tt.maxColor) >= tt.threshold {
+			t.Errorf("maxPhashDistance(%v, %v) = %d prunes distance %d scoring %v", tt.threshold, tt.maxColor, got, got+1, bestScore(got+1, tt.maxColor))
+		}
+		if got > 0 && bestScore(got, tt.maxColor) < tt.threshold {
+			t.Errorf("maxPhashDistance(%v, %v) = %d keeps distance %d scoring only %v", tt.threshold, tt.maxColor, got, got, bestScore(got, tt.maxColor))
+		}
+	}
+}
+
+func TestColorBound(t *testing.T) {
+	// uniform has every channel add up to 1, maxHist 1 is above any histogram
+	var red, blue, uniform, ones [48]float64
+	red[15], red[16], red[32] = 0.5, 0.25, 0.25
+	blue[7], blue[23] = 0.5, 0.5
+	for i := range uniform {
+		uniform[i], ones[i] = 1.0/16, 1
+	}
+
+	tests := []struct {
+		name          string
+		hist, maxHist [48]float64
+		want          float64
+	}{
+		{name: "itself", hist: red, maxHist: red, want: 100},
+		{name: "disjoint", hist: red, maxHist: blue, want: 0},
+		{name: "capped", hist: uniform, maxHist: ones, want: maxColorSimilarity},
+	}
+
+	for _, tt := range tests {
+		if got := colorBound(tt.hist, tt.maxHist); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: colorBound = %v, want %v", tt.name, got, tt.want)
+		}
+		// maxHist itself scores no higher
+		if sim := image.ColorHistogramSimilarity(tt.hist, tt.maxHist); tt.maxHist != ones && sim > colorBound(tt.hist, tt.maxHist)+1e-9 {
+			t.Errorf("%s: similarity %v exceeds the bound", tt.name, sim)
+		}
+	}
+}
+
+// TestGroupSimilarMatchesBruteForce checks that pruning the search never
+// drops a pair that comparing every file with every other would group
+func TestGroupSimilarMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const threshold = 90
+
+	// A few base images, each with near duplicates in slightly shifted colors
+	var files []hashedFile
+	for base := 0; base < 20; base++ {
+		phash := rng.Uint64()
+		var hist [48]float64
+		for i := range hist {
+			hist[i] = rng.Float64()
+		}
+		for copies := rng.Intn(8); copies >= 0; copies-- {
+			f := hashedFile{id: uint(len(files) + 1), phash: phash, area: rng.Intn(3), histogram: hist}
+			for flips := rng.Intn(12); flips > 0; flips-- {
+				f.phash ^= 1 << uint(rng.Intn(64))
+			}
+			sum := 0.0
+			for i := range f.histogram {
+				f.histogram[i] *= 0.5 + rng.Float64()
+				sum += f.histogram[i]
+			}
+			for i := range f.histogram {
+				f.histogram[i] /= sum
+			}
+			files = append(files, f)
+		}
+	}
+
+	want := append([]hashedFile(nil), files...)
+	sort.SliceStable(want, func(i, j int) bool { return keptBefore(want[i], want[j], nil) })
+	assigned := make([]bool, len(want))
+	var wantGroups [][]uint
+	for i := range want {
+		if assigned[i] {
+			continue
+		}
+		group := []uint{want[i].id}
+		for j := i + 1; j < len(want); j++ {
+			if !assigned[j] && combinedSimilarity(want[i].phash, want[i].histogram, want[j].phash, want[j].histogram) >= threshold {
+				assigned[j] = true
+				group = append(group, want[j].id)
+			}
+		}
+		if len(group) > 1 {
+			sort.Slice(group[1:], func(i, j int) bool { return group[1+i] < group[1+j] })
+			wantGroups = append(wantGroups, group)
+		}
+	}
+	if len(wantGroups) == 0 {
+		t.Fatal("no similar files generated")
+	}
+
+	svc := NewDedupeService(&models.Project{DedupeThreshold: threshold}, context.Background())
+	groups, err := svc.groupSimilar(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]uint
+	for _, group := range groups {
+		var ids []uint
+		for _, f := range group {
+			ids = append(ids, f.id)
+		}
+		sort.Slice(ids[1:], func(i, j int) bool { return ids[1+i] < ids[1+j] })
+		got = append(got, ids)
+	}
+	if !reflect.DeepEqual(got, wantGroups) {
+		t.Errorf("groupSimilar = %v, want %v", got, wantGroups)
+	}
+}
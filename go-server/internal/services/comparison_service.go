@@ -6,18 +6,17 @@ import (
 	"fmt"
 	"log"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/bilibili/look-alike/internal/database"
 	"github.com/bilibili/look-alike/internal/image"
 	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/workers"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-const (
-	batchSize         = 100
-	concurrentWorkers = 4
-)
+const batchSize = 100
 
 // ComparisonService handles comparison of source and target files
 type ComparisonService struct {
@@ -52,7 +51,7 @@ func ProcessComparison(project *models.Project, ctx context.Context) error {
 	// Run indexing first if needed
 	if project.Status != "indexed" {
 		log.Println("[INDEXING] Starting indexing phase...")
-		if err := Process(project); err != nil {
+		if err := Process(project, ctx); err != nil {
 			return err
 		}
 		log.Println("[INDEXING] Indexing phase completed")
@@ -74,44 +73,33 @@ func ProcessComparison(project *models.Project, ctx context.Context) error {
 	log.Printf("[VALIDATION] Total target files: %d", totalTargetFiles)
 
 	if totalSourceFiles == 0 {
-		err := fmt.Errorf("no source files found after indexing")
-		database.DB.Model(&project).Updates(map[string]interface{}{
-			"status":        "error",
-			"error_message": err.Error(),
-		})
-		return err
+		return failProject(project, fmt.Errorf("no source files found after indexing"))
 	}
 
 	if totalTargetFiles == 0 {
-		err := fmt.Errorf("no target files found after indexing")
-		database.DB.Model(&project).Updates(map[string]interface{}{
-			"status":        "error",
-			"error_message": err.Error(),
-		})
-		return err
+		return failProject(project, fmt.Errorf("no target files found after indexing"))
 	}
 
 	// Start comparison phase
 	log.Println("[COMPARING] Starting comparison phase...")
 	database.DB.Model(&project).Update("status", "comparing")
+	setPhase(project, "comparing")
 
 	svc := NewComparisonService(project, ctx)
 	if err := svc.compareAll(); err != nil {
-		database.DB.Model(&project).Updates(map[string]interface{}{
-			"status":        "error",
-			"error_message": err.Error(),
-		})
-		return err
+		return failProject(project, err)
 	}
 
 	// Create auto-selections
-	if err := svc.createAutoSelections(); err != nil {
+	setPhase(project, "auto_selecting")
+	if err := svc.createAutoSelections(0); err != nil {
 		log.Printf("[WARNING] Failed to create auto-selections: %v", err)
 	}
 
 	// Update to completed
 	database.DB.Model(&project).Updates(map[string]interface{}{
 		"status":   "completed",
+		"phase":    "",
 		"ended_at": time.Now(),
 	})
 
@@ -139,75 +127,141 @@ func (svc *ComparisonService) compareAll() error {
 	log.Printf("[COMPARING] Processing %d indexed source files...", len(sourceFiles))
 
 	if len(sourceFiles) == 0 {
+		// Nothing left when resuming a run that finished comparing
+		var analyzed int64
+		database.DB.Model(&models.SourceFile{}).Where("project_id = ? AND status = ?", svc.project.ID, "analyzed").Count(&analyzed)
+		if analyzed > 0 {
+			log.Println("[COMPARING] All source files are already analyzed")
+			return nil
+		}
 		return fmt.Errorf("no indexed source files found")
 	}
 
-	// Process concurrently with semaphore
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, concurrentWorkers)
-	var mu sync.Mutex
-	var candidateBatch []models.ComparisonCandidate
-	var updateBatch []uint
+	return svc.compareSources(sourceFiles, targets)
+}
+
+// comparisonResult holds the candidates found for one source file
+type comparisonResult struct {
+	sourceFileID uint
+	candidates   []models.ComparisonCandidate
+}
+
+// compareSources compares source files with the given targets, stores the
+// candidates and marks the source files as analyzed
+func (svc *ComparisonService) compareSources(sourceFiles []models.SourceFile, targets []models.ProjectTarget) error {
+	targetIDs := make([]uint, 0, len(targets))
+	for _, t := range targets {
+		targetIDs = append(targetIDs, t.ID)
+	}
 
+	// Compare on a bounded worker pool, a single writer batches the results
+	workerCount := workers.DefaultWorkerCount()
+	pool := workers.NewLimitedWorkerPool(workers.ResourceCPU, workerCount)
+	results := make(chan comparisonResult, workerCount*2)
+
+	var batch []comparisonResult
+	var batchCandidates int
+	var writeErr error
+	var saved int64
+	total := int64(len(sourceFiles))
+
+	flush := func() {
+		if len(batch) == 0 || writeErr != nil {
+			return
+		}
+		if err := saveResults(batch, targetIDs); err != nil {
+			log.Printf("[ERROR] Failed to save comparison results: %v", err)
+			writeErr = err
+		} else {
+			log.Printf("[COMPARING] Saved %d candidates for %d source files", batchCandidates, len(batch))
+			saved += int64(len(batch))
+			workers.ReportProgress(svc.ctx, saved, total)
+		}
+		batch = nil
+		batchCandidates = 0
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for result := range results {
+			batch = append(batch, result)
+			batchCandidates += len(result.candidates)
+			if batchCandidates >= batchSize || len(batch) >= batchSize {
+				flush()
+			}
+		}
+		flush()
+	}()
+
+	pool.Start()
 	for i := range sourceFiles {
 		// Check context cancellation
-		select {
-		case <-svc.ctx.Done():
+		if svc.ctx.Err() != nil {
 			log.Println("[COMPARING] Context cancelled, stopping comparison")
-			return svc.ctx.Err()
-		default:
+			break
 		}
 
-		wg.Add(1)
-		go func(sf *models.SourceFile) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			candidates := svc.compareSingleSource(sf, targets)
-
-			mu.Lock()
-			candidateBatch = append(candidateBatch, candidates...)
-			updateBatch = append(updateBatch, sf.ID)
-
-			// Batch insert candidates
-			if len(candidateBatch) >= batchSize {
-				if err := database.DB.Create(&candidateBatch).Error; err != nil {
-					log.Printf("[ERROR] Failed to batch insert candidates: %v", err)
-				} else {
-					log.Printf("[COMPARING] Batch inserted %d candidates", len(candidateBatch))
-				}
-				candidateBatch = nil
+		sf := &sourceFiles[i]
+		pool.AddJob(func() {
+			if svc.ctx.Err() != nil {
+				return
 			}
-
-			// Batch update source files
-			if len(updateBatch) >= batchSize {
-				database.DB.Model(&models.SourceFile{}).Where("id IN ?", updateBatch).Update("status", "analyzed")
-				log.Printf("[COMPARING] Batch updated %d source files to analyzed", len(updateBatch))
-				updateBatch = nil
+			results <- comparisonResult{
+				sourceFileID: sf.ID,
+				candidates:   svc.compareSingleSource(sf, targets),
 			}
-			mu.Unlock()
-		}(&sourceFiles[i])
+		})
 	}
 
-	wg.Wait()
+	pool.Stop()
+	close(results)
+	<-writerDone
 
-	// Insert remaining batches
-	if len(candidateBatch) > 0 {
-		if err := database.DB.Create(&candidateBatch).Error; err != nil {
-			return fmt.Errorf("failed to insert remaining candidates: %w", err)
-		}
-		log.Printf("[COMPARING] Inserted final batch of %d candidates", len(candidateBatch))
+	if writeErr != nil {
+		return fmt.Errorf("failed to save comparison results: %w", writeErr)
 	}
-
-	if len(updateBatch) > 0 {
-		database.DB.Model(&models.SourceFile{}).Where("id IN ?", updateBatch).Update("status", "analyzed")
-		log.Printf("[COMPARING] Updated final batch of %d source files", len(updateBatch))
+	if err := svc.ctx.Err(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// saveResults stores the candidates of whole source files and marks them
+// analyzed in one transaction, so a source is either fully compared or not
+// at all. Candidates the same sources already have for these targets (left
+// by an interrupted run) are replaced together with selections pointing at
+// them, which makes running the comparison again safe.
+func saveResults(results []comparisonResult, targetIDs []uint) error {
+	sourceFileIDs := make([]uint, 0, len(results))
+	var candidates []models.ComparisonCandidate
+	for _, result := range results {
+		sourceFileIDs = append(sourceFileIDs, result.sourceFileID)
+		candidates = append(candidates, result.candidates...)
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		stale := tx.Model(&models.ComparisonCandidate{}).Select("id").
+			Where("source_file_id IN ? AND project_target_id IN ?", sourceFileIDs, targetIDs)
+		if err := tx.Where("selected_candidate_id IN (?)", stale).Delete(&models.TargetSelection{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("source_file_id IN ? AND project_target_id IN ?", sourceFileIDs, targetIDs).
+			Delete(&models.ComparisonCandidate{}).Error; err != nil {
+			return err
+		}
+
+		if len(candidates) > 0 {
+			if err := tx.CreateInBatches(&candidates, batchSize).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&models.SourceFile{}).Where("id IN ?", sourceFileIDs).Update("status", "analyzed").Error
+	})
+}
+
 // compareSingleSource compares a single source file with all targets
 func (svc *ComparisonService) compareSingleSource(sourceFile *models.SourceFile, targets []models.ProjectTarget) []models.ComparisonCandidate {
 	var allCandidates []models.ComparisonCandidate
@@ -249,6 +303,10 @@ type candidateScore struct {
 	similarity float64
 }
 
+// highestAdaptiveThreshold is the first threshold applyAdaptiveThreshold
+// tries; candidates scoring above it are kept without lowering it
+const highestAdaptiveThreshold = 50.0
+
 // applyAdaptiveThreshold applies adaptive thresholding
 func (svc *ComparisonService) applyAdaptiveThreshold(candidates []candidateScore, sourceFileID uint, sourcePath, targetName string) []models.ComparisonCandidate {
 	if len(candidates) == 0 {
@@ -265,7 +323,7 @@ func (svc *ComparisonService) applyAdaptiveThreshold(candidates []candidateScore
 	}
 
 	// Try different thresholds
-	thresholds := []float64{50.0, 40.0, 30.0, 20.0, 10.0, 0.0}
+	thresholds := []float64{highestAdaptiveThreshold, 40.0, 30.0, 20.0, 10.0, 0.0}
 	var finalCandidates []candidateScore
 
 	for _, threshold := range thresholds {
@@ -298,7 +356,7 @@ func (svc *ComparisonService) applyAdaptiveThreshold(candidates []candidateScore
 		result = append(result, models.ComparisonCandidate{
 			SourceFileID:    sourceFileID,
 			ProjectTargetID: c.targetFile.ProjectTargetID,
-			FilePath:        c.targetFile.FullPath,
+			TargetFileID:    c.targetFile.ID,
 			SimilarityScore: c.similarity,
 			Rank:            i + 1,
 			Width:           c.targetFile.Width,
@@ -312,46 +370,53 @@ func (svc *ComparisonService) applyAdaptiveThreshold(candidates []candidateScore
 
 // calculateSimilarityFromHashes calculates similarity using phash and color histogram
 func calculateSimilarityFromHashes(source *models.SourceFile, target *models.TargetFile) float64 {
-	// Parse phash from strings
-	sourcePhash, _ := strconv.ParseUint(source.Phash, 10, 64)
-	targetPhash, _ := strconv.ParseUint(target.Phash, 10, 64)
+	sourcePhash, sourceHist := parseHashes(source.Phash, source.Histogram)
+	targetPhash, targetHist := parseHashes(target.Phash, target.Histogram)
+	return combinedSimilarity(sourcePhash, sourceHist, targetPhash, targetHist)
+}
 
-	// Calculate phash similarity
-	phashSim := image.HashSimilarity(sourcePhash, targetPhash, 64)
+// parseHashes parses the stored phash and color histogram of a file. A
+// missing or malformed histogram is returned as all zeros.
+func parseHashes(phash, histogram string) (uint64, [48]float64) {
+	hash, _ := strconv.ParseUint(phash, 10, 64)
 
-	// Parse color histograms
-	var sourceHist, targetHist [48]float64
-	if source.Histogram != "" && target.Histogram != "" {
-		var sourceHistSlice, targetHistSlice []float64
-		json.Unmarshal([]byte(source.Histogram), &sourceHistSlice)
-		json.Unmarshal([]byte(target.Histogram), &targetHistSlice)
+	var hist [48]float64
+	if histogram != "" {
+		var histSlice []float64
+		json.Unmarshal([]byte(histogram), &histSlice)
 
 		// Convert to fixed-size array
-		if len(sourceHistSlice) == 48 && len(targetHistSlice) == 48 {
-			for i := 0; i < 48; i++ {
-				sourceHist[i] = sourceHistSlice[i]
-				targetHist[i] = targetHistSlice[i]
-			}
+		if len(histSlice) == 48 {
+			copy(hist[:], histSlice)
 		}
 	}
+	return hash, hist
+}
 
-	// Calculate color similarity
-	colorSim := image.ColorHistogramSimilarity(sourceHist, targetHist)
+// combinedSimilarity weights phash and color histogram similarity
+func combinedSimilarity(phash1 uint64, hist1 [48]float64, phash2 uint64, hist2 [48]float64) float64 {
+	phashSim := image.HashSimilarity(phash1, phash2, 64)
+	colorSim := image.ColorHistogramSimilarity(hist1, hist2)
 
-	// Weighted combination
 	weights := image.Weights
 	return phashSim*weights["phash"] + colorSim*weights["color"]
 }
 
-// createAutoSelections creates default selections for rank 1 candidates
-func (svc *ComparisonService) createAutoSelections() error {
+// createAutoSelections creates default selections for rank 1 candidates.
+// A non-zero targetID restricts them to that target. Existing selections are
+// left alone, so it is safe to run again.
+func (svc *ComparisonService) createAutoSelections(targetID uint) error {
 	log.Println("Creating auto-selections for best matches...")
 
-	var bestCandidates []models.ComparisonCandidate
-	database.DB.Where("rank = ?", 1).
+	query := database.DB.Where("rank = ?", 1).
 		Joins("INNER JOIN source_files ON source_files.id = comparison_candidates.source_file_id").
-		Where("source_files.project_id = ?", svc.project.ID).
-		Find(&bestCandidates)
+		Where("source_files.project_id = ?", svc.project.ID)
+	if targetID != 0 {
+		query = query.Where("comparison_candidates.project_target_id = ?", targetID)
+	}
+
+	var bestCandidates []models.ComparisonCandidate
+	query.Find(&bestCandidates)
 
 	var selections []models.TargetSelection
 	for _, candidate := range bestCandidates {
@@ -363,7 +428,7 @@ func (svc *ComparisonService) createAutoSelections() error {
 		})
 
 		if len(selections) >= batchSize {
-			if err := database.DB.Create(&selections).Error; err != nil {
+			if err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&selections).Error; err != nil {
 				log.Printf("[ERROR] Failed to batch insert selections: %v", err)
 			} else {
 				log.Printf("Batch inserted %d auto-selections", len(selections))
@@ -373,7 +438,7 @@ func (svc *ComparisonService) createAutoSelections() error {
 	}
 
 	if len(selections) > 0 {
-		if err := database.DB.Create(&selections).Error; err != nil {
+		if err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&selections).Error; err != nil {
 			return err
 		}
 		log.Printf("Inserted final %d auto-selections", len(selections))
@@ -0,0 +1,623 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/archive"
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/image"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"github.com/bilibili/look-alike/internal/workers"
+	"gorm.io/gorm"
+)
+
+// DedupeService finds near-duplicate images within the targets of a dedupe
+// project. Target files are compared using the same phash and color
+// histogram similarity as the comparison, and images at or above the
+// project's DedupeThreshold of a cluster's keeper end up in that cluster.
+type DedupeService struct {
+	project *models.Project
+	ctx     context.Context
+}
+
+// NewDedupeService creates a new dedupe service
+func NewDedupeService(project *models.Project, ctx context.Context) *DedupeService {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &DedupeService{
+		project: project,
+		ctx:     ctx,
+	}
+}
+
+// ProcessDedupe indexes the targets of a dedupe project and rebuilds its
+// duplicate clusters. Clusters that were already exported or quarantined are
+// kept as they are, and keepers picked earlier are kept when their image
+// lands in a cluster again.
+func ProcessDedupe(project *models.Project, ctx context.Context) error {
+	log.Println("=========================================")
+	log.Printf("DedupeService.Process started for project %d: %s", project.ID, project.Name)
+	log.Println("=========================================")
+
+	database.DB.Model(&project).Updates(map[string]interface{}{
+		"status":     "indexing",
+		"started_at": time.Now(),
+	})
+
+	indexer := NewIndexingService(project, ctx)
+	setPhase(project, "indexing_targets")
+	if err := indexer.indexTargetFiles(); err != nil {
+		return failProject(project, fmt.Errorf("failed to index target files: %w", err))
+	}
+
+	database.DB.Model(&project).Update("status", "processing")
+	setPhase(project, "clustering")
+
+	svc := NewDedupeService(project, ctx)
+	if err := svc.buildClusters(); err != nil {
+		return failProject(project, err)
+	}
+
+	database.DB.Model(&project).Updates(map[string]interface{}{
+		"status":   "completed",
+		"phase":    "",
+		"ended_at": time.Now(),
+	})
+
+	log.Println("[SUCCESS] Duplicate clustering completed")
+	log.Println("=========================================")
+	return nil
+}
+
+// hashedFile is a target file with its parsed features
+type hashedFile struct {
+	id        uint
+	phash     uint64
+	histogram [48]float64
+	area      int
+	sizeBytes int64
+}
+
+// buildClusters replaces the pending clusters of the project
+func (svc *DedupeService) buildClusters() error {
+	// Files of clusters that were already acted on stay where they are
+	var resolvedFileIDs []uint
+	err := database.DB.Table("duplicate_members").
+		Joins("INNER JOIN duplicate_clusters ON duplicate_clusters.id = duplicate_members.cluster_id").
+		Where("duplicate_clusters.project_id = ?", svc.project.ID).
+		Where("duplicate_members.cluster_id IN (?)",
+			database.DB.Table("duplicate_members").Select("cluster_id").Where("status <> ?", "pending")).
+		Pluck("duplicate_members.target_file_id", &resolvedFileIDs).Error
+	if err != nil {
+		return err
+	}
+	excluded := make(map[uint]bool, len(resolvedFileIDs))
+	for _, id := range resolvedFileIDs {
+		excluded[id] = true
+	}
+
+	// Keepers picked on pending clusters are preferred again
+	var keeperFileIDs []uint
+	err = database.DB.Table("duplicate_members").
+		Joins("INNER JOIN duplicate_clusters ON duplicate_clusters.keeper_id = duplicate_members.id").
+		Where("duplicate_clusters.project_id = ?", svc.project.ID).
+		Pluck("duplicate_members.target_file_id", &keeperFileIDs).Error
+	if err != nil {
+		return err
+	}
+	previousKeepers := make(map[uint]bool, len(keeperFileIDs))
+	for _, id := range keeperFileIDs {
+		previousKeepers[id] = true
+	}
+
+	var targetFiles []models.TargetFile
+	err = database.DB.Select("target_files.id, target_files.phash, target_files.histogram, target_files.area, target_files.size_bytes").
+		Joins("INNER JOIN project_targets ON project_targets.id = target_files.project_target_id").
+		Where("project_targets.project_id = ?", svc.project.ID).
+		Order("target_files.id").
+		Find(&targetFiles).Error
+	if err != nil {
+		return err
+	}
+
+	files := make([]hashedFile, 0, len(targetFiles))
+	for _, tf := range targetFiles {
+		if excluded[tf.ID] {
+			continue
+		}
+		phash, histogram := parseHashes(tf.Phash, tf.Histogram)
+		files = append(files, hashedFile{
+			id:        tf.ID,
+			phash:     phash,
+			histogram: histogram,
+			area:      tf.Area,
+			sizeBytes: tf.SizeBytes,
+		})
+	}
+
+	log.Printf("[CLUSTERING] Comparing %d images with threshold %.1f%%", len(files), svc.project.DedupeThreshold)
+
+	groups, err := svc.groupSimilar(files, previousKeepers)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[CLUSTERING] Found %d duplicate clusters", len(groups))
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		// Drop the clusters nobody acted on yet
+		pending := tx.Table("duplicate_clusters").Select("id").
+			Where("project_id = ?", svc.project.ID).
+			Where("id NOT IN (?)", tx.Table("duplicate_members").Select("cluster_id").Where("status <> ?", "pending"))
+		var pendingIDs []uint
+		if err := pending.Pluck("id", &pendingIDs).Error; err != nil {
+			return err
+		}
+		if len(pendingIDs) > 0 {
+			if err := tx.Where("cluster_id IN ?", pendingIDs).Delete(&models.DuplicateMember{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", pendingIDs).Delete(&models.DuplicateCluster{}).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, group := range groups {
+			// The representative of a group is its keeper
+			keeper := group[0]
+
+			cluster := models.DuplicateCluster{ProjectID: svc.project.ID}
+			if err := tx.Create(&cluster).Error; err != nil {
+				return err
+			}
+
+			members := make([]models.DuplicateMember, 0, len(group))
+			for _, f := range group {
+				members = append(members, models.DuplicateMember{
+					ClusterID:    cluster.ID,
+					TargetFileID: f.id,
+					Status:       "pending",
+				})
+			}
+			if err := tx.Create(&members).Error; err != nil {
+				return err
+			}
+
+			for _, m := range members {
+				if m.TargetFileID == keeper.id {
+					if err := tx.Model(&cluster).Update("keeper_id", m.ID).Error; err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// groupSimilar groups files at or above the threshold. Every group has a
+// representative, the file that would be kept, and a file joins a group
+// only when it is similar to that representative, so unrelated files are
+// never chained together through a common neighbour. Candidates come from
+// a BK-tree over the phashes, searched on a worker pool within the distance
+// each file's best possible color similarity allows; files are then
+// assigned to the first representative in keeper order.
+func (svc *DedupeService) groupSimilar(files []hashedFile, previousKeepers map[uint]bool) ([][]hashedFile, error) {
+	threshold := svc.project.DedupeThreshold
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return keptBefore(files[i], files[j], previousKeepers)
+	})
+
+	tree := &bkTree{}
+	var maxHist [48]float64
+	for i := range files {
+		tree.add(files[i].phash, i)
+		for bin, v := range files[i].histogram {
+			maxHist[bin] = math.Max(maxHist[bin], v)
+		}
+	}
+
+	// neighbors[i] holds the similar files after i; each job writes its own row
+	neighbors := make([][]int, len(files))
+
+	pool := workers.NewLimitedWorkerPool(workers.ResourceCPU, workers.DefaultWorkerCount())
+	pool.Start()
+	for i := range files {
+		if svc.ctx.Err() != nil {
+			break
+		}
+
+		i := i
+		pool.AddJob(func() {
+			if svc.ctx.Err() != nil {
+				return
+			}
+			a := &files[i]
+			radius := maxPhashDistance(threshold, colorBound(a.histogram, maxHist))
+			tree.search(a.phash, radius, func(j int) {
+				b := &files[j]
+				if j > i && combinedSimilarity(a.phash, a.histogram, b.phash, b.histogram) >= threshold {
+					neighbors[i] = append(neighbors[i], j)
+				}
+			})
+		})
+	}
+	pool.Stop()
+
+	if err := svc.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// A file not taken by an earlier representative starts its own group.
+	// Neighbors before i are never free: they started a group themselves
+	// and would have taken i.
+	assigned := make([]bool, len(files))
+	var groups [][]hashedFile
+	for i := range files {
+		if assigned[i] {
+			continue
+		}
+		assigned[i] = true
+		group := []hashedFile{files[i]}
+		for _, j := range neighbors[i] {
+			if !assigned[j] {
+				assigned[j] = true
+				group = append(group, files[j])
+			}
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// keptBefore orders files by how likely they are kept: a previously picked
+// keeper first, then the image with the most pixels, then the largest file
+func keptBefore(a, b hashedFile, previousKeepers map[uint]bool) bool {
+	if previousKeepers[a.id] != previousKeepers[b.id] {
+		return previousKeepers[a.id]
+	}
+	if a.area != b.area {
+		return a.area > b.area
+	}
+	return a.sizeBytes > b.sizeBytes
+}
+
+// maxColorSimilarity is the largest color histogram similarity: the three
+// channels are normalized separately and each adds up to 100
+const maxColorSimilarity = 300
+
+// colorBound returns the highest color similarity hist can reach with any
+// histogram whose bins are at most those of maxHist
+func colorBound(hist, maxHist [48]float64) float64 {
+	bound := 0.0
+	for i := range hist {
+		bound += math.Sqrt(hist[i] * maxHist[i])
+	}
+	return math.Min(bound*100, maxColorSimilarity)
+}
+
+// maxPhashDistance returns the largest phash Hamming distance at which two
+// images can still reach threshold when their color similarity is at most
+// maxColor. With the default weights a pair of equal colors reaches 90 at
+// any distance, so up to a threshold of 90 the search is only narrowed for
+// images whose colors no other image comes close to.
+func maxPhashDistance(threshold, maxColor float64) int {
+	weights := image.Weights
+	if weights["phash"] <= 0 {
+		return 64
+	}
+	minPhash := (threshold - maxColor*weights["color"]) / weights["phash"]
+	if minPhash <= 0 {
+		return 64
+	}
+	distance := int(math.Floor(64*(1-minPhash/100) + 1e-9))
+	if distance < 0 {
+		return 0
+	}
+	return distance
+}
+
+// ClusterMember is a duplicate member resolved for display
+type ClusterMember struct {
+	ID           uint    `json:"id"`
+	TargetFileID uint    `json:"target_file_id"`
+	TargetID     uint    `json:"target_id"`
+	TargetName   string  `json:"target_name"`
+	RelativePath string  `json:"relative_path"`
+	Path         string  `json:"path"`
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	SizeBytes    int64   `json:"size_bytes"`
+	Similarity   float64 `json:"similarity"` // similarity to the keeper
+	Keeper       bool    `json:"keeper"`
+	Status       string  `json:"status"`
+	OutputPath   string  `json:"output_path,omitempty"`
+}
+
+// ClusterView is a duplicate cluster with its resolved members
+type ClusterView struct {
+	ID       uint            `json:"id"`
+	KeeperID *uint           `json:"keeper_id,omitempty"`
+	Resolved bool            `json:"resolved"` // every non-keeper was exported or quarantined
+	Members  []ClusterMember `json:"members"`
+}
+
+// ListClusters returns a page of duplicate clusters, largest first
+func ListClusters(project *models.Project, page, perPage int) ([]ClusterView, int64, error) {
+	var total int64
+	if err := database.DB.Model(&models.DuplicateCluster{}).Where("project_id = ?", project.ID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var clusters []models.DuplicateCluster
+	err := database.DB.Where("project_id = ?", project.ID).
+		Order("(SELECT COUNT(*) FROM duplicate_members WHERE duplicate_members.cluster_id = duplicate_clusters.id) DESC, id").
+		Limit(perPage).Offset((page-1)*perPage).
+		Preload("Members", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Members.TargetFile").
+		Find(&clusters).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var targets []models.ProjectTarget
+	database.DB.Where("project_id = ?", project.ID).Find(&targets)
+	targetsByID := make(map[uint]*models.ProjectTarget, len(targets))
+	for i := range targets {
+		targetsByID[targets[i].ID] = &targets[i]
+	}
+
+	views := make([]ClusterView, 0, len(clusters))
+	for _, cluster := range clusters {
+		views = append(views, clusterView(&cluster, targetsByID))
+	}
+	return views, total, nil
+}
+
+// clusterView resolves the members of a cluster against their target roots
+func clusterView(cluster *models.DuplicateCluster, targetsByID map[uint]*models.ProjectTarget) ClusterView {
+	var keeperPhash uint64
+	var keeperHist [48]float64
+	for _, m := range cluster.Members {
+		if cluster.KeeperID != nil && m.ID == *cluster.KeeperID && m.TargetFile != nil {
+			keeperPhash, keeperHist = parseHashes(m.TargetFile.Phash, m.TargetFile.Histogram)
+		}
+	}
+
+	view := ClusterView{
+		ID:       cluster.ID,
+		KeeperID: cluster.KeeperID,
+		Resolved: true,
+	}
+	for _, m := range cluster.Members {
+		member := ClusterMember{
+			ID:           m.ID,
+			TargetFileID: m.TargetFileID,
+			Keeper:       cluster.KeeperID != nil && m.ID == *cluster.KeeperID,
+			Status:       m.Status,
+			OutputPath:   m.OutputPath,
+		}
+		if tf := m.TargetFile; tf != nil {
+			member.TargetID = tf.ProjectTargetID
+			member.RelativePath = tf.RelativePath
+			member.Width = tf.Width
+			member.Height = tf.Height
+			member.SizeBytes = tf.SizeBytes
+
+			phash, hist := parseHashes(tf.Phash, tf.Histogram)
+			member.Similarity = combinedSimilarity(keeperPhash, keeperHist, phash, hist)
+
+			if target, ok := targetsByID[tf.ProjectTargetID]; ok {
+				member.TargetName = target.Name
+				member.Path = TargetFilePath(target, tf)
+			}
+		} else if m.OriginalPath != "" {
+			// Quarantined: the target file is gone, show where it was
+			member.TargetID = m.TargetID
+			member.RelativePath = m.RelativePath
+			member.Path = m.OriginalPath
+			if target, ok := targetsByID[m.TargetID]; ok {
+				member.TargetName = target.Name
+			}
+		}
+		if !member.Keeper && m.Status == "pending" {
+			view.Resolved = false
+		}
+		view.Members = append(view.Members, member)
+	}
+	return view
+}
+
+// SetClusterKeeper picks the member that is kept when the rest of the
+// cluster is exported or quarantined
+func SetClusterKeeper(project *models.Project, clusterID, memberID uint) error {
+	var cluster models.DuplicateCluster
+	if err := database.DB.Where("id = ? AND project_id = ?", clusterID, project.ID).First(&cluster).Error; err != nil {
+		return fmt.Errorf("cluster %d not found in project %d", clusterID, project.ID)
+	}
+
+	var member models.DuplicateMember
+	if err := database.DB.Where("id = ? AND cluster_id = ?", memberID, cluster.ID).First(&member).Error; err != nil {
+		return fmt.Errorf("member %d does not belong to cluster %d", memberID, cluster.ID)
+	}
+	if member.Status == "quarantined" {
+		return fmt.Errorf("member %d was quarantined and cannot be kept", memberID)
+	}
+
+	return database.DB.Model(&cluster).Update("keeper_id", member.ID).Error
+}
+
+// DefaultQuarantinePath returns the folder duplicates are moved to when no
+// folder is given, next to the default export folder
+func DefaultQuarantinePath(project *models.Project) string {
+	return filepath.Join(filepath.Dir(DefaultOutputPath(project)), fmt.Sprintf("%s_Quarantine", project.Name))
+}
+
+// ResolveClusters exports (copies) or quarantines (moves) every pending
+// member of the given clusters except the keeper. Files are laid out as
+// <outputPath>/<target name>/<relative path>. All clusters of the project
+// are resolved when clusterIDs is empty.
+func ResolveClusters(project *models.Project, clusterIDs []uint, action, outputPath string, ctx context.Context) error {
+	if action != "export" && action != "quarantine" {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	query := database.DB.Where("project_id = ? AND keeper_id IS NOT NULL", project.ID).
+		Preload("Members", "status = ?", "pending").
+		Preload("Members.TargetFile")
+	if len(clusterIDs) > 0 {
+		query = query.Where("id IN ?", clusterIDs)
+	}
+
+	var clusters []models.DuplicateCluster
+	if err := query.Find(&clusters).Error; err != nil {
+		return err
+	}
+
+	var targets []models.ProjectTarget
+	database.DB.Where("project_id = ?", project.ID).Find(&targets)
+	targetsByID := make(map[uint]*models.ProjectTarget, len(targets))
+	for i := range targets {
+		targetsByID[targets[i].ID] = &targets[i]
+	}
+
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	log.Printf("[DEDUPE] %s duplicates of %d clusters to %s", action, len(clusters), outputPath)
+
+	var total int64
+	for _, cluster := range clusters {
+		total += int64(len(cluster.Members))
+	}
+
+	var done int64
+	resolved := 0
+	for _, cluster := range clusters {
+		for _, m := range cluster.Members {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			done++
+			workers.ReportProgress(ctx, done, total)
+			if m.ID == *cluster.KeeperID || m.TargetFile == nil {
+				continue
+			}
+			target, ok := targetsByID[m.TargetFile.ProjectTargetID]
+			if !ok {
+				continue
+			}
+
+			srcPath := TargetFilePath(target, m.TargetFile)
+			// The target name is one folder, as in export layouts
+			dstPath := filepath.Join(outputPath, targetSegment(target.Name), archive.Flatten(m.TargetFile.RelativePath))
+			if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+				return err
+			}
+			dstPath = unusedPath(dstPath)
+
+			status := "exported"
+			var err error
+			if action == "quarantine" {
+				status = "quarantined"
+				err = moveFile(ctx, srcPath, dstPath)
+			} else {
+				err = copyFile(ctx, srcPath, dstPath)
+			}
+			if err != nil {
+				log.Printf("[ERROR] Failed to %s %s: %v", action, srcPath, err)
+				publishFileError(project.ID, srcPath, err)
+				continue
+			}
+
+			err = database.DB.Transaction(func(tx *gorm.DB) error {
+				updates := map[string]interface{}{
+					"status":      status,
+					"output_path": dstPath,
+				}
+				if action == "quarantine" {
+					updates["target_id"] = target.ID
+					updates["relative_path"] = m.TargetFile.RelativePath
+					updates["original_path"] = srcPath
+				}
+				if err := tx.Model(&m).Updates(updates).Error; err != nil || action != "quarantine" {
+					return err
+				}
+				// The file left its target
+				return forgetTargetFile(tx, m.TargetFileID)
+			})
+			if err != nil {
+				log.Printf("[ERROR] Failed to record %s of %s: %v", action, srcPath, err)
+			}
+			resolved++
+		}
+	}
+
+	log.Printf("[DEDUPE] %d duplicates handled (%s)", resolved, action)
+	return nil
+}
+
+// unusedPath returns p, or p with the first suffix _1, _2, ... that names no
+// existing file
+func unusedPath(p string) string {
+	ext := filepath.Ext(p)
+	stem := strings.TrimSuffix(p, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%s_%d%s", stem, n, ext)
+	}
+}
+
+// forgetTargetFile deletes a target file that was moved out of its target,
+// with the candidates and selections that point at it
+func forgetTargetFile(tx *gorm.DB, targetFileID uint) error {
+	candidateIDs := tx.Model(&models.ComparisonCandidate{}).Select("id").Where("target_file_id = ?", targetFileID)
+	if err := tx.Where("selected_candidate_id IN (?)", candidateIDs).Delete(&models.TargetSelection{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("target_file_id = ?", targetFileID).Delete(&models.ComparisonCandidate{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&models.TargetFile{}, targetFileID).Error
+}
+
+// moveFile moves a local file, copying it when src and dst are on different
+// filesystems. It never replaces an existing file. Remote objects and
+// archive entries cannot be moved.
+func moveFile(ctx context.Context, src, dst string) error {
+	if storage.IsRemote(src) || archive.IsVirtual(src) {
+		return fmt.Errorf("only plain local files can be moved")
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(ctx, src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
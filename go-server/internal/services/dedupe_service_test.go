@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	stdimage "image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/testutil"
+)
+
+func TestGroupSimilar(t *testing.T) {
+	var red, green, blue [48]float64
+	third := 1.0 / 3
+	red[15], red[16], red[32] = third, third, third
+	green[0], green[31], green[40] = third, third, third
+	blue[7], blue[23], blue[47] = third, third, third
+
+	// These histograms score 100 when equal, so at 98.9 only a phash
+	// distance of 1 is similar
+	newFiles := func() []hashedFile {
+		return []hashedFile{
+			{id: 1, phash: 0x00ff00ff00ff00ff, histogram: red},
+			{id: 2, phash: 0xff00ff00ff00ff00, histogram: blue},
+			{id: 3, phash: 0x00ff00ff00ff00fe, histogram: red}, // 1 bit from 1
+			{id: 4, phash: 0x00ff00ff00ff00fc, histogram: red}, // 1 bit from 3, 2 from 1
+			{id: 5, phash: 0xff00ff00ff00ff01, histogram: blue},
+			{id: 6, phash: 0x00ff00ff00ff00ff, histogram: green}, // same hash as 1
+		}
+	}
+
+	tests := []struct {
+		name            string
+		previousKeepers map[uint]bool
+		largest         uint
+		want            [][]uint
+	}{
+		// 4 is not chained to 1 through 3
+		{name: "input order", want: [][]uint{{1, 3}, {2, 5}}},
+		{name: "largest first", largest: 4, want: [][]uint{{4, 3}, {2, 5}}},
+		{name: "previous keeper", previousKeepers: map[uint]bool{3: true}, largest: 4, want: [][]uint{{3, 1, 4}, {2, 5}}},
+	}
+
+	for _, tt := range tests {
+		files := newFiles()
+		for i := range files {
+			if files[i].id == tt.largest {
+				files[i].area = 100
+			}
+		}
+		svc := NewDedupeService(&models.Project{DedupeThreshold: 98.9}, context.Background())
+
+		groups, err := svc.groupSimilar(files, tt.previousKeepers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]uint
+		for _, group := range groups {
+			var ids []uint
+			for _, f := range group {
+				ids = append(ids, f.id)
+			}
+			// The keeper comes first, the order of the rest is not defined
+			sort.Slice(ids[1:], func(i, j int) bool { return ids[1+i] < ids[1+j] })
+			got = append(got, ids)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: groupSimilar = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeptBefore(t *testing.T) {
+	files := []hashedFile{
+		{id: 1, area: 100, sizeBytes: 10},
+		{id: 2, area: 400, sizeBytes: 10},
+		{id: 3, area: 400, sizeBytes: 20},
+	}
+
+	tests := []struct {
+		name     string
+		previous map[uint]bool
+		want     uint
+	}{
+		{name: "largest image", want: 3},
+		{name: "previous keeper", previous: map[uint]bool{1: true}, want: 1},
+		{name: "previous keeper elsewhere", previous: map[uint]bool{9: true}, want: 3},
+	}
+
+	for _, tt := range tests {
+		sorted := append([]hashedFile(nil), files...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return keptBefore(sorted[i], sorted[j], tt.previous)
+		})
+		if sorted[0].id != tt.want {
+			t.Errorf("%s: first kept = %d, want %d", tt.name, sorted[0].id, tt.want)
+		}
+	}
+}
+
+// solidImage returns a single colored test image, unrelated to testutil.Pattern
+func solidImage(w, h int, c color.NRGBA) *stdimage.NRGBA {
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &stdimage.Uniform{C: c}, stdimage.Point{}, draw.Src)
+	return img
+}
+
+func TestProcessDedupe(t *testing.T) {
+	clearFeatureCache(t)
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	testutil.WritePNG(t, filepath.Join(target, "a.png"), testutil.Pattern(64, 64, 1))
+	testutil.WritePNG(t, filepath.Join(target, "copy", "a.png"), testutil.Pattern(64, 64, 1))
+	testutil.WritePNG(t, filepath.Join(target, "other.png"), solidImage(64, 64, color.NRGBA{R: 200, G: 30, B: 30, A: 255}))
+
+	project := &models.Project{Name: t.Name(), Type: "dedupe", DedupeThreshold: 90,
+		ProjectTargets: []models.ProjectTarget{{Name: "T", Path: target}}}
+	if err := database.DB.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ProcessDedupe(project, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clusters, total, err := ListClusters(project, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(clusters[0].Members) != 2 || clusters[0].KeeperID == nil {
+		t.Fatalf("clusters = %+v", clusters)
+	}
+
+	// Files already in the quarantine are never overwritten
+	quarantine := filepath.Join(dir, "quarantine")
+	existing := []string{filepath.Join(quarantine, "T", "a.png"), filepath.Join(quarantine, "T", "copy", "a.png")}
+	for _, p := range existing {
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ResolveClusters(project, nil, "quarantine", quarantine, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clusters, _, _ = ListClusters(project, 1, 10)
+	if !clusters[0].Resolved {
+		t.Errorf("cluster not resolved after quarantine: %+v", clusters[0])
+	}
+	for _, m := range clusters[0].Members {
+		if m.Keeper {
+			if _, err := os.Stat(m.Path); err != nil {
+				t.Errorf("keeper %s was touched: %v", m.Path, err)
+			}
+			continue
+		}
+		if m.Status != "quarantined" {
+			t.Errorf("member %s status = %q, want quarantined", m.RelativePath, m.Status)
+		}
+		// The member still shows where the file was
+		if m.TargetName != "T" || m.RelativePath == "" || m.Path != filepath.Join(target, m.RelativePath) {
+			t.Errorf("quarantined member shows target %q, path %q (%q)", m.TargetName, m.Path, m.RelativePath)
+		}
+		if _, err := os.Stat(m.OutputPath); err != nil {
+			t.Errorf("quarantined file missing: %v", err)
+		}
+		if filepath.Base(m.OutputPath) != "a_1.png" {
+			t.Errorf("quarantined to %s, want a free name next to the existing file", m.OutputPath)
+		}
+		if _, err := os.Stat(m.Path); !os.IsNotExist(err) {
+			t.Errorf("quarantined file %s still in the target", m.Path)
+		}
+	}
+	for _, p := range existing {
+		if data, _ := os.ReadFile(p); string(data) != "existing" {
+			t.Errorf("%s was overwritten", p)
+		}
+	}
+}
+
+func TestQuarantineKeepsTargetNameInside(t *testing.T) {
+	clearFeatureCache(t)
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	testutil.WritePNG(t, filepath.Join(target, "a.png"), testutil.Pattern(64, 64, 1))
+	testutil.WritePNG(t, filepath.Join(target, "b.png"), testutil.Pattern(64, 64, 1))
+
+	project := &models.Project{Name: t.Name(), Type: "dedupe", DedupeThreshold: 90,
+		ProjectTargets: []models.ProjectTarget{{Name: "../../escaped", Path: target}}}
+	if err := database.DB.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ProcessDedupe(project, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	quarantine := filepath.Join(dir, "out", "quarantine")
+	if err := ResolveClusters(project, nil, "quarantine", quarantine, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clusters, _, _ := ListClusters(project, 1, 10)
+	if len(clusters) != 1 {
+		t.Fatalf("clusters = %+v", clusters)
+	}
+	for _, m := range clusters[0].Members {
+		if m.Keeper {
+			continue
+		}
+		if rel, err := filepath.Rel(quarantine, m.OutputPath); err != nil || !filepath.IsLocal(rel) {
+			t.Errorf("quarantined to %s, outside %s", m.OutputPath, quarantine)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("quarantine wrote outside its folder: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+)
+
+// exportFormats maps the output formats of an export to their extension
+var exportFormats = map[string]string{
+	"jpg":  ".jpg",
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"webp": ".webp",
+	"gif":  ".gif",
+	"bmp":  ".bmp",
+	"tiff": ".tiff",
+}
+
+// Resize modes of an export. All of them size the selected target after
+// its source file; stretch, fill and pad export exactly the source's
+// dimensions.
+const (
+	ResizeSource  = "source"  // scale to fit within the source's dimensions, keeping the aspect ratio
+	ResizeStretch = "stretch" // scale to exactly the source's dimensions, stretching if the aspect ratio differs
+	ResizeFill    = "fill"    // scale to cover the source's dimensions and crop the overflow
+	ResizePad     = "pad"     // scale to fit within the source's dimensions and pad the rest
+)
+
+// resampleFilters are the resampling filters an export may resize with
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// Default encoder qualities used when an export does not set one
+const (
+	defaultJPEGQuality = 95
+	defaultWebPQuality = 90
+)
+
+// ValidateConvertOptions checks the format conversion and resizing options
+// of an export
+func ValidateConvertOptions(options models.ExportOptions) error {
+	if _, ok := exportFormats[strings.ToLower(options.Format)]; options.Format != "" && !ok {
+		return fmt.Errorf("unknown output format: %s", options.Format)
+	}
+	if options.Quality < 0 || options.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100, or 0 for the default")
+	}
+	if options.Background != "" {
+		if _, err := parseColor(options.Background); err != nil {
+			return err
+		}
+	}
+	switch options.Resize {
+	case "", ResizeSource, ResizeStretch, ResizeFill, ResizePad:
+	default:
+		return fmt.Errorf("unknown resize mode: %s", options.Resize)
+	}
+	if _, ok := resampleFilters[options.Filter]; options.Filter != "" && !ok {
+		return fmt.Errorf("unknown resampling filter: %s", options.Filter)
+	}
+	if options.MaxWidth < 0 || options.MaxHeight < 0 {
+		return fmt.Errorf("max_width and max_height must not be negative")
+	}
+	if (options.MaxWidth > 0 || options.MaxHeight > 0) && exactSize(options.Resize) {
+		return fmt.Errorf("max_width and max_height cannot be combined with resize %s, which exports the source's exact dimensions", options.Resize)
+	}
+	return nil
+}
+
+// exactSize reports whether a resize mode exports the source's exact
+// dimensions
+func exactSize(resize string) bool {
+	return resize == ResizeStretch || resize == ResizeFill || resize == ResizePad
+}
+
+// withFormat replaces the extension of an output path with the one of the
+// export's output format, if set
+func (svc *ExportService) withFormat(outputPath string) string {
+	ext, ok := exportFormats[strings.ToLower(svc.run.Options.Format)]
+	if !ok {
+		return outputPath
+	}
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ext
+}
+
+// sameFormat reports whether two files have the same image format, e.g.
+// a.JPG and b.jpeg
+func sameFormat(a, b string) bool {
+	formatA, errA := imaging.FormatFromFilename(a)
+	formatB, errB := imaging.FormatFromFilename(b)
+	if errA == nil && errB == nil {
+		return formatA == formatB
+	}
+	return strings.EqualFold(filepath.Ext(a), filepath.Ext(b))
+}
+
+// needsConversion reports whether the selected target of an item has to be
+// decoded and encoded again rather than copied as is
+func (svc *ExportService) needsConversion(item exportItem) bool {
+	if !sameFormat(item.targetPath, item.outputPath) {
+		return true
+	}
+	width, height := item.targetWidth, item.targetHeight
+	if width == 0 || height == 0 {
+		// Unknown dimensions: decode whenever a resize is asked for
+		return svc.run.Options.Resize != "" || svc.run.Options.MaxWidth > 0 || svc.run.Options.MaxHeight > 0
+	}
+	newWidth, newHeight := svc.resizedSize(item, width, height)
+	return newWidth != width || newHeight != height
+}
+
+// resizedSize returns the size an image of width×height is exported at
+func (svc *ExportService) resizedSize(item exportItem, width, height int) (int, int) {
+	options := svc.run.Options
+	if sourceWidth, sourceHeight := item.source.Width, item.source.Height; sourceWidth > 0 && sourceHeight > 0 {
+		switch options.Resize {
+		case ResizeSource:
+			width, height = scaleToFit(width, height, sourceWidth, sourceHeight, true)
+		case ResizeStretch, ResizeFill, ResizePad:
+			width, height = sourceWidth, sourceHeight
+		}
+	}
+	return svc.limitSize(width, height)
+}
+
+// limitSize scales width×height down to the export's maximum size
+func (svc *ExportService) limitSize(width, height int) (int, int) {
+	maxWidth, maxHeight := svc.run.Options.MaxWidth, svc.run.Options.MaxHeight
+	if maxWidth > 0 || maxHeight > 0 {
+		if maxWidth == 0 {
+			maxWidth = width
+		}
+		if maxHeight == 0 {
+			maxHeight = height
+		}
+		width, height = scaleToFit(width, height, maxWidth, maxHeight, false)
+	}
+	return width, height
+}
+
+// scaleToFit scales width×height to fit within maxWidth×maxHeight keeping
+// the aspect ratio. Images are only enlarged if upscale is set.
+func scaleToFit(width, height, maxWidth, maxHeight int, upscale bool) (int, int) {
+	scale := float64(maxWidth) / float64(width)
+	if s := float64(maxHeight) / float64(height); s < scale {
+		scale = s
+	}
+	if scale >= 1 && !upscale {
+		return width, height
+	}
+	newWidth := int(float64(width)*scale + 0.5)
+	newHeight := int(float64(height)*scale + 0.5)
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	return newWidth, newHeight
+}
+
+// convertImage resizes a decoded target image as the export asks for. If
+// the aspect ratio of the target differs from the source's, stretch, fill
+// and pad record in item.adjustment that the image was stretched, cropped or
+// padded.
+func (svc *ExportService) convertImage(item *exportItem, img image.Image) image.Image {
+	options := svc.run.Options
+	filter := imaging.Lanczos
+	if f, ok := resampleFilters[options.Filter]; ok {
+		filter = f
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if sourceWidth, sourceHeight := item.source.Width, item.source.Height; sourceWidth > 0 && sourceHeight > 0 {
+		// The size the target scales to within the source's dimensions
+		fitWidth, fitHeight := scaleToFit(width, height, sourceWidth, sourceHeight, true)
+		sameAspect := fitWidth == sourceWidth && fitHeight == sourceHeight
+
+		switch options.Resize {
+		case ResizeSource:
+			img = resize(img, fitWidth, fitHeight, filter)
+		case ResizeStretch:
+			if !sameAspect {
+				item.adjustment = "stretched"
+			}
+			img = resize(img, sourceWidth, sourceHeight, filter)
+		case ResizeFill:
+			if !sameAspect {
+				item.adjustment = "cropped"
+			}
+			img = imaging.Fill(img, sourceWidth, sourceHeight, imaging.Center, filter)
+		case ResizePad:
+			img = resize(img, fitWidth, fitHeight, filter)
+			if !sameAspect {
+				item.adjustment = "padded"
+				background := color.NRGBA{}
+				if options.Background != "" {
+					background, _ = parseColor(options.Background)
+				}
+				img = imaging.PasteCenter(imaging.New(sourceWidth, sourceHeight, background), img)
+			}
+		}
+	}
+
+	bounds = img.Bounds()
+	width, height = svc.limitSize(bounds.Dx(), bounds.Dy())
+	return resize(img, width, height, filter)
+}
+
+// resize scales img to width×height unless it already has that size
+func resize(img image.Image, width, height int, filter imaging.ResampleFilter) image.Image {
+	if bounds := img.Bounds(); bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	return imaging.Resize(img, width, height, filter)
+}
+
+// encodeImage writes img in the format of outputPath. Transparent areas are
+// flattened onto the export's background color for JPEG, which has no
+// alpha channel (white by default), and for any format if a background is
+// set.
+func (svc *ExportService) encodeImage(output io.Writer, img image.Image, outputPath string) error {
+	options := svc.run.Options
+	ext := strings.ToLower(filepath.Ext(outputPath))
+	isJPEG := ext == ".jpg" || ext == ".jpeg"
+
+	if options.Background != "" || isJPEG {
+		background := color.NRGBA{255, 255, 255, 255}
+		if options.Background != "" {
+			background, _ = parseColor(options.Background)
+		}
+		img = flatten(img, background)
+	}
+
+	if ext == ".webp" {
+		quality := defaultWebPQuality
+		if options.Quality > 0 {
+			quality = options.Quality
+		}
+		return webp.Encode(output, img, &webp.Options{Quality: float32(quality)})
+	}
+
+	format, err := imaging.FormatFromFilename(outputPath)
+	if err != nil {
+		return err
+	}
+	quality := defaultJPEGQuality
+	if options.Quality > 0 {
+		quality = options.Quality
+	}
+	return imaging.Encode(output, img, format, imaging.JPEGQuality(quality))
+}
+
+// flatten draws img onto an opaque background
+func flatten(img image.Image, background color.NRGBA) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	bounds := img.Bounds()
+	canvas := imaging.New(bounds.Dx(), bounds.Dy(), background)
+	return imaging.Overlay(canvas, img, image.Pt(0, 0), 1.0)
+}
+
+// parseColor parses a hex color such as #fff, #ffffff or #ffffff80 (the #
+// is optional)
+func parseColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", value)
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", value)
+	}
+	return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/disintegration/imaging"
+)
+
+func TestScaleToFit(t *testing.T) {
+	tests := []struct {
+		width, height       int
+		maxWidth, maxHeight int
+		upscale             bool
+		wantWidth           int
+		wantHeight          int
+	}{
+		{width: 200, height: 100, maxWidth: 100, maxHeight: 100, wantWidth: 100, wantHeight: 50},
+		{width: 100, height: 200, maxWidth: 100, maxHeight: 100, wantWidth: 50, wantHeight: 100},
+		{width: 100, height: 100, maxWidth: 100, maxHeight: 100, wantWidth: 100, wantHeight: 100},
+		{width: 50, height: 25, maxWidth: 100, maxHeight: 100, wantWidth: 50, wantHeight: 25},
+		{width: 50, height: 25, maxWidth: 100, maxHeight: 100, upscale: true, wantWidth: 100, wantHeight: 50},
+		{width: 300, height: 200, maxWidth: 100, maxHeight: 200, wantWidth: 100, wantHeight: 67},
+		{width: 3, height: 2, maxWidth: 2, maxHeight: 2, wantWidth: 2, wantHeight: 1},
+		{width: 10000, height: 1, maxWidth: 100, maxHeight: 100, wantWidth: 100, wantHeight: 1},
+	}
+
+	for _, tt := range tests {
+		width, height := scaleToFit(tt.width, tt.height, tt.maxWidth, tt.maxHeight, tt.upscale)
+		if width != tt.wantWidth || height != tt.wantHeight {
+			t.Errorf("scaleToFit(%d, %d, %d, %d, %v) = %d×%d, want %d×%d",
+				tt.width, tt.height, tt.maxWidth, tt.maxHeight, tt.upscale,
+				width, height, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    color.NRGBA
+		wantErr bool
+	}{
+		{value: "#ffffff", want: color.NRGBA{255, 255, 255, 255}},
+		{value: "000000", want: color.NRGBA{0, 0, 0, 255}},
+		{value: "#f80", want: color.NRGBA{255, 136, 0, 255}},
+		{value: "#12345678", want: color.NRGBA{0x12, 0x34, 0x56, 0x78}},
+		{value: "#ABCDEF", want: color.NRGBA{0xab, 0xcd, 0xef, 255}},
+		{value: "", wantErr: true},
+		{value: "#ff", wantErr: true},
+		{value: "#fffff", wantErr: true},
+		{value: "#gggggg", wantErr: true},
+		{value: "white", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseColor(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseColor(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseColor(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConvertOptionsQuality(t *testing.T) {
+	tests := []struct {
+		quality int
+		wantErr bool
+	}{
+		{quality: 0},
+		{quality: 1},
+		{quality: 100},
+		{quality: -1, wantErr: true},
+		{quality: 101, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := ValidateConvertOptions(models.ExportOptions{Quality: tt.quality})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("quality %d: error = %v, wantErr %v", tt.quality, err, tt.wantErr)
+		}
+		// The error tells that 0 is accepted
+		if err != nil && !strings.Contains(err.Error(), "0 for the default") {
+			t.Errorf("quality %d: error %q does not mention the default", tt.quality, err)
+		}
+	}
+}
+
+func TestExportConvert(t *testing.T) {
+	project := createExportProject(t) // match.png is 24×16, the sources 32×32
+
+	tests := []struct {
+		name       string
+		options    models.ExportOptions
+		output     string
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "copy", output: "T/a.png", wantWidth: 24, wantHeight: 16},
+		{name: "format", options: models.ExportOptions{Format: "jpg", Quality: 80}, output: "T/a.jpg", wantWidth: 24, wantHeight: 16},
+		{name: "max width", options: models.ExportOptions{MaxWidth: 12}, output: "T/a.png", wantWidth: 12, wantHeight: 8},
+		{name: "max width larger", options: models.ExportOptions{MaxWidth: 100}, output: "T/a.png", wantWidth: 24, wantHeight: 16},
+		{name: "source size", options: models.ExportOptions{Resize: ResizeSource}, output: "T/a.png", wantWidth: 32, wantHeight: 21},
+		{name: "source size capped", options: models.ExportOptions{Resize: ResizeSource, MaxHeight: 10}, output: "T/a.png", wantWidth: 15, wantHeight: 10},
+	}
+
+	for _, tt := range tests {
+		options := tt.options
+		options.OutputPath = t.TempDir()
+		if _, err := runExport(t, project, options); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		img, err := imaging.Open(filepath.Join(options.OutputPath, filepath.FromSlash(tt.output)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+			t.Errorf("%s: exported %d×%d, want %d×%d", tt.name, b.Dx(), b.Dy(), tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestExportAdjustmentInManifest(t *testing.T) {
+	project := createExportProject(t)
+	output := t.TempDir()
+	if _, err := runExport(t, project, models.ExportOptions{OutputPath: output, Resize: ResizeFill, Manifest: ManifestJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(output, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Adjustment != "cropped" || entries[0].Method != "convert" {
+		t.Errorf("manifest entry = %+v, want a cropped conversion", entries[0])
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 255, 0})
+
+	flat := flatten(img, color.NRGBA{255, 0, 0, 255})
+	tests := []struct {
+		x    int
+		want color.NRGBA
+	}{
+		{x: 0, want: color.NRGBA{0, 0, 255, 255}},
+		{x: 1, want: color.NRGBA{255, 0, 0, 255}},
+	}
+	for _, tt := range tests {
+		if got := color.NRGBAModel.Convert(flat.At(tt.x, 0)); got != tt.want {
+			t.Errorf("pixel %d = %v, want %v", tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	blue := color.NRGBA{0, 0, 255, 255}
+	wide := imaging.New(24, 16, blue)
+	square := imaging.New(16, 16, blue)
+
+	tests := []struct {
+		name           string
+		options        models.ExportOptions
+		img            image.Image
+		wantWidth      int
+		wantHeight     int
+		wantAdjustment string
+		wantCorner     color.NRGBA // top left pixel
+	}{
+		{name: "none", img: wide, wantWidth: 24, wantHeight: 16, wantCorner: blue},
+		{name: "source", options: models.ExportOptions{Resize: ResizeSource}, img: wide, wantWidth: 32, wantHeight: 21, wantCorner: blue},
+		{name: "stretch", options: models.ExportOptions{Resize: ResizeStretch}, img: wide, wantWidth: 32, wantHeight: 32, wantAdjustment: "stretched", wantCorner: blue},
+		{name: "fill", options: models.ExportOptions{Resize: ResizeFill, Filter: "nearest"}, img: wide, wantWidth: 32, wantHeight: 32, wantAdjustment: "cropped", wantCorner: blue},
+		{name: "pad", options: models.ExportOptions{Resize: ResizePad}, img: wide, wantWidth: 32, wantHeight: 32, wantAdjustment: "padded"},
+		{name: "pad with background", options: models.ExportOptions{Resize: ResizePad, Background: "#ff0000"}, img: wide,
+			wantWidth: 32, wantHeight: 32, wantAdjustment: "padded", wantCorner: color.NRGBA{255, 0, 0, 255}},
+		{name: "same aspect", options: models.ExportOptions{Resize: ResizeStretch}, img: square, wantWidth: 32, wantHeight: 32, wantCorner: blue},
+		{name: "same aspect padded", options: models.ExportOptions{Resize: ResizePad}, img: square, wantWidth: 32, wantHeight: 32, wantCorner: blue},
+	}
+
+	for _, tt := range tests {
+		svc := &ExportService{run: &models.ExportRun{Options: tt.options}}
+		item := &exportItem{source: &models.SourceFile{Width: 32, Height: 32}}
+		img := svc.convertImage(item, tt.img)
+
+		if b := img.Bounds(); b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+			t.Errorf("%s: %d×%d, want %d×%d", tt.name, b.Dx(), b.Dy(), tt.wantWidth, tt.wantHeight)
+		}
+		if item.adjustment != tt.wantAdjustment {
+			t.Errorf("%s: adjustment %q, want %q", tt.name, item.adjustment, tt.wantAdjustment)
+		}
+		b := img.Bounds()
+		if got := color.NRGBAModel.Convert(img.At(b.Min.X, b.Min.Y)); got != tt.wantCorner {
+			t.Errorf("%s: corner %v, want %v", tt.name, got, tt.wantCorner)
+		}
+		if got := color.NRGBAModel.Convert(img.At(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2)); got != blue {
+			t.Errorf("%s: center %v, want the image", tt.name, got)
+		}
+	}
+
+	if err := ValidateConvertOptions(models.ExportOptions{Filter: "bicubic"}); err == nil {
+		t.Error("ValidateConvertOptions accepted an unknown filter")
+	}
+	if err := ValidateConvertOptions(models.ExportOptions{Resize: "fit"}); err == nil {
+		t.Error("ValidateConvertOptions accepted an unknown resize mode")
+	}
+
+	// A maximum size would break the source's exact dimensions
+	for _, resize := range []string{ResizeStretch, ResizeFill, ResizePad} {
+		if err := ValidateConvertOptions(models.ExportOptions{Resize: resize, MaxHeight: 16}); err == nil {
+			t.Errorf("ValidateConvertOptions accepted resize %s with a maximum size", resize)
+		}
+	}
+	if err := ValidateConvertOptions(models.ExportOptions{Resize: ResizeSource, MaxWidth: 16}); err != nil {
+		t.Errorf("ValidateConvertOptions rejected resize source with a maximum size: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/archive"
+	"github.com/bilibili/look-alike/internal/storage"
+)
+
+// Export modes: how a selected target file is put into the export folder
+const (
+	ExportCopy     = "copy"     // streaming copy (default)
+	ExportHardlink = "hardlink" // hard link, same volume only
+	ExportSymlink  = "symlink"  // symbolic link to the target file
+	ExportReflink  = "reflink"  // copy-on-write clone (Btrfs, XFS), Linux only
+	ExportMove     = "move"     // moves the target file, recorded in the export journal
+)
+
+// ValidExportMode reports whether mode is an export mode, or empty for copy
+func ValidExportMode(mode string) bool {
+	switch mode {
+	case "", ExportCopy, ExportHardlink, ExportSymlink, ExportReflink, ExportMove:
+		return true
+	}
+	return false
+}
+
+// placeFile puts src at dst using mode and returns the mode that was used.
+// Links need a plain local file; for remote files, archive entries and
+// links the filesystem refuses (e.g. a hard link across volumes) it falls
+// back to a streaming copy.
+func placeFile(ctx context.Context, src, dst, mode string) (string, error) {
+	local := !storage.IsRemote(src) && !archive.IsVirtual(src)
+	if local && mode != "" && mode != ExportCopy {
+		err := linkFile(ctx, src, dst, mode)
+		if err == nil {
+			return mode, nil
+		}
+		log.Printf("[EXPORT] Cannot %s %s, copying instead: %v", mode, src, err)
+	}
+	return ExportCopy, copyFile(ctx, src, dst)
+}
+
+// linkFile links or clones src to dst, replacing dst
+func linkFile(ctx context.Context, src, dst, mode string) error {
+	switch mode {
+	case ExportHardlink, ExportSymlink:
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return err
+		}
+		tmp := tempName(dst)
+		if mode == ExportHardlink {
+			// rename is a no-op when dst already links to src and would
+			// leave tmp behind
+			if sameFile(absSrc, dst) {
+				return nil
+			}
+			err = os.Link(absSrc, tmp)
+		} else {
+			// A link to a missing file would be written without complaint
+			if _, err := os.Stat(absSrc); err != nil {
+				return err
+			}
+			err = os.Symlink(absSrc, tmp)
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	case ExportReflink:
+		input, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		return writeFile(dst, modTime(ctx, src), func(output *os.File) error {
+			return reflink(input, output)
+		})
+	default:
+		return fmt.Errorf("unknown export mode: %s", mode)
+	}
+}
+
+// sameFile reports whether a and b are the same file on disk
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Lstat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+// copyFile streams src to dst and keeps its modification time. src may
+// live on any storage backend.
+func copyFile(ctx context.Context, src, dst string) error {
+	input, err := storage.OpenContext(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	return writeFile(dst, modTime(ctx, src), func(output *os.File) error {
+		_, err := io.Copy(output, input)
+		return err
+	})
+}
+
+// writeFile writes dst through a temporary file in the same folder that
+// replaces dst once complete. An earlier export's hard link or symlink at
+// dst is replaced, never written through. A non-zero mtime is applied to
+// the new file.
+func writeFile(dst string, mtime time.Time, write func(output *os.File) error) error {
+	tmp := tempName(dst)
+	output, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := write(output); err != nil {
+		output.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !mtime.IsZero() {
+		os.Chtimes(tmp, mtime, mtime)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// tempName returns a hidden name next to path for writing it atomically
+func tempName(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d.tmp", filepath.Base(path), time.Now().UnixNano()))
+}
+
+// modTime returns the modification time of a file on any storage backend,
+// or the zero time if it is unknown
+func modTime(ctx context.Context, path string) time.Time {
+	info, err := storage.StatContext(ctx, path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
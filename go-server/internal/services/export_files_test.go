@@ -0,0 +1,138 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/archive"
+)
+
+func TestPlaceFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.png")
+	if err := os.WriteFile(src, []byte("target file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(src, mtime, mtime)
+	srcInfo, _ := os.Stat(src)
+
+	tests := []struct {
+		mode  string
+		check func(dst string, info os.FileInfo) bool
+	}{
+		{mode: "", check: func(dst string, info os.FileInfo) bool {
+			return !os.SameFile(info, srcInfo) && info.ModTime().Equal(mtime)
+		}},
+		{mode: ExportCopy, check: func(dst string, info os.FileInfo) bool {
+			return !os.SameFile(info, srcInfo) && info.ModTime().Equal(mtime)
+		}},
+		{mode: ExportHardlink, check: func(dst string, info os.FileInfo) bool {
+			return os.SameFile(info, srcInfo)
+		}},
+		{mode: ExportSymlink, check: func(dst string, info os.FileInfo) bool {
+			link, err := os.Readlink(dst)
+			return info.Mode()&os.ModeSymlink != 0 && err == nil && link == src
+		}},
+		{mode: ExportReflink, check: func(dst string, info os.FileInfo) bool {
+			return !os.SameFile(info, srcInfo) && info.ModTime().Equal(mtime)
+		}},
+	}
+
+	for _, tt := range tests {
+		dst := filepath.Join(t.TempDir(), "dst.png")
+		used, err := placeFile(context.Background(), src, dst, tt.mode)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.mode, err)
+		}
+		// Reflinks need a copy-on-write filesystem, elsewhere they fall
+		// back to a copy
+		want := tt.mode
+		if want == "" || (want == ExportReflink && used == ExportCopy) {
+			want = ExportCopy
+		}
+		if used != want {
+			t.Errorf("%q: placed with %s, want %s", tt.mode, used, want)
+		}
+		info, err := os.Lstat(dst)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.mode, err)
+		}
+		if !tt.check(dst, info) {
+			t.Errorf("%q: unexpected output %v", tt.mode, info)
+		}
+		if data, err := os.ReadFile(dst); err != nil || string(data) != "target file" {
+			t.Errorf("%q: output holds %q, %v", tt.mode, data, err)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(dst)); len(entries) != 1 {
+			t.Errorf("%q: %d files left in the output folder, want 1", tt.mode, len(entries))
+		}
+	}
+}
+
+func TestPlaceFileFallsBackToCopy(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bundle.zip")
+	f, err := os.Create(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("a.png")
+	w.Write([]byte("archive entry"))
+	zw.Close()
+	f.Close()
+
+	// Archive entries cannot be linked
+	for _, mode := range []string{ExportHardlink, ExportSymlink, ExportReflink} {
+		dst := filepath.Join(t.TempDir(), "a.png")
+		used, err := placeFile(context.Background(), archive.Join(bundle, "a.png"), dst, mode)
+		if err != nil || used != ExportCopy {
+			t.Errorf("%s of an archive entry = %s, %v, want a copy", mode, used, err)
+		}
+		if data, _ := os.ReadFile(dst); string(data) != "archive entry" {
+			t.Errorf("%s of an archive entry wrote %q", mode, data)
+		}
+	}
+
+	// A file linked by an earlier export is replaced, not written through
+	src := filepath.Join(dir, "src.png")
+	os.WriteFile(src, []byte("original"), 0644)
+	other := filepath.Join(dir, "other.png")
+	os.WriteFile(other, []byte("other"), 0644)
+	dst := filepath.Join(t.TempDir(), "dst.png")
+	if _, err := placeFile(context.Background(), src, dst, ExportHardlink); err != nil {
+		t.Fatal(err)
+	}
+
+	// Linking again to the same file leaves nothing behind
+	if _, err := placeFile(context.Background(), src, dst, ExportHardlink); err != nil {
+		t.Errorf("relinking = %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(dst)); len(entries) != 1 {
+		t.Errorf("relinking left %d files, want 1", len(entries))
+	}
+
+	if _, err := placeFile(context.Background(), other, dst, ExportCopy); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(src); string(data) != "original" {
+		t.Errorf("copy wrote through the hard link, source holds %q", data)
+	}
+
+	// A missing source fails in every mode and writes nothing, not even a
+	// dangling symlink
+	for _, mode := range []string{ExportCopy, ExportHardlink, ExportSymlink, ExportReflink} {
+		missingDst := filepath.Join(t.TempDir(), "missing.png")
+		if _, err := placeFile(context.Background(), filepath.Join(dir, "missing.png"), missingDst, mode); err == nil {
+			t.Errorf("%s of a missing file succeeded", mode)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(missingDst)); len(entries) != 0 {
+			t.Errorf("%s of a missing file left %d files", mode, len(entries))
+		}
+	}
+}
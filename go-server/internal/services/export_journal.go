@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/archive"
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+// ValidateMoveOptions checks the options of a move-mode export. Moved files
+// are restored by undo, so the export neither converts nor resizes them
+// (which would leave nothing to restore) nor asks to overwrite existing
+// output files (which undo could not bring back).
+func ValidateMoveOptions(options models.ExportOptions) error {
+	if options.Mode != ExportMove {
+		return nil
+	}
+	if options.Format != "" || options.Quality != 0 || options.Resize != "" || options.Filter != "" ||
+		options.MaxWidth > 0 || options.MaxHeight > 0 {
+		return fmt.Errorf("move exports cannot convert or resize files; drop format, quality, resize, filter, max_width and max_height or use another mode")
+	}
+	if options.OnConflict == ConflictOverwrite {
+		return fmt.Errorf("move exports never overwrite existing files; use on_conflict skip, rename or fail")
+	}
+	return nil
+}
+
+// loadJournal reads the files an earlier attempt of this run already moved,
+// so a resumed move-mode export neither moves them twice nor reports them
+// as missing
+func (svc *ExportService) loadJournal() error {
+	var entries []models.ExportJournalEntry
+	if err := database.DB.Where("export_run_id = ? AND state IN ?", svc.run.ID, []string{"pending", "moved"}).
+		Order("id").Find(&entries).Error; err != nil {
+		return err
+	}
+
+	svc.moved = make(map[string]string, len(entries))
+	for i := range entries {
+		if resolvePending(&entries[i]) == "moved" {
+			svc.moved[entries[i].FromPath] = entries[i].ToPath
+		}
+	}
+	return nil
+}
+
+// moveTarget moves a target file into the export folder and journals the
+// move. A target selected by several source files is moved once and
+// copied from its new place for the others. Remote files and archive
+// entries cannot be moved and are copied.
+func (svc *ExportService) moveTarget(src, dst string) (string, error) {
+	if storage.IsRemote(src) || archive.IsVirtual(src) {
+		return ExportCopy, copyFile(svc.ctx, src, dst)
+	}
+
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return "", err
+	}
+	if movedTo, ok := svc.moved[src]; ok {
+		if movedTo == absDst {
+			return ExportMove, nil
+		}
+		return ExportCopy, copyFile(svc.ctx, movedTo, dst)
+	}
+
+	// Undo moves the file back, so never replace a file it could not restore
+	if _, err := os.Lstat(absDst); err == nil {
+		return "", fmt.Errorf("%s already exists", absDst)
+	}
+
+	entry := models.ExportJournalEntry{
+		ExportRunID: svc.run.ID,
+		FromPath:    src,
+		ToPath:      absDst,
+		State:       "pending",
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		return "", fmt.Errorf("failed to write export journal: %w", err)
+	}
+
+	if err := moveFile(svc.ctx, src, absDst); err != nil {
+		setJournalState(&entry, "failed", err)
+		return "", err
+	}
+	setJournalState(&entry, "moved", nil)
+	svc.moved[src] = absDst
+	return ExportMove, nil
+}
+
+// resolvePending decides what happened to a move that was interrupted
+// before its journal entry was updated, stores the outcome and returns the
+// entry's state. A move that copied across volumes but did not remove the
+// original yet is completed.
+func resolvePending(entry *models.ExportJournalEntry) string {
+	if entry.State != "pending" {
+		return entry.State
+	}
+
+	_, fromErr := os.Lstat(entry.FromPath)
+	_, toErr := os.Lstat(entry.ToPath)
+	switch {
+	case toErr == nil && fromErr != nil:
+		setJournalState(entry, "moved", nil)
+	case toErr == nil:
+		// copyFile renames the copy into place only once it is complete
+		if err := os.Remove(entry.FromPath); err != nil {
+			setJournalState(entry, "failed", err)
+		} else {
+			setJournalState(entry, "moved", nil)
+		}
+	default:
+		setJournalState(entry, "failed", fmt.Errorf("the move was interrupted before it started"))
+	}
+	return entry.State
+}
+
+// setJournalState stores the state of a journal entry
+func setJournalState(entry *models.ExportJournalEntry, state string, err error) {
+	entry.State = state
+	entry.Error = nil
+	if err != nil {
+		msg := err.Error()
+		entry.Error = &msg
+	}
+	database.DB.Model(entry).Updates(map[string]interface{}{
+		"state": entry.State,
+		"error": entry.Error,
+	})
+}
+
+// MovedFilesExport returns the ID of a move-mode export of the project
+// whose files are not back in place, or 0. Target files and candidates of
+// such an export point at paths that no longer exist until it is undone.
+func MovedFilesExport(projectID uint) (uint, error) {
+	var runIDs []uint
+	err := database.DB.Model(&models.ExportJournalEntry{}).
+		Joins("INNER JOIN export_runs ON export_runs.id = export_journal.export_run_id").
+		Where("export_runs.project_id = ? AND export_journal.state IN ?", projectID, []string{"pending", "moved"}).
+		Limit(1).
+		Pluck("export_journal.export_run_id", &runIDs).Error
+	if err != nil || len(runIDs) == 0 {
+		return 0, err
+	}
+	return runIDs[0], nil
+}
+
+// UndoExport moves the files of a move-mode export back to where they were,
+// newest first, and returns how many were restored. Files whose original
+// path is taken again are left in place and reported; the undo can be
+// repeated once the path is free.
+func UndoExport(run *models.ExportRun) (int, error) {
+	if run.Options.Mode != ExportMove {
+		return 0, fmt.Errorf("export %d did not move files", run.ID)
+	}
+
+	var job models.Job
+	if err := database.DB.First(&job, run.JobID).Error; err == nil {
+		switch job.State {
+		case workers.JobQueued, workers.JobRunning, workers.JobPaused:
+			return 0, fmt.Errorf("export %d is %s, cancel it before undoing it", run.ID, job.State)
+		}
+	}
+
+	var entries []models.ExportJournalEntry
+	if err := database.DB.Where("export_run_id = ? AND state IN ?", run.ID, []string{"pending", "moved"}).
+		Order("id DESC").Find(&entries).Error; err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	var failures []string
+	for i := range entries {
+		entry := &entries[i]
+		if resolvePending(entry) != "moved" {
+			continue
+		}
+
+		err := restoreFile(entry)
+		if err != nil {
+			log.Printf("[EXPORT] Failed to restore %s: %v", entry.FromPath, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", entry.FromPath, err))
+			continue
+		}
+		setJournalState(entry, "restored", nil)
+		restored++
+	}
+
+	if len(failures) > 0 {
+		failed := len(failures)
+		if len(failures) > 3 {
+			failures = failures[:3]
+		}
+		return restored, fmt.Errorf("%d of %d files could not be restored, e.g. %s",
+			failed, failed+restored, strings.Join(failures, "; "))
+	}
+
+	now := time.Now()
+	run.UndoneAt = &now
+	if err := database.DB.Model(run).Update("undone_at", now).Error; err != nil {
+		return restored, err
+	}
+	log.Printf("[EXPORT] Export %d undone: %d files restored", run.ID, restored)
+	return restored, nil
+}
+
+// restoreFile moves a journaled file back to its original path
+func restoreFile(entry *models.ExportJournalEntry) error {
+	if _, err := os.Lstat(entry.FromPath); err == nil {
+		return fmt.Errorf("%s exists again", entry.FromPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.FromPath), 0755); err != nil {
+		return err
+	}
+	return moveFile(context.Background(), entry.ToPath, entry.FromPath)
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+func TestValidateMoveOptions(t *testing.T) {
+	tests := []struct {
+		options models.ExportOptions
+		valid   bool
+	}{
+		{options: models.ExportOptions{Mode: ExportMove}, valid: true},
+		{options: models.ExportOptions{Mode: ExportMove, OnConflict: ConflictRename}, valid: true},
+		{options: models.ExportOptions{Mode: ExportMove, OnConflict: ConflictOverwrite}},
+		{options: models.ExportOptions{Mode: ExportMove, Format: "jpg"}},
+		{options: models.ExportOptions{Mode: ExportMove, Quality: 80}},
+		{options: models.ExportOptions{Mode: ExportMove, Resize: ResizeSource}},
+		{options: models.ExportOptions{Mode: ExportMove, Filter: "nearest"}},
+		{options: models.ExportOptions{Mode: ExportMove, MaxWidth: 100}},
+		{options: models.ExportOptions{Format: "jpg", OnConflict: ConflictOverwrite}, valid: true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateMoveOptions(tt.options); (err == nil) != tt.valid {
+			t.Errorf("%+v: ValidateMoveOptions = %v, want valid %v", tt.options, err, tt.valid)
+		}
+	}
+}
+
+func TestResolvePending(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     string
+		fromExist bool
+		toExist   bool
+		want      string
+		wantFrom  bool // the original is still there afterwards
+		wantError bool
+	}{
+		{name: "finished entries are kept", state: "moved", toExist: true, want: "moved"},
+		{name: "failed entries are kept", state: "failed", fromExist: true, want: "failed", wantFrom: true},
+		{name: "renamed", state: "pending", toExist: true, want: "moved"},
+		{name: "copied but not removed", state: "pending", fromExist: true, toExist: true, want: "moved"},
+		{name: "not started", state: "pending", fromExist: true, want: "failed", wantFrom: true, wantError: true},
+		{name: "both missing", state: "pending", want: "failed", wantError: true},
+	}
+
+	run := models.ExportRun{Options: models.ExportOptions{Mode: ExportMove}}
+	if err := database.DB.Create(&run).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		entry := models.ExportJournalEntry{
+			ExportRunID: run.ID,
+			FromPath:    filepath.Join(dir, "from.png"),
+			ToPath:      filepath.Join(dir, "export", "to.png"),
+			State:       tt.state,
+		}
+		if tt.fromExist {
+			os.WriteFile(entry.FromPath, []byte("from"), 0644)
+		}
+		if tt.toExist {
+			os.MkdirAll(filepath.Dir(entry.ToPath), 0755)
+			os.WriteFile(entry.ToPath, []byte("to"), 0644)
+		}
+		if err := database.DB.Create(&entry).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if got := resolvePending(&entry); got != tt.want {
+			t.Errorf("%s: resolvePending = %q, want %q", tt.name, got, tt.want)
+		}
+		if _, err := os.Lstat(entry.FromPath); (err == nil) != tt.wantFrom {
+			t.Errorf("%s: original exists = %v, want %v", tt.name, err == nil, tt.wantFrom)
+		}
+
+		var stored models.ExportJournalEntry
+		if err := database.DB.First(&stored, entry.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.State != tt.want {
+			t.Errorf("%s: stored state = %q, want %q", tt.name, stored.State, tt.want)
+		}
+		if (stored.Error != nil) != tt.wantError {
+			t.Errorf("%s: stored error = %v, wantError %v", tt.name, stored.Error, tt.wantError)
+		}
+	}
+}
+
+func TestMoveExportAndUndo(t *testing.T) {
+	project := createExportProject(t)
+	targetFile := filepath.Join(project.ProjectTargets[0].Path, "match.png")
+	output := t.TempDir()
+	exported := filepath.Join(output, "T", "a.png")
+
+	run, err := runExport(t, project, models.ExportOptions{OutputPath: output, Mode: ExportMove})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(targetFile); !os.IsNotExist(err) {
+		t.Errorf("target file not moved: %v", err)
+	}
+	if _, err := os.Stat(exported); err != nil {
+		t.Errorf("moved file not in the export folder: %v", err)
+	}
+
+	if runID, err := MovedFilesExport(project.ID); err != nil || runID != run.ID {
+		t.Errorf("MovedFilesExport = %d, %v, want %d", runID, err, run.ID)
+	}
+
+	restored, err := UndoExport(run)
+	if err != nil || restored != 1 {
+		t.Fatalf("UndoExport = %d, %v, want 1 file restored", restored, err)
+	}
+	if _, err := os.Stat(targetFile); err != nil {
+		t.Errorf("target file not restored: %v", err)
+	}
+	if _, err := os.Stat(exported); !os.IsNotExist(err) {
+		t.Errorf("restored file still in the export folder: %v", err)
+	}
+	if run.UndoneAt == nil {
+		t.Error("undone export has no undone_at")
+	}
+	if runID, err := MovedFilesExport(project.ID); err != nil || runID != 0 {
+		t.Errorf("MovedFilesExport after undo = %d, %v, want 0", runID, err)
+	}
+
+	// Copies leave the targets alone and cannot be undone
+	copied, err := runExport(t, project, models.ExportOptions{OutputPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UndoExport(copied); err == nil {
+		t.Error("undoing a copy export succeeded")
+	}
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// DefaultLayout is the export layout used when none is given:
+// <source rel dir>/<target name>/<source file name>
+const DefaultLayout = "{rel_dir}/{target}/{stem}.{ext}"
+
+// layoutVariables are the variables an export layout may use
+var layoutVariables = map[string]bool{
+	"target":   true, // target name
+	"rel_dir":  true, // directory of the source file relative to the source folder
+	"rel_path": true, // source path relative to the source folder, without extension
+	"stem":     true, // source file name without extension
+	"ext":      true, // source file extension without the dot
+	"score":    true, // similarity score of the selected candidate, rounded
+	"rank":     true, // rank of the selected candidate within its target
+}
+
+// layoutPart is a literal or a variable of a parsed layout
+type layoutPart struct {
+	literal  string
+	variable string
+}
+
+// exportLayout is a parsed output path template such as
+// "{target}/{rel_dir}/{stem}.{ext}"
+type exportLayout struct {
+	parts []layoutPart
+}
+
+// ParseLayout parses an export layout. Variables are written as {name};
+// the result must be a relative path that stays inside the export folder.
+func ParseLayout(layout string) (*exportLayout, error) {
+	if layout == "" {
+		layout = DefaultLayout
+	}
+
+	parsed := &exportLayout{}
+	hasName := false
+	rest := layout
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			parsed.parts = append(parsed.parts, layoutPart{literal: rest})
+			break
+		}
+		if open > 0 {
+			parsed.parts = append(parsed.parts, layoutPart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in layout %q", layout)
+		}
+		name := rest[open+1 : open+end]
+		if !layoutVariables[name] {
+			return nil, fmt.Errorf("unknown layout variable {%s}", name)
+		}
+		if name == "stem" || name == "rel_path" {
+			hasName = true
+		}
+		parsed.parts = append(parsed.parts, layoutPart{variable: name})
+		rest = rest[open+end+1:]
+	}
+
+	for _, part := range parsed.parts {
+		if strings.Contains(part.literal, "}") {
+			return nil, fmt.Errorf("unexpected } in layout %q", layout)
+		}
+	}
+	if strings.HasPrefix(layout, "/") || filepath.IsAbs(layout) {
+		return nil, fmt.Errorf("layout %q must be relative to the export folder", layout)
+	}
+	for _, segment := range strings.Split(layout, "/") {
+		if segment == ".." {
+			return nil, fmt.Errorf("layout %q must not leave the export folder", layout)
+		}
+	}
+	if !hasName {
+		return nil, fmt.Errorf("layout %q must contain {stem} or {rel_path}, otherwise source files overwrite each other", layout)
+	}
+	return parsed, nil
+}
+
+// layoutValues are the values of the layout variables for one export item
+type layoutValues struct {
+	target  string
+	relPath string // flattened source path relative to the source folder
+	score   *float64
+	rank    int
+}
+
+// expand returns the output path of an item relative to the export folder
+func (l *exportLayout) expand(values layoutValues) string {
+	relPath := filepath.ToSlash(values.relPath)
+	ext := path.Ext(relPath)
+	relDir := path.Dir(relPath)
+	stem := strings.TrimSuffix(path.Base(relPath), ext)
+
+	var b strings.Builder
+	for _, part := range l.parts {
+		switch part.variable {
+		case "":
+			b.WriteString(part.literal)
+		case "target":
+			b.WriteString(targetSegment(values.target))
+		case "rel_dir":
+			// "." is the source folder itself and cleaned away below
+			if relDir == "." {
+				b.WriteString(relDir)
+			} else {
+				b.WriteString(safePath(relDir))
+			}
+		case "rel_path":
+			b.WriteString(safePath(strings.TrimSuffix(relPath, ext)))
+		case "stem":
+			b.WriteString(safePath(stem))
+		case "ext":
+			b.WriteString(strings.TrimPrefix(ext, "."))
+		case "score":
+			if values.score != nil {
+				fmt.Fprintf(&b, "%.0f", *values.score)
+			}
+		case "rank":
+			if values.rank > 0 {
+				fmt.Fprintf(&b, "%d", values.rank)
+			}
+		}
+	}
+
+	// Files without extension do not end in a dot
+	expanded := strings.TrimSuffix(path.Clean(b.String()), ".")
+	return filepath.FromSlash(expanded)
+}
+
+// targetSegment returns a target name as a single path segment
+func targetSegment(target string) string {
+	return safePath(strings.NewReplacer("/", "_", "\\", "_").Replace(target))
+}
+
+// safePath replaces "." and ".." segments of a substituted value, so no
+// value can lead out of the export folder
+func safePath(value string) string {
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		if segment == "." || segment == ".." {
+			segments[i] = strings.Repeat("_", len(segment))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// LayoutCollision is an output path that more than one export item maps to
+type LayoutCollision struct {
+	OutputPath string   `json:"output_path"`
+	Sources    []string `json:"sources"` // "<source rel path> (<target>)" of every item writing the path
+}
+
+// findCollisions returns the output paths written by more than one item.
+// With foldCase, paths differing only in case collide too, as they do on
+// Windows and macOS; such a collision is reported under the first of them.
+func findCollisions(items []exportItem, foldCase bool) []LayoutCollision {
+	var collisions []LayoutCollision
+	for _, group := range groupOutputs(items, foldCase) {
+		if len(group.Sources) > 1 {
+			collisions = append(collisions, group.LayoutCollision)
+		}
+	}
+	return sortCollisions(collisions)
+}
+
+// findCaseCollisions returns the output paths that differ only in case from
+// another item's output path. They are distinct files on a case-sensitive
+// file system, but overwrite each other when copied to a case-insensitive
+// one.
+func findCaseCollisions(items []exportItem) []LayoutCollision {
+	var collisions []LayoutCollision
+	for _, group := range groupOutputs(items, true) {
+		if len(group.paths) > 1 {
+			collisions = append(collisions, group.LayoutCollision)
+		}
+	}
+	return sortCollisions(collisions)
+}
+
+// outputGroup is the items writing one output path, and the spellings of
+// the path they use
+type outputGroup struct {
+	LayoutCollision
+	paths map[string]bool
+}
+
+// groupOutputs groups the items that write a file by their output path,
+// ignoring case with foldCase
+func groupOutputs(items []exportItem, foldCase bool) map[string]*outputGroup {
+	groups := make(map[string]*outputGroup)
+	for _, item := range items {
+		if item.outputPath == "" {
+			continue
+		}
+		outputPath := filepath.ToSlash(item.outputPath)
+		key := outputPath
+		if foldCase {
+			key = strings.ToLower(outputPath)
+		}
+		if groups[key] == nil {
+			groups[key] = &outputGroup{LayoutCollision: LayoutCollision{OutputPath: outputPath}, paths: make(map[string]bool)}
+		}
+		groups[key].Sources = append(groups[key].Sources, fmt.Sprintf("%s (%s)", item.source.RelativePath, item.targetName))
+		groups[key].paths[outputPath] = true
+	}
+	return groups
+}
+
+// sortCollisions sorts collisions by output path
+func sortCollisions(collisions []LayoutCollision) []LayoutCollision {
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i].OutputPath < collisions[j].OutputPath
+	})
+	return collisions
+}
+
+// caseInsensitive reports whether the file system holding dir, or the
+// nearest existing folder above it, ignores case in file names. It creates
+// a probe file and looks it up in upper case; if that is not possible it
+// assumes the default of the operating system.
+func caseInsensitive(dir string) bool {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	probe, err := os.CreateTemp(dir, ".lookalike-case-")
+	if err != nil {
+		return caseInsensitiveOS()
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name()))))
+	return err == nil
+}
+
+// caseInsensitiveOS reports whether the default file system of the
+// operating system ignores case, as on Windows and macOS
+func caseInsensitiveOS() bool {
+	return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		layout  string
+		wantErr bool
+	}{
+		{layout: ""},
+		{layout: DefaultLayout},
+		{layout: "{target}/{rel_path}.{ext}"},
+		{layout: "{target}/{stem}_{score}_{rank}.{ext}"},
+		{layout: "flat/{stem}"},
+		{layout: "{target}/{ext}", wantErr: true},
+		{layout: "{target}/{stem", wantErr: true},
+		{layout: "{target}/stem}.{ext}", wantErr: true},
+		{layout: "{unknown}/{stem}", wantErr: true},
+		{layout: "/abs/{stem}", wantErr: true},
+		{layout: "../{stem}", wantErr: true},
+		{layout: "{target}/../{stem}", wantErr: true},
+		{layout: "{target}/..{stem}"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseLayout(tt.layout)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLayout(%q) error = %v, wantErr %v", tt.layout, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLayoutExpand(t *testing.T) {
+	score := 87.6
+	tests := []struct {
+		layout string
+		values layoutValues
+		want   string
+	}{
+		{
+			layout: DefaultLayout,
+			values: layoutValues{target: "A", relPath: "dir/sub/a.png"},
+			want:   "dir/sub/A/a.png",
+		},
+		{
+			layout: DefaultLayout,
+			values: layoutValues{target: "A", relPath: "a.png"},
+			want:   "A/a.png",
+		},
+		{
+			layout: "{target}/{rel_path}.{ext}",
+			values: layoutValues{target: "A", relPath: "dir/a.b.jpg"},
+			want:   "A/dir/a.b.jpg",
+		},
+		{
+			layout: "{target}/{stem}.{ext}",
+			values: layoutValues{target: "A", relPath: "dir/README"},
+			want:   "A/README",
+		},
+		{
+			layout: "{stem}_{score}_{rank}.{ext}",
+			values: layoutValues{target: "A", relPath: "a.png", score: &score, rank: 2},
+			want:   "a_88_2.png",
+		},
+		{
+			layout: "{stem}_{score}_{rank}.{ext}",
+			values: layoutValues{target: "A", relPath: "a.png"},
+			want:   "a__.png",
+		},
+		{
+			layout: "{target}/{stem}.{ext}",
+			values: layoutValues{target: "x/../y", relPath: "a.png"},
+			want:   "x_.._y/a.png",
+		},
+		{
+			layout: "{target}/{stem}.{ext}",
+			values: layoutValues{target: "..", relPath: "a.png"},
+			want:   "__/a.png",
+		},
+		{
+			layout: DefaultLayout,
+			values: layoutValues{target: "A", relPath: "../../etc/a.png"},
+			want:   "__/__/etc/A/a.png",
+		},
+		{
+			layout: "{target}/{rel_path}.{ext}",
+			values: layoutValues{target: "A", relPath: "./x/../a.png"},
+			want:   "A/_/x/__/a.png",
+		},
+		{
+			layout: "{target}/{stem}.{ext}",
+			values: layoutValues{target: "A", relPath: "dir/...png"},
+			want:   "A/__.png",
+		},
+	}
+
+	for _, tt := range tests {
+		layout, err := ParseLayout(tt.layout)
+		if err != nil {
+			t.Fatalf("ParseLayout(%q) = %v", tt.layout, err)
+		}
+		got := layout.expand(tt.values)
+		if got != filepath.FromSlash(tt.want) {
+			t.Errorf("%q.expand(%+v) = %q, want %q", tt.layout, tt.values, got, tt.want)
+		}
+		if !filepath.IsLocal(got) {
+			t.Errorf("%q.expand(%+v) = %q leaves the export folder", tt.layout, tt.values, got)
+		}
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "a/b", want: "a/b"},
+		{value: "..", want: "__"},
+		{value: ".", want: "_"},
+		{value: "a/../b", want: "a/__/b"},
+		{value: "..a/b..", want: "..a/b.."},
+		{value: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := safePath(tt.value); got != tt.want {
+			t.Errorf("safePath(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFindCollisions(t *testing.T) {
+	item := func(source, outputPath string) exportItem {
+		return exportItem{source: &models.SourceFile{RelativePath: source}, targetName: "T", outputPath: outputPath}
+	}
+	items := []exportItem{
+		item("a.png", "T/a.png"),
+		item("sub/a.png", "T/a.png"),
+		item("B.png", "T/B.png"),
+		item("b.png", "T/b.png"),
+		item("c.png", "T/c.png"),
+		item("skipped.png", ""),
+		item("also-skipped.png", ""),
+	}
+
+	exact := []LayoutCollision{
+		{OutputPath: "T/a.png", Sources: []string{"a.png (T)", "sub/a.png (T)"}},
+	}
+	if got := findCollisions(items, false); !reflect.DeepEqual(got, exact) {
+		t.Errorf("findCollisions = %v, want %v", got, exact)
+	}
+
+	folded := []LayoutCollision{
+		{OutputPath: "T/B.png", Sources: []string{"B.png (T)", "b.png (T)"}},
+		{OutputPath: "T/a.png", Sources: []string{"a.png (T)", "sub/a.png (T)"}},
+	}
+	if got := findCollisions(items, true); !reflect.DeepEqual(got, folded) {
+		t.Errorf("findCollisions folding case = %v, want %v", got, folded)
+	}
+
+	caseOnly := []LayoutCollision{
+		{OutputPath: "T/B.png", Sources: []string{"B.png (T)", "b.png (T)"}},
+	}
+	if got := findCaseCollisions(items); !reflect.DeepEqual(got, caseOnly) {
+		t.Errorf("findCaseCollisions = %v, want %v", got, caseOnly)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	dir := t.TempDir()
+	want := caseInsensitive(dir)
+
+	// Folders that do not exist yet are probed at their nearest parent
+	if got := caseInsensitive(filepath.Join(dir, "new", "export")); got != want {
+		t.Errorf("caseInsensitive of a missing folder = %v, want %v", got, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("probe left %d files behind", len(entries))
+	}
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Manifest formats
+const (
+	ManifestCSV  = "csv"
+	ManifestJSON = "json"
+	ManifestBoth = "both"
+)
+
+// manifestName is the file name of the manifest in the export folder,
+// without extension
+const manifestName = "manifest"
+
+// ManifestEntry describes one selection of an exported source file
+type ManifestEntry struct {
+	SourcePath  string   `json:"source_path"` // relative to the source folder
+	TargetName  string   `json:"target_name"`
+	TargetPath  string   `json:"target_path"` // selected target file, empty for no-match selections
+	Score       *float64 `json:"score"`
+	Confirmed   bool     `json:"confirmed"`
+	Placeholder bool     `json:"placeholder"`
+	OutputPath  string   `json:"output_path"`          // relative to the export folder, empty when nothing was written
+	Method      string   `json:"method,omitempty"`     // copy, hardlink, symlink, reflink, move, convert or placeholder; empty for files of an earlier run
+	Adjustment  string   `json:"adjustment,omitempty"` // stretched, cropped or padded when resizing to the source changed the aspect ratio
+	Status      string   `json:"status"`               // exported, no_match, skipped, failed
+	Error       string   `json:"error,omitempty"`
+}
+
+// ValidManifestFormat reports whether format is a manifest format, or empty
+// for no manifest
+func ValidManifestFormat(format string) bool {
+	switch format {
+	case "", ManifestCSV, ManifestJSON, ManifestBoth:
+		return true
+	}
+	return false
+}
+
+// newManifestEntry records the outcome of an export item
+func newManifestEntry(item exportItem, err error) ManifestEntry {
+	entry := ManifestEntry{
+		SourcePath:  item.source.RelativePath,
+		TargetName:  item.targetName,
+		TargetPath:  item.targetPath,
+		Score:       item.score,
+		Confirmed:   item.source.SourceConfirmation != nil && item.source.SourceConfirmation.Confirmed,
+		Placeholder: item.placeholder,
+		OutputPath:  filepath.ToSlash(item.outputPath),
+		Method:      item.method,
+		Adjustment:  item.adjustment,
+		Status:      "exported",
+	}
+	switch {
+	case err != nil:
+		entry.Status = "failed"
+		entry.Error = err.Error()
+	case item.outputPath == "":
+		entry.Status = "no_match"
+	case item.skipped:
+		entry.Status = "skipped"
+	}
+	return entry
+}
+
+// writeManifest writes the manifest in the formats the export asked for
+func (svc *ExportService) writeManifest(entries []ManifestEntry) error {
+	format := svc.run.Options.Manifest
+	if format == ManifestCSV || format == ManifestBoth {
+		if err := svc.writeOutput(manifestName+".csv", time.Now(), func(output io.Writer) error {
+			return writeManifestCSV(output, entries)
+		}); err != nil {
+			return err
+		}
+	}
+	if format == ManifestJSON || format == ManifestBoth {
+		if err := svc.writeOutput(manifestName+".json", time.Now(), func(output io.Writer) error {
+			return writeManifestJSON(output, entries)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeManifestCSV(output io.Writer, entries []ManifestEntry) error {
+	w := csv.NewWriter(output)
+	w.Write([]string{"source_path", "target_name", "target_path", "score", "confirmed", "placeholder", "output_path", "method", "adjustment", "status", "error"})
+	for _, entry := range entries {
+		score := ""
+		if entry.Score != nil {
+			score = fmt.Sprintf("%.2f", *entry.Score)
+		}
+		w.Write([]string{
+			entry.SourcePath,
+			entry.TargetName,
+			entry.TargetPath,
+			score,
+			strconv.FormatBool(entry.Confirmed),
+			strconv.FormatBool(entry.Placeholder),
+			entry.OutputPath,
+			entry.Method,
+			entry.Adjustment,
+			entry.Status,
+			entry.Error,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeManifestJSON(output io.Writer, entries []ManifestEntry) error {
+	if entries == nil {
+		entries = []ManifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(data)
+	return err
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"gorm.io/gorm/clause"
+)
+
+// outcomeKey identifies an item of an export run across restarts
+func outcomeKey(sourceFileID uint, targetName string) string {
+	return fmt.Sprintf("%d|%s", sourceFileID, targetName)
+}
+
+// loadOutcomes returns the outcomes stored by earlier attempts of this run
+func (svc *ExportService) loadOutcomes() (map[string]models.ExportOutcome, error) {
+	var outcomes []models.ExportOutcome
+	if err := database.DB.Where("export_run_id = ?", svc.run.ID).Find(&outcomes).Error; err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]models.ExportOutcome, len(outcomes))
+	for _, outcome := range outcomes {
+		byKey[outcomeKey(outcome.SourceFileID, outcome.TargetName)] = outcome
+	}
+	return byKey, nil
+}
+
+// clearOutcomes forgets the outcomes of an earlier attempt when the run
+// starts over
+func (svc *ExportService) clearOutcomes() error {
+	return database.DB.Where("export_run_id = ?", svc.run.ID).Delete(&models.ExportOutcome{}).Error
+}
+
+// saveOutcomes stores outcomes, replacing earlier ones of the same items
+func saveOutcomes(outcomes []models.ExportOutcome) error {
+	if len(outcomes) == 0 {
+		return nil
+	}
+	return database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "export_run_id"}, {Name: "source_file_id"}, {Name: "target_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"output_path", "method", "adjustment", "status", "error", "updated_at"}),
+	}).CreateInBatches(&outcomes, 100).Error
+}
+
+// newOutcome records the manifest entry of an item
+func (svc *ExportService) newOutcome(item exportItem, entry ManifestEntry) models.ExportOutcome {
+	return models.ExportOutcome{
+		ExportRunID:  svc.run.ID,
+		SourceFileID: item.source.ID,
+		TargetName:   item.targetName,
+		OutputPath:   filepath.ToSlash(item.outputPath),
+		Method:       entry.Method,
+		Adjustment:   entry.Adjustment,
+		Status:       entry.Status,
+		Error:        entry.Error,
+	}
+}
+
+// replayOutcome returns the manifest entry of an item written by an earlier
+// attempt of this run
+func replayOutcome(item exportItem, outcome models.ExportOutcome) ManifestEntry {
+	item.outputPath = filepath.FromSlash(outcome.OutputPath)
+	item.method = outcome.Method
+	item.adjustment = outcome.Adjustment
+	entry := newManifestEntry(item, nil)
+	entry.Status = outcome.Status
+	entry.Error = outcome.Error
+	return entry
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Placeholder patterns
+const (
+	PlaceholderSolid        = "solid"
+	PlaceholderCheckerboard = "checkerboard"
+)
+
+const (
+	// defaultPlaceholderColor is the fill of generated placeholders
+	defaultPlaceholderColor = "#808080"
+
+	// defaultPlaceholderSize is used for sources whose dimensions are unknown
+	defaultPlaceholderSize = 256
+)
+
+// ValidatePlaceholderOptions checks the placeholder options of an export.
+// A placeholder image must exist and be decodable.
+func ValidatePlaceholderOptions(options models.ExportOptions) error {
+	if options.PlaceholderColor != "" {
+		if _, err := parseColor(options.PlaceholderColor); err != nil {
+			return err
+		}
+	}
+	switch options.PlaceholderPattern {
+	case "", PlaceholderSolid, PlaceholderCheckerboard:
+	default:
+		return fmt.Errorf("unknown placeholder pattern: %s", options.PlaceholderPattern)
+	}
+	if options.PlaceholderImage != "" {
+		if _, err := loadImage(options.PlaceholderImage); err != nil {
+			return fmt.Errorf("cannot use placeholder image: %w", err)
+		}
+	}
+	return nil
+}
+
+// placeholderPath returns where the placeholder of a no-match selection is
+// written: where a match would go if the export asks for it, otherwise
+// <rel dir>/<target>/<source name>_no_match_placeholder.png like the
+// default layout, so the placeholders of different targets do not collide
+func (svc *ExportService) placeholderPath(targetName, relPath string) string {
+	if svc.run.Options.PlaceholderLayout {
+		return svc.withFormat(svc.layout.expand(layoutValues{target: targetName, relPath: relPath}))
+	}
+	relPath = filepath.ToSlash(relPath)
+	relDir := path.Dir(relPath)
+	if relDir != "." {
+		relDir = safePath(relDir)
+	}
+	placeholder := path.Join(relDir, targetSegment(targetName), safePath(path.Base(relPath))+"_no_match_placeholder.png")
+	return filepath.FromSlash(placeholder)
+}
+
+// createPlaceholder writes the placeholder of a no-match selection, in the
+// format of its output path and the size of its source file
+func (svc *ExportService) createPlaceholder(item *exportItem) error {
+	width, height := item.source.Width, item.source.Height
+	if width <= 0 || height <= 0 {
+		width, height = defaultPlaceholderSize, defaultPlaceholderSize
+	}
+
+	img, err := svc.placeholderImage(width, height)
+	if err != nil {
+		return err
+	}
+	if svc.run.Options.PlaceholderText {
+		img = drawLabel(img, []string{item.source.RelativePath, "no match: " + item.targetName})
+	}
+
+	return svc.writeOutput(item.outputPath, time.Time{}, func(output io.Writer) error {
+		return svc.encodeImage(output, img, item.outputPath)
+	})
+}
+
+// placeholderImage returns the background of a placeholder: the user's
+// placeholder image cropped to size, or a solid or checkerboard fill
+func (svc *ExportService) placeholderImage(width, height int) (*image.NRGBA, error) {
+	options := svc.run.Options
+	if options.PlaceholderImage != "" {
+		if svc.placeholder == nil {
+			img, err := loadImage(options.PlaceholderImage)
+			if err != nil {
+				return nil, err
+			}
+			svc.placeholder = img
+		}
+		return imaging.Fill(svc.placeholder, width, height, imaging.Center, imaging.Lanczos), nil
+	}
+
+	fill, _ := parseColor(defaultPlaceholderColor)
+	if options.PlaceholderColor != "" {
+		fill, _ = parseColor(options.PlaceholderColor)
+	}
+	img := imaging.New(width, height, fill)
+	if options.PlaceholderPattern != PlaceholderCheckerboard {
+		return img, nil
+	}
+
+	// Alternate the fill with a lighter tint in squares of about 1/16 of
+	// the shorter side
+	light := color.NRGBA{
+		R: fill.R + (255-fill.R)/2,
+		G: fill.G + (255-fill.G)/2,
+		B: fill.B + (255-fill.B)/2,
+		A: fill.A,
+	}
+	square := width
+	if height < square {
+		square = height
+	}
+	square /= 16
+	if square < 8 {
+		square = 8
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if (x/square+y/square)%2 == 1 {
+				img.SetNRGBA(x, y, light)
+			}
+		}
+	}
+	return img, nil
+}
+
+// loadImage decodes an image file from any storage backend
+func loadImage(path string) (image.Image, error) {
+	input, err := storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	return imaging.Decode(input)
+}
+
+// drawLabel draws lines of text centered onto img. The text is rendered
+// with a small bitmap font and scaled up to about 80% of the image width,
+// in black or white depending on the brightness of the image.
+func drawLabel(img *image.NRGBA, lines []string) *image.NRGBA {
+	face := basicfont.Face7x13
+	lineHeight := face.Metrics().Height.Ceil()
+
+	textWidth := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > textWidth {
+			textWidth = w
+		}
+	}
+	textHeight := lineHeight * len(lines)
+	if textWidth == 0 {
+		return img
+	}
+
+	label := image.NewNRGBA(image.Rect(0, 0, textWidth, textHeight))
+	drawer := &font.Drawer{Dst: label, Src: image.NewUniform(labelColor(img)), Face: face}
+	for i, line := range lines {
+		lineWidth := font.MeasureString(face, line).Ceil()
+		drawer.Dot = fixed.P((textWidth-lineWidth)/2, i*lineHeight+face.Metrics().Ascent.Ceil())
+		drawer.DrawString(line)
+	}
+
+	bounds := img.Bounds()
+	scale := float64(bounds.Dx()) * 0.8 / float64(textWidth)
+	if s := float64(bounds.Dy()) * 0.8 / float64(textHeight); s < scale {
+		scale = s
+	}
+	if scale >= 1 {
+		// Whole multiples keep the bitmap font sharp
+		scale = float64(int(scale))
+	}
+	width, height := int(float64(textWidth)*scale), int(float64(textHeight)*scale)
+	if width < 1 || height < 1 {
+		return img
+	}
+	scaled := imaging.Resize(label, width, height, imaging.NearestNeighbor)
+	return imaging.OverlayCenter(img, scaled, 1.0)
+}
+
+// labelColor picks black or white, whichever stands out more on img
+func labelColor(img *image.NRGBA) color.Color {
+	var sum, count float64
+	bounds := img.Bounds()
+	step := bounds.Dx()*bounds.Dy()/1024 + 1
+	for i := 0; i < len(img.Pix); i += 4 * step {
+		sum += 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+		count++
+	}
+	if count > 0 && sum/count < 128 {
+		return color.White
+	}
+	return color.Black
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/testutil"
+	"github.com/disintegration/imaging"
+)
+
+func TestPlaceholderPath(t *testing.T) {
+	tests := []struct {
+		options models.ExportOptions
+		want    string
+	}{
+		{want: "dir/T/a.png_no_match_placeholder.png"},
+		{options: models.ExportOptions{Format: "jpg"}, want: "dir/T/a.png_no_match_placeholder.png"},
+		{options: models.ExportOptions{PlaceholderLayout: true}, want: "dir/T/a.png"},
+		{options: models.ExportOptions{PlaceholderLayout: true, Format: "jpg"}, want: "dir/T/a.jpg"},
+		{options: models.ExportOptions{PlaceholderLayout: true, Layout: "{target}/{rel_path}.{ext}"}, want: "T/dir/a.png"},
+	}
+
+	for _, tt := range tests {
+		layout, err := ParseLayout(tt.options.Layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc := &ExportService{run: &models.ExportRun{Options: tt.options}, layout: layout}
+		if got := svc.placeholderPath("T", filepath.FromSlash("dir/a.png")); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%+v: placeholderPath = %q, want %q", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceholderImage(t *testing.T) {
+	gray := color.NRGBA{0x80, 0x80, 0x80, 255}
+	red := color.NRGBA{255, 0, 0, 255}
+	lightRed := color.NRGBA{255, 127, 127, 255}
+	imagePath := filepath.Join(t.TempDir(), "placeholder.png")
+	testutil.WritePNG(t, imagePath, imaging.New(100, 50, color.NRGBA{0, 255, 0, 255}))
+
+	tests := []struct {
+		name    string
+		options models.ExportOptions
+		pixels  map[image.Point]color.NRGBA
+	}{
+		{name: "default", pixels: map[image.Point]color.NRGBA{{0, 0}: gray, {40, 20}: gray}},
+		{name: "color", options: models.ExportOptions{PlaceholderColor: "#ff0000"},
+			pixels: map[image.Point]color.NRGBA{{0, 0}: red, {40, 20}: red}},
+		// Squares are 8 pixels, the minimum
+		{name: "checkerboard", options: models.ExportOptions{PlaceholderColor: "#ff0000", PlaceholderPattern: PlaceholderCheckerboard},
+			pixels: map[image.Point]color.NRGBA{{0, 0}: red, {7, 7}: red, {8, 0}: lightRed, {0, 8}: lightRed, {8, 8}: red}},
+		{name: "image", options: models.ExportOptions{PlaceholderImage: imagePath, PlaceholderColor: "#ff0000"},
+			pixels: map[image.Point]color.NRGBA{{0, 0}: {0, 255, 0, 255}, {40, 20}: {0, 255, 0, 255}}},
+	}
+
+	for _, tt := range tests {
+		svc := &ExportService{run: &models.ExportRun{Options: tt.options}}
+		img, err := svc.placeholderImage(48, 24)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if b := img.Bounds(); b.Dx() != 48 || b.Dy() != 24 {
+			t.Errorf("%s: %d×%d, want 48×24", tt.name, b.Dx(), b.Dy())
+		}
+		for p, want := range tt.pixels {
+			if got := img.NRGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: pixel %v = %v, want %v", tt.name, p, got, want)
+			}
+		}
+	}
+}
+
+func TestDrawLabel(t *testing.T) {
+	tests := []struct {
+		name       string
+		background color.NRGBA
+		text       color.NRGBA
+	}{
+		{name: "light", background: color.NRGBA{200, 200, 200, 255}, text: color.NRGBA{0, 0, 0, 255}},
+		{name: "dark", background: color.NRGBA{30, 30, 60, 255}, text: color.NRGBA{255, 255, 255, 255}},
+	}
+
+	for _, tt := range tests {
+		img := drawLabel(imaging.New(200, 100, tt.background), []string{"dir/a.png", "no match: T"})
+		if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+			t.Errorf("%s: label changed the size to %d×%d", tt.name, b.Dx(), b.Dy())
+		}
+		text := 0
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 200; x++ {
+				if img.NRGBAAt(x, y) == tt.text {
+					text++
+				}
+			}
+		}
+		if text == 0 {
+			t.Errorf("%s: no text drawn in %v", tt.name, tt.text)
+		}
+		// The label stays within about 80% of the image
+		if img.NRGBAAt(0, 0) != tt.background || img.NRGBAAt(199, 99) != tt.background {
+			t.Errorf("%s: label reaches the corners", tt.name)
+		}
+	}
+
+	// Too small for any text
+	tiny := imaging.New(2, 2, color.NRGBA{200, 200, 200, 255})
+	if img := drawLabel(tiny, []string{"a long line of text"}); img.NRGBAAt(1, 1) != tiny.NRGBAAt(1, 1) {
+		t.Error("label drawn onto a 2×2 image")
+	}
+}
+
+func TestValidatePlaceholderOptions(t *testing.T) {
+	tests := []struct {
+		options models.ExportOptions
+		wantErr bool
+	}{
+		{options: models.ExportOptions{}},
+		{options: models.ExportOptions{PlaceholderColor: "#abc", PlaceholderPattern: PlaceholderCheckerboard}},
+		{options: models.ExportOptions{PlaceholderColor: "grey"}, wantErr: true},
+		{options: models.ExportOptions{PlaceholderPattern: "stripes"}, wantErr: true},
+		{options: models.ExportOptions{PlaceholderImage: filepath.Join(t.TempDir(), "missing.png")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidatePlaceholderOptions(tt.options); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: error = %v, wantErr %v", tt.options, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExportPlaceholderLayout(t *testing.T) {
+	project := createExportProject(t)
+	output := t.TempDir()
+	options := models.ExportOptions{OutputPath: output, UsePlaceholder: true, PlaceholderLayout: true, PlaceholderText: true, Format: "jpg"}
+	if _, err := runExport(t, project, options); err != nil {
+		t.Fatal(err)
+	}
+
+	// b.png has no match; its placeholder takes the place of the match,
+	// in the source's size
+	img, err := imaging.Open(filepath.Join(output, "T", "b.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Errorf("placeholder is %d×%d, want 32×32", b.Dx(), b.Dy())
+	}
+}
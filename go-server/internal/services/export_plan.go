@@ -0,0 +1,283 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+// reserveBatch is the number of source files whose output paths are
+// reserved at a time, see reserve
+const reserveBatch = 100
+
+// Conflict policies for output files that already exist in the export
+// folder
+const (
+	ConflictOverwrite = "overwrite" // replace the file (default)
+	ConflictSkip      = "skip"      // keep the file and skip the item
+	ConflictRename    = "rename"    // write to <name>_1.<ext>, <name>_2.<ext>, ...
+	ConflictFail      = "fail"      // do not start the export
+)
+
+// ValidConflictPolicy reports whether policy is a conflict policy, or empty
+// for overwrite
+func ValidConflictPolicy(policy string) bool {
+	switch policy {
+	case "", ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail:
+		return true
+	}
+	return false
+}
+
+// PlannedOperation is what an export would do for one selection of a
+// source file
+type PlannedOperation struct {
+	SourcePath string `json:"source_path"`
+	TargetName string `json:"target_name"`
+	TargetPath string `json:"target_path,omitempty"` // selected target file, empty for no-match selections
+	OutputPath string `json:"output_path,omitempty"` // relative to the export folder, after renaming
+	Action     string `json:"action"`                // copy, hardlink, symlink, reflink, move, convert, placeholder or none
+	Conflict   string `json:"conflict,omitempty"`    // the conflict policy applied because the output file exists
+}
+
+// ExportPlan is the result of a dry run: the planned operations, the
+// output paths more than one file maps to, and the existing files the
+// export would run into
+type ExportPlan struct {
+	OutputPath     string             `json:"output_path"`
+	Operations     []PlannedOperation `json:"operations"`
+	Collisions     []LayoutCollision  `json:"collisions"`
+	CaseCollisions []LayoutCollision  `json:"case_collisions"` // warning: paths differing only in case, distinct files on this file system
+	Conflicts      []string           `json:"conflicts"`       // existing output files, relative to the export folder
+}
+
+// PlanExport plans an export without writing anything. Links, moves and
+// conversions are reported as requested; links fall back to copies only
+// when the export runs. A dry run does not probe the export folder for a
+// case-insensitive file system but assumes the default of the operating
+// system.
+func PlanExport(project *models.Project, options models.ExportOptions, dryRun bool) (*ExportPlan, error) {
+	run := &models.ExportRun{ProjectID: project.ID, Options: options}
+	svc := NewExportService(project, run, context.Background())
+	svc.dryRun = dryRun
+	_, plan, err := svc.plan()
+	if err != nil {
+		return nil, err
+	}
+
+	items := flattenPlan(plan)
+	svc.planOutputs(items)
+	foldCase := svc.foldCase()
+
+	// Renames are reserved for this plan only
+	reserved := make(map[string]bool, len(svc.planned))
+	for p := range svc.planned {
+		reserved[p] = true
+	}
+
+	result := &ExportPlan{
+		OutputPath: svc.outputPath,
+		Operations: make([]PlannedOperation, 0, len(items)),
+		Collisions: findCollisions(items, foldCase),
+		Conflicts:  []string{},
+	}
+	if !foldCase {
+		// Not an error here, but worth a warning before the export folder
+		// is copied elsewhere
+		result.CaseCollisions = findCaseCollisions(items)
+	}
+	for _, item := range items {
+		op := PlannedOperation{
+			SourcePath: item.source.RelativePath,
+			TargetName: item.targetName,
+			TargetPath: item.targetPath,
+			Action:     svc.plannedAction(item),
+		}
+		if svc.outputExists(item.outputPath) {
+			result.Conflicts = append(result.Conflicts, filepath.ToSlash(item.outputPath))
+			op.Conflict = svc.conflictPolicy()
+			if op.Conflict == ConflictRename {
+				item.outputPath = svc.freeOutputPath(item.outputPath, reserved)
+			}
+		}
+		op.OutputPath = filepath.ToSlash(item.outputPath)
+		result.Operations = append(result.Operations, op)
+	}
+	if result.Collisions == nil {
+		result.Collisions = []LayoutCollision{}
+	}
+	if result.CaseCollisions == nil {
+		result.CaseCollisions = []LayoutCollision{}
+	}
+	return result, nil
+}
+
+// ExportCollisions returns the output paths an export would write more
+// than once. Unlike PlanExport it does not look at the output folder, e.g.
+// for a download.
+func ExportCollisions(project *models.Project, options models.ExportOptions) ([]LayoutCollision, error) {
+	run := &models.ExportRun{ProjectID: project.ID, Options: options}
+	svc := NewExportService(project, run, context.Background())
+	_, plan, err := svc.plan()
+	if err != nil {
+		return nil, err
+	}
+	return findCollisions(flattenPlan(plan), svc.foldCase()), nil
+}
+
+// plannedAction returns how an item would be written
+func (svc *ExportService) plannedAction(item exportItem) string {
+	switch {
+	case item.outputPath == "":
+		return "none"
+	case item.placeholder:
+		return "placeholder"
+	case svc.needsConversion(item):
+		return "convert"
+	case svc.run.Options.Archive != "" || svc.run.Options.Mode == "":
+		return ExportCopy
+	}
+	return svc.run.Options.Mode
+}
+
+// conflictPolicy returns the conflict policy of the export
+func (svc *ExportService) conflictPolicy() string {
+	if svc.run.Options.OnConflict == "" {
+		return ConflictOverwrite
+	}
+	return svc.run.Options.OnConflict
+}
+
+// planOutputs records the output paths of all items, so renamed files do
+// not take a path another item writes
+func (svc *ExportService) planOutputs(items []exportItem) {
+	svc.planned = make(map[string]bool, len(items))
+	for _, item := range items {
+		if item.outputPath != "" {
+			svc.planned[filepath.ToSlash(item.outputPath)] = true
+		}
+	}
+}
+
+// outputExists reports whether a file exists at outputPath in the export
+// folder. Archives are always written from scratch.
+func (svc *ExportService) outputExists(outputPath string) bool {
+	if outputPath == "" || svc.run.Options.Archive != "" {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(svc.outputPath, outputPath))
+	return err == nil
+}
+
+// foldCase reports whether output paths differing only in case name the
+// same file: in archives, which are often unpacked on Windows or macOS, and
+// in export folders on case-insensitive file systems
+func (svc *ExportService) foldCase() bool {
+	if svc.run.Options.Archive != "" {
+		return true
+	}
+	if svc.dryRun {
+		return caseInsensitiveOS()
+	}
+	return caseInsensitive(svc.outputPath)
+}
+
+// existingOutputs returns the output paths of items that exist already
+func (svc *ExportService) existingOutputs(items []exportItem) []string {
+	var existing []string
+	for _, item := range items {
+		if svc.outputExists(item.outputPath) {
+			existing = append(existing, filepath.ToSlash(item.outputPath))
+		}
+	}
+	return existing
+}
+
+// freeOutputPath returns outputPath with the first suffix _1, _2, ... that
+// neither exists nor is in reserved, and adds it to reserved
+func (svc *ExportService) freeOutputPath(outputPath string, reserved map[string]bool) string {
+	ext := filepath.Ext(outputPath)
+	stem := strings.TrimSuffix(outputPath, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s_%d%s", stem, n, ext)
+		if !reserved[filepath.ToSlash(candidate)] && !svc.outputExists(candidate) {
+			reserved[filepath.ToSlash(candidate)] = true
+			return candidate
+		}
+	}
+}
+
+// reserve applies the conflict policy to the items of the source files
+// from plan[from] on and stores their output paths before anything is
+// written, a batch at a time. It returns the index after the batch. Items
+// an interrupted attempt of the run already decided keep their output path,
+// so files it wrote are replaced rather than renamed or skipped.
+func (svc *ExportService) reserve(plan [][]exportItem, from int) int {
+	to := from + reserveBatch
+	if to > len(plan) {
+		to = len(plan)
+	}
+
+	var pending []models.ExportOutcome
+	for i := from; i < to; i++ {
+		for j := range plan[i] {
+			item := &plan[i][j]
+			if item.outputPath == "" {
+				continue
+			}
+
+			if outcome, ok := svc.outcomes[outcomeKey(item.source.ID, item.targetName)]; ok {
+				item.outputPath = filepath.FromSlash(outcome.OutputPath)
+				item.skipped = outcome.Status == "skipped"
+			} else {
+				write, err := svc.resolveConflict(item)
+				if err != nil {
+					// Fails again when the item is written
+					continue
+				}
+				item.skipped = !write
+			}
+			item.resolved = true
+
+			status := "pending"
+			if item.skipped {
+				status = "skipped"
+			}
+			pending = append(pending, models.ExportOutcome{
+				ExportRunID:  svc.run.ID,
+				SourceFileID: item.source.ID,
+				TargetName:   item.targetName,
+				OutputPath:   filepath.ToSlash(item.outputPath),
+				Status:       status,
+			})
+		}
+	}
+
+	if err := saveOutcomes(pending); err != nil {
+		log.Printf("[ERROR] Failed to save export outcomes: %v", err)
+	}
+	return to
+}
+
+// resolveConflict applies the conflict policy to an item whose output file
+// exists. It returns false if the item is skipped.
+func (svc *ExportService) resolveConflict(item *exportItem) (bool, error) {
+	if !svc.outputExists(item.outputPath) {
+		return true, nil
+	}
+
+	switch svc.conflictPolicy() {
+	case ConflictSkip:
+		return false, nil
+	case ConflictRename:
+		item.outputPath = svc.freeOutputPath(item.outputPath, svc.planned)
+	case ConflictFail:
+		return false, fmt.Errorf("%s already exists", filepath.ToSlash(item.outputPath))
+	}
+	return true, nil
+}
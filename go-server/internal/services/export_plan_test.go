@@ -0,0 +1,207 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+// newConflictTestService returns an export service writing into a temporary
+// folder that holds the given files
+func newConflictTestService(t *testing.T, options models.ExportOptions, existing ...string) *ExportService {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range existing {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &ExportService{
+		run:        &models.ExportRun{Options: options},
+		outputPath: dir,
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	existing := []string{"a.png", "a_1.png", "noext", "d/x.png"}
+	// a_2.png is written by another item of the export
+	planned := []string{"a.png", "a_2.png", "c.png", "noext", "d/x.png"}
+
+	tests := []struct {
+		policy    string
+		archive   string
+		output    string
+		want      string
+		wantWrite bool
+		wantErr   bool
+	}{
+		{policy: "", output: "a.png", want: "a.png", wantWrite: true},
+		{policy: ConflictOverwrite, output: "a.png", want: "a.png", wantWrite: true},
+		{policy: ConflictSkip, output: "a.png", want: "a.png"},
+		{policy: ConflictSkip, output: "c.png", want: "c.png", wantWrite: true},
+		{policy: ConflictRename, output: "a.png", want: "a_3.png", wantWrite: true},
+		{policy: ConflictRename, output: "c.png", want: "c.png", wantWrite: true},
+		{policy: ConflictRename, output: "noext", want: "noext_1", wantWrite: true},
+		{policy: ConflictRename, output: "d/x.png", want: "d/x_1.png", wantWrite: true},
+		{policy: ConflictFail, output: "a.png", want: "a.png", wantErr: true},
+		{policy: ConflictFail, output: "c.png", want: "c.png", wantWrite: true},
+		{policy: ConflictFail, archive: "zip", output: "a.png", want: "a.png", wantWrite: true},
+	}
+
+	for _, tt := range tests {
+		svc := newConflictTestService(t, models.ExportOptions{OnConflict: tt.policy, Archive: tt.archive}, existing...)
+		var items []exportItem
+		for _, p := range planned {
+			items = append(items, exportItem{outputPath: filepath.FromSlash(p)})
+		}
+		svc.planOutputs(items)
+
+		item := &exportItem{outputPath: filepath.FromSlash(tt.output)}
+		write, err := svc.resolveConflict(item)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %q: error = %v, wantErr %v", tt.policy, tt.output, err, tt.wantErr)
+		}
+		if write != tt.wantWrite {
+			t.Errorf("%s %q: write = %v, want %v", tt.policy, tt.output, write, tt.wantWrite)
+		}
+		if item.outputPath != filepath.FromSlash(tt.want) {
+			t.Errorf("%s %q: output path = %q, want %q", tt.policy, tt.output, item.outputPath, tt.want)
+		}
+	}
+}
+
+func TestFreeOutputPath(t *testing.T) {
+	svc := newConflictTestService(t, models.ExportOptions{OnConflict: ConflictRename}, "a.png", "a_1.png", "a_3.png")
+	reserved := map[string]bool{"a_2.png": true}
+
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{output: "a.png", want: "a_4.png"},
+		{output: "a.png", want: "a_5.png"},
+		{output: "b.png", want: "b_1.png"},
+		{output: "a_1.png", want: "a_1_1.png"},
+	}
+
+	for _, tt := range tests {
+		if got := svc.freeOutputPath(tt.output, reserved); got != tt.want {
+			t.Errorf("freeOutputPath(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+		if !reserved[tt.want] {
+			t.Errorf("freeOutputPath(%q) did not reserve %q", tt.output, tt.want)
+		}
+	}
+}
+
+func TestPlanExport(t *testing.T) {
+	project := createExportProject(t)
+	output := t.TempDir()
+	existing := filepath.Join(output, "T", "a.png")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	os.WriteFile(existing, []byte("earlier export"), 0644)
+
+	options := models.ExportOptions{OutputPath: output, Mode: ExportHardlink, UsePlaceholder: true, OnConflict: ConflictRename}
+	plan, err := PlanExport(project, options, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlannedOperation{
+		{SourcePath: "a.png", TargetName: "T", OutputPath: "T/a_1.png", Action: ExportHardlink, Conflict: ConflictRename},
+		{SourcePath: "b.png", TargetName: "T", OutputPath: "T/b.png_no_match_placeholder.png", Action: "placeholder"},
+		{SourcePath: "c.png", TargetName: "T", OutputPath: "T/c.png", Action: ExportHardlink},
+	}
+	if len(plan.Operations) != len(want) {
+		t.Fatalf("planned %+v, want %+v", plan.Operations, want)
+	}
+	for i, w := range want {
+		op := plan.Operations[i]
+		op.TargetPath = ""
+		if op != w {
+			t.Errorf("operation %d = %+v, want %+v", i, op, w)
+		}
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0] != "T/a.png" {
+		t.Errorf("conflicts = %v, want [T/a.png]", plan.Conflicts)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(output, "T")); len(entries) != 1 {
+		t.Errorf("dry run wrote %d files", len(entries)-1)
+	}
+
+	// Not even a probe file is created and removed again in the output
+	// folder, or in the nearest existing folder above a missing one, which
+	// would change the folder's modification time
+	missing := filepath.Join(t.TempDir(), "new", "out")
+	earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, outputPath := range []string{output, missing} {
+		dir := outputPath
+		if outputPath == missing {
+			dir = filepath.Dir(filepath.Dir(missing))
+		}
+		if err := os.Chtimes(dir, earlier, earlier); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := PlanExport(project, models.ExportOptions{OutputPath: outputPath, UsePlaceholder: true}, true); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.ModTime().Equal(earlier) {
+			t.Errorf("dry run to %s changed %s: %v", outputPath, dir, err)
+		}
+	}
+
+	// The export keeps the existing file when asked to skip it
+	options.OnConflict, options.Mode = ConflictSkip, ""
+	if _, err := runExport(t, project, options); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "earlier export" {
+		t.Errorf("skipped file was replaced with %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(output, "T", "b.png_no_match_placeholder.png")); err != nil {
+		t.Errorf("other files not exported: %v", err)
+	}
+}
+
+func TestReserveReusesOutputPaths(t *testing.T) {
+	project := createTestProject(t, t.TempDir(), nil)
+	// An interrupted attempt renamed a.png to a_1.png and wrote it
+	svc := newConflictTestService(t, models.ExportOptions{OnConflict: ConflictRename}, "a.png", "a_1.png", "b.png")
+	svc.run.ProjectID = project.ID
+	if err := database.DB.Create(svc.run).Error; err != nil {
+		t.Fatal(err)
+	}
+	a := &models.SourceFile{ID: 1}
+	b := &models.SourceFile{ID: 2}
+	svc.outcomes = map[string]models.ExportOutcome{
+		outcomeKey(a.ID, "T"): {SourceFileID: a.ID, TargetName: "T", OutputPath: "a_1.png", Status: "pending"},
+	}
+
+	plan := [][]exportItem{
+		{{source: a, targetName: "T", outputPath: "a.png"}},
+		{{source: b, targetName: "T", outputPath: "b.png"}},
+	}
+	svc.planOutputs(flattenPlan(plan))
+	if next := svc.reserve(plan, 0); next != 2 {
+		t.Errorf("reserve = %d, want 2", next)
+	}
+
+	for i, want := range []string{"a_1.png", "b_1.png"} {
+		item := plan[i][0]
+		if !item.resolved || item.outputPath != want {
+			t.Errorf("item %d reserved %q (resolved %v), want %q", i, item.outputPath, item.resolved, want)
+		}
+	}
+	var stored []string
+	database.DB.Model(&models.ExportOutcome{}).Where("export_run_id = ?", svc.run.ID).Order("source_file_id").Pluck("output_path", &stored)
+	if len(stored) != 2 || stored[0] != "a_1.png" || stored[1] != "b_1.png" {
+		t.Errorf("stored output paths = %v, want [a_1.png b_1.png]", stored)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package services
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only implemented on Linux; callers fall back to a copy
+func reflink(src, dst *os.File) error {
+	return errors.New("reflink is not supported on this platform")
+}
@@ -2,222 +2,577 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"image/color"
+	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/chai2010/webp"
+	"github.com/bilibili/look-alike/internal/archive"
 	"github.com/bilibili/look-alike/internal/database"
 	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"github.com/bilibili/look-alike/internal/workers"
+	_ "github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 	_ "golang.org/x/image/bmp"
 	_ "golang.org/x/image/tiff"
+	"gorm.io/gorm"
 )
 
 // ExportService handles exporting of selected images
 type ExportService struct {
-	project         *models.Project
-	usePlaceholder  bool
-	onlyConfirmed   bool
-	outputPath      string
-	ctx             context.Context
+	project        *models.Project
+	run            *models.ExportRun
+	usePlaceholder bool
+	onlyConfirmed  bool
+	outputPath     string
+	ctx            context.Context
+	targets        map[uint]*models.ProjectTarget
+	layout         *exportLayout
+	moved          map[string]string               // target files moved by this run: from path -> to path
+	archive        *archive.Writer                 // set when the export is written as an archive
+	placeholder    image.Image                     // decoded placeholder image, loaded on first use
+	planned        map[string]bool                 // output paths of all items, see planOutputs
+	dryRun         bool                            // only planning, nothing may be written, not even a probe file
+	outcomes       map[string]models.ExportOutcome // outcomes of an earlier attempt, see outcomeKey
+	unsaved        []models.ExportOutcome          // outcomes since the last checkpoint
+	checkpoint     uint64                          // last finished source file
+	lastSave       time.Time
+	lastCheckpoint time.Time
 }
 
-// NewExportService creates a new export service
-func NewExportService(project *models.Project, usePlaceholder, onlyConfirmed bool, outputPath string, ctx context.Context) *ExportService {
+// NewExportService creates a new export service for an export run
+func NewExportService(project *models.Project, run *models.ExportRun, ctx context.Context) *ExportService {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	if outputPath == "" {
-		outputPath = filepath.Join(filepath.Dir(project.SourcePath), fmt.Sprintf("%s_Output", project.Name))
-	}
 	return &ExportService{
 		project:        project,
-		usePlaceholder: usePlaceholder,
-		onlyConfirmed:  onlyConfirmed,
-		outputPath:     outputPath,
+		run:            run,
+		usePlaceholder: run.Options.UsePlaceholder,
+		onlyConfirmed:  run.Options.OnlyConfirmed,
+		outputPath:     exportOutputPath(project, run.Options),
 		ctx:            ctx,
 	}
 }
 
+// CreateExportRun stores an export run and queues its job. The output path
+// is completed as by exportOutputPath so the history shows where the files
+// went.
+func CreateExportRun(project *models.Project, options models.ExportOptions, priority int) (*models.ExportRun, error) {
+	options.OutputPath = exportOutputPath(project, options)
+
+	run := &models.ExportRun{
+		ProjectID: project.ID,
+		Options:   options,
+	}
+	if err := database.DB.Create(run).Error; err != nil {
+		return nil, err
+	}
+
+	job, err := workers.GetQueue().Enqueue(JobExport, project.ID, priority, ExportPayload{ExportRunID: run.ID})
+	if err != nil {
+		database.DB.Delete(run)
+		return nil, err
+	}
+	run.JobID = job.ID
+	if err := database.DB.Model(run).Update("job_id", job.ID).Error; err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// DefaultOutputPath returns the export folder used when none is given:
+// next to the source folder, or in the working directory for remote sources
+func DefaultOutputPath(project *models.Project) string {
+	name := fmt.Sprintf("%s_Output", project.Name)
+	if storage.IsRemote(project.SourcePath) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(project.SourcePath), name)
+}
+
+// exportOutputPath returns the folder or archive file an export writes to:
+// the given output path, or DefaultOutputPath. Archive files get the
+// extension of their format if it is missing.
+func exportOutputPath(project *models.Project, options models.ExportOptions) string {
+	outputPath := options.OutputPath
+	if outputPath == "" {
+		outputPath = DefaultOutputPath(project)
+	}
+	ext := archive.Ext(options.Archive)
+	if ext != "" && !strings.HasSuffix(strings.ToLower(outputPath), ext) {
+		outputPath += ext
+	}
+	return outputPath
+}
+
+// exportItem is one selection of a source file: the file the export writes
+// for it, or the reason nothing is written
+type exportItem struct {
+	source       *models.SourceFile
+	targetName   string
+	targetPath   string // selected target file, "" for no-match selections
+	targetWidth  int    // dimensions of the selected target file, 0 if unknown
+	targetHeight int
+	score        *float64 // similarity of the selected candidate
+	rank         int      // rank of the selected candidate
+	placeholder  bool
+	skipped      bool   // the output file existed and the conflict policy is skip
+	resolved     bool   // the conflict policy was applied and the output path reserved
+	outputPath   string // relative to the output folder, "" when nothing is written
+	method       string // how the file was written, see writeItem
+	adjustment   string // stretched, cropped or padded when resizing changed the aspect ratio
+}
+
 // Process runs the export process
 func (svc *ExportService) Process() error {
 	log.Printf("Starting export for project %s to %s", svc.project.Name, svc.outputPath)
 
+	sourceFiles, plan, err := svc.plan()
+	if err != nil {
+		return err
+	}
+	items := flattenPlan(plan)
+	if collisions := findCollisions(items, svc.foldCase()); len(collisions) > 0 {
+		return collisionError(collisions)
+	}
+	svc.planOutputs(items)
+
+	if svc.run.Options.Archive != "" {
+		return svc.processArchive(sourceFiles, plan)
+	}
+
 	// Create output directory
 	if err := os.MkdirAll(svc.outputPath, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Get source files
-	query := database.DB.Preload("TargetSelections").
-		Preload("TargetSelections.ComparisonCandidate").
-		Where("project_id = ?", svc.project.ID)
+	if svc.run.Options.Mode == ExportMove {
+		if err := svc.loadJournal(); err != nil {
+			return fmt.Errorf("failed to load export journal: %w", err)
+		}
+	}
 
-	if svc.onlyConfirmed {
-		query = query.Joins("INNER JOIN source_confirmations ON source_confirmations.source_file_id = source_files.id").
-			Where("source_confirmations.confirmed = ?", true)
+	// A paused or interrupted export continues after the last exported file
+	var resumeAfter uint64
+	if checkpoint := workers.Checkpoint(svc.ctx); checkpoint != "" {
+		resumeAfter, _ = strconv.ParseUint(checkpoint, 10, 64)
+		log.Printf("Resuming export after source file %d", resumeAfter)
+		if svc.outcomes, err = svc.loadOutcomes(); err != nil {
+			return fmt.Errorf("failed to load export outcomes: %w", err)
+		}
+	} else {
+		svc.run.Failed = 0
+		if err := svc.clearOutcomes(); err != nil {
+			return err
+		}
+
+		// Files found on a resume were written by this export, so only a
+		// fresh export is stopped by existing files
+		if existing := svc.existingOutputs(items); len(existing) > 0 && svc.conflictPolicy() == ConflictFail {
+			if len(existing) > 3 {
+				existing = existing[:3]
+			}
+			return fmt.Errorf("output files exist already, e.g. %s", strings.Join(existing, ", "))
+		}
 	}
 
-	var sourceFiles []models.SourceFile
-	if err := query.Find(&sourceFiles).Error; err != nil {
+	return svc.export(sourceFiles, plan, resumeAfter)
+}
+
+// processArchive writes the export into an archive file. The archive is
+// written next to its final path and renamed once complete; a paused or
+// interrupted archive export starts over.
+func (svc *ExportService) processArchive(sourceFiles []models.SourceFile, plan [][]exportItem) error {
+	if err := os.MkdirAll(filepath.Dir(svc.outputPath), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	tmp := tempName(svc.outputPath)
+	file, err := os.Create(tmp)
+	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp)
+	defer file.Close()
 
-	total := len(sourceFiles)
-	log.Printf("Exporting %d source files", total)
+	svc.archive, err = archive.NewWriter(file, svc.run.Options.Archive)
+	if err != nil {
+		return err
+	}
+	svc.run.Failed = 0
+	if err := svc.export(sourceFiles, plan, 0); err != nil {
+		return err
+	}
+	if err := svc.archive.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, svc.outputPath)
+}
 
-	// Write initial progress
-	if err := svc.WriteProgress(total, 0, "Starting export..."); err != nil {
-		log.Printf("[WARN] Failed to write initial progress: %v", err)
+// StreamArchive writes the export as an archive to w without creating an
+// export run or touching the output folder, e.g. for a download
+func (svc *ExportService) StreamArchive(w io.Writer) error {
+	sourceFiles, plan, err := svc.plan()
+	if err != nil {
+		return err
+	}
+	if collisions := findCollisions(flattenPlan(plan), true); len(collisions) > 0 {
+		return collisionError(collisions)
 	}
 
-	// If no files to export, mark as completed immediately
-	if total == 0 {
-		if err := svc.WriteProgress(0, 0, "No files to export"); err != nil {
-			log.Printf("[WARN] Failed to write completion progress: %v", err)
-		}
-		log.Println("Export completed: no files to export")
-		return nil
+	svc.archive, err = archive.NewWriter(w, svc.run.Options.Archive)
+	if err != nil {
+		return err
 	}
+	if err := svc.export(sourceFiles, plan, 0); err != nil {
+		return err
+	}
+	return svc.archive.Close()
+}
 
-	// Process each source file
-	processed := 0
-	for _, sf := range sourceFiles {
+// export writes the planned items of every source file after resumeAfter
+// and then the manifest
+func (svc *ExportService) export(sourceFiles []models.SourceFile, plan [][]exportItem, resumeAfter uint64) error {
+	total := len(sourceFiles)
+	log.Printf("Exporting %d source files", total)
+
+	svc.run.Total = int64(total)
+	svc.saveProgress(true)
+	defer svc.saveCheckpoint(true)
+
+	// Process each source file. Failed files count as processed, the
+	// failures are kept in run.Failed (which survives a pause).
+	var manifest []ManifestEntry
+	svc.run.Processed = 0
+	reserved := 0
+	for i := range sourceFiles {
+		sf := &sourceFiles[i]
 		select {
 		case <-svc.ctx.Done():
+			svc.saveProgress(true)
 			return svc.ctx.Err()
 		default:
 		}
 
-		if err := svc.exportSourceFile(&sf); err != nil {
-			log.Printf("[ERROR] Failed to export %s: %v", sf.RelativePath, err)
+		items := plan[i]
+
+		// Files before the checkpoint were written by an earlier run
+		if uint64(sf.ID) <= resumeAfter {
+			for _, item := range items {
+				if outcome, ok := svc.outcomes[outcomeKey(sf.ID, item.targetName)]; ok {
+					manifest = append(manifest, replayOutcome(item, outcome))
+				} else {
+					manifest = append(manifest, newManifestEntry(item, nil))
+				}
+			}
+			svc.run.Processed++
 			continue
 		}
 
-		processed++
-		// Update progress
-		if err := svc.WriteProgress(total, processed, sf.RelativePath); err != nil {
-			log.Printf("[WARN] Failed to write progress: %v", err)
+		if svc.resumable() && i >= reserved {
+			reserved = svc.reserve(plan, i)
+		}
+
+		failed := false
+		for _, item := range items {
+			err := svc.writeItem(&item)
+			if err != nil {
+				log.Printf("[ERROR] Failed to export %s for target %s: %v", sf.RelativePath, item.targetName, err)
+				publishFileError(svc.project.ID, sf.RelativePath, err)
+				failed = true
+			}
+			entry := newManifestEntry(item, err)
+			manifest = append(manifest, entry)
+			svc.unsaved = append(svc.unsaved, svc.newOutcome(item, entry))
+		}
+		svc.checkpoint = uint64(sf.ID)
+		svc.saveCheckpoint(false)
+		if failed {
+			svc.run.Failed++
 		}
+
+		svc.run.Processed++
+		svc.run.Current = sf.RelativePath
+		workers.ReportProgress(svc.ctx, svc.run.Processed, svc.run.Total)
+		svc.saveProgress(false)
 	}
+	svc.saveProgress(true)
 
-	// Write completion progress
-	if err := svc.WriteProgress(total, processed, "Export completed"); err != nil {
-		log.Printf("[WARN] Failed to write completion progress: %v", err)
+	if err := svc.writeManifest(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
 	}
 
-	log.Println("Export completed")
+	log.Printf("Export completed: %d files, %d failed", svc.run.Processed, svc.run.Failed)
 	return nil
 }
 
-// exportSourceFile exports a single source file
-func (svc *ExportService) exportSourceFile(sf *models.SourceFile) error {
-	// Create subdirectory
-	relDir := filepath.Dir(sf.RelativePath)
-	outputDir := filepath.Join(svc.outputPath, relDir)
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return err
+// resumable reports whether the export can continue from a checkpoint.
+// Archives are written from scratch, streamed archives have no export run.
+func (svc *ExportService) resumable() bool {
+	return svc.archive == nil && svc.run.ID != 0
+}
+
+// saveCheckpoint stores the outcomes since the last checkpoint and the last
+// finished source file, at most once a second unless force is set. It is
+// forced when the export stops, so a paused export resumes exactly where it
+// stopped.
+func (svc *ExportService) saveCheckpoint(force bool) {
+	if !svc.resumable() || svc.checkpoint == 0 {
+		return
+	}
+	if !force && time.Since(svc.lastCheckpoint) < time.Second {
+		return
+	}
+	svc.lastCheckpoint = time.Now()
+
+	if err := saveOutcomes(svc.unsaved); err != nil {
+		log.Printf("[ERROR] Failed to save export outcomes: %v", err)
+		return
+	}
+	svc.unsaved = nil
+	workers.SaveCheckpoint(svc.ctx, strconv.FormatUint(svc.checkpoint, 10))
+}
+
+// saveProgress stores the counters of the export run, at most once a
+// second unless force is set
+func (svc *ExportService) saveProgress(force bool) {
+	// Streamed archives have no export run
+	if svc.run.ID == 0 {
+		return
+	}
+	if !force && time.Since(svc.lastSave) < time.Second {
+		return
+	}
+	svc.lastSave = time.Now()
+
+	database.DB.Model(svc.run).Updates(map[string]interface{}{
+		"total":     svc.run.Total,
+		"processed": svc.run.Processed,
+		"failed":    svc.run.Failed,
+		"current":   svc.run.Current,
+	})
+}
+
+// plan loads the source files to export and decides where each of their
+// selections is written. plan[i] holds the items of sourceFiles[i].
+func (svc *ExportService) plan() ([]models.SourceFile, [][]exportItem, error) {
+	layout, err := ParseLayout(svc.run.Options.Layout)
+	if err != nil {
+		return nil, nil, err
+	}
+	svc.layout = layout
+
+	query := database.DB.Preload("SourceConfirmation").
+		Preload("TargetSelections", func(db *gorm.DB) *gorm.DB {
+			return db.Order("project_target_id")
+		}).
+		Preload("TargetSelections.ComparisonCandidate").
+		Preload("TargetSelections.ComparisonCandidate.TargetFile").
+		Where("project_id = ?", svc.project.ID)
+
+	if svc.onlyConfirmed {
+		query = query.Joins("INNER JOIN source_confirmations ON source_confirmations.source_file_id = source_files.id").
+			Where("source_confirmations.confirmed = ?", true)
 	}
 
-	// Get selected files for all targets
+	var sourceFiles []models.SourceFile
+	if err := query.Order("source_files.id").Find(&sourceFiles).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var targets []models.ProjectTarget
+	if err := database.DB.Where("project_id = ?", svc.project.ID).Find(&targets).Error; err != nil {
+		return nil, nil, err
+	}
+	svc.targets = make(map[uint]*models.ProjectTarget, len(targets))
+	for i := range targets {
+		svc.targets[targets[i].ID] = &targets[i]
+	}
+
+	plan := make([][]exportItem, len(sourceFiles))
+	for i := range sourceFiles {
+		plan[i] = svc.planSource(&sourceFiles[i])
+	}
+	return sourceFiles, plan, nil
+}
+
+// flattenPlan lists the items of all source files
+func flattenPlan(plan [][]exportItem) []exportItem {
+	var items []exportItem
+	for _, sourceItems := range plan {
+		items = append(items, sourceItems...)
+	}
+	return items
+}
+
+// collisionError describes the output paths written more than once
+func collisionError(collisions []LayoutCollision) error {
+	examples := make([]string, 0, 3)
+	for _, collision := range collisions {
+		if len(examples) == cap(examples) {
+			break
+		}
+		examples = append(examples, fmt.Sprintf("%s <- %s", collision.OutputPath, strings.Join(collision.Sources, ", ")))
+	}
+	return fmt.Errorf("layout maps %d output paths to more than one file, e.g. %s", len(collisions), strings.Join(examples, "; "))
+}
+
+// planSource decides where the selections of a source file are written.
+// Matches follow the export layout, placeholders are placed by
+// placeholderPath. Archive entries are mirrored as plain folders.
+func (svc *ExportService) planSource(sf *models.SourceFile) []exportItem {
+	relPath := archive.Flatten(sf.RelativePath)
+
+	items := make([]exportItem, 0, len(sf.TargetSelections))
 	for _, selection := range sf.TargetSelections {
-		var targetPath string
-		var targetName string
+		item := exportItem{source: sf}
+		target, ok := svc.targets[selection.ProjectTargetID]
+		if ok {
+			item.targetName = target.Name
+		}
 
 		if selection.NoMatch {
-			if !svc.usePlaceholder {
-				continue
-			}
-			// Create placeholder
-			targetName = "no_match_placeholder"
-			targetPath = filepath.Join(outputDir, fmt.Sprintf("%s_%s.png", filepath.Base(sf.RelativePath), targetName))
-			if err := svc.createPlaceholder(targetPath, sf.Width, sf.Height); err != nil {
-				return err
+			if svc.usePlaceholder {
+				item.placeholder = true
+				item.outputPath = svc.placeholderPath(item.targetName, relPath)
 			}
+			items = append(items, item)
 			continue
 		}
 
-		if selection.ComparisonCandidate != nil {
-			targetPath = selection.ComparisonCandidate.FilePath
-			// Get target name
-			var target models.ProjectTarget
-			database.DB.First(&target, selection.ProjectTargetID)
-			targetName = target.Name
-		}
-
-		if targetPath == "" {
+		candidate := selection.ComparisonCandidate
+		if !ok || candidate == nil || candidate.TargetFile == nil {
 			continue
 		}
+		score := candidate.SimilarityScore
+		item.score = &score
+		item.rank = candidate.Rank
+		item.targetPath = TargetFilePath(target, candidate.TargetFile)
+		item.targetWidth = candidate.TargetFile.Width
+		item.targetHeight = candidate.TargetFile.Height
+		item.outputPath = svc.withFormat(svc.layout.expand(layoutValues{
+			target:  target.Name,
+			relPath: relPath,
+			score:   item.score,
+			rank:    item.rank,
+		}))
+		items = append(items, item)
+	}
+	return items
+}
 
-		// Create target-specific subdirectory
-		targetOutputDir := filepath.Join(outputDir, targetName)
-		if err := os.MkdirAll(targetOutputDir, 0755); err != nil {
-			return err
-		}
+// writeItem writes the file of a planned item and records in item.method
+// how it was written: copy, hardlink, symlink, reflink, move, convert or
+// placeholder
+func (svc *ExportService) writeItem(item *exportItem) error {
+	if item.outputPath == "" {
+		return nil
+	}
+	if !filepath.IsLocal(item.outputPath) {
+		return fmt.Errorf("output path %s leaves the export folder", filepath.ToSlash(item.outputPath))
+	}
 
-		// Use source file name (keep original name, just change extension if needed)
-		outputPath := filepath.Join(targetOutputDir, filepath.Base(sf.RelativePath))
+	if svc.archive == nil {
+		if !item.resolved {
+			write, err := svc.resolveConflict(item)
+			if err != nil || !write {
+				item.skipped = !write && err == nil
+				return err
+			}
+		} else if item.skipped {
+			return nil
+		}
 
-		if err := svc.copyAndConvert(targetPath, outputPath, filepath.Ext(sf.RelativePath)); err != nil {
+		outputPath := filepath.Join(svc.outputPath, item.outputPath)
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if item.placeholder {
+		item.method = "placeholder"
+		return svc.createPlaceholder(item)
+	}
+
+	var err error
+	item.method, err = svc.copyAndConvert(item)
+	return err
 }
 
-// copyAndConvert copies and converts an image file
-func (svc *ExportService) copyAndConvert(srcPath, dstPath, targetExt string) error {
-	srcExt := filepath.Ext(srcPath)
+// copyAndConvert puts the target file of an item at its output path,
+// converting or resizing it as the export asks for, and returns how it was
+// written
+func (svc *ExportService) copyAndConvert(item *exportItem) (string, error) {
+	srcPath, outputPath := item.targetPath, item.outputPath
 
-	// If same extension, just copy
-	if srcExt == targetExt {
-		return copyFile(srcPath, dstPath)
+	// If nothing changes, copy, link or move
+	if !svc.needsConversion(*item) {
+		if svc.archive != nil {
+			return ExportCopy, svc.archiveFile(srcPath, outputPath)
+		}
+		dstPath := filepath.Join(svc.outputPath, outputPath)
+		if svc.run.Options.Mode == ExportMove {
+			return svc.moveTarget(srcPath, dstPath)
+		}
+		return placeFile(svc.ctx, srcPath, dstPath, svc.run.Options.Mode)
 	}
 
 	// Convert format
-	img, err := imaging.Open(srcPath)
+	input, err := storage.OpenContext(svc.ctx, srcPath)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer input.Close()
 
-	return imaging.Save(img, dstPath)
-}
+	img, err := imaging.Decode(input)
+	if err != nil {
+		return "", err
+	}
 
-// createPlaceholder creates a placeholder image
-func (svc *ExportService) createPlaceholder(path string, width, height int) error {
-	// Create a simple gray placeholder
-	img := imaging.New(width, height, color.RGBA{128, 128, 128, 255})
-	return imaging.Save(img, path)
+	img = svc.convertImage(item, img)
+	return "convert", svc.writeOutput(outputPath, modTime(svc.ctx, srcPath), func(output io.Writer) error {
+		return svc.encodeImage(output, img, outputPath)
+	})
 }
 
-// copyFile copies a file
-func copyFile(src, dst string) error {
-	input, err := os.ReadFile(src)
-	if err != nil {
-		return err
+// writeOutput writes a file at outputPath, relative to the export folder
+// or inside the archive
+func (svc *ExportService) writeOutput(outputPath string, mtime time.Time, write func(output io.Writer) error) error {
+	if svc.archive != nil {
+		return svc.archive.Add(filepath.ToSlash(outputPath), mtime, -1, write)
 	}
-	return os.WriteFile(dst, input, 0644)
+	return writeFile(filepath.Join(svc.outputPath, outputPath), mtime, func(output *os.File) error {
+		return write(output)
+	})
 }
 
-// WriteProgress writes progress information
-func (svc *ExportService) WriteProgress(total, processed int, current string) error {
-	progressFile := filepath.Join(svc.outputPath, ".export_progress.json")
-	progress := map[string]interface{}{
-		"total":     total,
-		"processed": processed,
-		"current":   current,
+// archiveFile streams a target file into the archive
+func (svc *ExportService) archiveFile(srcPath, outputPath string) error {
+	info, err := storage.StatContext(svc.ctx, srcPath)
+	if err != nil {
+		return err
 	}
-	data, err := json.Marshal(progress)
+	input, err := storage.OpenContext(svc.ctx, srcPath)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(progressFile, data, 0644)
+	defer input.Close()
+
+	return svc.archive.Add(filepath.ToSlash(outputPath), info.ModTime(), info.Size(), func(output io.Writer) error {
+		_, err := io.Copy(output, input)
+		return err
+	})
 }
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/archive"
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/testutil"
+)
+
+// createExportProject stores a project with three source files: a.png is
+// matched to match.png of target T and confirmed, b.png has no match and
+// c.png is matched to a target file that no longer exists
+func createExportProject(t *testing.T) *models.Project {
+	t.Helper()
+	dir := t.TempDir()
+	source, target := filepath.Join(dir, "source"), filepath.Join(dir, "target")
+	writeTestImages(t, source, 3, 1)
+	testutil.WritePNG(t, filepath.Join(target, "match.png"), testutil.Pattern(24, 16, 1))
+	project := createTestProject(t, source, map[string]string{"T": target})
+	targetID := project.ProjectTargets[0].ID
+
+	for i, name := range []string{"a.png", "b.png", "c.png"} {
+		sf := models.SourceFile{ProjectID: project.ID, RelativePath: name, Width: 32, Height: 32, Status: "analyzed"}
+		if err := database.DB.Create(&sf).Error; err != nil {
+			t.Fatal(err)
+		}
+		selection := models.TargetSelection{SourceFileID: sf.ID, ProjectTargetID: targetID, NoMatch: name == "b.png"}
+		if !selection.NoMatch {
+			tf := models.TargetFile{ProjectTargetID: targetID, RelativePath: []string{"match.png", "", "gone.png"}[i], Width: 24, Height: 16}
+			if err := database.DB.Create(&tf).Error; err != nil {
+				t.Fatal(err)
+			}
+			candidate := models.ComparisonCandidate{SourceFileID: sf.ID, ProjectTargetID: targetID, TargetFileID: tf.ID, SimilarityScore: 95.5, Rank: 1}
+			if err := database.DB.Create(&candidate).Error; err != nil {
+				t.Fatal(err)
+			}
+			selection.SelectedCandidateID = &candidate.ID
+		}
+		if err := database.DB.Create(&selection).Error; err != nil {
+			t.Fatal(err)
+		}
+		if name == "a.png" {
+			now := time.Now()
+			database.DB.Create(&models.SourceConfirmation{SourceFileID: sf.ID, Confirmed: true, ConfirmedAt: &now})
+		}
+	}
+	return project
+}
+
+// runExport stores an export run with options and processes it in place of
+// the job queue
+func runExport(t *testing.T, project *models.Project, options models.ExportOptions) (*models.ExportRun, error) {
+	t.Helper()
+	run := &models.ExportRun{ProjectID: project.ID, Options: options}
+	if err := database.DB.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	err := NewExportService(project, run, context.Background()).Process()
+	return run, err
+}
+
+func TestExportManifest(t *testing.T) {
+	project := createExportProject(t)
+	tests := []struct {
+		format string
+		csv    bool
+		json   bool
+	}{
+		{format: ""},
+		{format: ManifestCSV, csv: true},
+		{format: ManifestJSON, json: true},
+		{format: ManifestBoth, csv: true, json: true},
+	}
+
+	for _, tt := range tests {
+		output := t.TempDir()
+		run, err := runExport(t, project, models.ExportOptions{OutputPath: output, Manifest: tt.format})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.format, err)
+		}
+		if run.Total != 3 || run.Processed != 3 || run.Failed != 1 {
+			t.Errorf("%q: processed %d/%d, %d failed, want 3/3, 1", tt.format, run.Processed, run.Total, run.Failed)
+		}
+		if _, err := os.Stat(filepath.Join(output, "T", "a.png")); err != nil {
+			t.Errorf("%q: match not exported: %v", tt.format, err)
+		}
+
+		_, err = os.Stat(filepath.Join(output, "manifest.csv"))
+		if (err == nil) != tt.csv {
+			t.Errorf("%q: manifest.csv exists = %v", tt.format, err == nil)
+		}
+		_, err = os.Stat(filepath.Join(output, "manifest.json"))
+		if (err == nil) != tt.json {
+			t.Errorf("%q: manifest.json exists = %v", tt.format, err == nil)
+		}
+	}
+
+	output := t.TempDir()
+	if _, err := runExport(t, project, models.ExportOptions{OutputPath: output, Manifest: ManifestBoth}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(output, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		source, status, output string
+		confirmed              bool
+	}{
+		{source: "a.png", status: "exported", output: "T/a.png", confirmed: true},
+		{source: "b.png", status: "no_match"},
+		{source: "c.png", status: "failed", output: "T/c.png"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("manifest has %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.SourcePath != w.source || e.Status != w.status || e.OutputPath != w.output || e.Confirmed != w.confirmed {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+	if entries[0].Score == nil || *entries[0].Score != 95.5 || entries[2].Error == "" {
+		t.Errorf("entries = %+v, want the score of the match and the error of the failure", entries)
+	}
+
+	f, err := os.Open(filepath.Join(output, "manifest.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0][0] != "source_path" || records[1][3] != "95.50" {
+		t.Errorf("manifest.csv = %v", records)
+	}
+}
+
+func TestExportLayout(t *testing.T) {
+	project := createExportProject(t)
+
+	output := t.TempDir()
+	if _, err := runExport(t, project, models.ExportOptions{OutputPath: output, Layout: "{target}_{rank}/{stem}.{ext}"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "T_1", "a.png")); err != nil {
+		t.Errorf("match not exported along the layout: %v", err)
+	}
+
+	// sub/a.png is matched as well; without {rel_dir} both a.png files of T
+	// are written to the same file
+	sf := models.SourceFile{ProjectID: project.ID, RelativePath: "sub/a.png", Width: 32, Height: 32, Status: "analyzed"}
+	database.DB.Create(&sf)
+	var candidate models.ComparisonCandidate
+	database.DB.Joins("TargetFile").Where("TargetFile.relative_path = ? AND comparison_candidates.project_target_id = ?", "match.png", project.ProjectTargets[0].ID).First(&candidate)
+	candidate.ID, candidate.SourceFileID = 0, sf.ID
+	database.DB.Create(&candidate)
+	database.DB.Create(&models.TargetSelection{SourceFileID: sf.ID, ProjectTargetID: candidate.ProjectTargetID, SelectedCandidateID: &candidate.ID})
+
+	options := models.ExportOptions{OutputPath: t.TempDir(), Layout: "flat/{target}/{stem}.{ext}"}
+	plan, err := PlanExport(project, options, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collisions := plan.Collisions
+	want := []LayoutCollision{{OutputPath: "flat/T/a.png", Sources: []string{"a.png (T)", "sub/a.png (T)"}}}
+	if fmt.Sprint(collisions) != fmt.Sprint(want) {
+		t.Errorf("collisions = %v, want %v", collisions, want)
+	}
+	if _, err := runExport(t, project, options); err == nil {
+		t.Error("export with colliding outputs succeeded")
+	}
+	if entries, _ := os.ReadDir(options.OutputPath); len(entries) != 0 {
+		t.Errorf("export with colliding outputs wrote %d files", len(entries))
+	}
+}
+
+func TestExportModeInManifest(t *testing.T) {
+	project := createExportProject(t)
+	output := t.TempDir()
+	if _, err := runExport(t, project, models.ExportOptions{OutputPath: output, Mode: ExportSymlink, UsePlaceholder: true, Manifest: ManifestJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(output, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, entry := range entries[:2] {
+		methods = append(methods, entry.Method)
+	}
+	if want := []string{ExportSymlink, "placeholder"}; fmt.Sprint(methods) != fmt.Sprint(want) {
+		t.Errorf("manifest methods = %v, want %v", methods, want)
+	}
+	if info, err := os.Lstat(filepath.Join(output, "T", "a.png")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("match is not a symlink: %v, %v", info, err)
+	}
+}
+
+func TestExportArchive(t *testing.T) {
+	project := createExportProject(t)
+
+	for _, format := range []string{archive.FormatZip, archive.FormatTarGz} {
+		output := filepath.Join(t.TempDir(), "out")
+		_, err := runExport(t, project, models.ExportOptions{OutputPath: output, Archive: format, UsePlaceholder: true, Manifest: ManifestCSV})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		// The extension is added and no folder is written
+		entries, err := archive.List(output + archive.Ext(format))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		if want := []string{"T/a.png", "T/b.png_no_match_placeholder.png", "manifest.csv"}; fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Errorf("%s: archive holds %v, want %v", format, names, want)
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Errorf("%s: export folder written: %v", format, err)
+		}
+	}
+}
+
+func TestExportPlaceholdersOfSeveralTargets(t *testing.T) {
+	project := createTestProject(t, t.TempDir(), map[string]string{"T1": t.TempDir(), "T2": t.TempDir()})
+	sf := models.SourceFile{ProjectID: project.ID, RelativePath: "a.png", Width: 32, Height: 32, Status: "analyzed"}
+	if err := database.DB.Create(&sf).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range project.ProjectTargets {
+		selection := models.TargetSelection{SourceFileID: sf.ID, ProjectTargetID: target.ID, NoMatch: true}
+		if err := database.DB.Create(&selection).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every target gets its own placeholder, in a folder and in an archive
+	output := t.TempDir()
+	if _, err := runExport(t, project, models.ExportOptions{OutputPath: output, UsePlaceholder: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"T1", "T2"} {
+		if _, err := os.Stat(filepath.Join(output, target, "a.png_no_match_placeholder.png")); err != nil {
+			t.Errorf("placeholder of %s not exported: %v", target, err)
+		}
+	}
+
+	output = filepath.Join(t.TempDir(), "out")
+	if _, err := runExport(t, project, models.ExportOptions{OutputPath: output, Archive: archive.FormatZip, UsePlaceholder: true}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := archive.List(output + archive.Ext(archive.FormatZip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if want := []string{"T1/a.png_no_match_placeholder.png", "T2/a.png_no_match_placeholder.png"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("archive holds %v, want %v", names, want)
+	}
+}
+
+func TestSaveCheckpointThrottled(t *testing.T) {
+	project := createTestProject(t, t.TempDir(), nil)
+	run := &models.ExportRun{ProjectID: project.ID}
+	if err := database.DB.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	svc := NewExportService(project, run, context.Background())
+	stored := func() int64 {
+		var count int64
+		database.DB.Model(&models.ExportOutcome{}).Where("export_run_id = ?", run.ID).Count(&count)
+		return count
+	}
+	finish := func(sourceFileID uint) {
+		svc.unsaved = append(svc.unsaved, models.ExportOutcome{ExportRunID: run.ID, SourceFileID: sourceFileID, TargetName: "T", Status: "exported"})
+		svc.checkpoint = uint64(sourceFileID)
+	}
+
+	// Nothing finished yet
+	svc.saveCheckpoint(true)
+	if n := stored(); n != 0 {
+		t.Errorf("%d outcomes saved before the first file", n)
+	}
+
+	finish(1)
+	svc.saveCheckpoint(false)
+	finish(2)
+	svc.saveCheckpoint(false)
+	if n := stored(); n != 1 {
+		t.Errorf("%d outcomes saved within a second, want 1", n)
+	}
+	svc.saveCheckpoint(true)
+	if n := stored(); n != 2 || len(svc.unsaved) != 0 {
+		t.Errorf("%d outcomes saved when forced, %d unsaved, want 2 and 0", n, len(svc.unsaved))
+	}
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	goimage "image"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/image"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// imageFeatures holds the features computed for a single image file
+type imageFeatures struct {
+	Width     int
+	Height    int
+	SizeBytes int64
+	Phash     string
+	Histogram string
+}
+
+// CacheStats summarizes the shared feature cache
+type CacheStats struct {
+	Entries    int64      `json:"entries"`
+	TotalHits  int64      `json:"total_hits"`
+	OldestUsed *time.Time `json:"oldest_used,omitempty"`
+	NewestUsed *time.Time `json:"newest_used,omitempty"`
+}
+
+// Cache hits are counted in memory and written in batches
+const (
+	cacheHitBatch         = 256
+	cacheHitFlushInterval = 5 * time.Second
+)
+
+var (
+	hitsMu       sync.Mutex
+	pendingHits  = make(map[uint]int64) // key: cache entry ID
+	lastHitFlush time.Time
+)
+
+// featureLookup remembers the cache keys of a file whose features were not
+// found in the cache, so they can be stored once computed
+type featureLookup struct {
+	path      string
+	fileKey   string
+	checksum  string
+	sizeBytes int64
+}
+
+// lookupFeatures returns the cached features of an image when the same
+// file was seen before. On a miss it returns nil features and a lookup to
+// load the image with.
+func lookupFeatures(ctx context.Context, fullPath string) (*imageFeatures, *featureLookup, error) {
+	fileInfo, err := storage.StatContext(ctx, fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileKey := cacheFileKey(fullPath, fileInfo)
+
+	// Fast path: same path, size and modification time
+	var cached models.FeatureCache
+	if err := database.DB.Where("file_key = ?", fileKey).Take(&cached).Error; err == nil {
+		touchCacheEntry(cached.ID)
+		return featuresFromCache(&cached, fileInfo.Size()), nil, nil
+	}
+
+	return nil, &featureLookup{
+		path:      fullPath,
+		fileKey:   fileKey,
+		sizeBytes: fileInfo.Size(),
+	}, nil
+}
+
+// load reads the file once and hashes it. When the same content is cached
+// under another path its features are returned; only on a miss is the
+// image decoded.
+func (l *featureLookup) load(ctx context.Context) (goimage.Image, *imageFeatures, error) {
+	reader, err := storage.OpenContext(ctx, l.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(data)
+	l.checksum = hex.EncodeToString(sum[:])
+
+	// Same content under another path
+	var cached models.FeatureCache
+	if err := database.DB.Where("checksum = ?", l.checksum).Take(&cached).Error; err == nil {
+		touchCacheEntry(cached.ID)
+		features := featuresFromCache(&cached, l.sizeBytes)
+		storeCacheEntry(l.fileKey, l.checksum, features)
+		return nil, features, nil
+	}
+
+	img, _, err := goimage.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, nil, nil
+}
+
+// computeFeatures calculates phash and histogram of a decoded image and
+// stores them in the cache
+func (l *featureLookup) computeFeatures(img goimage.Image) (*imageFeatures, error) {
+	comparator, err := image.NewImageComparatorFromImage(l.path, img)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert color histogram to JSON
+	histogramJSON, err := json.Marshal(comparator.ColorHistogram)
+	if err != nil {
+		return nil, err
+	}
+
+	features := &imageFeatures{
+		Width:     comparator.Width,
+		Height:    comparator.Height,
+		SizeBytes: l.sizeBytes,
+		Phash:     fmt.Sprintf("%d", comparator.Phash),
+		Histogram: string(histogramJSON),
+	}
+	storeCacheEntry(l.fileKey, l.checksum, features)
+	return features, nil
+}
+
+// featuresFromCache converts a cache entry into imageFeatures
+func featuresFromCache(entry *models.FeatureCache, sizeBytes int64) *imageFeatures {
+	return &imageFeatures{
+		Width:     entry.Width,
+		Height:    entry.Height,
+		SizeBytes: sizeBytes,
+		Phash:     entry.Phash,
+		Histogram: entry.Histogram,
+	}
+}
+
+// cacheFileKey builds the path+size+mtime lookup key
+func cacheFileKey(fullPath string, info fs.FileInfo) string {
+	return fmt.Sprintf("%s|%d|%d", fullPath, info.Size(), info.ModTime().UnixNano())
+}
+
+// storeCacheEntry saves features for later reuse. Failures are only logged,
+// the cache is an optimization and must never fail indexing.
+func storeCacheEntry(fileKey, checksum string, features *imageFeatures) {
+	entry := models.FeatureCache{
+		FileKey:    fileKey,
+		Checksum:   checksum,
+		Width:      features.Width,
+		Height:     features.Height,
+		Phash:      features.Phash,
+		Histogram:  features.Histogram,
+		LastUsedAt: time.Now(),
+	}
+	err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error
+	if err != nil {
+		log.Printf("[WARN] Failed to store feature cache entry: %v", err)
+	}
+}
+
+// touchCacheEntry records a cache hit. Hits are written in batches, see
+// flushCacheHits.
+func touchCacheEntry(id uint) {
+	hitsMu.Lock()
+	defer hitsMu.Unlock()
+
+	pendingHits[id]++
+	if len(pendingHits) >= cacheHitBatch || time.Since(lastHitFlush) >= cacheHitFlushInterval {
+		flushHitsLocked()
+	}
+}
+
+// flushCacheHits writes the counted cache hits to the database
+func flushCacheHits() {
+	hitsMu.Lock()
+	defer hitsMu.Unlock()
+	flushHitsLocked()
+}
+
+// flushHitsLocked writes pending hits in one transaction. Caller holds hitsMu.
+func flushHitsLocked() {
+	lastHitFlush = time.Now()
+	if len(pendingHits) == 0 {
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for id, hits := range pendingHits {
+			err := tx.Model(&models.FeatureCache{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+				"hit_count":    gorm.Expr("hit_count + ?", hits),
+				"last_used_at": lastHitFlush,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to record feature cache hits: %v", err)
+	}
+	pendingHits = make(map[uint]int64)
+}
+
+// GetCacheStats returns statistics about the shared feature cache
+func GetCacheStats() (*CacheStats, error) {
+	flushCacheHits()
+
+	stats := &CacheStats{}
+	err := database.DB.Model(&models.FeatureCache{}).
+		Select("COUNT(*) AS entries, COALESCE(SUM(hit_count), 0) AS total_hits").
+		Scan(stats).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.Entries > 0 {
+		var oldest, newest models.FeatureCache
+		database.DB.Order("last_used_at ASC").Select("last_used_at").Take(&oldest)
+		database.DB.Order("last_used_at DESC").Select("last_used_at").Take(&newest)
+		stats.OldestUsed = &oldest.LastUsedAt
+		stats.NewestUsed = &newest.LastUsedAt
+	}
+	return stats, nil
+}
+
+// EvictCache removes cache entries. Entries not used for unusedFor are
+// removed first; when maxEntries > 0 the least recently used entries above
+// that limit are removed as well. With both limits unset the cache is cleared.
+func EvictCache(unusedFor time.Duration, maxEntries int) (int64, error) {
+	flushCacheHits()
+
+	var removed int64
+
+	if unusedFor <= 0 && maxEntries <= 0 {
+		result := database.DB.Where("1 = 1").Delete(&models.FeatureCache{})
+		return result.RowsAffected, result.Error
+	}
+
+	if unusedFor > 0 {
+		result := database.DB.Where("last_used_at < ?", time.Now().Add(-unusedFor)).Delete(&models.FeatureCache{})
+		if result.Error != nil {
+			return removed, result.Error
+		}
+		removed += result.RowsAffected
+	}
+
+	if maxEntries > 0 {
+		keep := database.DB.Model(&models.FeatureCache{}).
+			Select("id").
+			Order("last_used_at DESC").
+			Limit(maxEntries)
+		result := database.DB.Where("id NOT IN (?)", keep).Delete(&models.FeatureCache{})
+		if result.Error != nil {
+			return removed, result.Error
+		}
+		removed += result.RowsAffected
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/testutil"
+)
+
+// clearFeatureCache empties the shared feature cache between tests
+func clearFeatureCache(t *testing.T) {
+	t.Helper()
+	if err := database.DB.Where("1 = 1").Delete(&models.FeatureCache{}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// indexFeatures looks up the features of an image, computing them on a miss
+func indexFeatures(t *testing.T, path string) *imageFeatures {
+	t.Helper()
+	features, lookup, err := lookupFeatures(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features != nil {
+		return features
+	}
+	img, features, err := lookup.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features != nil {
+		return features
+	}
+	features, err = lookup.computeFeatures(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return features
+}
+
+func TestLookupFeaturesCache(t *testing.T) {
+	clearFeatureCache(t)
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.png")
+	testutil.WritePNG(t, first, testutil.Pattern(40, 30, 1))
+
+	if features, lookup, err := lookupFeatures(context.Background(), first); features != nil || lookup == nil || err != nil {
+		t.Fatalf("lookupFeatures of a new file = %v, %v, %v", features, lookup, err)
+	}
+	features := indexFeatures(t, first)
+	if features.Width != 40 || features.Height != 30 || features.Phash == "" {
+		t.Fatalf("extractFeatures = %+v", features)
+	}
+
+	// Same file again: served from the file key
+	indexFeatures(t, first)
+
+	// Same content under another path: served from the checksum
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(dir, "copy.png")
+	if err := os.WriteFile(copied, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if again := indexFeatures(t, copied); *again != *features {
+		t.Errorf("features of the copy = %+v, want %+v", again, features)
+	}
+
+	stats, err := GetCacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 2 || stats.TotalHits != 2 {
+		t.Errorf("cache stats = %d entries, %d hits, want 2 and 2", stats.Entries, stats.TotalHits)
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		unusedFor  time.Duration
+		maxEntries int
+		want       []string // remaining file keys
+	}{
+		{name: "clear", want: nil},
+		{name: "unused", unusedFor: 48 * time.Hour, want: []string{"new", "recent"}},
+		{name: "max entries", maxEntries: 1, want: []string{"new"}},
+		{name: "both", unusedFor: 2 * time.Hour, maxEntries: 2, want: []string{"new"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearFeatureCache(t)
+			now := time.Now()
+			for key, lastUsed := range map[string]time.Time{
+				"new":    now,
+				"recent": now.Add(-24 * time.Hour),
+				"old":    now.Add(-72 * time.Hour),
+			} {
+				entry := models.FeatureCache{FileKey: key, Checksum: key, LastUsedAt: lastUsed}
+				if err := database.DB.Create(&entry).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := EvictCache(tt.unusedFor, tt.maxEntries); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			database.DB.Model(&models.FeatureCache{}).Order("file_key").Pluck("file_key", &keys)
+			if fmt.Sprint(keys) != fmt.Sprint(tt.want) {
+				t.Errorf("remaining = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheHitsAreBatched(t *testing.T) {
+	clearFeatureCache(t)
+	entry := models.FeatureCache{FileKey: "key", Checksum: "sum", LastUsedAt: time.Now().Add(-time.Hour)}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	flushCacheHits()
+
+	for i := 0; i < 3; i++ {
+		touchCacheEntry(entry.ID)
+	}
+	var stored models.FeatureCache
+	database.DB.First(&stored, entry.ID)
+	if stored.HitCount != 0 {
+		t.Errorf("hits written before the flush: %d", stored.HitCount)
+	}
+
+	stats, err := GetCacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalHits != 3 {
+		t.Errorf("total hits = %d after the flush, want 3", stats.TotalHits)
+	}
+	database.DB.First(&stored, entry.ID)
+	if !stored.LastUsedAt.After(entry.LastUsedAt) {
+		t.Errorf("last used %v not updated by the flush", stored.LastUsedAt)
+	}
+}
+
+func TestLoadHashesBeforeDecoding(t *testing.T) {
+	clearFeatureCache(t)
+	// Content known from another path is not decoded again, so even a file
+	// no decoder understands is served from the cache
+	data := []byte("not an image, but cached")
+	path := filepath.Join(t.TempDir(), "cached.png")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	entry := models.FeatureCache{FileKey: "elsewhere", Checksum: hex.EncodeToString(sum[:]), Width: 7, Height: 5, Phash: "ff", LastUsedAt: time.Now()}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, lookup, err := lookupFeatures(context.Background(), path)
+	if err != nil || lookup == nil {
+		t.Fatalf("lookupFeatures = %v, %v", lookup, err)
+	}
+	img, features, err := lookup.load(context.Background())
+	if err != nil || img != nil || features == nil || features.Width != 7 || features.Height != 5 {
+		t.Fatalf("load = %v, %+v, %v, want the cached features", img, features, err)
+	}
+
+	// Unknown content is decoded
+	broken := filepath.Join(t.TempDir(), "broken.png")
+	os.WriteFile(broken, []byte("not an image"), 0644)
+	_, lookup, _ = lookupFeatures(context.Background(), broken)
+	if _, _, err := lookup.load(context.Background()); err == nil {
+		t.Error("load of an undecodable file succeeded")
+	}
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/events"
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+// RootProgress reports indexing counters for a single source or target root
+type RootProgress struct {
+	Kind     string `json:"kind"` // source, target
+	TargetID uint   `json:"target_id,omitempty"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Scanned  int64  `json:"scanned"` // image files found while walking the root
+	Hashed   int64  `json:"hashed"`  // files whose features were computed or loaded from cache
+	Failed   int64  `json:"failed"`  // files that could not be read or decoded
+	Done     bool   `json:"done"`
+
+	progress *indexProgress
+}
+
+// indexProgress holds the progress of all roots of one indexing run
+type indexProgress struct {
+	projectID   uint
+	mu          sync.Mutex
+	roots       []*RootProgress
+	lastPublish time.Time
+}
+
+var (
+	indexProgressMu        sync.Mutex
+	indexProgressByProject = make(map[uint]*indexProgress)
+)
+
+// startIndexProgress resets the indexing progress of a project
+func startIndexProgress(projectID uint) *indexProgress {
+	progress := &indexProgress{projectID: projectID}
+
+	indexProgressMu.Lock()
+	indexProgressByProject[projectID] = progress
+	indexProgressMu.Unlock()
+
+	return progress
+}
+
+// addRoot registers a root and returns its counters
+func (p *indexProgress) addRoot(kind string, targetID uint, name, path string) *RootProgress {
+	root := &RootProgress{
+		Kind:     kind,
+		TargetID: targetID,
+		Name:     name,
+		Path:     path,
+		progress: p,
+	}
+
+	p.mu.Lock()
+	p.roots = append(p.roots, root)
+	p.mu.Unlock()
+
+	return root
+}
+
+// finish marks a root as completely indexed
+func (p *indexProgress) finish(root *RootProgress) {
+	p.mu.Lock()
+	root.Done = true
+	p.mu.Unlock()
+	p.publish(true)
+}
+
+// publish sends the counters of all roots to the event bus, at most once a
+// second unless force is set
+func (p *indexProgress) publish(force bool) {
+	p.mu.Lock()
+	if !force && time.Since(p.lastPublish) < time.Second {
+		p.mu.Unlock()
+		return
+	}
+	p.lastPublish = time.Now()
+	p.mu.Unlock()
+
+	roots := p.snapshot()
+	var done, total int64
+	for _, root := range roots {
+		done += root.Hashed + root.Failed
+		total += root.Scanned
+	}
+	events.Publish(events.Event{
+		Type:      events.TypeIndexing,
+		ProjectID: p.projectID,
+		Done:      done,
+		Total:     total,
+		Data:      roots,
+	})
+}
+
+// snapshot copies the counters of all roots
+func (p *indexProgress) snapshot() []RootProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot := make([]RootProgress, 0, len(p.roots))
+	for _, root := range p.roots {
+		snapshot = append(snapshot, RootProgress{
+			Kind:     root.Kind,
+			TargetID: root.TargetID,
+			Name:     root.Name,
+			Path:     root.Path,
+			Scanned:  atomic.LoadInt64(&root.Scanned),
+			Hashed:   atomic.LoadInt64(&root.Hashed),
+			Failed:   atomic.LoadInt64(&root.Failed),
+			Done:     root.Done,
+		})
+	}
+	return snapshot
+}
+
+func (r *RootProgress) addScanned() {
+	atomic.AddInt64(&r.Scanned, 1)
+	r.progress.publish(false)
+}
+
+func (r *RootProgress) addHashed() {
+	atomic.AddInt64(&r.Hashed, 1)
+	r.progress.publish(false)
+}
+
+// addFailed counts a file that could not be read or decoded and reports it
+func (r *RootProgress) addFailed(path string, err error) {
+	atomic.AddInt64(&r.Failed, 1)
+	publishFileError(r.progress.projectID, path, err)
+	r.progress.publish(false)
+}
+
+// GetIndexProgress returns a snapshot of the latest indexing run of a
+// project, or nil if the project was not indexed since the server started
+func GetIndexProgress(projectID uint) []RootProgress {
+	indexProgressMu.Lock()
+	progress, ok := indexProgressByProject[projectID]
+	indexProgressMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return progress.snapshot()
+}
+
+// ClearIndexProgress forgets the indexing progress of a project
+func ClearIndexProgress(projectID uint) {
+	indexProgressMu.Lock()
+	delete(indexProgressByProject, projectID)
+	indexProgressMu.Unlock()
+}
+
+// setPhase records which processing phase is currently running
+func setPhase(project *models.Project, phase string) {
+	project.Phase = phase
+	database.DB.Model(project).Update("phase", phase)
+	publishStatus(project.ID)
+}
+
+// failProject records why a run stopped and clears its phase. A cancelled
+// run is reported as cancelled, not as an error; paused runs get their
+// previous status back from comparisonJob.
+func failProject(project *models.Project, err error) error {
+	status := "error"
+	if errors.Is(err, context.Canceled) {
+		status = "cancelled"
+	}
+	database.DB.Model(project).Updates(map[string]interface{}{
+		"status":        status,
+		"phase":         "",
+		"error_message": err.Error(),
+	})
+	project.Phase = ""
+	return err
+}
+
+// publishStatus sends the stored status and phase of a project to the
+// event bus
+func publishStatus(projectID uint) {
+	var project models.Project
+	if err := database.DB.Select("id, status, phase, error_message").First(&project, projectID).Error; err != nil {
+		return
+	}
+
+	event := events.Event{
+		Type:      events.TypeStatus,
+		ProjectID: project.ID,
+		Status:    project.Status,
+		Phase:     project.Phase,
+	}
+	if project.ErrorMessage != nil {
+		event.Error = *project.ErrorMessage
+	}
+	events.Publish(event)
+}
+
+// publishFileError reports a file that could not be processed
+func publishFileError(projectID uint, path string, err error) {
+	events.Publish(events.Event{
+		Type:      events.TypeFileError,
+		ProjectID: projectID,
+		File:      path,
+		Error:     err.Error(),
+	})
+}
@@ -1,35 +1,37 @@
 package services
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 	"strings"
-	"sync"
 
 	"github.com/bilibili/look-alike/internal/database"
-	"github.com/bilibili/look-alike/internal/image"
 	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
 )
 
-var supportedExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".bmp", ".gif", ".tiff", ".tif"}
-
 // IndexingService handles indexing of source and target files
 type IndexingService struct {
-	project *models.Project
+	project  *models.Project
+	ctx      context.Context
+	progress *indexProgress
 }
 
 // NewIndexingService creates a new indexing service
-func NewIndexingService(project *models.Project) *IndexingService {
+func NewIndexingService(project *models.Project, ctx context.Context) *IndexingService {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	return &IndexingService{
-		project: project,
+		project:  project,
+		ctx:      ctx,
+		progress: startIndexProgress(project.ID),
 	}
 }
 
-// Process runs the indexing process
-func Process(project *models.Project) error {
+// Process runs the indexing process. It stops as soon as ctx is cancelled.
+func Process(project *models.Project, ctx context.Context) error {
 	log.Printf("========================================")
 	log.Printf("IndexingService.Process started")
 	log.Printf("Project: %s (ID: %d)", project.Name, project.ID)
@@ -41,30 +43,29 @@ func Process(project *models.Project) error {
 		return err
 	}
 
-	svc := NewIndexingService(project)
+	svc := NewIndexingService(project, ctx)
 
 	// Index source files
+	setPhase(project, "indexing_source")
 	if err := svc.indexSourceFiles(); err != nil {
-		database.DB.Model(&project).Updates(map[string]interface{}{
-			"status":        "error",
-			"error_message": err.Error(),
-		})
-		return fmt.Errorf("failed to index source files: %w", err)
+		return failProject(project, fmt.Errorf("failed to index source files: %w", err))
 	}
 
 	// Index target files
+	setPhase(project, "indexing_targets")
 	if err := svc.indexTargetFiles(); err != nil {
-		database.DB.Model(&project).Updates(map[string]interface{}{
-			"status":        "error",
-			"error_message": err.Error(),
-		})
-		return fmt.Errorf("failed to index target files: %w", err)
+		return failProject(project, fmt.Errorf("failed to index target files: %w", err))
 	}
 
 	// Update project status to indexed
-	if err := database.DB.Model(&project).Update("status", "indexed").Error; err != nil {
+	err := database.DB.Model(&project).Updates(map[string]interface{}{
+		"status": "indexed",
+		"phase":  "",
+	}).Error
+	if err != nil {
 		return err
 	}
+	project.Phase = ""
 
 	log.Println("[SUCCESS] IndexingService completed")
 	log.Println("========================================")
@@ -76,12 +77,14 @@ func (svc *IndexingService) indexSourceFiles() error {
 	log.Printf("[SOURCE] Scanning source directory: %s", svc.project.SourcePath)
 
 	sourcePath := strings.TrimSpace(svc.project.SourcePath)
-	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-		return fmt.Errorf("source path does not exist: %s", sourcePath)
+	if err := storage.CheckRoot(sourcePath); err != nil {
+		return fmt.Errorf("source path is not accessible: %s: %w", sourcePath, err)
 	}
 
+	root := svc.progress.addRoot("source", 0, "source", sourcePath)
+
 	// Find all image files
-	images, err := findImages(sourcePath)
+	images, err := findImages(svc.ctx, sourcePath, svc.project.SourceScan, root)
 	if err != nil {
 		return err
 	}
@@ -103,7 +106,7 @@ func (svc *IndexingService) indexSourceFiles() error {
 	// Filter new images
 	var newImages []string
 	for _, imgPath := range images {
-		relPath, _ := filepath.Rel(sourcePath, imgPath)
+		relPath, _ := relativePath(sourcePath, imgPath)
 		if !existingPaths[relPath] {
 			newImages = append(newImages, imgPath)
 		}
@@ -111,42 +114,41 @@ func (svc *IndexingService) indexSourceFiles() error {
 
 	log.Printf("[SOURCE] %d new source images to process", len(newImages))
 
-	// Process images concurrently
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 4) // Limit to 4 concurrent goroutines
-	var mu sync.Mutex
+	// Process images through the bounded indexing pipeline
 	var batch []models.SourceFile
 	const batchSize = 100
 
-	for _, imgPath := range newImages {
-		wg.Add(1)
-		go func(path string) {
-			defer wg.Done()
-			semaphore <- struct{}{} // Acquire
-			defer func() { <-semaphore }() // Release
+	// A failed insert stops the pipeline, the files would be lost otherwise
+	ctx, cancel := context.WithCancel(svc.ctx)
+	defer cancel()
+	var insertErr error
 
-			sourceFile, err := processSourceFile(path, sourcePath, svc.project.ID)
-			if err != nil {
-				log.Printf("[ERROR] Failed to process source file %s: %v", path, err)
-				return
-			}
+	pipelineErr := runIndexPipeline(ctx, newImages, root, func(path string, features *imageFeatures) {
+		if insertErr != nil {
+			return
+		}
+		sourceFile, err := buildSourceFile(path, sourcePath, svc.project.ID, features)
+		if err != nil {
+			log.Printf("[ERROR] Failed to process source file %s: %v", path, err)
+			publishFileError(svc.project.ID, path, err)
+			return
+		}
 
-			mu.Lock()
-			batch = append(batch, *sourceFile)
-			if len(batch) >= batchSize {
-				if err := database.DB.Create(&batch).Error; err != nil {
-					log.Printf("[ERROR] Failed to batch insert source files: %v", err)
-				} else {
-					log.Printf("[SOURCE] Batch inserted %d source files", len(batch))
-				}
-				batch = nil
+		batch = append(batch, *sourceFile)
+		if len(batch) >= batchSize {
+			if err := database.DB.Create(&batch).Error; err != nil {
+				insertErr = fmt.Errorf("failed to insert source files: %w", err)
+				cancel()
+				return
 			}
-			mu.Unlock()
-		}(imgPath)
+			log.Printf("[SOURCE] Batch inserted %d source files", len(batch))
+			batch = nil
+		}
+	})
+	if insertErr != nil {
+		return insertErr
 	}
 
-	wg.Wait()
-
 	// Insert remaining batch
 	if len(batch) > 0 {
 		if err := database.DB.Create(&batch).Error; err != nil {
@@ -155,6 +157,12 @@ func (svc *IndexingService) indexSourceFiles() error {
 		log.Printf("[SOURCE] Inserted final batch of %d source files", len(batch))
 	}
 
+	if pipelineErr != nil {
+		log.Println("[SOURCE] Context cancelled, stopping indexing")
+		return pipelineErr
+	}
+
+	svc.progress.finish(root)
 	log.Println("[SOURCE] Source file indexing completed")
 	return nil
 }
@@ -170,6 +178,9 @@ func (svc *IndexingService) indexTargetFiles() error {
 
 	for _, target := range targets {
 		if err := svc.indexSingleTarget(&target); err != nil {
+			if svc.ctx.Err() != nil {
+				return err
+			}
 			log.Printf("[ERROR] Failed to index target %s: %v", target.Name, err)
 			continue
 		}
@@ -184,11 +195,13 @@ func (svc *IndexingService) indexSingleTarget(target *models.ProjectTarget) erro
 	log.Printf("[TARGET] Indexing target: %s (%s)", target.Name, target.Path)
 
 	targetPath := strings.TrimSpace(target.Path)
-	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-		return fmt.Errorf("target path does not exist: %s", targetPath)
+	if err := storage.CheckRoot(targetPath); err != nil {
+		return fmt.Errorf("target path is not accessible: %s: %w", targetPath, err)
 	}
 
-	images, err := findImages(targetPath)
+	root := svc.progress.addRoot("target", target.ID, target.Name, targetPath)
+
+	images, err := findImages(svc.ctx, targetPath, target.Scan, root)
 	if err != nil {
 		return err
 	}
@@ -206,7 +219,7 @@ func (svc *IndexingService) indexSingleTarget(target *models.ProjectTarget) erro
 	// Filter new images
 	var newImages []string
 	for _, imgPath := range images {
-		relPath, _ := filepath.Rel(targetPath, imgPath)
+		relPath, _ := relativePath(targetPath, imgPath)
 		if !existingPaths[relPath] {
 			newImages = append(newImages, imgPath)
 		}
@@ -214,42 +227,41 @@ func (svc *IndexingService) indexSingleTarget(target *models.ProjectTarget) erro
 
 	log.Printf("[TARGET] %d new images to process for target %s", len(newImages), target.Name)
 
-	// Process concurrently
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 4)
-	var mu sync.Mutex
+	// Process through the bounded indexing pipeline
 	var batch []models.TargetFile
 	const batchSize = 100
 
-	for _, imgPath := range newImages {
-		wg.Add(1)
-		go func(path string) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+	// A failed insert stops the pipeline, the files would be lost otherwise
+	ctx, cancel := context.WithCancel(svc.ctx)
+	defer cancel()
+	var insertErr error
 
-			targetFile, err := processTargetFile(path, targetPath, target.ID)
-			if err != nil {
-				log.Printf("[ERROR] Failed to process target file %s: %v", path, err)
-				return
-			}
+	pipelineErr := runIndexPipeline(ctx, newImages, root, func(path string, features *imageFeatures) {
+		if insertErr != nil {
+			return
+		}
+		targetFile, err := buildTargetFile(path, targetPath, target.ID, features)
+		if err != nil {
+			log.Printf("[ERROR] Failed to process target file %s: %v", path, err)
+			publishFileError(svc.project.ID, path, err)
+			return
+		}
 
-			mu.Lock()
-			batch = append(batch, *targetFile)
-			if len(batch) >= batchSize {
-				if err := database.DB.Create(&batch).Error; err != nil {
-					log.Printf("[ERROR] Failed to batch insert target files: %v", err)
-				} else {
-					log.Printf("[TARGET] Batch inserted %d target files", len(batch))
-				}
-				batch = nil
+		batch = append(batch, *targetFile)
+		if len(batch) >= batchSize {
+			if err := database.DB.Create(&batch).Error; err != nil {
+				insertErr = fmt.Errorf("failed to insert target files: %w", err)
+				cancel()
+				return
 			}
-			mu.Unlock()
-		}(imgPath)
+			log.Printf("[TARGET] Batch inserted %d target files", len(batch))
+			batch = nil
+		}
+	})
+	if insertErr != nil {
+		return insertErr
 	}
 
-	wg.Wait()
-
 	// Insert remaining batch
 	if len(batch) > 0 {
 		if err := database.DB.Create(&batch).Error; err != nil {
@@ -258,125 +270,67 @@ func (svc *IndexingService) indexSingleTarget(target *models.ProjectTarget) erro
 		log.Printf("[TARGET] Inserted final batch of %d target files", len(batch))
 	}
 
-	return nil
-}
-
-// processSourceFile processes a single source file
-func processSourceFile(fullPath, basePath string, projectID uint) (*models.SourceFile, error) {
-	relPath, err := filepath.Rel(basePath, fullPath)
-	if err != nil {
-		return nil, err
+	if pipelineErr != nil {
+		log.Printf("[TARGET] Context cancelled, stopping indexing of target %s", target.Name)
+		return pipelineErr
 	}
 
-	// Get file info
-	fileInfo, err := os.Stat(fullPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Calculate phash and color histogram
-	comparator, err := image.NewImageComparator(fullPath)
-	if err != nil {
-		return nil, err
-	}
+	svc.progress.finish(root)
+	return nil
+}
 
-	// Convert color histogram to JSON
-	histogramJSON, err := json.Marshal(comparator.ColorHistogram)
+// buildSourceFile builds the SourceFile row for an indexed image
+func buildSourceFile(fullPath, basePath string, projectID uint, features *imageFeatures) (*models.SourceFile, error) {
+	relPath, err := relativePath(basePath, fullPath)
 	if err != nil {
 		return nil, err
 	}
 
 	// Calculate aspect ratio and area
-	aspectRatio := float64(comparator.Width) / float64(comparator.Height)
-	area := comparator.Width * comparator.Height
+	aspectRatio := float64(features.Width) / float64(features.Height)
+	area := features.Width * features.Height
 
 	sourceFile := &models.SourceFile{
 		ProjectID:    projectID,
 		RelativePath: relPath,
-		FullPath:     fullPath,
-		Width:        comparator.Width,
-		Height:       comparator.Height,
-		SizeBytes:    fileInfo.Size(),
+		Width:        features.Width,
+		Height:       features.Height,
+		SizeBytes:    features.SizeBytes,
 		Status:       "indexed",
 		AspectRatio:  aspectRatio,
 		Area:         area,
-		Phash:        fmt.Sprintf("%d", comparator.Phash),
+		Phash:        features.Phash,
 		Ahash:        "", // Not used
 		Dhash:        "", // Not used
-		Histogram:    string(histogramJSON),
+		Histogram:    features.Histogram,
 	}
 
 	return sourceFile, nil
 }
 
-// processTargetFile processes a single target file
-func processTargetFile(fullPath, basePath string, targetID uint) (*models.TargetFile, error) {
-	relPath, err := filepath.Rel(basePath, fullPath)
-	if err != nil {
-		return nil, err
-	}
-
-	fileInfo, err := os.Stat(fullPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Calculate phash and color histogram
-	comparator, err := image.NewImageComparator(fullPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Convert color histogram to JSON
-	histogramJSON, err := json.Marshal(comparator.ColorHistogram)
+// buildTargetFile builds the TargetFile row for an indexed image
+func buildTargetFile(fullPath, basePath string, targetID uint, features *imageFeatures) (*models.TargetFile, error) {
+	relPath, err := relativePath(basePath, fullPath)
 	if err != nil {
 		return nil, err
 	}
 
-	aspectRatio := float64(comparator.Width) / float64(comparator.Height)
-	area := comparator.Width * comparator.Height
+	aspectRatio := float64(features.Width) / float64(features.Height)
+	area := features.Width * features.Height
 
 	targetFile := &models.TargetFile{
 		ProjectTargetID: targetID,
-		FullPath:        fullPath,
 		RelativePath:    relPath,
-		Width:           comparator.Width,
-		Height:          comparator.Height,
-		SizeBytes:       fileInfo.Size(),
+		Width:           features.Width,
+		Height:          features.Height,
+		SizeBytes:       features.SizeBytes,
 		AspectRatio:     aspectRatio,
 		Area:            area,
-		Phash:           fmt.Sprintf("%d", comparator.Phash),
+		Phash:           features.Phash,
 		Ahash:           "", // Not used
 		Dhash:           "", // Not used
-		Histogram:       string(histogramJSON),
+		Histogram:       features.Histogram,
 	}
 
 	return targetFile, nil
 }
-
-// findImages finds all image files in a directory recursively
-func findImages(rootPath string) ([]string, error) {
-	var images []string
-
-	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		ext := strings.ToLower(filepath.Ext(path))
-		for _, supportedExt := range supportedExtensions {
-			if ext == supportedExt {
-				images = append(images, path)
-				break
-			}
-		}
-
-		return nil
-	})
-
-	return images, err
-}
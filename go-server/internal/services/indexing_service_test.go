@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/testutil"
+	"gorm.io/gorm"
+)
+
+// createTestProject stores a project with one target per name => path
+func createTestProject(t *testing.T, sourcePath string, targets map[string]string) *models.Project {
+	t.Helper()
+	project := &models.Project{Name: t.Name(), SourcePath: sourcePath}
+	for name, path := range targets {
+		project.ProjectTargets = append(project.ProjectTargets, models.ProjectTarget{Name: name, Path: path})
+	}
+	if err := database.DB.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	return project
+}
+
+// writeTestImages writes count distinct PNG images named a.png, b.png, ...
+func writeTestImages(t *testing.T, dir string, count, seed int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		testutil.WritePNG(t, filepath.Join(dir, string(rune('a'+i))+".png"), testutil.Pattern(32, 32, seed+i))
+	}
+}
+
+func TestProcessProgress(t *testing.T) {
+	dir := t.TempDir()
+	source, target := filepath.Join(dir, "source"), filepath.Join(dir, "target")
+	writeTestImages(t, source, 2, 1)
+	writeTestImages(t, target, 3, 10)
+	if err := os.WriteFile(filepath.Join(source, "broken.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	project := createTestProject(t, source, map[string]string{"T": target})
+
+	if err := Process(project, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []RootProgress{
+		{Kind: "source", Name: "source", Path: source, Scanned: 3, Hashed: 2, Failed: 1, Done: true},
+		{Kind: "target", TargetID: project.ProjectTargets[0].ID, Name: "T", Path: target, Scanned: 3, Hashed: 3, Done: true},
+	}
+	got := GetIndexProgress(project.ID)
+	if len(got) != len(want) {
+		t.Fatalf("progress = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("root %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	var stored models.Project
+	database.DB.First(&stored, project.ID)
+	if stored.Status != "indexed" || stored.Phase != "" {
+		t.Errorf("status = %q, phase %q, want indexed and no phase", stored.Status, stored.Phase)
+	}
+}
+
+func TestProcessCancelled(t *testing.T) {
+	source := t.TempDir()
+	writeTestImages(t, source, 2, 1)
+	project := createTestProject(t, source, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := Process(project, ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Process = %v, want context.Canceled", err)
+	}
+
+	progress := GetIndexProgress(project.ID)
+	if len(progress) != 1 || progress[0].Done || progress[0].Hashed != 0 {
+		t.Errorf("progress after cancel = %+v", progress)
+	}
+	var count int64
+	database.DB.Model(&models.SourceFile{}).Where("project_id = ?", project.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("%d source files indexed after cancel", count)
+	}
+	var stored models.Project
+	database.DB.First(&stored, project.ID)
+	if stored.Status != "cancelled" || stored.Phase != "" {
+		t.Errorf("cancelled run left status %q, phase %q", stored.Status, stored.Phase)
+	}
+}
+
+func TestProcessBatchInsertFails(t *testing.T) {
+	source := t.TempDir()
+	for i := 0; i < 120; i++ {
+		testutil.WritePNG(t, filepath.Join(source, fmt.Sprintf("%03d.png", i)), testutil.Pattern(16, 16, i))
+	}
+	project := createTestProject(t, source, nil)
+
+	// Fail the first batch of 100, the rest would insert fine
+	var failed atomic.Bool
+	err := database.DB.Callback().Create().Before("gorm:create").Register("test:fail_batch", func(db *gorm.DB) {
+		if db.Statement.Table == "source_files" && failed.CompareAndSwap(false, true) {
+			db.AddError(errors.New("disk full"))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.DB.Callback().Create().Remove("test:fail_batch")
+
+	if err := Process(project, context.Background()); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Process = %v, want the insert error", err)
+	}
+	var stored models.Project
+	database.DB.First(&stored, project.ID)
+	if stored.Status != "error" {
+		t.Errorf("status = %q after a failed insert, want error", stored.Status)
+	}
+}
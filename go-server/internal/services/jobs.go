@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+// Job types
+const (
+	JobComparison        = "comparison"         // index and compare (or cluster) a new project
+	JobAddTarget         = "add_target"         // index and compare a target added later
+	JobResume            = "resume"             // continue an interrupted run
+	JobRestart           = "restart"            // discard results and run again
+	JobExport            = "export"             // export the selections of an ExportRun
+	JobResolveDuplicates = "resolve_duplicates" // export or quarantine duplicates
+)
+
+// AddTargetPayload are the arguments of an add_target job
+type AddTargetPayload struct {
+	TargetID uint `json:"target_id"`
+}
+
+// ExportPayload are the arguments of an export job; the options are
+// stored on the export run
+type ExportPayload struct {
+	ExportRunID uint `json:"export_run_id"`
+}
+
+// ResolveDuplicatesPayload are the arguments of a resolve_duplicates job
+type ResolveDuplicatesPayload struct {
+	Action     string `json:"action"`
+	ClusterIDs []uint `json:"cluster_ids,omitempty"`
+	OutputPath string `json:"output_path"`
+}
+
+// RegisterJobHandlers registers every job type with the job queue
+func RegisterJobHandlers(queue *workers.JobQueue) {
+	queue.Register(JobComparison, workers.TaskTypeComparison, comparisonJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		if project.Type == "dedupe" {
+			return ProcessDedupe(project, ctx)
+		}
+		return ProcessComparison(project, ctx)
+	}))
+
+	queue.Register(JobAddTarget, workers.TaskTypeComparison, comparisonJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		var payload AddTargetPayload
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		if project.Type == "dedupe" {
+			return ProcessDedupe(project, ctx)
+		}
+
+		var target models.ProjectTarget
+		if err := database.DB.Where("id = ? AND project_id = ?", payload.TargetID, project.ID).First(&target).Error; err != nil {
+			return fmt.Errorf("target %d not found", payload.TargetID)
+		}
+		return ProcessNewTarget(project, &target, ctx)
+	}))
+
+	queue.Register(JobResume, workers.TaskTypeComparison, comparisonJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		return ResumeProject(project, ctx)
+	}))
+
+	queue.Register(JobRestart, workers.TaskTypeComparison, comparisonJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		return RestartProject(project, ctx)
+	}))
+
+	queue.Register(JobExport, workers.TaskTypeExport, projectJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		var payload ExportPayload
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		var run models.ExportRun
+		if err := database.DB.Where("id = ? AND project_id = ?", payload.ExportRunID, project.ID).First(&run).Error; err != nil {
+			return fmt.Errorf("export run %d not found", payload.ExportRunID)
+		}
+		svc := NewExportService(project, &run, ctx)
+		return svc.Process()
+	}))
+
+	queue.Register(JobResolveDuplicates, workers.TaskTypeExport, projectJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		var payload ResolveDuplicatesPayload
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		return ResolveClusters(project, payload.ClusterIDs, payload.Action, payload.OutputPath, ctx)
+	}))
+}
+
+// projectJob wraps a handler that needs the job's project
+func projectJob(fn func(ctx context.Context, project *models.Project, job *models.Job) error) workers.JobHandler {
+	return func(ctx context.Context, job *models.Job) error {
+		var project models.Project
+		if err := database.DB.First(&project, job.ProjectID).Error; err != nil {
+			return fmt.Errorf("project %d not found", job.ProjectID)
+		}
+		return fn(ctx, &project, job)
+	}
+}
+
+// comparisonJob wraps a handler that drives the project status. When the job
+// is paused the status and error it had before are put back, so the project
+// does not show the cancellation as an error; the pause itself is reported
+// from the paused job.
+func comparisonJob(fn func(ctx context.Context, project *models.Project, job *models.Job) error) workers.JobHandler {
+	return projectJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		status, errorMessage := project.Status, project.ErrorMessage
+		err := fn(ctx, project, job)
+		if workers.Paused(ctx) {
+			database.DB.Model(&models.Project{}).Where("id = ?", project.ID).Updates(map[string]interface{}{
+				"status":        status,
+				"error_message": errorMessage,
+			})
+			log.Printf("[JOBS] Project %d (%s) paused during %s", project.ID, project.Name, project.Phase)
+		}
+		publishStatus(project.ID)
+		return err
+	})
+}
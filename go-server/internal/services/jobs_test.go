@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/workers"
+	"gorm.io/gorm"
+)
+
+var startQueue sync.Once
+
+// startJobQueue registers the job handlers with the global queue and starts
+// its dispatcher, once per test binary
+func startJobQueue(t *testing.T) *workers.JobQueue {
+	t.Helper()
+	queue := workers.GetQueue()
+	startQueue.Do(func() {
+		RegisterJobHandlers(queue)
+		if err := queue.Start(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return queue
+}
+
+// waitForJob waits until a job reaches state
+func waitForJob(t *testing.T, id uint, state string) models.Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var job models.Job
+		if err := database.DB.First(&job, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d is %s, want %s", id, job.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestComparisonJobPauseRestoresStatus(t *testing.T) {
+	queue := startJobQueue(t)
+	started := make(chan struct{})
+	queue.Register("test_comparison", workers.TaskTypeComparison, comparisonJob(func(ctx context.Context, project *models.Project, job *models.Job) error {
+		database.DB.Model(project).Updates(map[string]interface{}{"status": "comparing", "error_message": "cancelled"})
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+
+	project := createTestProject(t, t.TempDir(), nil)
+	database.DB.Model(project).Update("status", "completed")
+	project.Status = "completed"
+
+	job, err := queue.Enqueue("test_comparison", project.ID, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := queue.Pause(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, job.ID, workers.JobPaused)
+
+	var stored models.Project
+	database.DB.First(&stored, project.ID)
+	if stored.Status != "completed" || stored.ErrorMessage != nil {
+		t.Errorf("paused project has status %q, error %v, want completed and no error", stored.Status, stored.ErrorMessage)
+	}
+	queue.Cancel(job.ID)
+}
+
+func TestExportPauseAndResume(t *testing.T) {
+	queue := startJobQueue(t)
+	project := createTestProject(t, t.TempDir(), map[string]string{"T": t.TempDir()})
+	names := []string{"a.png", "b.png", "c.png"}
+	var sourceFiles []models.SourceFile
+	for _, name := range names {
+		sf := models.SourceFile{ProjectID: project.ID, RelativePath: name, Width: 8, Height: 8, Status: "analyzed"}
+		if err := database.DB.Create(&sf).Error; err != nil {
+			t.Fatal(err)
+		}
+		selection := models.TargetSelection{SourceFileID: sf.ID, ProjectTargetID: project.ProjectTargets[0].ID, NoMatch: true}
+		if err := database.DB.Create(&selection).Error; err != nil {
+			t.Fatal(err)
+		}
+		sourceFiles = append(sourceFiles, sf)
+	}
+
+	// Pause the export as soon as it saved its first checkpoint
+	var paused atomic.Bool
+	err := database.DB.Callback().Update().After("gorm:update").Register("test:pause_export", func(db *gorm.DB) {
+		dest, ok := db.Statement.Dest.(map[string]interface{})
+		if !ok || db.Statement.Table != "jobs" || dest["checkpoint"] == nil {
+			return
+		}
+		var running models.Job
+		if database.DB.Where("type = ? AND state = ?", JobExport, workers.JobRunning).First(&running).Error == nil &&
+			paused.CompareAndSwap(false, true) {
+			queue.Pause(running.ID)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.DB.Callback().Update().Remove("test:pause_export")
+
+	output := t.TempDir()
+	placeholder := func(name string) string {
+		return filepath.Join(output, "T", name+"_no_match_placeholder.png")
+	}
+
+	run, err := CreateExportRun(project, models.ExportOptions{UsePlaceholder: true, OutputPath: output, Manifest: "json"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := waitForJob(t, run.JobID, workers.JobPaused)
+	if want := strconv.FormatUint(uint64(sourceFiles[0].ID), 10); stored.Checkpoint != want {
+		t.Errorf("paused export has checkpoint %q, want %q", stored.Checkpoint, want)
+	}
+	for i, name := range names {
+		_, err := os.Stat(placeholder(name))
+		if exported := err == nil; exported != (i == 0) {
+			t.Errorf("%s exported = %v before resume", name, exported)
+		}
+	}
+	var outcomes int64
+	database.DB.Model(&models.ExportOutcome{}).Where("export_run_id = ? AND status <> ?", run.ID, "pending").Count(&outcomes)
+	if outcomes != 1 {
+		t.Errorf("%d finished outcomes stored with the checkpoint, want 1", outcomes)
+	}
+
+	// The resumed export skips what was exported before the pause
+	if err := os.Remove(placeholder(names[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Resume(run.JobID); err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, run.JobID, workers.JobCompleted)
+	database.DB.First(run, run.ID)
+	if run.Total != 3 || run.Processed != 3 || run.Failed != 0 {
+		t.Errorf("export run counted %d/%d processed, %d failed, want 3/3, 0", run.Processed, run.Total, run.Failed)
+	}
+	for i, name := range names {
+		_, err := os.Stat(placeholder(name))
+		if exported := err == nil; exported != (i != 0) {
+			t.Errorf("%s exported = %v by the resumed export", name, exported)
+		}
+	}
+
+	// The manifest lists the file written before the pause as it was written
+	data, err := os.ReadFile(filepath.Join(output, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest []ManifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 3 {
+		t.Fatalf("manifest has %d entries, want 3", len(manifest))
+	}
+	for _, entry := range manifest {
+		if entry.Method != "placeholder" || entry.Status != "exported" {
+			t.Errorf("manifest entry %s: method %q, status %q", entry.SourcePath, entry.Method, entry.Status)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/testutil"
+)
+
+func TestMain(m *testing.M) {
+	testutil.RunWithDatabase(m)
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"gorm.io/gorm"
+)
+
+// DefaultOrphanThreshold is the candidate score at or above which a target
+// file counts as matched, the highest adaptive threshold of the comparison
+const DefaultOrphanThreshold = highestAdaptiveThreshold
+
+// OrphanFile is a target file no source file maps to
+type OrphanFile struct {
+	ID           uint     `json:"id"`
+	TargetID     uint     `json:"target_id"`
+	TargetName   string   `json:"target_name"`
+	RelativePath string   `json:"relative_path"`
+	Path         string   `json:"path"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	SizeBytes    int64    `json:"size_bytes"`
+	BestScore    *float64 `json:"best_score"` // highest candidate score below the threshold, nil if never a candidate
+}
+
+// OrphanTargetStats counts the orphans of one target
+type OrphanTargetStats struct {
+	TargetID   uint   `json:"target_id"`
+	TargetName string `json:"target_name"`
+	TotalFiles int64  `json:"total_files"`
+	Orphans    int64  `json:"orphans"`
+}
+
+// orphanScope selects the target files of a project that were never picked
+// in a TargetSelection and never became a candidate scoring at or above
+// threshold
+func orphanScope(projectID uint, threshold float64) *gorm.DB {
+	return database.DB.Table("target_files").
+		Joins("INNER JOIN project_targets ON project_targets.id = target_files.project_target_id").
+		Where("project_targets.project_id = ?", projectID).
+		Where(`NOT EXISTS (SELECT 1 FROM target_selections
+			INNER JOIN comparison_candidates ON comparison_candidates.id = target_selections.selected_candidate_id
+			WHERE comparison_candidates.target_file_id = target_files.id)`).
+		Where(`NOT EXISTS (SELECT 1 FROM comparison_candidates
+			WHERE comparison_candidates.target_file_id = target_files.id
+			AND comparison_candidates.similarity_score >= ?)`, threshold)
+}
+
+// FindOrphans returns the orphaned target files of a project ordered by
+// target and path. targetID limits the result to one target when non-zero;
+// perPage <= 0 returns every orphan.
+func FindOrphans(project *models.Project, threshold float64, targetID uint, page, perPage int) ([]OrphanFile, int64, error) {
+	query := orphanScope(project.ID, threshold)
+	if targetID != 0 {
+		query = query.Where("target_files.project_target_id = ?", targetID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	query = query.Select(`target_files.id, target_files.project_target_id AS target_id,
+		project_targets.name AS target_name, project_targets.path AS root,
+		target_files.relative_path, target_files.width, target_files.height, target_files.size_bytes,
+		(SELECT MAX(similarity_score) FROM comparison_candidates
+			WHERE comparison_candidates.target_file_id = target_files.id) AS best_score`).
+		Order("project_targets.id, target_files.relative_path")
+	if perPage > 0 {
+		query = query.Limit(perPage).Offset((page - 1) * perPage)
+	}
+
+	var rows []struct {
+		OrphanFile
+		Root string
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+
+	orphans := make([]OrphanFile, 0, len(rows))
+	for _, row := range rows {
+		orphan := row.OrphanFile
+		orphan.Path = storage.Resolve(row.Root, orphan.RelativePath)
+		orphans = append(orphans, orphan)
+	}
+	return orphans, total, nil
+}
+
+// GetOrphanStats counts files and orphans for every target of a project
+func GetOrphanStats(project *models.Project, threshold float64) ([]OrphanTargetStats, error) {
+	var targets []models.ProjectTarget
+	if err := database.DB.Where("project_id = ?", project.ID).Order("id").Find(&targets).Error; err != nil {
+		return nil, err
+	}
+
+	var orphanCounts []struct {
+		TargetID uint
+		Count    int64
+	}
+	err := orphanScope(project.ID, threshold).
+		Select("target_files.project_target_id AS target_id, COUNT(*) AS count").
+		Group("target_files.project_target_id").
+		Scan(&orphanCounts).Error
+	if err != nil {
+		return nil, err
+	}
+	orphansByTarget := make(map[uint]int64, len(orphanCounts))
+	for _, row := range orphanCounts {
+		orphansByTarget[row.TargetID] = row.Count
+	}
+
+	stats := make([]OrphanTargetStats, 0, len(targets))
+	for _, target := range targets {
+		var totalFiles int64
+		database.DB.Model(&models.TargetFile{}).Where("project_target_id = ?", target.ID).Count(&totalFiles)
+		stats = append(stats, OrphanTargetStats{
+			TargetID:   target.ID,
+			TargetName: target.Name,
+			TotalFiles: totalFiles,
+			Orphans:    orphansByTarget[target.ID],
+		})
+	}
+	return stats, nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+// createOrphanFixture stores a project with one source file and a target
+// holding selected, matched, weakly matched and unmatched files
+func createOrphanFixture(t *testing.T) (*models.Project, map[string]uint) {
+	t.Helper()
+	dir := t.TempDir()
+	project := createTestProject(t, dir, map[string]string{"T": dir})
+	targetID := project.ProjectTargets[0].ID
+
+	source := models.SourceFile{ProjectID: project.ID, RelativePath: "s.png"}
+	if err := database.DB.Create(&source).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]uint)
+	scores := map[string]float64{"selected.png": 20, "matched.png": 80, "weak.png": 30}
+	for _, name := range []string{"matched.png", "selected.png", "unmatched.png", "weak.png"} {
+		tf := models.TargetFile{ProjectTargetID: targetID, RelativePath: name}
+		if err := database.DB.Create(&tf).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = tf.ID
+
+		score, ok := scores[name]
+		if !ok {
+			continue
+		}
+		candidate := models.ComparisonCandidate{SourceFileID: source.ID, ProjectTargetID: targetID,
+			TargetFileID: tf.ID, SimilarityScore: score}
+		if err := database.DB.Create(&candidate).Error; err != nil {
+			t.Fatal(err)
+		}
+		if name == "selected.png" {
+			selection := models.TargetSelection{SourceFileID: source.ID, ProjectTargetID: targetID,
+				SelectedCandidateID: &candidate.ID}
+			if err := database.DB.Create(&selection).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return project, ids
+}
+
+func TestOrphanScope(t *testing.T) {
+	project, ids := createOrphanFixture(t)
+
+	tests := []struct {
+		threshold float64
+		want      []string
+	}{
+		{threshold: DefaultOrphanThreshold, want: []string{"unmatched.png", "weak.png"}},
+		{threshold: 25, want: []string{"unmatched.png"}},
+		{threshold: 90, want: []string{"matched.png", "unmatched.png", "weak.png"}},
+	}
+
+	for _, tt := range tests {
+		var got []uint
+		orphanScope(project.ID, tt.threshold).Order("target_files.relative_path").Pluck("target_files.id", &got)
+		var want []uint
+		for _, name := range tt.want {
+			want = append(want, ids[name])
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("threshold %.0f: orphans = %v, want %v (%v)", tt.threshold, got, want, tt.want)
+		}
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	project, _ := createOrphanFixture(t)
+
+	orphans, total, err := FindOrphans(project, DefaultOrphanThreshold, 0, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(orphans) != 1 || orphans[0].RelativePath != "unmatched.png" || orphans[0].BestScore != nil {
+		t.Errorf("first page = %+v, total %d", orphans, total)
+	}
+
+	orphans, _, err = FindOrphans(project, DefaultOrphanThreshold, project.ProjectTargets[0].ID, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].BestScore == nil || *orphans[0].BestScore != 30 || orphans[0].TargetName != "T" {
+		t.Errorf("second page = %+v", orphans)
+	}
+
+	stats, err := GetOrphanStats(project, DefaultOrphanThreshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].TotalFiles != 4 || stats[0].Orphans != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
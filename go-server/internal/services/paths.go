@@ -0,0 +1,118 @@
+package services
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+	"github.com/bilibili/look-alike/internal/workers"
+	"gorm.io/gorm"
+)
+
+// SourceFilePath resolves the full path of a source file from its project root
+func SourceFilePath(project *models.Project, sf *models.SourceFile) string {
+	return storage.Resolve(project.SourcePath, sf.RelativePath)
+}
+
+// TargetFilePath resolves the full path of a target file from its target root
+func TargetFilePath(target *models.ProjectTarget, tf *models.TargetFile) string {
+	return storage.Resolve(target.Path, tf.RelativePath)
+}
+
+// CandidatePaths resolves the file paths of comparison candidates in bulk
+func CandidatePaths(candidates []models.ComparisonCandidate) (map[uint]string, error) {
+	paths := make(map[uint]string)
+	if len(candidates) == 0 {
+		return paths, nil
+	}
+
+	targetFileIDs := make([]uint, 0, len(candidates))
+	for _, cand := range candidates {
+		targetFileIDs = append(targetFileIDs, cand.TargetFileID)
+	}
+
+	var rows []struct {
+		ID           uint
+		RelativePath string
+		Root         string
+	}
+	err := database.DB.Table("target_files").
+		Select("target_files.id, target_files.relative_path, project_targets.path AS root").
+		Joins("INNER JOIN project_targets ON project_targets.id = target_files.project_target_id").
+		Where("target_files.id IN ?", targetFileIDs).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byTargetFile := make(map[uint]string, len(rows))
+	for _, row := range rows {
+		byTargetFile[row.ID] = storage.Resolve(row.Root, row.RelativePath)
+	}
+	for _, cand := range candidates {
+		paths[cand.ID] = byTargetFile[cand.TargetFileID]
+	}
+	return paths, nil
+}
+
+// HasRunningJob reports whether a job of the project is queued or running.
+// It reads the stored jobs, so the CLI can check it without a queue.
+func HasRunningJob(projectID uint) (bool, error) {
+	var count int64
+	err := database.DB.Model(&models.Job{}).
+		Where("project_id = ? AND state IN ?", projectID, []string{workers.JobQueued, workers.JobRunning}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// RebaseRoots moves the source root and/or target roots of a project to new
+// locations. Files are stored relative to their roots, so candidates,
+// selections and confirmations are kept as they are. Empty values leave a
+// root unchanged. Every new root must be reachable.
+func RebaseRoots(project *models.Project, sourcePath string, targetPaths map[uint]string) error {
+	var targets []models.ProjectTarget
+	if err := database.DB.Where("project_id = ?", project.ID).Find(&targets).Error; err != nil {
+		return err
+	}
+	known := make(map[uint]bool, len(targets))
+	for _, t := range targets {
+		known[t.ID] = true
+	}
+
+	if sourcePath != "" {
+		if err := storage.CheckRoot(sourcePath); err != nil {
+			return fmt.Errorf("source path is not accessible: %s: %w", sourcePath, err)
+		}
+	}
+	for id, path := range targetPaths {
+		if !known[id] {
+			return fmt.Errorf("target %d does not belong to project %d", id, project.ID)
+		}
+		if err := storage.CheckRoot(path); err != nil {
+			return fmt.Errorf("target path is not accessible: %s: %w", path, err)
+		}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if sourcePath != "" {
+			log.Printf("[REBASE] Project %d source: %s -> %s", project.ID, project.SourcePath, sourcePath)
+			if err := tx.Model(project).Update("source_path", sourcePath).Error; err != nil {
+				return err
+			}
+		}
+		for _, t := range targets {
+			path, ok := targetPaths[t.ID]
+			if !ok {
+				continue
+			}
+			log.Printf("[REBASE] Project %d target %s: %s -> %s", project.ID, t.Name, t.Path, path)
+			if err := tx.Model(&models.ProjectTarget{}).Where("id = ?", t.ID).Update("path", path).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+func TestRebaseRoots(t *testing.T) {
+	dir := t.TempDir()
+	project := createTestProject(t, filepath.Join(dir, "old-source"), map[string]string{"A": filepath.Join(dir, "old-a")})
+	other := createTestProject(t, dir, map[string]string{"B": dir})
+	targetID := project.ProjectTargets[0].ID
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name        string
+		sourcePath  string
+		targetPaths map[uint]string
+		wantErr     bool
+		wantSource  string
+		wantTarget  string
+	}{
+		{name: "missing source", sourcePath: missing, wantErr: true,
+			wantSource: project.SourcePath, wantTarget: project.ProjectTargets[0].Path},
+		{name: "missing target", sourcePath: dir, targetPaths: map[uint]string{targetID: missing}, wantErr: true,
+			wantSource: project.SourcePath, wantTarget: project.ProjectTargets[0].Path},
+		{name: "foreign target", targetPaths: map[uint]string{other.ProjectTargets[0].ID: dir}, wantErr: true,
+			wantSource: project.SourcePath, wantTarget: project.ProjectTargets[0].Path},
+		{name: "source only", sourcePath: dir,
+			wantSource: dir, wantTarget: project.ProjectTargets[0].Path},
+		{name: "target only", targetPaths: map[uint]string{targetID: dir},
+			wantSource: dir, wantTarget: dir},
+	}
+
+	for _, tt := range tests {
+		err := RebaseRoots(project, tt.sourcePath, tt.targetPaths)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: RebaseRoots error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+
+		var stored models.Project
+		database.DB.Preload("ProjectTargets").First(&stored, project.ID)
+		if stored.SourcePath != tt.wantSource || stored.ProjectTargets[0].Path != tt.wantTarget {
+			t.Errorf("%s: roots = %q, %q, want %q, %q", tt.name,
+				stored.SourcePath, stored.ProjectTargets[0].Path, tt.wantSource, tt.wantTarget)
+		}
+	}
+}
+
+func TestHasRunningJob(t *testing.T) {
+	project := createTestProject(t, t.TempDir(), nil)
+
+	tests := []struct {
+		state string
+		want  bool
+	}{
+		{state: workers.JobCompleted, want: false},
+		{state: workers.JobPaused, want: false},
+		{state: workers.JobQueued, want: true},
+		{state: workers.JobRunning, want: true},
+	}
+	for _, tt := range tests {
+		job := models.Job{Type: JobComparison, ProjectID: project.ID, State: tt.state}
+		if err := database.DB.Create(&job).Error; err != nil {
+			t.Fatal(err)
+		}
+		got, err := HasRunningJob(project.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("HasRunningJob with a %s job = %v, want %v", tt.state, got, tt.want)
+		}
+		database.DB.Delete(&job)
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	goimage "image"
+	"log"
+
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+// decodedQueueSize bounds the decoded images waiting for the feature stage.
+// A decoded image can take tens of MB, so only a few are buffered.
+const decodedQueueSize = 2
+
+// indexResult is handed from the feature stage to the writer stage
+type indexResult struct {
+	path     string
+	features *imageFeatures
+}
+
+// runIndexPipeline indexes files through three bounded stages:
+//
+//	decode   - cache lookup and image decoding (worker pool)
+//	features - phash and color histogram (worker pool)
+//	write    - a single goroutine calling write, which batches DB inserts
+//
+// Memory stays bounded because decoded images wait in a small fixed queue
+// and results are small. write is never called concurrently. Cancelling ctx
+// stops feeding new files and skips queued ones. It returns ctx.Err().
+func runIndexPipeline(ctx context.Context, paths []string, root *RootProgress, write func(path string, features *imageFeatures)) error {
+	workerCount := workers.DefaultWorkerCount()
+	// Decode jobs take their IO slot in decodeStage, so it is not held
+	// while they wait for the feature stage
+	decodePool := workers.NewWorkerPool(workerCount)
+	featurePool := workers.NewLimitedWorkerPool(workers.ResourceCPU, workerCount).WithQueue(decodedQueueSize)
+	results := make(chan indexResult, workerCount*2)
+
+	// Writer stage
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for result := range results {
+			write(result.path, result.features)
+		}
+	}()
+
+	decodePool.Start()
+	featurePool.Start()
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+
+		decodePool.AddJob(func() {
+			if ctx.Err() != nil {
+				return
+			}
+
+			img, lookup, features, err := decodeStage(ctx, path)
+			if err != nil {
+				log.Printf("[ERROR] Failed to index %s: %v", path, err)
+				root.addFailed(path, err)
+				return
+			}
+			if features != nil {
+				root.addHashed()
+				results <- indexResult{path: path, features: features}
+				return
+			}
+
+			featurePool.AddJob(func() {
+				computeStage(ctx, lookup, img, root, results)
+			})
+		})
+	}
+
+	// Drain stages in order: decode jobs enqueue feature jobs, feature jobs
+	// send results to the writer
+	decodePool.Stop()
+	featurePool.Stop()
+	close(results)
+	<-writerDone
+	flushCacheHits()
+
+	return ctx.Err()
+}
+
+// decodeStage is the decode stage of runIndexPipeline. It holds an IO slot
+// while it reads the file and returns either cached features or the
+// decoded image with its lookup.
+func decodeStage(ctx context.Context, path string) (goimage.Image, *featureLookup, *imageFeatures, error) {
+	workers.Acquire(workers.ResourceIO)
+	defer workers.Release(workers.ResourceIO)
+
+	features, lookup, err := lookupFeatures(ctx, path)
+	if err != nil || features != nil {
+		return nil, nil, features, err
+	}
+	img, features, err := lookup.load(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode: %w", err)
+	}
+	return img, lookup, features, nil
+}
+
+// computeStage is the feature stage of runIndexPipeline
+func computeStage(ctx context.Context, lookup *featureLookup, img goimage.Image, root *RootProgress, results chan<- indexResult) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	features, err := lookup.computeFeatures(img)
+	if err != nil {
+		log.Printf("[ERROR] Failed to compute features for %s: %v", lookup.path, err)
+		root.addFailed(lookup.path, err)
+		return
+	}
+
+	root.addHashed()
+	results <- indexResult{path: lookup.path, features: features}
+}
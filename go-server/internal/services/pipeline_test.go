@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/testutil"
+	"github.com/bilibili/look-alike/internal/workers"
+)
+
+// writePipelineImages writes count distinct images and returns their paths
+func writePipelineImages(t *testing.T, count int) []string {
+	t.Helper()
+	clearFeatureCache(t)
+	dir := t.TempDir()
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, "img", string(rune('a'+i%26))+string(rune('a'+i/26))+".png")
+		testutil.WritePNG(t, paths[i], testutil.Pattern(16, 16, i))
+	}
+	return paths
+}
+
+func TestRunIndexPipeline(t *testing.T) {
+	paths := writePipelineImages(t, 20)
+	broken := filepath.Join(t.TempDir(), "broken.png")
+	if err := os.WriteFile(broken, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, broken)
+
+	root := startIndexProgress(0).addRoot("source", 0, "source", "")
+	written := make(map[string]int)
+	var active int32
+	err := runIndexPipeline(context.Background(), paths, root, func(path string, features *imageFeatures) {
+		if atomic.AddInt32(&active, 1) != 1 {
+			t.Error("write called concurrently")
+		}
+		written[path]++
+		atomic.AddInt32(&active, -1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(written) != 20 || written[broken] != 0 {
+		t.Errorf("written %d files, want 20 without the broken one", len(written))
+	}
+	for path, n := range written {
+		if n != 1 {
+			t.Errorf("%s written %d times", path, n)
+		}
+	}
+	if root.Hashed != 20 || root.Failed != 1 {
+		t.Errorf("hashed %d, failed %d, want 20 and 1", root.Hashed, root.Failed)
+	}
+}
+
+func TestRunIndexPipelineCancel(t *testing.T) {
+	paths := writePipelineImages(t, 40)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var written int
+	err := runIndexPipeline(ctx, paths, startIndexProgress(0).addRoot("source", 0, "source", ""), func(path string, features *imageFeatures) {
+		written++
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("runIndexPipeline = %v, want context.Canceled", err)
+	}
+	if written == 0 || written == len(paths) {
+		t.Errorf("written %d of %d files after cancel", written, len(paths))
+	}
+}
+
+func TestRunIndexPipelineBackpressure(t *testing.T) {
+	t.Setenv(workers.WorkerCountEnv, "2")
+	paths := writePipelineImages(t, 40)
+
+	// A blocked writer must stall the earlier stages instead of letting
+	// them decode every file into memory
+	release := make(chan struct{})
+	var once sync.Once
+	root := startIndexProgress(0).addRoot("source", 0, "source", "")
+	done := make(chan error)
+	var written int32
+	go func() {
+		done <- runIndexPipeline(context.Background(), paths, root, func(path string, features *imageFeatures) {
+			once.Do(func() { <-release })
+			atomic.AddInt32(&written, 1)
+		})
+	}()
+
+	// 2 workers: 4 buffered results, 2 blocked feature workers, 1 in write
+	const bound = 7
+	time.Sleep(200 * time.Millisecond)
+	if hashed := atomic.LoadInt64(&root.Hashed); hashed > bound {
+		t.Errorf("%d files hashed while the writer was blocked, want at most %d", hashed, bound)
+	}
+
+	// Decode workers waiting for the feature stage hold no IO slot
+	if os.Getenv(workers.IOLimitEnv) == "" {
+		acquired := make(chan struct{})
+		go func() {
+			for i := 0; i < 2*runtime.NumCPU(); i++ {
+				workers.Acquire(workers.ResourceIO)
+			}
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			for i := 0; i < 2*runtime.NumCPU(); i++ {
+				workers.Release(workers.ResourceIO)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("IO slots held while the pipeline was stalled")
+		}
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if written != int32(len(paths)) {
+		t.Errorf("written %d of %d files", written, len(paths))
+	}
+}
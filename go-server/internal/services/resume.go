@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/workers"
+	"gorm.io/gorm"
+)
+
+// activeStatuses are the states of a project while a task works on it
+var activeStatuses = []string{"pending", "indexing", "indexed", "processing", "comparing"}
+
+// comparisonJobs are the job types that drive a project's status
+var comparisonJobs = []string{JobComparison, JobAddTarget, JobResume, JobRestart}
+
+// MarkInterruptedProjects flags projects that were still being processed
+// when the server stopped. It must run at startup, before the job queue
+// starts. Projects whose job is going to be queued again or is paused are
+// left alone; the others can be resumed with ResumeProject or started over
+// with RestartProject.
+func MarkInterruptedProjects() ([]models.Project, error) {
+	pendingJobs := database.DB.Model(&models.Job{}).Select("project_id").
+		Where("type IN ?", comparisonJobs).
+		Where("state IN ? OR (state = ? AND attempts < ?)", []string{workers.JobQueued, workers.JobPaused}, workers.JobRunning, workers.MaxJobAttempts)
+
+	var projects []models.Project
+	if err := database.DB.Where("status IN ? AND id NOT IN (?)", activeStatuses, pendingJobs).Find(&projects).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range projects {
+		project := &projects[i]
+		stage := project.Phase
+		if stage == "" {
+			stage = project.Status
+		}
+		message := fmt.Sprintf("server stopped during %s", stage)
+
+		err := database.DB.Model(project).Updates(map[string]interface{}{
+			"status":        "interrupted",
+			"phase":         "",
+			"error_message": message,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[RESUME] Project %d (%s) was interrupted: %s", project.ID, project.Name, message)
+	}
+
+	return projects, nil
+}
+
+// ResumeProject continues an interrupted or failed run. Files that are
+// already indexed are not read again, analyzed source files are skipped and
+// auto-selections are only added where none exist.
+func ResumeProject(project *models.Project, ctx context.Context) error {
+	log.Printf("[RESUME] Resuming project %d (%s)", project.ID, project.Name)
+	database.DB.Model(project).Update("error_message", nil)
+	if project.Type == "dedupe" {
+		return ProcessDedupe(project, ctx)
+	}
+	return ProcessComparison(project, ctx)
+}
+
+// RestartProject discards the comparison results of a project and runs it
+// again from the indexed files. Candidates and selections are deleted;
+// confirmations are kept. Dedupe projects lose all of their clusters.
+func RestartProject(project *models.Project, ctx context.Context) error {
+	log.Printf("[RESUME] Restarting project %d (%s)", project.ID, project.Name)
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if project.Type == "dedupe" {
+			clusterIDs := tx.Model(&models.DuplicateCluster{}).Select("id").Where("project_id = ?", project.ID)
+			if err := tx.Where("cluster_id IN (?)", clusterIDs).Delete(&models.DuplicateMember{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("project_id = ?", project.ID).Delete(&models.DuplicateCluster{}).Error
+		}
+
+		sourceFileIDs := func() *gorm.DB {
+			return tx.Model(&models.SourceFile{}).Select("id").Where("project_id = ?", project.ID)
+		}
+		if err := tx.Where("source_file_id IN (?)", sourceFileIDs()).Delete(&models.TargetSelection{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("source_file_id IN (?)", sourceFileIDs()).Delete(&models.ComparisonCandidate{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.SourceFile{}).
+			Where("project_id = ? AND status = ?", project.ID, "analyzed").
+			Update("status", "indexed").Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset project: %w", err)
+	}
+
+	return ResumeProject(project, ctx)
+}
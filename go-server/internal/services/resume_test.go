@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"gorm.io/gorm"
+)
+
+// createComparisonFixture stores a project whose target holds copies of
+// its source images
+func createComparisonFixture(t *testing.T, count int) *models.Project {
+	t.Helper()
+	clearFeatureCache(t)
+	dir := t.TempDir()
+	writeTestImages(t, filepath.Join(dir, "source"), count, 1)
+	writeTestImages(t, filepath.Join(dir, "target"), count, 1)
+	return createTestProject(t, filepath.Join(dir, "source"), map[string]string{"T": filepath.Join(dir, "target")})
+}
+
+// countCandidates returns the candidates of a project and how many distinct
+// source/target file pairs they cover
+func countCandidates(t *testing.T, projectID uint) (total, pairs int64) {
+	t.Helper()
+	query := database.DB.Model(&models.ComparisonCandidate{}).
+		Joins("INNER JOIN source_files ON source_files.id = comparison_candidates.source_file_id").
+		Where("source_files.project_id = ?", projectID)
+	query.Session(&gorm.Session{}).Count(&total)
+	query.Session(&gorm.Session{}).Distinct("comparison_candidates.source_file_id", "comparison_candidates.target_file_id").Count(&pairs)
+	return total, pairs
+}
+
+func TestResumeAfterFailedSave(t *testing.T) {
+	project := createComparisonFixture(t, 3)
+
+	// Fail saveResults after the candidates were written, right before the
+	// source files are marked analyzed
+	var failing atomic.Bool
+	failing.Store(true)
+	err := database.DB.Callback().Update().Before("gorm:update").Register("test:fail_analyzed", func(db *gorm.DB) {
+		if failing.Load() && db.Statement.Table == "source_files" {
+			db.AddError(errors.New("simulated crash"))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.DB.Callback().Update().Remove("test:fail_analyzed")
+
+	if err := ProcessComparison(project, context.Background()); err == nil {
+		t.Fatal("comparison succeeded although saving failed")
+	}
+	if total, _ := countCandidates(t, project.ID); total != 0 {
+		t.Errorf("%d candidates kept from the failed save", total)
+	}
+	var indexed int64
+	database.DB.Model(&models.SourceFile{}).Where("project_id = ? AND status = ?", project.ID, "indexed").Count(&indexed)
+	if indexed != 3 {
+		t.Errorf("%d source files left indexed, want 3", indexed)
+	}
+
+	failing.Store(false)
+	if err := ResumeProject(project, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	total, pairs := countCandidates(t, project.ID)
+	if total == 0 || total != pairs {
+		t.Errorf("after resume: %d candidates for %d pairs", total, pairs)
+	}
+	var stored models.Project
+	database.DB.First(&stored, project.ID)
+	if stored.Status != "completed" || stored.ErrorMessage != nil {
+		t.Errorf("after resume: status %q, error %v", stored.Status, stored.ErrorMessage)
+	}
+
+	// Running again from scratch gives the same candidates
+	if err := RestartProject(project, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := countCandidates(t, project.ID); again != total {
+		t.Errorf("after restart: %d candidates, want %d", again, total)
+	}
+}
+
+func TestMarkInterruptedProjects(t *testing.T) {
+	database.DB.Model(&models.Project{}).Where("1 = 1").Update("status", "completed")
+
+	tests := []struct {
+		status      string
+		phase       string
+		wantStatus  string
+		wantMessage string
+	}{
+		{status: "comparing", phase: "comparing", wantStatus: "interrupted", wantMessage: "server stopped during comparing"},
+		{status: "indexing", wantStatus: "interrupted", wantMessage: "server stopped during indexing"},
+		{status: "processing", phase: "indexing_targets", wantStatus: "interrupted", wantMessage: "server stopped during indexing_targets"},
+		{status: "completed", wantStatus: "completed"},
+		{status: "error", wantStatus: "error"},
+	}
+
+	ids := make([]uint, len(tests))
+	for i, tt := range tests {
+		project := models.Project{Name: tt.status, SourcePath: "/src", Status: tt.status, Phase: tt.phase}
+		if err := database.DB.Create(&project).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = project.ID
+	}
+
+	interrupted, err := MarkInterruptedProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interrupted) != 3 {
+		t.Errorf("%d projects reported as interrupted, want 3", len(interrupted))
+	}
+
+	for i, tt := range tests {
+		var project models.Project
+		database.DB.First(&project, ids[i])
+		message := ""
+		if project.ErrorMessage != nil {
+			message = *project.ErrorMessage
+		}
+		if project.Status != tt.wantStatus || message != tt.wantMessage || project.Phase != "" && tt.wantStatus == "interrupted" {
+			t.Errorf("%s: status %q, phase %q, message %q, want %q, %q",
+				tt.status, project.Status, project.Phase, message, tt.wantStatus, tt.wantMessage)
+		}
+	}
+}
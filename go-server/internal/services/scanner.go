@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bilibili/look-alike/internal/archive"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/storage"
+)
+
+var supportedExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".bmp", ".gif", ".tiff", ".tif"}
+
+// scanner walks a root directory according to its ScanOptions
+type scanner struct {
+	ctx     context.Context
+	opts    models.ScanOptions
+	root    *RootProgress
+	rootDev uint64
+	hasDev  bool
+	visited map[string]bool // real paths of directories already walked
+	images  []string
+}
+
+// findImages finds all image files below rootPath and counts them as
+// scanned on root. Archives found along the way (or given as rootPath) are
+// indexed in place and their images are returned as virtual paths, e.g.
+// "a/bundle.zip!/dir/x.png". opts decides whether symlinked directories are
+// followed, dotfiles skipped and mount points crossed.
+func findImages(ctx context.Context, rootPath string, opts models.ScanOptions, root *RootProgress) ([]string, error) {
+	if storage.IsRemote(rootPath) {
+		return findRemoteImages(ctx, rootPath, opts, root)
+	}
+
+	info, err := os.Stat(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scanner{
+		ctx:     ctx,
+		opts:    opts,
+		root:    root,
+		visited: make(map[string]bool),
+	}
+
+	if !info.IsDir() {
+		s.addFile(rootPath)
+		return s.images, nil
+	}
+
+	if opts.OneFilesystem {
+		s.rootDev, s.hasDev = deviceID(info)
+	}
+
+	if err := s.walkDir(rootPath); err != nil {
+		return nil, err
+	}
+	return s.images, nil
+}
+
+// walkDir scans a directory recursively
+func (s *scanner) walkDir(dir string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	realPath, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if s.visited[realPath] {
+		log.Printf("[SCAN] Skipping %s: directory already scanned (symlink loop)", dir)
+		return nil
+	}
+	s.visited[realPath] = true
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if s.opts.SkipHidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		isDir := entry.IsDir()
+
+		if entry.Type()&os.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Printf("[SCAN] Skipping broken symlink %s: %v", path, err)
+				continue
+			}
+			if info.IsDir() && !s.opts.FollowSymlinks {
+				continue
+			}
+			isDir = info.IsDir()
+		}
+
+		if !isDir {
+			s.addFile(path)
+			continue
+		}
+
+		if s.opts.OneFilesystem && s.hasDev {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if dev, ok := deviceID(info); ok && dev != s.rootDev {
+				log.Printf("[SCAN] Skipping %s: on another filesystem", path)
+				continue
+			}
+		}
+
+		if err := s.walkDir(path); err != nil {
+			return fmt.Errorf("failed to scan %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// findRemoteImages lists the images of a root on remote storage. Symlink and
+// mount options do not apply there, and archives are only read locally.
+func findRemoteImages(ctx context.Context, rootPath string, opts models.ScanOptions, root *RootProgress) ([]string, error) {
+	backend, err := storage.For(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := backend.(storage.Lister)
+	if !ok {
+		return nil, fmt.Errorf("cannot list %s", rootPath)
+	}
+
+	var images []string
+	err = lister.List(ctx, rootPath, func(p string, info fs.FileInfo) error {
+		rel, err := storage.Rel(rootPath, p)
+		if err != nil {
+			return err
+		}
+		if opts.SkipHidden && hasHiddenElement(rel) {
+			return nil
+		}
+		if archive.IsArchive(p) {
+			log.Printf("[SCAN] Skipping remote archive %s: archives are only supported on local storage", p)
+			return nil
+		}
+		if isSupportedImage(p) {
+			images = append(images, p)
+			root.addScanned()
+		}
+		return nil
+	})
+	return images, err
+}
+
+// addFile records an image file, or the images inside an archive
+func (s *scanner) addFile(path string) {
+	if archive.IsArchive(path) {
+		entries, err := archive.List(path)
+		if err != nil {
+			log.Printf("[WARN] Skipping unreadable archive %s: %v", path, err)
+			return
+		}
+		for _, entry := range entries {
+			if s.opts.SkipHidden && hasHiddenElement(entry.Name) {
+				continue
+			}
+			if isSupportedImage(entry.Name) {
+				s.images = append(s.images, archive.Join(path, entry.Name))
+				s.root.addScanned()
+			}
+		}
+		return
+	}
+
+	if isSupportedImage(path) {
+		s.images = append(s.images, path)
+		s.root.addScanned()
+	}
+}
+
+// hasHiddenElement reports whether any element of a slash-separated path
+// starts with a dot
+func hasHiddenElement(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSupportedImage checks the file extension against supportedExtensions
+func isSupportedImage(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, supportedExt := range supportedExtensions {
+		if ext == supportedExt {
+			return true
+		}
+	}
+	return false
+}
+
+// relativePath returns the path of fullPath relative to basePath. When
+// basePath is itself an archive, the entry name inside it is returned.
+func relativePath(basePath, fullPath string) (string, error) {
+	archivePath, entry, ok := archive.Split(fullPath)
+	if !ok {
+		return storage.Rel(basePath, fullPath)
+	}
+	if archivePath == basePath {
+		return entry, nil
+	}
+	relArchive, err := filepath.Rel(basePath, archivePath)
+	if err != nil {
+		return "", err
+	}
+	return archive.Join(relArchive, entry), nil
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+// writeScanTree creates files (slash-separated, relative to dir) and
+// symlinks (name -> target), skipping the test if symlinks are unsupported
+func writeScanTree(t *testing.T, dir string, files []string, links map[string]string) {
+	t.Helper()
+	for _, name := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+}
+
+func TestFindImagesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	writeScanTree(t, dir,
+		[]string{"root/a.png", "root/sub/b.jpg", "root/.hidden/d.png", "root/notes.txt", "outside/c.png"},
+		map[string]string{
+			"root/sub/loop": "..",          // cycle back to the root
+			"root/sub/self": ".",           // cycle to its own directory
+			"root/link":     "../outside",  // directory outside the root
+			"root/broken":   "missing",     // dangling link
+			"outside/back":  "../root/sub", // reached again through link
+		})
+	root := filepath.Join(dir, "root")
+
+	tests := []struct {
+		name string
+		opts models.ScanOptions
+		want []string
+	}{
+		{
+			name: "links not followed",
+			want: []string{".hidden/d.png", "a.png", "sub/b.jpg"},
+		},
+		{
+			// Directories are walked in name order, so sub is first
+			// reached through link/back and skipped later
+			name: "links followed once",
+			opts: models.ScanOptions{FollowSymlinks: true},
+			want: []string{".hidden/d.png", "a.png", "link/back/b.jpg", "link/c.png"},
+		},
+		{
+			name: "hidden skipped",
+			opts: models.ScanOptions{FollowSymlinks: true, SkipHidden: true},
+			want: []string{"a.png", "link/back/b.jpg", "link/c.png"},
+		},
+	}
+
+	for _, tt := range tests {
+		progress := startIndexProgress(0).addRoot("source", 0, "root", root)
+		images, err := findImages(context.Background(), root, tt.opts, progress)
+		if err != nil {
+			t.Fatalf("%s: findImages = %v", tt.name, err)
+		}
+
+		var got []string
+		for _, p := range images {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(rel))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: found %v, want %v", tt.name, got, tt.want)
+		}
+		if progress.Scanned != int64(len(tt.want)) {
+			t.Errorf("%s: scanned %d, want %d", tt.name, progress.Scanned, len(tt.want))
+		}
+	}
+}
+
+func TestFindImagesCancelled(t *testing.T) {
+	dir := t.TempDir()
+	writeScanTree(t, dir, []string{"a.png"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	progress := startIndexProgress(0).addRoot("source", 0, "root", dir)
+	if _, err := findImages(ctx, dir, models.ScanOptions{}, progress); err != context.Canceled {
+		t.Errorf("findImages with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
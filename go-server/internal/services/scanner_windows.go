@@ -0,0 +1,10 @@
+//go:build windows
+
+package services
+
+import "os"
+
+// deviceID is not available on Windows, mount boundaries are not detected
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"gorm.io/gorm"
+)
+
+// ProcessNewTarget indexes a target added to an existing project and
+// compares it with the source files that were already analyzed. Other
+// targets are not touched, so their selections and confirmations are kept.
+// Source files that were never compared pick the target up with the rest of
+// the targets when the comparison runs again.
+func ProcessNewTarget(project *models.Project, target *models.ProjectTarget, ctx context.Context) error {
+	log.Println("=========================================")
+	log.Printf("Adding target %s (%s) to project %d: %s", target.Name, target.Path, project.ID, project.Name)
+	log.Println("=========================================")
+
+	previousStatus := project.Status
+	database.DB.Model(&project).Update("status", "processing")
+
+	// Index the new target only
+	indexer := NewIndexingService(project, ctx)
+	setPhase(project, "indexing_targets")
+	if err := indexer.indexSingleTarget(target); err != nil {
+		return failProject(project, fmt.Errorf("failed to index target %s: %w", target.Name, err))
+	}
+
+	var sourceFiles []models.SourceFile
+	if err := database.DB.Where("project_id = ? AND status = ?", project.ID, "analyzed").Find(&sourceFiles).Error; err != nil {
+		return failProject(project, err)
+	}
+
+	if len(sourceFiles) > 0 {
+		var targets []models.ProjectTarget
+		if err := database.DB.Preload("TargetFiles").Where("id = ?", target.ID).Find(&targets).Error; err != nil {
+			return failProject(project, err)
+		}
+
+		log.Printf("[COMPARING] Comparing %d analyzed source files with target %s...", len(sourceFiles), target.Name)
+		setPhase(project, "comparing")
+
+		svc := NewComparisonService(project, ctx)
+		if err := svc.compareSources(sourceFiles, targets); err != nil {
+			return failProject(project, err)
+		}
+
+		setPhase(project, "auto_selecting")
+		if err := svc.createAutoSelections(target.ID); err != nil {
+			log.Printf("[WARNING] Failed to create auto-selections: %v", err)
+		}
+	}
+
+	database.DB.Model(&project).Updates(map[string]interface{}{
+		"status":   previousStatus,
+		"phase":    "",
+		"ended_at": time.Now(),
+	})
+
+	log.Printf("[SUCCESS] Target %s added to project %d", target.Name, project.ID)
+	return nil
+}
+
+// RemoveTarget deletes a target of a project together with its indexed
+// files, candidates, selections and duplicate cluster memberships
+func RemoveTarget(project *models.Project, targetID uint) error {
+	var target models.ProjectTarget
+	if err := database.DB.Where("id = ? AND project_id = ?", targetID, project.ID).First(&target).Error; err != nil {
+		return fmt.Errorf("target %d of project %d: %w", targetID, project.ID, err)
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("project_target_id = ?", target.ID).Delete(&models.TargetSelection{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("project_target_id = ?", target.ID).Delete(&models.ComparisonCandidate{}).Error; err != nil {
+			return err
+		}
+		targetFileIDs := tx.Model(&models.TargetFile{}).Select("id").Where("project_target_id = ?", target.ID)
+		if err := tx.Where("target_file_id IN (?)", targetFileIDs).Delete(&models.DuplicateMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("project_target_id = ?", target.ID).Delete(&models.TargetFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&target).Error; err != nil {
+			return err
+		}
+
+		log.Printf("[TARGET] Removed target %s from project %d", target.Name, project.ID)
+		return nil
+	})
+}
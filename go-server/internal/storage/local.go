@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/bilibili/look-alike/internal/archive"
+)
+
+// localBackend reads from the local filesystem, including entries inside
+// ZIP and TAR archives addressed by virtual paths (see archive.Split)
+type localBackend struct{}
+
+var local Backend = localBackend{}
+
+func (localBackend) Open(ctx context.Context, p string) (io.ReadCloser, error) {
+	return archive.Open(p)
+}
+
+func (localBackend) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	return archive.Stat(p)
+}
+
+func (localBackend) CheckRoot(root string) error {
+	_, err := os.Stat(root)
+	return err
+}
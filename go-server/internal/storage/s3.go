@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Environment variables configuring the S3-compatible backend
+const (
+	S3EndpointEnv  = "LOOK_ALIKE_S3_ENDPOINT"   // host[:port], default s3.amazonaws.com
+	S3AccessKeyEnv = "LOOK_ALIKE_S3_ACCESS_KEY" // falls back to AWS_ACCESS_KEY_ID
+	S3SecretKeyEnv = "LOOK_ALIKE_S3_SECRET_KEY" // falls back to AWS_SECRET_ACCESS_KEY
+	S3RegionEnv    = "LOOK_ALIKE_S3_REGION"
+	S3InsecureEnv  = "LOOK_ALIKE_S3_INSECURE" // "true" to use plain HTTP, e.g. a local MinIO
+)
+
+// s3Backend reads objects from an S3-compatible service. Paths look like
+// s3://bucket/prefix/key.png
+type s3Backend struct {
+	client *minio.Client
+}
+
+var (
+	s3Once    sync.Once
+	s3Shared  *s3Backend
+	s3InitErr error
+)
+
+// getS3 returns the shared S3 backend, creating the client on first use
+func getS3() (Backend, error) {
+	s3Once.Do(func() {
+		endpoint := envOr(S3EndpointEnv, "s3.amazonaws.com")
+		accessKey := envOr(S3AccessKeyEnv, os.Getenv("AWS_ACCESS_KEY_ID"))
+		secretKey := envOr(S3SecretKeyEnv, os.Getenv("AWS_SECRET_ACCESS_KEY"))
+
+		client, err := minio.New(endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+			Secure: os.Getenv(S3InsecureEnv) != "true",
+			Region: os.Getenv(S3RegionEnv),
+		})
+		if err != nil {
+			s3InitErr = fmt.Errorf("failed to create S3 client: %w", err)
+			return
+		}
+		s3Shared = &s3Backend{client: client}
+	})
+	if s3InitErr != nil {
+		return nil, s3InitErr
+	}
+	return s3Shared, nil
+}
+
+// splitS3 splits s3://bucket/key into bucket and key. Keys with "." or
+// ".." segments are rejected, they could reach outside a root's prefix.
+func splitS3(p string) (bucket, key string, err error) {
+	rest := p[strings.Index(p, "://")+3:]
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 path, expected s3://bucket/key: %s", p)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return "", "", fmt.Errorf("invalid S3 path, %q segments are not allowed: %s", segment, p)
+		}
+	}
+	return bucket, key, nil
+}
+
+func (b *s3Backend) Open(ctx context.Context, p string) (io.ReadCloser, error) {
+	bucket, key, err := splitS3(p)
+	if err != nil {
+		return nil, err
+	}
+	return b.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+}
+
+func (b *s3Backend) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	bucket, key, err := splitS3(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := b.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return objectInfo{info}, nil
+}
+
+func (b *s3Backend) CheckRoot(root string) error {
+	bucket, prefix, err := splitS3(root)
+	if err != nil {
+		return err
+	}
+	exists, err := b.client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket does not exist: %s", bucket)
+	}
+	if prefix == "" {
+		return nil
+	}
+
+	// A folder only exists while some object is stored under it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := b.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:    strings.TrimSuffix(prefix, "/") + "/",
+		Recursive: true,
+		MaxKeys:   1,
+	})
+	object, ok := <-objects
+	if !ok {
+		return fmt.Errorf("no objects under %s", root)
+	}
+	return object.Err
+}
+
+func (b *s3Backend) List(ctx context.Context, root string, fn func(p string, info fs.FileInfo) error) error {
+	bucket, prefix, err := splitS3(root)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	// Cancelling stops the listing goroutine when fn returns early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := b.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return object.Err
+		}
+		if strings.HasSuffix(object.Key, "/") {
+			continue // folder marker
+		}
+		if err := fn("s3://"+bucket+"/"+object.Key, objectInfo{object}); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// objectInfo adapts minio.ObjectInfo to fs.FileInfo
+type objectInfo struct {
+	info minio.ObjectInfo
+}
+
+func (o objectInfo) Name() string       { return path.Base(o.info.Key) }
+func (o objectInfo) Size() int64        { return o.info.Size }
+func (o objectInfo) Mode() fs.FileMode  { return 0444 }
+func (o objectInfo) ModTime() time.Time { return o.info.LastModified }
+func (o objectInfo) IsDir() bool        { return false }
+func (o objectInfo) Sys() interface{}   { return o.info }
+
+// envOr returns the value of an environment variable or a fallback
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// S3TestBucketEnv names a bucket on the configured S3 endpoint used by the
+// integration test, e.g. a local MinIO:
+//
+//	LOOK_ALIKE_S3_ENDPOINT=127.0.0.1:9000 LOOK_ALIKE_S3_INSECURE=true \
+//	LOOK_ALIKE_S3_ACCESS_KEY=minioadmin LOOK_ALIKE_S3_SECRET_KEY=minioadmin \
+//	LOOK_ALIKE_S3_TEST_BUCKET=look-alike-test go test ./internal/storage
+const S3TestBucketEnv = "LOOK_ALIKE_S3_TEST_BUCKET"
+
+func TestSplitS3(t *testing.T) {
+	tests := []struct {
+		path    string
+		bucket  string
+		key     string
+		wantErr bool
+	}{
+		{path: "s3://bucket/dir/a.png", bucket: "bucket", key: "dir/a.png"},
+		{path: "s3://bucket", bucket: "bucket", key: ""},
+		{path: "s3://bucket/", bucket: "bucket", key: ""},
+		{path: "s3://bucket/dir/..a.png", bucket: "bucket", key: "dir/..a.png"},
+		{path: "s3:///key", wantErr: true},
+		{path: "s3://bucket/dir/../other/a.png", wantErr: true},
+		{path: "s3://bucket/../a.png", wantErr: true},
+		{path: "s3://bucket/dir/./a.png", wantErr: true},
+		{path: "s3://bucket/..", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		bucket, key, err := splitS3(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitS3(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if bucket != tt.bucket || key != tt.key {
+			t.Errorf("splitS3(%q) = %q, %q, want %q, %q", tt.path, bucket, key, tt.bucket, tt.key)
+		}
+	}
+}
+
+func TestJoinKeepsRemoteEscapes(t *testing.T) {
+	tests := []struct {
+		root string
+		rel  string
+		want string
+	}{
+		{root: "s3://bucket/lib", rel: "a/b.png", want: "s3://bucket/lib/a/b.png"},
+		{root: "s3://bucket/lib/", rel: "a/./b.png", want: "s3://bucket/lib/a/b.png"},
+		{root: "s3://bucket/lib", rel: "a/../b.png", want: "s3://bucket/lib/b.png"},
+		{root: "s3://bucket/lib", rel: "../other/b.png", want: "s3://bucket/lib/../other/b.png"},
+	}
+
+	for _, tt := range tests {
+		got := Join(tt.root, tt.rel)
+		if got != tt.want {
+			t.Errorf("Join(%q, %q) = %q, want %q", tt.root, tt.rel, got, tt.want)
+		}
+		if _, _, err := splitS3(got); (err != nil) != strings.Contains(tt.want, "..") {
+			t.Errorf("splitS3(%q) error = %v", got, err)
+		}
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	bucket := os.Getenv(S3TestBucketEnv)
+	if bucket == "" {
+		t.Skipf("%s is not set", S3TestBucketEnv)
+	}
+	ctx := context.Background()
+
+	backend, err := getS3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := backend.(*s3Backend).client
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects := map[string]string{
+		"storage-test/a.png":     "first",
+		"storage-test/dir/b.png": "second object",
+		"storage-test-other.png": "outside the root",
+	}
+	for key, content := range objects {
+		_, err := client.PutObject(ctx, bucket, key, strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			client.RemoveObject(context.Background(), bucket, key, minio.RemoveObjectOptions{})
+		})
+	}
+
+	root := "s3://" + bucket + "/storage-test"
+	if err := CheckRoot(root); err != nil {
+		t.Fatalf("CheckRoot(%q) = %v", root, err)
+	}
+	for _, missing := range []string{"s3://" + bucket + "-missing/x", root + "-missing", root + "/a"} {
+		if err := CheckRoot(missing); err == nil {
+			t.Errorf("CheckRoot(%q) on a missing folder succeeded", missing)
+		}
+	}
+
+	// Stopping early ends the listing
+	count := 0
+	stop := errors.New("stop")
+	err = backend.(Lister).List(ctx, root, func(p string, info fs.FileInfo) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("List stopped after %d objects with %v, want 1 and %v", count, err, stop)
+	}
+
+	listed := make(map[string]int64)
+	err = backend.(Lister).List(ctx, root, func(p string, info fs.FileInfo) error {
+		listed[p] = info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[root+"/a.png"] != 5 || listed[root+"/dir/b.png"] != 13 {
+		t.Errorf("List(%q) = %v", root, listed)
+	}
+
+	tests := []struct {
+		rel     string
+		content string
+		wantErr bool
+	}{
+		{rel: "a.png", content: "first"},
+		{rel: "dir/b.png", content: "second object"},
+		{rel: "missing.png", wantErr: true},
+		{rel: "../storage-test-other.png", wantErr: true},
+		{rel: "dir/../../storage-test-other.png", wantErr: true},
+	}
+	for _, tt := range tests {
+		p := Resolve(root, tt.rel)
+
+		info, err := StatContext(ctx, p)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Stat(%q) error = %v, wantErr %v", p, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if info.Size() != int64(len(tt.content)) {
+			t.Errorf("Stat(%q).Size() = %d, want %d", p, info.Size(), len(tt.content))
+		}
+
+		data, err := ReadFile(p)
+		if err != nil {
+			t.Errorf("ReadFile(%q) = %v", p, err)
+		} else if string(data) != tt.content {
+			t.Errorf("ReadFile(%q) = %q, want %q", p, data, tt.content)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if reader, err := OpenContext(cancelled, root+"/a.png"); err == nil {
+		_, err = io.ReadAll(reader)
+		reader.Close()
+		if err == nil {
+			t.Error("reading with a cancelled context succeeded")
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bilibili/look-alike/internal/archive"
+)
+
+// Backend gives read access to the images of a source or target root
+type Backend interface {
+	// Open opens a file for reading
+	Open(ctx context.Context, p string) (io.ReadCloser, error)
+	// Stat returns file information
+	Stat(ctx context.Context, p string) (fs.FileInfo, error)
+	// CheckRoot verifies that a root exists and is reachable
+	CheckRoot(root string) error
+}
+
+// Lister is implemented by remote backends. Local roots are walked by the
+// scanner, which also follows symlinks and looks into archives.
+type Lister interface {
+	// List calls fn for every file below root
+	List(ctx context.Context, root string, fn func(p string, info fs.FileInfo) error) error
+}
+
+// For returns the backend responsible for a path. Paths with an s3:// scheme
+// go to object storage, everything else is the local filesystem.
+func For(p string) (Backend, error) {
+	switch scheme(p) {
+	case "":
+		return local, nil
+	case "s3":
+		return getS3()
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme: %s", p)
+	}
+}
+
+// IsRemote reports whether a path lives outside the local filesystem
+func IsRemote(p string) bool {
+	return scheme(p) != ""
+}
+
+// scheme returns the URI scheme of a path, or "" for local paths.
+// Single letter schemes are treated as Windows drive letters.
+func scheme(p string) string {
+	idx := strings.Index(p, "://")
+	if idx <= 1 {
+		return ""
+	}
+	return strings.ToLower(p[:idx])
+}
+
+// Open opens a file on the backend responsible for it
+func Open(p string) (io.ReadCloser, error) {
+	return OpenContext(context.Background(), p)
+}
+
+// OpenContext is Open with a context that cancels remote requests
+func OpenContext(ctx context.Context, p string) (io.ReadCloser, error) {
+	backend, err := For(p)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Open(ctx, p)
+}
+
+// Stat returns file information from the backend responsible for a path
+func Stat(p string) (fs.FileInfo, error) {
+	return StatContext(context.Background(), p)
+}
+
+// StatContext is Stat with a context that cancels remote requests
+func StatContext(ctx context.Context, p string) (fs.FileInfo, error) {
+	backend, err := For(p)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Stat(ctx, p)
+}
+
+// CheckRoot verifies that a source or target root is reachable
+func CheckRoot(root string) error {
+	backend, err := For(root)
+	if err != nil {
+		return err
+	}
+	return backend.CheckRoot(root)
+}
+
+// ReadFile reads the whole content of a file
+func ReadFile(p string) ([]byte, error) {
+	reader, err := Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Rel returns the path of full relative to root
+func Rel(root, full string) (string, error) {
+	if !IsRemote(root) {
+		return filepath.Rel(root, full)
+	}
+
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	if !strings.HasPrefix(full, prefix) {
+		return "", fmt.Errorf("%s is not inside %s", full, root)
+	}
+	return strings.TrimPrefix(full, prefix), nil
+}
+
+// Resolve turns a path stored relative to its root back into a full path.
+// Relative paths may point into archives ("bundle.zip!/a.png"), and the
+// root may itself be an archive file.
+func Resolve(root, rel string) string {
+	root = strings.TrimSpace(root)
+	if !IsRemote(root) && archive.IsArchive(root) {
+		if info, err := os.Stat(root); err == nil && !info.IsDir() {
+			return archive.Join(root, rel)
+		}
+	}
+	if archivePath, entry, ok := archive.Split(rel); ok {
+		return archive.Join(Join(root, archivePath), entry)
+	}
+	return Join(root, rel)
+}
+
+// Join joins a root and a relative path. A remote path that climbs out of
+// its root keeps its ".." and is rejected by the backend.
+func Join(root, rel string) string {
+	if !IsRemote(root) {
+		return filepath.Join(root, rel)
+	}
+	return strings.TrimSuffix(root, "/") + "/" + path.Clean(filepath.ToSlash(rel))
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsRemote(t *testing.T) {
+	tests := []struct {
+		path   string
+		remote bool
+	}{
+		{path: "/data/images", remote: false},
+		{path: `C:\data\images`, remote: false},
+		{path: "C://data", remote: false},
+		{path: "s3://bucket/images", remote: true},
+		{path: "S3://bucket/images", remote: true},
+	}
+
+	for _, tt := range tests {
+		if got := IsRemote(tt.path); got != tt.remote {
+			t.Errorf("IsRemote(%q) = %v, want %v", tt.path, got, tt.remote)
+		}
+	}
+
+	if _, err := For("ftp://host/images"); err == nil {
+		t.Error("For on an unsupported scheme succeeded")
+	}
+}
+
+func TestRelJoin(t *testing.T) {
+	tests := []struct {
+		root    string
+		full    string
+		rel     string
+		wantErr bool
+	}{
+		{root: "/data", full: "/data/a/b.png", rel: filepath.Join("a", "b.png")},
+		{root: "s3://bucket/lib", full: "s3://bucket/lib/a/b.png", rel: "a/b.png"},
+		{root: "s3://bucket/lib/", full: "s3://bucket/lib/b.png", rel: "b.png"},
+		{root: "s3://bucket/lib", full: "s3://bucket/library/b.png", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		rel, err := Rel(tt.root, tt.full)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Rel(%q, %q) error = %v, wantErr %v", tt.root, tt.full, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if rel != tt.rel {
+			t.Errorf("Rel(%q, %q) = %q, want %q", tt.root, tt.full, rel, tt.rel)
+		}
+		if joined := Join(tt.root, rel); joined != tt.full {
+			t.Errorf("Join(%q, %q) = %q, want %q", tt.root, rel, joined, tt.full)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bundle.zip")
+	if err := os.WriteFile(bundle, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root string
+		rel  string
+		want string
+	}{
+		{root: dir, rel: "a/b.png", want: filepath.Join(dir, "a", "b.png")},
+		{root: dir, rel: "sub/x.zip!/a.png", want: filepath.Join(dir, "sub", "x.zip") + "!/a.png"},
+		{root: bundle, rel: "dir/a.png", want: bundle + "!/dir/a.png"},
+		{root: " " + dir + " ", rel: "a.png", want: filepath.Join(dir, "a.png")},
+		{root: "s3://bucket/lib", rel: "x.zip!/a.png", want: "s3://bucket/lib/x.zip!/a.png"},
+	}
+
+	for _, tt := range tests {
+		if got := Resolve(tt.root, tt.rel); got != tt.want {
+			t.Errorf("Resolve(%q, %q) = %q, want %q", tt.root, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.png", "sub/b.png"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend, err := For(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CheckRoot(dir); err != nil {
+		t.Errorf("CheckRoot(%q) = %v", dir, err)
+	}
+	if err := backend.CheckRoot(filepath.Join(dir, "missing")); err == nil {
+		t.Error("CheckRoot on a missing folder succeeded")
+	}
+	// Local roots are walked by the scanner
+	if _, ok := backend.(Lister); ok {
+		t.Error("local backend is a Lister")
+	}
+
+	p := Join(dir, "sub/b.png")
+	info, err := StatContext(context.Background(), p)
+	if err != nil || info.Size() != int64(len("sub/b.png")) {
+		t.Errorf("StatContext(%q) = %v, %v", p, info, err)
+	}
+	reader, err := OpenContext(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "sub/b.png" {
+		t.Errorf("OpenContext(%q) read %q, %v", p, data, err)
+	}
+}
@@ -0,0 +1,64 @@
+// Package testutil holds fixtures shared by the package tests
+package testutil
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bilibili/look-alike/internal/database"
+)
+
+// RunWithDatabase runs the tests of a package against a fresh database in a
+// temporary folder and exits with their result. Call it from TestMain.
+func RunWithDatabase(m *testing.M) {
+	dir, err := os.MkdirTemp("", "look-alike-test-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := database.Initialize(filepath.Join(dir, "test.sqlite3")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	database.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// WritePNG encodes img as a PNG file, creating missing parent folders
+func WritePNG(t testing.TB, path string, img image.Image) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Pattern returns a w x h test image. Different seeds give visibly
+// different images, the same seed always gives the same pixels.
+func Pattern(w, h, seed int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i] = uint8(x * 255 / w)
+			img.Pix[i+1] = uint8(y * 255 / h)
+			img.Pix[i+2] = uint8((x/(1+seed%7) + y*seed) * 37)
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
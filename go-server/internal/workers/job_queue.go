@@ -0,0 +1,744 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/events"
+	"github.com/bilibili/look-alike/internal/models"
+)
+
+// TaskType is the slot a job occupies on its project. A project runs at most
+// one job per slot at a time; further jobs wait in the queue.
+type TaskType string
+
+const (
+	TaskTypeComparison TaskType = "comparison"
+	TaskTypeExport     TaskType = "export"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobPaused    = "paused"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// MaxJobAttempts is how often a job interrupted by a server stop is started
+// again before it is marked failed
+const MaxJobAttempts = 3
+
+// JobHandler runs a job. ctx is cancelled when the job is cancelled.
+type JobHandler func(ctx context.Context, job *models.Job) error
+
+// jobType describes a registered job type
+type jobType struct {
+	slot    TaskType
+	handler JobHandler
+}
+
+// runningJob is a job currently executed by this process
+type runningJob struct {
+	job    *models.Job
+	slot   string
+	state  *jobState
+	cancel context.CancelFunc
+}
+
+// JobQueue runs jobs stored in the jobs table. Jobs are claimed from the
+// table by a dispatcher, so queued jobs survive restarts, and jobs that were
+// running when the server stopped are queued again at startup.
+//
+// At most MaxJobs jobs run at a time. Higher priorities are started first;
+// among jobs of equal priority the project with the fewest running jobs,
+// then the one served longest ago, goes next, so one project queuing many
+// jobs does not hold back the others.
+type JobQueue struct {
+	mu         sync.Mutex
+	types      map[string]jobType
+	running    map[uint]*runningJob // key: job ID
+	lastServed map[uint]time.Time   // key: project ID
+	maxJobs    int
+	reserved   int // slots taken by work outside the queue, see Reserve
+	wake       chan struct{}
+	started    bool
+}
+
+var globalQueue = &JobQueue{
+	types:      make(map[string]jobType),
+	running:    make(map[uint]*runningJob),
+	lastServed: make(map[uint]time.Time),
+	maxJobs:    MaxJobs(),
+	wake:       make(chan struct{}, 1),
+}
+
+// GetQueue returns the global job queue
+func GetQueue() *JobQueue {
+	return globalQueue
+}
+
+// Register adds a job type and the slot its jobs occupy
+func (q *JobQueue) Register(name string, slot TaskType, handler JobHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.types[name] = jobType{slot: slot, handler: handler}
+}
+
+// Start recovers jobs interrupted by the last shutdown and starts the
+// dispatcher. Job types must be registered before.
+func (q *JobQueue) Start() error {
+	q.mu.Lock()
+	if q.started {
+		q.mu.Unlock()
+		return nil
+	}
+	q.started = true
+	q.mu.Unlock()
+
+	if err := q.recoverJobs(); err != nil {
+		return err
+	}
+
+	log.Printf("[JOBS] Running up to %d jobs at a time", q.maxJobs)
+	go q.dispatch()
+	q.signal()
+	return nil
+}
+
+// recoverJobs queues jobs left running by a previous process again, or
+// fails them once they used up their attempts
+func (q *JobQueue) recoverJobs() error {
+	var jobs []models.Job
+	if err := database.DB.Where("state = ?", JobRunning).Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.Attempts >= MaxJobAttempts {
+			message := "server stopped while the job was running"
+			database.DB.Model(&job).Updates(map[string]interface{}{
+				"state":       JobFailed,
+				"error":       message,
+				"finished_at": time.Now(),
+			})
+			log.Printf("[JOBS] Job %d (%s) failed after %d attempts", job.ID, job.Type, job.Attempts)
+			continue
+		}
+
+		database.DB.Model(&job).Update("state", JobQueued)
+		log.Printf("[JOBS] Job %d (%s) for project %d queued again after restart", job.ID, job.Type, job.ProjectID)
+	}
+	return nil
+}
+
+// Enqueue stores a new job. payload is saved as JSON and handed to the
+// handler through job.Payload; jobs with a higher priority start first.
+func (q *JobQueue) Enqueue(name string, projectID uint, priority int, payload interface{}) (*models.Job, error) {
+	q.mu.Lock()
+	_, ok := q.types[name]
+	q.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown job type: %s", name)
+	}
+
+	job := &models.Job{
+		Type:      name,
+		ProjectID: projectID,
+		State:     JobQueued,
+		Priority:  priority,
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		job.Payload = string(data)
+	}
+
+	if err := database.DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+
+	log.Printf("[JOBS] Queued job %d (%s) for project %d, priority %d", job.ID, job.Type, job.ProjectID, job.Priority)
+	q.signal()
+	return job, nil
+}
+
+// Cancel cancels a queued or running job
+func (q *JobQueue) Cancel(jobID uint) error {
+	var job models.Job
+	if err := database.DB.First(&job, jobID).Error; err != nil {
+		return fmt.Errorf("job %d not found", jobID)
+	}
+
+	switch job.State {
+	case JobQueued, JobPaused:
+		// Only cancel if the dispatcher did not claim it in the meantime
+		result := database.DB.Model(&models.Job{}).
+			Where("id = ? AND state = ?", job.ID, job.State).
+			Updates(map[string]interface{}{
+				"state":       JobCancelled,
+				"finished_at": time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			log.Printf("[JOBS] Cancelled %s job %d (%s)", job.State, job.ID, job.Type)
+			return nil
+		}
+		fallthrough
+	case JobRunning:
+		q.mu.Lock()
+		running, ok := q.running[job.ID]
+		q.mu.Unlock()
+		if ok {
+			running.cancel()
+			log.Printf("[JOBS] Cancelling running job %d (%s)", job.ID, job.Type)
+			return nil
+		}
+		// Not running here: it finished, or was resumed or paused meanwhile
+		return q.retryIn(job.ID, q.Cancel, JobQueued, JobPaused)
+	default:
+		return fmt.Errorf("job %d is already %s", job.ID, job.State)
+	}
+}
+
+// CancelProjectJobs cancels every queued, running and paused job of a
+// project
+func (q *JobQueue) CancelProjectJobs(projectID uint) {
+	var jobs []models.Job
+	database.DB.Where("project_id = ? AND state IN ?", projectID, activeJobStates).Find(&jobs)
+	for _, job := range jobs {
+		if err := q.Cancel(job.ID); err != nil {
+			log.Printf("[JOBS] Failed to cancel job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// CancelActive cancels the queued, running and paused jobs of a project
+// that use the given slot
+func (q *JobQueue) CancelActive(projectID uint, slot TaskType) {
+	for _, job := range q.activeJobs(projectID, slot) {
+		if err := q.Cancel(job.ID); err != nil {
+			log.Printf("[JOBS] Failed to cancel job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// Retry queues a failed or cancelled job again
+func (q *JobQueue) Retry(jobID uint) (*models.Job, error) {
+	var job models.Job
+	if err := database.DB.First(&job, jobID).Error; err != nil {
+		return nil, fmt.Errorf("job %d not found", jobID)
+	}
+	if job.State != JobFailed && job.State != JobCancelled {
+		return nil, fmt.Errorf("job %d is %s, only failed or cancelled jobs can be retried", job.ID, job.State)
+	}
+
+	err := database.DB.Model(&job).Updates(map[string]interface{}{
+		"state":          JobQueued,
+		"error":          nil,
+		"attempts":       0,
+		"progress_done":  0,
+		"progress_total": 0,
+		"checkpoint":     "",
+		"started_at":     nil,
+		"finished_at":    nil,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[JOBS] Retrying job %d (%s)", job.ID, job.Type)
+	q.signal()
+	return &job, nil
+}
+
+// Pause stops a queued or running job so it can be resumed later. A running
+// job is cancelled and gives up its workers; it keeps its checkpoint and
+// starts over from it when resumed.
+func (q *JobQueue) Pause(jobID uint) error {
+	var job models.Job
+	if err := database.DB.First(&job, jobID).Error; err != nil {
+		return fmt.Errorf("job %d not found", jobID)
+	}
+
+	switch job.State {
+	case JobQueued:
+		result := database.DB.Model(&models.Job{}).
+			Where("id = ? AND state = ?", job.ID, JobQueued).
+			Update("state", JobPaused)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			log.Printf("[JOBS] Paused queued job %d (%s)", job.ID, job.Type)
+			return nil
+		}
+		fallthrough
+	case JobRunning:
+		q.mu.Lock()
+		running, ok := q.running[job.ID]
+		q.mu.Unlock()
+		if ok {
+			running.state.paused.Store(true)
+			running.cancel()
+			log.Printf("[JOBS] Pausing running job %d (%s)", job.ID, job.Type)
+			return nil
+		}
+		return q.retryIn(job.ID, q.Pause, JobQueued)
+	default:
+		return fmt.Errorf("job %d is %s, only queued or running jobs can be paused", job.ID, job.State)
+	}
+}
+
+// retryIn calls op again when the job is in one of states after op lost a
+// state change race, e.g. to a concurrent Resume
+func (q *JobQueue) retryIn(jobID uint, op func(uint) error, states ...string) error {
+	var job models.Job
+	if err := database.DB.First(&job, jobID).Error; err != nil {
+		return fmt.Errorf("job %d not found", jobID)
+	}
+	for _, state := range states {
+		if job.State == state {
+			return op(jobID)
+		}
+	}
+	return nil
+}
+
+// Resume queues a paused job again
+func (q *JobQueue) Resume(jobID uint) error {
+	result := database.DB.Model(&models.Job{}).
+		Where("id = ? AND state = ?", jobID, JobPaused).
+		Update("state", JobQueued)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("job %d is not paused", jobID)
+	}
+
+	log.Printf("[JOBS] Resumed job %d", jobID)
+	q.signal()
+	return nil
+}
+
+// PauseActive pauses the queued and running jobs of a project that use the
+// given slot and returns how many were paused
+func (q *JobQueue) PauseActive(projectID uint, slot TaskType) int {
+	paused := 0
+	for _, job := range q.activeJobs(projectID, slot) {
+		if job.State == JobPaused {
+			continue
+		}
+		if err := q.Pause(job.ID); err != nil {
+			log.Printf("[JOBS] Failed to pause job %d: %v", job.ID, err)
+			continue
+		}
+		paused++
+	}
+	return paused
+}
+
+// PausedJobs returns the paused jobs of the given projects by project ID
+func (q *JobQueue) PausedJobs(projectIDs ...uint) (map[uint][]models.Job, error) {
+	var jobs []models.Job
+	if err := database.DB.Where("project_id IN ? AND state = ?", projectIDs, JobPaused).Order("id").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	byProject := make(map[uint][]models.Job)
+	for _, job := range jobs {
+		byProject[job.ProjectID] = append(byProject[job.ProjectID], job)
+	}
+	return byProject, nil
+}
+
+// Reserve takes one of the MaxJobs slots for work that runs outside the
+// queue, e.g. an export streamed to a client. It returns false when all
+// slots are taken; otherwise release must be called once the work is done.
+func (q *JobQueue) Reserve() (release func(), ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.running)+q.reserved >= q.maxJobs {
+		return nil, false
+	}
+	q.reserved++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.reserved--
+			q.mu.Unlock()
+			q.signal()
+		})
+	}, true
+}
+
+// Slot returns the slot jobs of a type occupy
+func (q *JobQueue) Slot(jobType string) TaskType {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.types[jobType].slot
+}
+
+// SetPriority changes the priority of a queued job
+func (q *JobQueue) SetPriority(jobID uint, priority int) (*models.Job, error) {
+	var job models.Job
+	if err := database.DB.First(&job, jobID).Error; err != nil {
+		return nil, fmt.Errorf("job %d not found", jobID)
+	}
+
+	result := database.DB.Model(&models.Job{}).
+		Where("id = ? AND state = ?", job.ID, JobQueued).
+		Update("priority", priority)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, fmt.Errorf("job %d is no longer queued", job.ID)
+	}
+	job.Priority = priority
+
+	log.Printf("[JOBS] Job %d (%s) priority set to %d", job.ID, job.Type, priority)
+	q.signal()
+	return &job, nil
+}
+
+// HasActiveJob reports whether a project has a queued, running or paused
+// job in the given slot
+func (q *JobQueue) HasActiveJob(projectID uint, slot TaskType) bool {
+	return len(q.activeJobs(projectID, slot)) > 0
+}
+
+// activeJobStates are the states of jobs that are not finished
+var activeJobStates = []string{JobQueued, JobRunning, JobPaused}
+
+// activeJobs returns the unfinished jobs of a project in a slot
+func (q *JobQueue) activeJobs(projectID uint, slot TaskType) []models.Job {
+	var jobs []models.Job
+	database.DB.Where("project_id = ? AND state IN ?", projectID, activeJobStates).Find(&jobs)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var active []models.Job
+	for _, job := range jobs {
+		if t, ok := q.types[job.Type]; ok && t.slot == slot {
+			active = append(active, job)
+		}
+	}
+	return active
+}
+
+// signal wakes up the dispatcher
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch claims runnable jobs whenever the queue changes. The ticker
+// picks up jobs queued by other means, e.g. directly in the database.
+func (q *JobQueue) dispatch() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		q.claimJobs()
+
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimJobs starts queued jobs until MaxJobs are running. A job is only
+// runnable while its project slot is free.
+func (q *JobQueue) claimJobs() {
+	var jobs []models.Job
+	if err := database.DB.Where("state = ?", JobQueued).Order("priority DESC, id").Find(&jobs).Error; err != nil {
+		log.Printf("[JOBS] Failed to load queued jobs: %v", err)
+		return
+	}
+
+	skipped := make(map[uint]bool, len(jobs))
+	for {
+		job, t := q.nextJob(jobs, skipped)
+		if job == nil {
+			return
+		}
+		skipped[job.ID] = true
+
+		// Claim the job; another dispatcher or a cancel may have won. The
+		// job is added to running under the same lock, so a Cancel or Pause
+		// that loses the race to the claim finds it there.
+		now := time.Now()
+		q.mu.Lock()
+		result := database.DB.Model(&models.Job{}).
+			Where("id = ? AND state = ?", job.ID, JobQueued).
+			Updates(map[string]interface{}{
+				"state":      JobRunning,
+				"started_at": now,
+				"attempts":   job.Attempts + 1,
+			})
+		if result.Error != nil || result.RowsAffected != 1 {
+			q.mu.Unlock()
+			continue
+		}
+		job.State = JobRunning
+		job.StartedAt = &now
+		job.Attempts++
+
+		state := &jobState{job: job, checkpoint: job.Checkpoint, startedAt: now, startDone: -1}
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = context.WithValue(ctx, jobStateKey{}, state)
+
+		q.running[job.ID] = &runningJob{job: job, slot: jobSlot(job.ProjectID, t.slot), state: state, cancel: cancel}
+		q.lastServed[job.ProjectID] = now
+		q.mu.Unlock()
+
+		go q.run(ctx, job, t.handler)
+	}
+}
+
+// nextJob picks the queued job to start next, or nil when no more jobs may
+// start. jobs are ordered by priority; within the highest runnable priority
+// the project with the fewest running jobs wins, then the one served least
+// recently, then the oldest job.
+func (q *JobQueue) nextJob(jobs []models.Job, skipped map[uint]bool) (*models.Job, jobType) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.running)+q.reserved >= q.maxJobs {
+		return nil, jobType{}
+	}
+
+	busySlots := make(map[string]bool, len(q.running))
+	runningByProject := make(map[uint]int)
+	for _, running := range q.running {
+		busySlots[running.slot] = true
+		runningByProject[running.job.ProjectID]++
+	}
+
+	var best *models.Job
+	var bestType jobType
+	for i := range jobs {
+		job := &jobs[i]
+		if skipped[job.ID] {
+			continue
+		}
+		if best != nil && job.Priority < best.Priority {
+			break
+		}
+
+		t, ok := q.types[job.Type]
+		if !ok {
+			log.Printf("[JOBS] Skipping job %d: unknown type %s", job.ID, job.Type)
+			skipped[job.ID] = true
+			continue
+		}
+		if busySlots[jobSlot(job.ProjectID, t.slot)] {
+			continue
+		}
+
+		if best == nil || q.fairer(job.ProjectID, best.ProjectID, runningByProject) {
+			best, bestType = job, t
+		}
+	}
+	return best, bestType
+}
+
+// fairer reports whether project a should be served before project b
+func (q *JobQueue) fairer(a, b uint, runningByProject map[uint]int) bool {
+	if a == b {
+		return false
+	}
+	if runningByProject[a] != runningByProject[b] {
+		return runningByProject[a] < runningByProject[b]
+	}
+	return q.lastServed[a].Before(q.lastServed[b])
+}
+
+// jobSlot identifies a slot of a project
+func jobSlot(projectID uint, slot TaskType) string {
+	return fmt.Sprintf("%d-%s", projectID, slot)
+}
+
+// run executes a claimed job and records its outcome
+func (q *JobQueue) run(ctx context.Context, job *models.Job, handler JobHandler) {
+	log.Printf("[JOBS] Started job %d (%s) for project %d, attempt %d", job.ID, job.Type, job.ProjectID, job.Attempts)
+	publishJob(job, JobRunning, nil)
+
+	err := callHandler(ctx, job, handler)
+
+	updates := map[string]interface{}{
+		"finished_at": time.Now(),
+	}
+	// A job that finished is completed even if a pause or cancel arrived
+	// after its handler returned
+	switch {
+	case err == nil:
+		updates["state"] = JobCompleted
+		log.Printf("[JOBS] Job %d (%s) completed", job.ID, job.Type)
+	case Paused(ctx) && errors.Is(err, ctx.Err()):
+		// A pause is not an attempt; the job starts again when resumed
+		updates = map[string]interface{}{
+			"state":    JobPaused,
+			"attempts": job.Attempts - 1,
+		}
+		log.Printf("[JOBS] Job %d (%s) paused", job.ID, job.Type)
+	case ctx.Err() != nil:
+		updates["state"] = JobCancelled
+		log.Printf("[JOBS] Job %d (%s) cancelled", job.ID, job.Type)
+	default:
+		updates["state"] = JobFailed
+		updates["error"] = err.Error()
+		log.Printf("[JOBS] Job %d (%s) failed: %v", job.ID, job.Type, err)
+	}
+	database.DB.Model(&models.Job{}).Where("id = ?", job.ID).Updates(updates)
+	publishJob(job, updates["state"].(string), err)
+
+	q.mu.Lock()
+	if running, ok := q.running[job.ID]; ok {
+		running.cancel()
+		delete(q.running, job.ID)
+	}
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// callHandler runs the handler of a job. A panic fails the job instead of
+// the server, so its state is stored and its slot released as usual.
+func callHandler(ctx context.Context, job *models.Job, handler JobHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[JOBS] Job %d (%s) panicked: %v\n%s", job.ID, job.Type, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// publishJob sends a state change of a job to the event bus
+func publishJob(job *models.Job, state string, err error) {
+	event := events.Event{
+		Type:      events.TypeJob,
+		ProjectID: job.ProjectID,
+		JobID:     job.ID,
+		JobType:   job.Type,
+		State:     state,
+	}
+	if err != nil && state == JobFailed {
+		event.Error = err.Error()
+	}
+	events.Publish(event)
+}
+
+// jobStateKey is the context key of the jobState of a running job
+type jobStateKey struct{}
+
+// jobState is shared between the queue and a running job
+type jobState struct {
+	job        *models.Job
+	paused     atomic.Bool
+	mu         sync.Mutex
+	lastWrite  time.Time
+	checkpoint string
+	startedAt  time.Time
+	startDone  int64 // first reported progress of this run, -1 before, for the ETA
+}
+
+// Paused reports whether the job running with ctx was stopped by Pause
+func Paused(ctx context.Context) bool {
+	state, ok := ctx.Value(jobStateKey{}).(*jobState)
+	return ok && state.paused.Load()
+}
+
+// ReportProgress records the progress of the job running with ctx and
+// publishes it with an estimate of the remaining time. Writes are throttled;
+// the final update (done == total) is always stored. It does nothing when
+// ctx does not belong to a job.
+func ReportProgress(ctx context.Context, done, total int64) {
+	state, ok := ctx.Value(jobStateKey{}).(*jobState)
+	if !ok {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.startDone < 0 {
+		state.startDone = done
+	}
+	if done < total && time.Since(state.lastWrite) < time.Second {
+		return
+	}
+	state.lastWrite = time.Now()
+
+	database.DB.Model(&models.Job{}).Where("id = ?", state.job.ID).Updates(map[string]interface{}{
+		"progress_done":  done,
+		"progress_total": total,
+	})
+
+	event := events.Event{
+		Type:      events.TypeProgress,
+		ProjectID: state.job.ProjectID,
+		JobID:     state.job.ID,
+		JobType:   state.job.Type,
+		Done:      done,
+		Total:     total,
+	}
+	// Extrapolate the rate of this run; progress made by an earlier run
+	// (before a pause or restart) does not count
+	if doneThisRun := done - state.startDone; doneThisRun > 0 && done <= total {
+		eta := time.Since(state.startedAt).Seconds() / float64(doneThisRun) * float64(total-done)
+		event.ETASeconds = &eta
+	}
+	events.Publish(event)
+}
+
+// Checkpoint returns the checkpoint the job running with ctx saved before it
+// was paused or interrupted, or "" on its first run
+func Checkpoint(ctx context.Context) string {
+	state, ok := ctx.Value(jobStateKey{}).(*jobState)
+	if !ok {
+		return ""
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.checkpoint
+}
+
+// SaveCheckpoint stores where the job running with ctx should continue when
+// it is started again. The meaning of checkpoint is up to the job type.
+func SaveCheckpoint(ctx context.Context, checkpoint string) {
+	state, ok := ctx.Value(jobStateKey{}).(*jobState)
+	if !ok {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.checkpoint = checkpoint
+	database.DB.Model(&models.Job{}).Where("id = ?", state.job.ID).Update("checkpoint", checkpoint)
+}
@@ -0,0 +1,481 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bilibili/look-alike/internal/database"
+	"github.com/bilibili/look-alike/internal/models"
+	"github.com/bilibili/look-alike/internal/testutil"
+)
+
+func TestMain(m *testing.M) {
+	testutil.RunWithDatabase(m)
+}
+
+// newTestQueue returns an empty queue without a dispatcher; tests call
+// claimJobs themselves. Jobs of earlier tests are removed. Job types:
+// "block" runs until cancelled, "ok" succeeds, "fail" fails and "panic"
+// panics; "export" blocks in the export slot.
+func newTestQueue(t *testing.T, maxJobs int) *JobQueue {
+	t.Helper()
+	if err := database.DB.Where("1 = 1").Delete(&models.Job{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	q := &JobQueue{
+		types:      make(map[string]jobType),
+		running:    make(map[uint]*runningJob),
+		lastServed: make(map[uint]time.Time),
+		maxJobs:    maxJobs,
+		wake:       make(chan struct{}, 1),
+	}
+	block := func(ctx context.Context, job *models.Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	q.Register("block", TaskTypeComparison, block)
+	q.Register("export", TaskTypeExport, block)
+	q.Register("ok", TaskTypeComparison, func(ctx context.Context, job *models.Job) error { return nil })
+	q.Register("fail", TaskTypeComparison, func(ctx context.Context, job *models.Job) error { return errors.New("broken") })
+	q.Register("panic", TaskTypeComparison, func(ctx context.Context, job *models.Job) error { panic("boom") })
+	return q
+}
+
+// createJob stores a job directly in the given state
+func createJob(t *testing.T, jobType, state string, attempts int) *models.Job {
+	t.Helper()
+	job := &models.Job{Type: jobType, ProjectID: 1, State: state, Attempts: attempts}
+	if err := database.DB.Create(job).Error; err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// loadJob reads a job back from the database
+func loadJob(t *testing.T, id uint) models.Job {
+	t.Helper()
+	var job models.Job
+	if err := database.DB.First(&job, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// waitForState waits until a job reaches state
+func waitForState(t *testing.T, id uint, state string) models.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job := loadJob(t, id)
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d is %s, want %s", id, job.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForIdle waits until no job runs in this process
+func waitForIdle(t *testing.T, q *JobQueue) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		running := len(q.running)
+		q.mu.Unlock()
+		if running == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs still running", running)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForIdleSlot waits until no job of this process runs in a project slot
+func waitForIdleSlot(t *testing.T, q *JobQueue, projectID uint, slot TaskType) {
+	t.Helper()
+	key := fmt.Sprintf("%d-%s", projectID, slot)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		busy := false
+		q.mu.Lock()
+		for _, running := range q.running {
+			busy = busy || running.slot == key
+		}
+		q.mu.Unlock()
+		if !busy {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot %s is still busy", key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobStateTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		op      func(q *JobQueue, id uint) error
+		want    string
+		wantErr bool
+	}{
+		{name: "cancel queued", state: JobQueued, op: (*JobQueue).Cancel, want: JobCancelled},
+		{name: "cancel completed", state: JobCompleted, op: (*JobQueue).Cancel, want: JobCompleted, wantErr: true},
+		{name: "cancel cancelled", state: JobCancelled, op: (*JobQueue).Cancel, want: JobCancelled, wantErr: true},
+		{name: "retry failed", state: JobFailed, op: retry, want: JobQueued},
+		{name: "retry cancelled", state: JobCancelled, op: retry, want: JobQueued},
+		{name: "retry completed", state: JobCompleted, op: retry, want: JobCompleted, wantErr: true},
+		{name: "retry queued", state: JobQueued, op: retry, want: JobQueued, wantErr: true},
+		{name: "pause queued", state: JobQueued, op: (*JobQueue).Pause, want: JobPaused},
+		{name: "pause failed", state: JobFailed, op: (*JobQueue).Pause, want: JobFailed, wantErr: true},
+		{name: "resume paused", state: JobPaused, op: (*JobQueue).Resume, want: JobQueued},
+		{name: "resume queued", state: JobQueued, op: (*JobQueue).Resume, want: JobQueued, wantErr: true},
+		{name: "cancel paused", state: JobPaused, op: (*JobQueue).Cancel, want: JobCancelled},
+	}
+
+	for _, tt := range tests {
+		q := newTestQueue(t, 2)
+		job := createJob(t, "block", tt.state, 1)
+
+		err := tt.op(q, job.ID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if state := loadJob(t, job.ID).State; state != tt.want {
+			t.Errorf("%s: state = %s, want %s", tt.name, state, tt.want)
+		}
+	}
+}
+
+func TestRetryResetsAttempts(t *testing.T) {
+	q := newTestQueue(t, 2)
+	job := createJob(t, "fail", JobFailed, MaxJobAttempts)
+
+	if _, err := q.Retry(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored := loadJob(t, job.ID); stored.Attempts != 0 {
+		t.Errorf("retried job has %d attempts, want 0", stored.Attempts)
+	}
+}
+
+func retry(q *JobQueue, id uint) error {
+	_, err := q.Retry(id)
+	return err
+}
+
+func TestRunningJobs(t *testing.T) {
+	tests := []struct {
+		name      string
+		jobType   string
+		cancel    bool
+		want      string
+		wantError bool
+	}{
+		{name: "completes", jobType: "ok", want: JobCompleted},
+		{name: "fails", jobType: "fail", want: JobFailed, wantError: true},
+		{name: "panics", jobType: "panic", want: JobFailed, wantError: true},
+		{name: "cancelled", jobType: "block", cancel: true, want: JobCancelled},
+	}
+
+	for _, tt := range tests {
+		q := newTestQueue(t, 2)
+		job, err := q.Enqueue(tt.jobType, 1, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.claimJobs()
+
+		if tt.cancel {
+			waitForState(t, job.ID, JobRunning)
+			if err := q.Cancel(job.ID); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		stored := waitForState(t, job.ID, tt.want)
+		waitForIdle(t, q)
+
+		if stored.Attempts != 1 {
+			t.Errorf("%s: attempts = %d, want 1", tt.name, stored.Attempts)
+		}
+		if (stored.Error != nil) != tt.wantError {
+			t.Errorf("%s: error = %v, wantError %v", tt.name, stored.Error, tt.wantError)
+		}
+		if tt.jobType == "panic" && stored.Error != nil && !strings.Contains(*stored.Error, "boom") {
+			t.Errorf("%s: error %q does not carry the panic", tt.name, *stored.Error)
+		}
+	}
+}
+
+func TestPauseRunningJob(t *testing.T) {
+	q := newTestQueue(t, 2)
+	checkpoints := make(chan string, 2)
+	q.Register("checkpoint", TaskTypeComparison, func(ctx context.Context, job *models.Job) error {
+		checkpoints <- Checkpoint(ctx)
+		SaveCheckpoint(ctx, "42")
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	job, err := q.Enqueue("checkpoint", 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.claimJobs()
+	if first := <-checkpoints; first != "" {
+		t.Errorf("first run got checkpoint %q, want none", first)
+	}
+
+	if err := q.Pause(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	stored := waitForState(t, job.ID, JobPaused)
+	waitForIdle(t, q)
+	if stored.Attempts != 0 || stored.Checkpoint != "42" {
+		t.Errorf("paused job has attempts %d, checkpoint %q, want 0, \"42\"", stored.Attempts, stored.Checkpoint)
+	}
+	if paused, _ := q.PausedJobs(1); len(paused[1]) != 1 {
+		t.Errorf("PausedJobs = %v, want the paused job", paused)
+	}
+
+	// A paused job is not claimed until it is resumed, then it continues
+	// from its checkpoint
+	q.claimJobs()
+	if state := loadJob(t, job.ID).State; state != JobPaused {
+		t.Fatalf("paused job is %s after claimJobs", state)
+	}
+	if err := q.Resume(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	q.claimJobs()
+	if second := <-checkpoints; second != "42" {
+		t.Errorf("resumed run got checkpoint %q, want \"42\"", second)
+	}
+
+	if n := q.PauseActive(1, TaskTypeComparison); n != 1 {
+		t.Errorf("PauseActive paused %d jobs, want 1", n)
+	}
+	waitForState(t, job.ID, JobPaused)
+	waitForIdle(t, q)
+}
+
+func TestPauseAfterJobFinished(t *testing.T) {
+	q := newTestQueue(t, 2)
+
+	// The handler finishes its work although a pause arrived meanwhile
+	q.Register("finish", TaskTypeComparison, func(ctx context.Context, job *models.Job) error {
+		<-ctx.Done()
+		return nil
+	})
+	job, err := q.Enqueue("finish", 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.claimJobs()
+	waitForState(t, job.ID, JobRunning)
+
+	if err := q.Pause(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	stored := waitForState(t, job.ID, JobCompleted)
+	waitForIdle(t, q)
+	if stored.Attempts != 1 {
+		t.Errorf("completed job has attempts %d, want 1", stored.Attempts)
+	}
+}
+
+func TestClaimRespectsSlots(t *testing.T) {
+	q := newTestQueue(t, 3)
+	first, _ := q.Enqueue("block", 1, 0, nil)
+	second, _ := q.Enqueue("block", 1, 0, nil) // same project slot as first
+	export, _ := q.Enqueue("export", 1, 0, nil)
+	other, _ := q.Enqueue("block", 2, 0, nil)
+	q.claimJobs()
+
+	waitForState(t, first.ID, JobRunning)
+	waitForState(t, export.ID, JobRunning)
+	waitForState(t, other.ID, JobRunning)
+	if state := loadJob(t, second.ID).State; state != JobQueued {
+		t.Errorf("second job of the slot is %s, want queued", state)
+	}
+	if !q.HasActiveJob(1, TaskTypeExport) || q.HasActiveJob(3, TaskTypeComparison) {
+		t.Error("HasActiveJob does not match the queued and running jobs")
+	}
+
+	// The queued job starts once its slot is free
+	q.Cancel(first.ID)
+	waitForState(t, first.ID, JobCancelled)
+	waitForIdleSlot(t, q, 1, TaskTypeComparison)
+	q.claimJobs()
+	waitForState(t, second.ID, JobRunning)
+
+	q.CancelProjectJobs(1)
+	q.CancelProjectJobs(2)
+	waitForIdle(t, q)
+}
+
+// recordJobs registers a "record" job type that appends the project of every
+// job it runs to the returned slice, and tracks how many run at once
+func recordJobs(q *JobQueue) (order *[]uint, maxRunning *int32) {
+	var mu sync.Mutex
+	var running int32
+	order, maxRunning = new([]uint), new(int32)
+	q.Register("record", TaskTypeComparison, func(ctx context.Context, job *models.Job) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(maxRunning, max, n) {
+				break
+			}
+		}
+		mu.Lock()
+		*order = append(*order, job.ProjectID)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	return order, maxRunning
+}
+
+// runAll claims jobs until none is queued or running
+func runAll(t *testing.T, q *JobQueue) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var queued int64
+		database.DB.Model(&models.Job{}).Where("state = ?", JobQueued).Count(&queued)
+		q.mu.Lock()
+		running := len(q.running)
+		q.mu.Unlock()
+		if queued == 0 && running == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs queued, %d running", queued, running)
+		}
+		q.claimJobs()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairQueuing(t *testing.T) {
+	// One job at a time: the projects take turns although project 1
+	// queued all of its jobs first
+	q := newTestQueue(t, 1)
+	order, maxRunning := recordJobs(q)
+	for _, projectID := range []uint{1, 1, 1, 2, 2} {
+		if _, err := q.Enqueue("record", projectID, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runAll(t, q)
+
+	if want := []uint{1, 2, 1, 2, 1}; fmt.Sprint(*order) != fmt.Sprint(want) {
+		t.Errorf("projects served in order %v, want %v", *order, want)
+	}
+	if *maxRunning != 1 {
+		t.Errorf("%d jobs ran at once, MaxJobs is 1", *maxRunning)
+	}
+}
+
+func TestMaxJobs(t *testing.T) {
+	q := newTestQueue(t, 2)
+	order, maxRunning := recordJobs(q)
+	for projectID := uint(1); projectID <= 6; projectID++ {
+		if _, err := q.Enqueue("record", projectID, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runAll(t, q)
+
+	if len(*order) != 6 {
+		t.Errorf("%d jobs ran, want 6", len(*order))
+	}
+	if *maxRunning != 2 {
+		t.Errorf("%d jobs ran at once, want MaxJobs = 2", *maxRunning)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	q := newTestQueue(t, 1)
+	release, ok := q.Reserve()
+	if !ok {
+		t.Fatal("Reserve on an idle queue failed")
+	}
+	if _, ok := q.Reserve(); ok {
+		t.Error("Reserve succeeded with all slots taken")
+	}
+
+	// Queued jobs wait for the reserved slot
+	job, err := q.Enqueue("ok", 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.claimJobs()
+	if state := loadJob(t, job.ID).State; state != JobQueued {
+		t.Errorf("job is %s while the only slot is reserved, want queued", state)
+	}
+
+	release()
+	release() // a second call is ignored
+	q.claimJobs()
+	waitForState(t, job.ID, JobCompleted)
+	waitForIdle(t, q)
+	if q.reserved != 0 {
+		t.Errorf("%d slots still reserved", q.reserved)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	q := newTestQueue(t, 1)
+	order, _ := recordJobs(q)
+	low, _ := q.Enqueue("record", 1, 0, nil)
+	q.Enqueue("record", 2, 5, nil)
+	q.Enqueue("record", 3, 0, nil)
+	if _, err := q.SetPriority(low.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	runAll(t, q)
+
+	if want := []uint{2, 1, 3}; fmt.Sprint(*order) != fmt.Sprint(want) {
+		t.Errorf("projects served in order %v, want %v", *order, want)
+	}
+	if _, err := q.SetPriority(low.ID, 3); err == nil {
+		t.Error("SetPriority on a completed job succeeded")
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     string
+	}{
+		{attempts: 1, want: JobQueued},
+		{attempts: MaxJobAttempts - 1, want: JobQueued},
+		{attempts: MaxJobAttempts, want: JobFailed},
+	}
+
+	for _, tt := range tests {
+		q := newTestQueue(t, 2)
+		job := createJob(t, "block", JobRunning, tt.attempts)
+		if err := q.recoverJobs(); err != nil {
+			t.Fatal(err)
+		}
+		if state := loadJob(t, job.ID).State; state != tt.want {
+			t.Errorf("running job with %d attempts recovered as %s, want %s", tt.attempts, state, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package workers
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// Environment variables configuring the server-wide scheduler
+const (
+	MaxJobsEnv  = "LOOK_ALIKE_MAX_JOBS"  // jobs running at the same time, default 2
+	CPULimitEnv = "LOOK_ALIKE_CPU_LIMIT" // CPU-bound work items (hashing, comparing) across all jobs, default NumCPU
+	IOLimitEnv  = "LOOK_ALIKE_IO_LIMIT"  // files read and decoded at the same time across all jobs, default 2*NumCPU
+)
+
+// Resource is a server-wide limit shared by the worker pools of all jobs
+type Resource int
+
+const (
+	ResourceCPU Resource = iota
+	ResourceIO
+)
+
+var (
+	cpuSlots = make(chan struct{}, envInt(CPULimitEnv, runtime.NumCPU()))
+	ioSlots  = make(chan struct{}, envInt(IOLimitEnv, 2*runtime.NumCPU()))
+)
+
+// MaxJobs returns how many jobs may run at the same time
+func MaxJobs() int {
+	return envInt(MaxJobsEnv, 2)
+}
+
+// Acquire blocks until a slot of the resource is free
+func Acquire(r Resource) {
+	slots(r) <- struct{}{}
+}
+
+// Release frees a slot taken with Acquire
+func Release(r Resource) {
+	<-slots(r)
+}
+
+func slots(r Resource) chan struct{} {
+	if r == ResourceIO {
+		return ioSlots
+	}
+	return cpuSlots
+}
+
+// envInt reads a positive integer from the environment
+func envInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+	}
+	return fallback
+}
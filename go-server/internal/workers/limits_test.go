@@ -0,0 +1,109 @@
+package workers
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withSlots replaces the slots of both resources for the duration of a test
+func withSlots(t *testing.T, cpu, io int) {
+	t.Helper()
+	oldCPU, oldIO := cpuSlots, ioSlots
+	cpuSlots, ioSlots = make(chan struct{}, cpu), make(chan struct{}, io)
+	t.Cleanup(func() { cpuSlots, ioSlots = oldCPU, oldIO })
+}
+
+func TestAcquireBlocksAtLimit(t *testing.T) {
+	withSlots(t, 1, 2)
+
+	tests := []struct {
+		resource Resource
+		limit    int
+	}{
+		{resource: ResourceCPU, limit: 1},
+		{resource: ResourceIO, limit: 2},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < tt.limit; i++ {
+			Acquire(tt.resource)
+		}
+
+		acquired := make(chan struct{})
+		go func() {
+			Acquire(tt.resource)
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			t.Fatalf("resource %d: Acquire beyond the limit of %d did not block", tt.resource, tt.limit)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		Release(tt.resource)
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Fatalf("resource %d: Acquire still blocked after Release", tt.resource)
+		}
+		for i := 0; i < tt.limit; i++ {
+			Release(tt.resource)
+		}
+	}
+}
+
+func TestLimitedPoolsShareSlots(t *testing.T) {
+	withSlots(t, 2, 4)
+
+	// Two pools of four workers, as two jobs would start them, never run
+	// more than two CPU jobs together
+	var running, maxRunning int32
+	job := func() {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < 2; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool := NewLimitedWorkerPool(ResourceCPU, 4)
+			pool.Start()
+			for i := 0; i < 20; i++ {
+				pool.AddJob(job)
+			}
+			pool.Stop()
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("%d jobs ran at once, want the CPU limit of 2", maxRunning)
+	}
+	if len(cpuSlots) != 0 {
+		t.Errorf("%d CPU slots still taken after the pools stopped", len(cpuSlots))
+	}
+}
+
+func TestLimitedJobReleasesSlotOnPanic(t *testing.T) {
+	withSlots(t, 1, 1)
+	pool := NewLimitedWorkerPool(ResourceCPU, 1)
+
+	func() {
+		defer func() { recover() }()
+		pool.runLimited(func() { panic("boom") })
+	}()
+	if len(cpuSlots) != 0 {
+		t.Errorf("%d CPU slots still taken after a job panicked", len(cpuSlots))
+	}
+}
@@ -1,10 +1,19 @@
 package workers
 
 import (
-	"fmt"
+	"runtime"
 	"sync"
 )
 
+// WorkerCountEnv overrides the default number of workers per pool
+const WorkerCountEnv = "LOOK_ALIKE_WORKERS"
+
+// DefaultWorkerCount returns the worker count from LOOK_ALIKE_WORKERS,
+// falling back to the number of CPUs
+func DefaultWorkerCount() int {
+	return envInt(WorkerCountEnv, runtime.NumCPU())
+}
+
 // Job represents a unit of work
 type Job func()
 
@@ -15,12 +24,15 @@ type WorkerPool struct {
 	wg          sync.WaitGroup
 	started     bool
 	mu          sync.Mutex
+	limited     bool
+	resource    Resource
 }
 
-// NewWorkerPool creates a new worker pool with the specified number of workers
+// NewWorkerPool creates a new worker pool with the specified number of workers.
+// A non-positive count uses DefaultWorkerCount.
 func NewWorkerPool(workerCount int) *WorkerPool {
 	if workerCount <= 0 {
-		workerCount = 4 // Default
+		workerCount = DefaultWorkerCount()
 	}
 
 	return &WorkerPool{
@@ -30,6 +42,23 @@ func NewWorkerPool(workerCount int) *WorkerPool {
 	}
 }
 
+// NewLimitedWorkerPool creates a worker pool whose jobs also take a slot of
+// a server-wide resource, so pools of concurrent jobs share the CPU and IO
+// limits instead of each running at full width
+func NewLimitedWorkerPool(resource Resource, workerCount int) *WorkerPool {
+	wp := NewWorkerPool(workerCount)
+	wp.limited = true
+	wp.resource = resource
+	return wp
+}
+
+// WithQueue sets how many jobs AddJob buffers before it blocks. It must be
+// called before Start.
+func (wp *WorkerPool) WithQueue(size int) *WorkerPool {
+	wp.jobs = make(chan Job, size)
+	return wp
+}
+
 // Start starts the worker pool
 func (wp *WorkerPool) Start() {
 	wp.mu.Lock()
@@ -45,8 +74,6 @@ func (wp *WorkerPool) Start() {
 		wp.wg.Add(1)
 		go wp.worker(i)
 	}
-
-	fmt.Printf("Worker pool started with %d workers\n", wp.workerCount)
 }
 
 // worker is the goroutine that executes jobs
@@ -54,11 +81,23 @@ func (wp *WorkerPool) worker(id int) {
 	defer wp.wg.Done()
 
 	for job := range wp.jobs {
+		if wp.limited {
+			wp.runLimited(job)
+			continue
+		}
 		job()
 	}
 }
 
-// AddJob adds a job to the worker pool
+// runLimited runs a job while holding a slot of the pool's resource
+func (wp *WorkerPool) runLimited(job Job) {
+	Acquire(wp.resource)
+	defer Release(wp.resource)
+	job()
+}
+
+// AddJob adds a job to the worker pool. It blocks while the job buffer is
+// full, which keeps producers bounded by the pool's throughput.
 func (wp *WorkerPool) AddJob(job Job) {
 	wp.jobs <- job
 }
@@ -74,5 +113,4 @@ func (wp *WorkerPool) Stop() {
 
 	close(wp.jobs)
 	wp.wg.Wait()
-	fmt.Println("Worker pool stopped")
 }